@@ -0,0 +1,316 @@
+// Package board is the manifest of the boards this repository ships device
+// trees for.
+package board
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Board is a supported board.
+type Board struct {
+	// Name identifies the board, e.g. with -boards.
+	Name string
+
+	// DTB is the file name of the device tree as the firmware expects it,
+	// e.g. bcm2711-rpi-4-b.dtb.
+	DTB string
+
+	// Committed is the file name of the device tree in this repository,
+	// which differs from DTB for historical reasons on some boards.
+	Committed string
+
+	// Src is the path of the device tree within the kernel tree.
+	Src string
+
+	// DTB, Committed and Src are empty for boards without device tree
+	// (e.g. QEMU, which generates it).
+
+	// Config is a kernel config fragment with the drivers the board needs
+	// beyond the gokrazy defaults.
+	Config string
+
+	// Optional boards are only built when listed in -boards, not by
+	// default.
+	Optional bool
+
+	// UBoot boards are booted by U-Boot instead of the Raspberry Pi
+	// firmware, so config.txt and the overlays in dts/overlays do not
+	// apply to them.
+	UBoot bool
+
+	// WiFi and Bluetooth are the firmware base names (as the brcmfmac and
+	// btbcm drivers request them) of the board’s wireless chip, e.g.
+	// brcmfmac43455-sdio and BCM4345C0, or empty for boards without one.
+	// Compatible is the first compatible string of the board’s device
+	// tree, which the drivers use for board-specific firmware files, e.g.
+	// brcmfmac43455-sdio.raspberrypi,4-model-b.txt.
+	WiFi       string
+	Bluetooth  string
+	Compatible string
+
+	// MinBootloader is the release date (YYYY-MM-DD) of the oldest
+	// bootloader EEPROM which boots the board with our kernel and DTB, for
+	// boards booting from an EEPROM (Pi 4 family), or empty. Older EEPROMs
+	// fail to boot newer DTBs in confusing ways.
+	MinBootloader string
+}
+
+// Boards lists all supported boards.
+var Boards = []Board{
+	{Name: "rpi3b", DTB: "bcm2710-rpi-3-b.dtb", Committed: "bcm2710-rpi-3-b.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2837-rpi-3-b.dtb", WiFi: "brcmfmac43430-sdio", Bluetooth: "BCM43430A1", Compatible: "raspberrypi,3-model-b"},
+	{Name: "rpi3bplus", DTB: "bcm2710-rpi-3-b-plus.dtb", Committed: "bcm2710-rpi-3-b-plus.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2837-rpi-3-b-plus.dtb", WiFi: "brcmfmac43455-sdio", Bluetooth: "BCM4345C0", Compatible: "raspberrypi,3-model-b-plus"},
+	{Name: "cm3", DTB: "bcm2710-rpi-cm3.dtb", Committed: "bcm2710-rpi-cm3.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2837-rpi-cm3-io3.dtb"},
+	{Name: "rpi4b", DTB: "bcm2711-rpi-4-b.dtb", Committed: "bcm2711-rpi-4-b.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2711-rpi-4-b.dtb", WiFi: "brcmfmac43455-sdio", Bluetooth: "BCM4345C0", Compatible: "raspberrypi,4-model-b", MinBootloader: "2020-09-03"},
+	{Name: "rpi400", DTB: "bcm2711-rpi-400.dtb", Committed: "bcm2711-rpi-400.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2711-rpi-400.dtb", WiFi: "brcmfmac43456-sdio", Bluetooth: "BCM4345C5", Compatible: "raspberrypi,400", MinBootloader: "2020-09-03"},
+	// The Pi 500 (bcm2712-rpi-500.dtb) is missing until the kernel has a
+	// device tree for it.
+	{Name: "zero2w", DTB: "bcm2710-rpi-zero-2-w.dtb", Committed: "bcm2710-rpi-zero-2.dtb", Src: "arch/arm64/boot/dts/broadcom/bcm2837-rpi-zero-2-w.dtb", WiFi: "brcmfmac43436-sdio", Bluetooth: "BCM43430B0", Compatible: "raspberrypi,model-zero-2-w"},
+	{
+		// Compute Module 4 on the CM4 IO board, which is the only CM4
+		// carrier with a mainline device tree (there is none for the CM4S).
+		// The firmware loads bcm2711-rpi-cm4.dtb on any carrier.
+		Name:       "cm4",
+		DTB:        "bcm2711-rpi-cm4.dtb",
+		Committed:  "bcm2711-rpi-cm4.dtb",
+		Src:        "arch/arm64/boot/dts/broadcom/bcm2711-rpi-cm4-io.dtb",
+		Optional:   true,
+		WiFi:       "brcmfmac43455-sdio",
+		Bluetooth:  "BCM4345C0",
+		Compatible: "raspberrypi,4-compute-module",
+		// The CM4 was released later than the Pi 4, with a newer EEPROM.
+		MinBootloader: "2021-02-16",
+	},
+	{
+		// Radxa ROCK Pi 4 (RK3399).
+		Name:      "rock4",
+		DTB:       "rk3399-rock-pi-4b.dtb",
+		Committed: "rk3399-rock-pi-4b.dtb",
+		Src:       "arch/arm64/boot/dts/rockchip/rk3399-rock-pi-4b.dtb",
+		Optional:  true,
+		UBoot:     true,
+		Config: `
+CONFIG_ARCH_ROCKCHIP=y
+CONFIG_ROCKCHIP_PM_DOMAINS=y
+CONFIG_ROCKCHIP_IOMMU=y
+CONFIG_ROCKCHIP_THERMAL=y
+CONFIG_MFD_RK8XX_I2C=y
+CONFIG_REGULATOR_RK808=y
+CONFIG_COMMON_CLK_RK808=y
+CONFIG_RTC_DRV_RK808=y
+CONFIG_REGULATOR_FAN53555=y
+CONFIG_I2C_RK3X=y
+CONFIG_SPI_ROCKCHIP=y
+CONFIG_PWM_ROCKCHIP=y
+CONFIG_SERIAL_8250=y
+CONFIG_SERIAL_8250_CONSOLE=y
+CONFIG_SERIAL_8250_DW=y
+CONFIG_MMC_DW=y
+CONFIG_MMC_DW_ROCKCHIP=y
+CONFIG_MMC_SDHCI_OF_ARASAN=y
+CONFIG_STMMAC_ETH=y
+CONFIG_DWMAC_ROCKCHIP=y
+CONFIG_PHY_ROCKCHIP_INNO_USB2=y
+CONFIG_PHY_ROCKCHIP_TYPEC=y
+CONFIG_PHY_ROCKCHIP_PCIE=y
+CONFIG_PCIE_ROCKCHIP_HOST=y
+CONFIG_USB_DWC3=y
+CONFIG_USB_EHCI_HCD_PLATFORM=y
+CONFIG_USB_OHCI_HCD_PLATFORM=y
+CONFIG_ARM_RK3399_DMC_DEVFREQ=y
+CONFIG_CPUFREQ_DT=y
+`,
+	},
+	{
+		// Radxa ROCK 5B (RK3588).
+		Name:      "rock5b",
+		DTB:       "rk3588-rock-5b.dtb",
+		Committed: "rk3588-rock-5b.dtb",
+		Src:       "arch/arm64/boot/dts/rockchip/rk3588-rock-5b.dtb",
+		Optional:  true,
+		UBoot:     true,
+		Config: `
+CONFIG_ARCH_ROCKCHIP=y
+CONFIG_ROCKCHIP_PM_DOMAINS=y
+CONFIG_ROCKCHIP_IOMMU=y
+CONFIG_MFD_RK8XX_SPI=y
+CONFIG_REGULATOR_RK808=y
+CONFIG_REGULATOR_FAN53555=y
+CONFIG_I2C_RK3X=y
+CONFIG_SPI_ROCKCHIP=y
+CONFIG_PWM_ROCKCHIP=y
+CONFIG_SERIAL_8250=y
+CONFIG_SERIAL_8250_CONSOLE=y
+CONFIG_SERIAL_8250_DW=y
+CONFIG_MMC_DW=y
+CONFIG_MMC_DW_ROCKCHIP=y
+CONFIG_MMC_SDHCI_OF_DWCMSHC=y
+CONFIG_STMMAC_ETH=y
+CONFIG_DWMAC_ROCKCHIP=y
+CONFIG_PHY_ROCKCHIP_NANENG_COMBO_PHY=y
+CONFIG_PHY_ROCKCHIP_SNPS_PCIE3=y
+CONFIG_PCIE_ROCKCHIP_DW_HOST=y
+CONFIG_R8169=y
+CONFIG_USB_EHCI_HCD_PLATFORM=y
+CONFIG_USB_OHCI_HCD_PLATFORM=y
+`,
+	},
+	{
+		// Hardkernel ODROID-C4 (Amlogic S905X3, SM1).
+		Name:      "odroidc4",
+		DTB:       "meson-sm1-odroid-c4.dtb",
+		Committed: "meson-sm1-odroid-c4.dtb",
+		Src:       "arch/arm64/boot/dts/amlogic/meson-sm1-odroid-c4.dtb",
+		Optional:  true,
+		UBoot:     true,
+		Config: `
+CONFIG_ARCH_MESON=y
+CONFIG_MESON_SM=y
+CONFIG_MESON_EE_PM_DOMAINS=y
+CONFIG_MESON_SECURE_PM_DOMAINS=y
+CONFIG_MESON_IRQ_GPIO=y
+CONFIG_COMMON_CLK_G12A=y
+CONFIG_PINCTRL_MESON_G12A=y
+CONFIG_SERIAL_MESON=y
+CONFIG_SERIAL_MESON_CONSOLE=y
+CONFIG_I2C_MESON=y
+CONFIG_SPI_MESON_SPIFC=y
+CONFIG_PWM_MESON=y
+CONFIG_REGULATOR_PWM=y
+CONFIG_REGULATOR_GPIO=y
+CONFIG_MMC_MESON_GX=y
+CONFIG_STMMAC_ETH=y
+CONFIG_DWMAC_MESON=y
+CONFIG_MDIO_BUS_MUX_MESON_G12A=y
+CONFIG_REALTEK_PHY=y
+CONFIG_PHY_MESON_G12A_USB2=y
+CONFIG_PHY_MESON_G12A_USB3_PCIE=y
+CONFIG_USB_DWC3=y
+CONFIG_USB_DWC3_MESON_G12A=y
+CONFIG_USB_DWC2=y
+CONFIG_MESON_WATCHDOG=y
+CONFIG_MESON_GXBB_WATCHDOG=y
+CONFIG_AMLOGIC_THERMAL=y
+CONFIG_ARM_SCPI_CPUFREQ=y
+CONFIG_CPUFREQ_DT=y
+`,
+	},
+	{
+		// Hardkernel ODROID-N2+ (Amlogic S922X, G12B).
+		Name:      "odroidn2plus",
+		DTB:       "meson-g12b-odroid-n2-plus.dtb",
+		Committed: "meson-g12b-odroid-n2-plus.dtb",
+		Src:       "arch/arm64/boot/dts/amlogic/meson-g12b-odroid-n2-plus.dtb",
+		Optional:  true,
+		UBoot:     true,
+		Config: `
+CONFIG_ARCH_MESON=y
+CONFIG_MESON_SM=y
+CONFIG_MESON_EE_PM_DOMAINS=y
+CONFIG_MESON_SECURE_PM_DOMAINS=y
+CONFIG_MESON_IRQ_GPIO=y
+CONFIG_COMMON_CLK_G12A=y
+CONFIG_PINCTRL_MESON_G12A=y
+CONFIG_SERIAL_MESON=y
+CONFIG_SERIAL_MESON_CONSOLE=y
+CONFIG_I2C_MESON=y
+CONFIG_SPI_MESON_SPIFC=y
+CONFIG_PWM_MESON=y
+CONFIG_REGULATOR_PWM=y
+CONFIG_REGULATOR_GPIO=y
+CONFIG_MMC_MESON_GX=y
+CONFIG_STMMAC_ETH=y
+CONFIG_DWMAC_MESON=y
+CONFIG_MDIO_BUS_MUX_MESON_G12A=y
+CONFIG_REALTEK_PHY=y
+CONFIG_PHY_MESON_G12A_USB2=y
+CONFIG_PHY_MESON_G12A_USB3_PCIE=y
+CONFIG_USB_DWC3=y
+CONFIG_USB_DWC3_MESON_G12A=y
+CONFIG_USB_DWC2=y
+CONFIG_MESON_WATCHDOG=y
+CONFIG_MESON_GXBB_WATCHDOG=y
+CONFIG_AMLOGIC_THERMAL=y
+CONFIG_ARM_SCPI_CPUFREQ=y
+CONFIG_CPUFREQ_DT=y
+CONFIG_RTC_DRV_PCF8563=y
+`,
+	},
+	{
+		// The QEMU virt machine, for building and boot-testing without
+		// hardware (see gokr-rebuild-kernel boot-test).
+		Name:     "qemu-virt",
+		Optional: true,
+		Config: `
+CONFIG_PCI=y
+CONFIG_PCI_HOST_GENERIC=y
+CONFIG_VIRTIO_MENU=y
+CONFIG_VIRTIO=y
+CONFIG_VIRTIO_PCI=y
+CONFIG_VIRTIO_MMIO=y
+CONFIG_VIRTIO_BLK=y
+CONFIG_VIRTIO_NET=y
+CONFIG_VIRTIO_CONSOLE=y
+CONFIG_HW_RANDOM_VIRTIO=y
+CONFIG_SERIAL_AMBA_PL011=y
+CONFIG_SERIAL_AMBA_PL011_CONSOLE=y
+CONFIG_RTC_DRV_PL031=y
+CONFIG_WATCHDOG=y
+CONFIG_I6300ESB_WDT=y
+`,
+	},
+}
+
+// MinBootloader returns the newest MinBootloader of boards, i.e. the oldest
+// bootloader EEPROM which boots all of them, or an empty string.
+func MinBootloader(boards []Board) string {
+	min := ""
+	for _, b := range boards {
+		if b.MinBootloader > min {
+			min = b.MinBootloader
+		}
+	}
+	return min
+}
+
+// Names returns the names of all supported boards.
+func Names() []string {
+	names := make([]string, len(Boards))
+	for idx, b := range Boards {
+		names[idx] = b.Name
+	}
+	return names
+}
+
+// Resolve returns the boards in the comma-separated list, all boards which
+// are not optional if list is empty, or none if list is “none”.
+func Resolve(list string) ([]Board, error) {
+	if list == "none" {
+		return nil, nil
+	}
+	if list == "" {
+		var result []Board
+		for _, b := range Boards {
+			if !b.Optional {
+				result = append(result, b)
+			}
+		}
+		return result, nil
+	}
+	var result []Board
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, b := range Boards {
+			if b.Name == name {
+				result = append(result, b)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown board %q, known boards: %v", name, Names())
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,207 @@
+// Package buildinfo defines build-info.json, which gokr-rebuild-kernel
+// writes next to vmlinuz to describe how the kernel artifacts were built.
+package buildinfo
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// FileName is the name of the file next to vmlinuz.
+const FileName = "build-info.json"
+
+// SchemaVersion is incremented for incompatible changes of BuildInfo.
+const SchemaVersion = 1
+
+// BuildInfo is the content of build-info.json.
+type BuildInfo struct {
+	// SchemaVersion is the SchemaVersion the file was written with.
+	SchemaVersion int
+
+	// KernelVersion is the upstream kernel version, e.g. 6.5.7.
+	KernelVersion string
+
+	// KernelRelease is the kernel release (uname -r) as printed by make
+	// kernelrelease, e.g. 6.5.7-gokrazy-1a2b3c4, which is also the name of
+	// the lib/modules directory. Empty for builds predating the field.
+	KernelRelease string `json:",omitempty"`
+
+	// SourceURL is the URL the kernel source was downloaded from.
+	SourceURL string
+
+	// GitDescribe is the output of git describe --always --dirty in this
+	// repository at build time, or empty if it is not a git checkout.
+	GitDescribe string `json:",omitempty"`
+
+	// Patches are the patches which were applied, in order.
+	Patches []kernelversion.Patch
+
+	// Profiles and Capabilities are the config profiles and capabilities
+	// which were enabled.
+	Profiles     []string
+	Capabilities []string
+
+	// ConfigSHA256 is the hex-encoded SHA-256 hash of the final .config.
+	ConfigSHA256 string
+
+	// RecordedConfig are the final values (n if not set) of the config
+	// symbols which the enabled profiles record, e.g. the compressors
+	// enabled by the zram profile (CONFIG_CRYPTO_ZSTD=y).
+	RecordedConfig map[string]string `json:",omitempty"`
+
+	// Notes are the usage notes of the enabled profiles, by profile name,
+	// e.g. where the fan profile's fan speed is in sysfs.
+	Notes map[string][]string `json:",omitempty"`
+
+	// Compiler identifies the compiler, e.g. “aarch64-linux-gnu-gcc (Debian
+	// 8.3.0-2) 8.3.0”.
+	Compiler string
+
+	// BuildTime is when the build finished.
+	BuildTime time.Time
+
+	// ReproducibilityHash is the hex-encoded SHA-256 hash of the artifacts
+	// (kernel image, DTBs, overlays and modules, see HashArtifacts). Two
+	// builds from the same inputs have the same hash if the build is
+	// reproducible.
+	ReproducibilityHash string
+
+	// MinBootloader is the release date (YYYY-MM-DD) of the oldest Raspberry
+	// Pi bootloader EEPROM which boots the built boards with these
+	// artifacts, if any of them boots from an EEPROM. Check it on the
+	// device with gokr-bootloader-check.
+	MinBootloader string `json:",omitempty"`
+
+	// Firmware is the Raspberry Pi firmware (with the hashes of its files)
+	// which was bundled with the kernel, if any (see build -firmware).
+	Firmware *kernelversion.Firmware `json:",omitempty"`
+
+	// Benchmarks are the results of the last gokr-rebuild-kernel boot-test
+	// -bench run with these artifacts, if any.
+	Benchmarks []Benchmark `json:",omitempty"`
+}
+
+// Benchmark is the result of a single benchmark of the boot test.
+type Benchmark struct {
+	// Name identifies the benchmark, e.g. boot_to_userspace.
+	Name string
+
+	// Value is the result, in Unit (e.g. ms, us or Mbit/s).
+	Value float64
+	Unit  string
+}
+
+// Release returns the kernel release of the artifacts in dir: the
+// KernelRelease recorded in its build-info.json or, for builds predating it,
+// the name of the only lib/modules directory.
+func Release(dir string) (string, error) {
+	if bi, err := Read(filepath.Join(dir, FileName)); err == nil && bi.KernelRelease != "" {
+		return bi.KernelRelease, nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "lib", "modules", "*"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("expected exactly one lib/modules/* directory in %s, found %d", dir, len(matches))
+	}
+	return filepath.Base(matches[0]), nil
+}
+
+// Read reads the build-info.json file at path.
+func Read(path string) (*BuildInfo, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bi BuildInfo
+	if err := json.Unmarshal(b, &bi); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if bi.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d (want <= %d)", path, bi.SchemaVersion, SchemaVersion)
+	}
+	return &bi, nil
+}
+
+// Write writes bi as a build-info.json file to path.
+func (bi *BuildInfo) Write(path string) error {
+	bi.SchemaVersion = SchemaVersion
+	b, err := json.MarshalIndent(bi, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// artifactPatterns match the artifacts in a build result directory, relative
+// to it.
+var artifactPatterns = []string{"vmlinuz", "*.dtb", "overlays/*.dtbo"}
+
+// ArtifactFiles returns the paths (relative to dir, slash-separated and
+// sorted) of the artifacts in the build result directory dir: vmlinuz, the
+// DTBs, the overlays and the files in lib/modules.
+func ArtifactFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range artifactPatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	modules := filepath.Join(dir, "lib", "modules")
+	if err := filepath.Walk(modules, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for idx, path := range files {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		files[idx] = filepath.ToSlash(rel)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// HashArtifacts returns the hex-encoded SHA-256 hash over the names and
+// contents of the artifacts in the build result directory dir (see
+// ArtifactFiles).
+func HashArtifacts(dir string) (string, error) {
+	files, err := ArtifactFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, rel := range files {
+		fmt.Fprintf(h, "%s\x00", rel)
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,237 @@
+// Package capability maps hardware capabilities which gokrazy applications
+// need (e.g. “i2c” or “bluetooth”) to the kernel config symbols and
+// Raspberry Pi config.txt lines which provide them, so that users do not need
+// to know about Kconfig to get the drivers they need.
+package capability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Capability describes how to provide a capability.
+type Capability struct {
+	// Name identifies the capability, e.g. “1-wire”.
+	Name string
+
+	// Description is a human-readable summary.
+	Description string
+
+	// Config is a kernel config fragment which is appended to the gokrazy
+	// default config.
+	Config string
+
+	// ConfigTxt lists lines (typically dtoverlay= or dtparam=) which must be
+	// present in the Raspberry Pi config.txt.
+	ConfigTxt []string
+}
+
+var all = []Capability{
+	{
+		Name:        "i2c",
+		Description: "I²C bus access via /dev/i2c-*",
+		Config: `
+CONFIG_I2C=y
+CONFIG_I2C_CHARDEV=y
+CONFIG_I2C_BCM2835=y
+`,
+		ConfigTxt: []string{"dtparam=i2c_arm=on"},
+	},
+	{
+		Name:        "spi",
+		Description: "SPI bus access via /dev/spidev*",
+		Config: `
+CONFIG_SPI=y
+CONFIG_SPI_BCM2835=y
+CONFIG_SPI_SPIDEV=y
+`,
+		ConfigTxt: []string{"dtparam=spi=on"},
+	},
+	{
+		Name:        "gpio",
+		Description: "GPIO access via the character device and sysfs",
+		Config: `
+CONFIG_GPIOLIB=y
+CONFIG_GPIO_CDEV=y
+CONFIG_GPIO_SYSFS=y
+`,
+	},
+	{
+		Name:        "pwm",
+		Description: "hardware PWM on GPIO 18",
+		Config: `
+CONFIG_PWM=y
+CONFIG_PWM_BCM2835=y
+`,
+		ConfigTxt: []string{"dtoverlay=pwm"},
+	},
+	{
+		Name:        "1-wire",
+		Description: "1-wire bus on GPIO 4, e.g. for DS18B20 temperature sensors",
+		Config: `
+CONFIG_W1=y
+CONFIG_W1_MASTER_GPIO=y
+CONFIG_W1_SLAVE_THERM=y
+`,
+		ConfigTxt: []string{"dtoverlay=w1-gpio"},
+	},
+	{
+		Name:        "rtc",
+		Description: "DS1307/DS3231 real-time clock on I²C",
+		Config: `
+CONFIG_I2C=y
+CONFIG_I2C_BCM2835=y
+CONFIG_RTC_DRV_DS1307=y
+`,
+		ConfigTxt: []string{"dtoverlay=i2c-rtc,ds3231"},
+	},
+	{
+		Name:        "can",
+		Description: "CAN bus via an MCP2515 SPI controller",
+		Config: `
+CONFIG_CAN=y
+CONFIG_CAN_RAW=y
+CONFIG_CAN_DEV=y
+CONFIG_CAN_MCP251X=y
+`,
+		ConfigTxt: []string{"dtoverlay=mcp2515-can0,oscillator=16000000,interrupt=25"},
+	},
+	{
+		Name:        "ir",
+		Description: "infrared receiver on GPIO 18",
+		Config: `
+CONFIG_RC_CORE=y
+CONFIG_LIRC=y
+CONFIG_IR_GPIO_CIR=y
+`,
+		ConfigTxt: []string{"dtoverlay=gpio-ir"},
+	},
+	{
+		Name:        "usb-serial",
+		Description: "common USB serial adapters (FTDI, CP210x, CH341, PL2303)",
+		Config: `
+CONFIG_USB_SERIAL=y
+CONFIG_USB_SERIAL_FTDI_SIO=y
+CONFIG_USB_SERIAL_CP210X=y
+CONFIG_USB_SERIAL_CH341=y
+CONFIG_USB_SERIAL_PL2303=y
+`,
+	},
+	{
+		Name:        "usb-gadget",
+		Description: "USB device mode (e.g. Ethernet gadget) on the Pi Zero 2 W and Pi 4 USB-C port",
+		Config: `
+CONFIG_USB_GADGET=y
+CONFIG_USB_DWC2=y
+CONFIG_USB_DWC2_DUAL_ROLE=y
+CONFIG_USB_CONFIGFS=y
+CONFIG_USB_CONFIGFS_ECM=y
+CONFIG_USB_CONFIGFS_ACM=y
+`,
+		ConfigTxt: []string{"dtoverlay=dwc2"},
+	},
+	{
+		Name:        "wifi",
+		Description: "the on-board Broadcom Wi-Fi",
+		Config: `
+CONFIG_WLAN=y
+CONFIG_CFG80211=y
+CONFIG_BRCMFMAC=m
+`,
+	},
+	{
+		Name:        "bluetooth",
+		Description: "the on-board Broadcom Bluetooth (attached via UART)",
+		Config: `
+CONFIG_BT=m
+CONFIG_BT_BCM=m
+CONFIG_BT_HCIUART=m
+CONFIG_BT_HCIUART_BCM=y
+CONFIG_BT_LE=y
+CONFIG_SERIAL_DEV_BUS=y
+CONFIG_SERIAL_DEV_CTRL_TTYPORT=y
+`,
+	},
+	{
+		Name:        "v4l2-camera",
+		Description: "USB (UVC) cameras via V4L2",
+		Config: `
+CONFIG_MEDIA_SUPPORT=y
+CONFIG_MEDIA_CAMERA_SUPPORT=y
+CONFIG_MEDIA_USB_SUPPORT=y
+CONFIG_VIDEO_DEV=y
+CONFIG_USB_VIDEO_CLASS=m
+`,
+	},
+}
+
+// normalize turns user input like “V4L2 camera” into a capability name.
+func normalize(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// Names returns the names of all known capabilities in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(all))
+	for _, c := range all {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the capability with the specified name. Case and
+// whitespace are ignored, i.e. “V4L2 camera” finds “v4l2-camera”.
+func Lookup(name string) (Capability, error) {
+	normalized := normalize(name)
+	for _, c := range all {
+		if c.Name == normalized {
+			return c, nil
+		}
+	}
+	return Capability{}, fmt.Errorf("unknown capability %q, known capabilities: %v", name, Names())
+}
+
+// Resolve looks up the comma-separated list of capability names. Duplicates
+// are removed.
+func Resolve(list string) ([]Capability, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var (
+		result []Capability
+		seen   = make(map[string]bool)
+	)
+	for _, name := range strings.Split(list, ",") {
+		c, err := Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[c.Name] {
+			continue
+		}
+		seen[c.Name] = true
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// ConfigTxt returns the config.txt lines required by caps, without
+// duplicates.
+func ConfigTxt(caps []Capability) []string {
+	var (
+		lines []string
+		seen  = make(map[string]bool)
+	)
+	for _, c := range caps {
+		for _, line := range c.ConfigTxt {
+			if seen[line] {
+				continue
+			}
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
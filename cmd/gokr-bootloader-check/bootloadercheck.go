@@ -0,0 +1,80 @@
+// gokr-bootloader-check verifies on a Raspberry Pi 4 (or 400, CM4) that its
+// bootloader EEPROM is at least the version the kernel artifacts need, as
+// recorded in build-info.json (MinBootloader) by gokr-rebuild-kernel. Add it
+// to your gokrazy instance with that version as flag:
+//
+//	gok add github.com/alf632/gokrazy-kernel/cmd/gokr-bootloader-check
+//	# flag: -min=2020-09-03
+//
+// It prints the running bootloader version and a final line which is either
+// PASS or FAIL, like gokr-kernel-smoketest. Update an old EEPROM with
+// rpi-eeprom-update (e.g. from Raspberry Pi OS) before updating the kernel.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// bootloaderDir contains the bootloader version which the firmware passes
+// in the device tree.
+const bootloaderDir = "/proc/device-tree/chosen/bootloader"
+
+// dontRestartExitStatus tells the gokrazy supervisor not to restart us.
+const dontRestartExitStatus = 125
+
+// bootloaderBuild returns the build time of the running bootloader, from
+// the 4-byte big-endian UNIX timestamp in the device tree.
+func bootloaderBuild() (time.Time, error) {
+	b, err := ioutil.ReadFile(bootloaderDir + "/build-timestamp")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v (not booted from a bootloader EEPROM, e.g. not a Pi 4?)", err)
+	}
+	if len(b) != 4 {
+		return time.Time{}, fmt.Errorf("%s/build-timestamp: unexpected length %d", bootloaderDir, len(b))
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(b)), 0).UTC(), nil
+}
+
+func check(min string) error {
+	want, err := time.Parse("2006-01-02", min)
+	if err != nil {
+		return fmt.Errorf("invalid -min=%s, expected YYYY-MM-DD: %v", min, err)
+	}
+	got, err := bootloaderBuild()
+	if err != nil {
+		return err
+	}
+	version := ""
+	if b, err := ioutil.ReadFile(bootloaderDir + "/version"); err == nil {
+		version = " (" + strings.TrimRight(string(b), "\x00\n") + ")"
+	}
+	fmt.Printf("bootloader EEPROM built %s%s, minimum %s\n", got.Format("2006-01-02"), version, min)
+	if got.Before(want) {
+		return fmt.Errorf("bootloader EEPROM %s is older than %s, which the kernel needs: update it with rpi-eeprom-update", got.Format("2006-01-02"), min)
+	}
+	return nil
+}
+
+func main() {
+	var min = flag.String("min",
+		"",
+		"minimum bootloader EEPROM release date (YYYY-MM-DD), from MinBootloader in build-info.json")
+	flag.Parse()
+	if *min == "" {
+		fmt.Println("no -min specified, nothing to check")
+		os.Exit(dontRestartExitStatus)
+	}
+	if err := check(*min); err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		fmt.Println("gokr-bootloader-check: FAIL")
+	} else {
+		fmt.Println("gokr-bootloader-check: PASS")
+	}
+	os.Exit(dontRestartExitStatus)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// analyzers maps the values of -analyze to the make arguments which enable
+// the analysis: sparse (C=2 checks all given objects, even if they are up
+// to date) or the extra compiler warnings of W=1.
+var analyzers = map[string][]string{
+	"sparse": {"C=2"},
+	"w1":     {"W=1"},
+}
+
+// analysisReport is the file in the build result with the findings.
+const analysisReport = "analysis-report.txt"
+
+var (
+	hunkRe    = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+	findingRe = regexp.MustCompile(`^(\S+?):(\d+):(?:\d+:)? (warning|error): (.*)$`)
+)
+
+// touchedLines returns the lines which the patch file adds, keyed by the
+// path (within the kernel tree) of the file they are added to.
+func touchedLines(patch string) (map[string]map[int]bool, error) {
+	f, err := os.Open(patch)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	touched := make(map[string]map[int]bool)
+	var file string
+	line := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		text := scanner.Text()
+		switch {
+		case strings.HasPrefix(text, "+++ "):
+			// Strip the first path component, like patch -p1.
+			file = ""
+			if parts := strings.SplitN(strings.Fields(text)[1], "/", 2); len(parts) == 2 && parts[0] != "" {
+				file = parts[1]
+			}
+		case strings.HasPrefix(text, "@@ "):
+			m := hunkRe.FindStringSubmatch(text)
+			if m == nil {
+				continue
+			}
+			line, _ = strconv.Atoi(m[1])
+		case file == "" || line == 0:
+		case strings.HasPrefix(text, "+"):
+			if touched[file] == nil {
+				touched[file] = make(map[int]bool)
+			}
+			touched[file][line] = true
+			line++
+		case strings.HasPrefix(text, " "):
+			line++
+		}
+	}
+	return touched, scanner.Err()
+}
+
+// analyze runs the analyzer over the C files which the patches touch and
+// writes the findings to resultDir, marking those on lines the patches add
+// as new.
+func analyze(analyzer string, patches []string, resultDir string) error {
+	args, ok := analyzers[analyzer]
+	if !ok {
+		return fmt.Errorf("unknown analyzer %q", analyzer)
+	}
+	touched := make(map[string]map[int]bool)
+	for _, patch := range patches {
+		lines, err := touchedLines(patch)
+		if err != nil {
+			return err
+		}
+		for file, l := range lines {
+			if touched[file] == nil {
+				touched[file] = make(map[int]bool)
+			}
+			for n := range l {
+				touched[file][n] = true
+			}
+		}
+	}
+	var objects []string
+	for file := range touched {
+		if filepath.Ext(file) != ".c" {
+			continue
+		}
+		object := strings.TrimSuffix(file, ".c") + ".o"
+		if _, err := os.Stat(object); err != nil {
+			// Not built with our config.
+			continue
+		}
+		if analyzer == "w1" {
+			// Force recompiling the object with the extra warnings.
+			if err := os.Remove(object); err != nil {
+				return err
+			}
+		}
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	var report strings.Builder
+	if len(objects) == 0 {
+		fmt.Fprintf(&report, "%s: the patches touch no C files which are built\n", analyzer)
+		return ioutil.WriteFile(filepath.Join(resultDir, analysisReport), []byte(report.String()), 0644)
+	}
+
+	cmd := exec.Command("make", append(append([]string{
+		"ARCH=arm64",
+		"CROSS_COMPILE=aarch64-linux-gnu-",
+		"-j" + strconv.Itoa(runtime.NumCPU()),
+	}, args...), objects...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Stderr.Write(out)
+		return fmt.Errorf("make %s: %v", strings.Join(args, " "), err)
+	}
+	var findings, fresh []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		m := findingRe.FindStringSubmatch(line)
+		if m == nil || seen[line] {
+			continue
+		}
+		seen[line] = true
+		n, _ := strconv.Atoi(m[2])
+		if touched[m[1]][n] {
+			fresh = append(fresh, line)
+		} else {
+			findings = append(findings, line)
+		}
+	}
+	fmt.Fprintf(&report, "%s over %d files touched by the patches: %d findings on lines the patches add, %d elsewhere in those files\n", analyzer, len(objects), len(fresh), len(findings))
+	for _, line := range fresh {
+		fmt.Fprintf(&report, "  new: %s\n", line)
+	}
+	for _, line := range findings {
+		fmt.Fprintf(&report, "  %s\n", line)
+	}
+	log.Printf("%s", strings.TrimSpace(report.String()))
+	return ioutil.WriteFile(filepath.Join(resultDir, analysisReport), []byte(report.String()), 0644)
+}
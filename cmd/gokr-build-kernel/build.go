@@ -1,20 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
-)
 
-// see https://www.kernel.org/releases.json
-var latest = "https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.5.7.tar.xz"
+	"github.com/alf632/gokrazy-kernel/board"
+	"github.com/alf632/gokrazy-kernel/capability"
+	"github.com/alf632/gokrazy-kernel/hardening"
+	"github.com/alf632/gokrazy-kernel/kconfig"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+	"github.com/alf632/gokrazy-kernel/profile"
+)
 
 const configAddendum = `
 CONFIG_WLAN=y
@@ -23,12 +28,14 @@ CONFIG_MT76_CORE=y
 CONFIG_MAC80211=y
 CONFIG_MT76x0U=y
 CONFIG_ARCH_BCM2835=y 
+CONFIG_HW_RANDOM=y
 CONFIG_HW_RANDOM_BCM2835=y
 CONFIG_DMA_BCM2835=y
 CONFIG_I2C_BCM2835=y
 CONFIG_SPI_BCM2835=y
 CONFIG_SPI_BCM2835AUX=y
 CONFIG_SERIAL_8250_BCM2835AUX=y
+CONFIG_WATCHDOG=y
 CONFIG_BCM2835_WDT=y
 CONFIG_SND_BCM2835_SOC_I2S=y
 CONFIG_USB_USBNET=y
@@ -189,7 +196,7 @@ CONFIG_INET_DIAG=y
 # For macvlan ethernet devices:
 CONFIG_MACVLAN=y
 
-# For /proc/config.gz
+# For /proc/config.gz (see -ikconfig)
 CONFIG_IKCONFIG=y
 CONFIG_IKCONFIG_PROC=y
 
@@ -1057,32 +1064,22 @@ CONFIG_VIDEO_DEV=y
 CONFIG_USB_VIDEO_CLASS=m
 `
 
-func downloadKernel() error {
-	out, err := os.Create(filepath.Base(latest))
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	resp, err := http.Get(latest)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if got, want := resp.StatusCode, http.StatusOK; got != want {
-		return fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", latest, got, want)
-	}
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return err
-	}
-	return out.Close()
-}
-
-func applyPatches(srcdir string) error {
+func applyPatches(srcdir string, skipApplied bool) error {
 	patches, err := filepath.Glob("*.patch")
 	if err != nil {
 		return err
 	}
 	for _, patch := range patches {
+		if skipApplied {
+			applied, err := patchApplied(srcdir, patch)
+			if err != nil {
+				return err
+			}
+			if applied {
+				log.Printf("patch %q is already applied", patch)
+				continue
+			}
+		}
 		log.Printf("applying patch %q", patch)
 		f, err := os.Open(patch)
 		if err != nil {
@@ -1103,12 +1100,48 @@ func applyPatches(srcdir string) error {
 	return nil
 }
 
-func compile() error {
-	defconfig := exec.Command("make", "ARCH=arm64", "defconfig")
+// patchApplied reports whether patch is already applied to srcdir, i.e.
+// whether it applies in reverse.
+func patchApplied(srcdir, patch string) (bool, error) {
+	abs, err := filepath.Abs(patch)
+	if err != nil {
+		return false, err
+	}
+	cmd := exec.Command("patch", "-p1", "-R", "--dry-run", "-s", "-f", "-i", abs)
+	cmd.Dir = srcdir
+	return cmd.Run() == nil, nil
+}
+
+// customDefconfig is the make target under which a -defconfig file is
+// installed into arch/arm64/configs.
+const customDefconfig = "gokrazy_custom_defconfig"
+
+// defconfigTarget returns the make target which configures the kernel from
+// base, which is either the name of a defconfig target (e.g. defconfig) or
+// the path of a defconfig file, which is installed into arch/arm64/configs.
+func defconfigTarget(base string) (string, error) {
+	if !strings.Contains(base, "/") {
+		return base, nil
+	}
+	if err := copyFile(filepath.Join("arch/arm64/configs", customDefconfig), base); err != nil {
+		return "", err
+	}
+	return customDefconfig, nil
+}
+
+// configure configures the kernel starting from the base defconfig (see
+// defconfigTarget) with the fragments on top, verifies the requirements and
+// assertions and writes the config report into resultDir.
+func configure(base string, fragments []fragment, assert assertions, resultDir string) error {
+	target, err := defconfigTarget(base)
+	if err != nil {
+		return err
+	}
+	defconfig := exec.Command("make", "ARCH=arm64", target)
 	defconfig.Stdout = os.Stdout
 	defconfig.Stderr = os.Stderr
 	if err := defconfig.Run(); err != nil {
-		return fmt.Errorf("make defconfig: %v", err)
+		return fmt.Errorf("make %s: %v", target, err)
 	}
 
 	// Change answers from mod to no if possible
@@ -1127,6 +1160,12 @@ func compile() error {
 	if _, err := f.Write([]byte(configAddendum)); err != nil {
 		return err
 	}
+	for _, frag := range fragments {
+		log.Printf("enabling %s %q", frag.kind, frag.name)
+		if _, err := f.Write([]byte(frag.config)); err != nil {
+			return err
+		}
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
@@ -1137,6 +1176,48 @@ func compile() error {
 	if err := olddefconfig.Run(); err != nil {
 		return fmt.Errorf("make olddefconfig: %v", err)
 	}
+
+	final, err := kconfig.ParseFile(".config")
+	if err != nil {
+		return err
+	}
+	if err := checkRequirements(final, fragments); err != nil {
+		return err
+	}
+	requested, err := requestedModules(fragments)
+	if err != nil {
+		return err
+	}
+	if err := checkAssertions(final, assert, requested); err != nil {
+		return err
+	}
+	if len(fragments) > 0 {
+		// The Kconfig files only serve to explain dropped options, so a
+		// parse error must not fail the build.
+		deps, err := parseKconfig(".", "arm64")
+		if err != nil {
+			log.Printf("warning: not explaining dropped config options: %v", err)
+		}
+		report, dropped, err := configReport(fragments, final, deps)
+		if err != nil {
+			return err
+		}
+		log.Printf("config report:\n%s", report)
+		if dropped > 0 {
+			log.Printf("warning: olddefconfig dropped or changed %d requested config option(s), see the config report above", dropped)
+		}
+		if err := ioutil.WriteFile(filepath.Join(resultDir, "config-report.txt"), []byte(report), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compile builds the configured kernel, installing the modules into
+// resultDir. makeArgs are passed to the make invocation which builds the
+// kernel, DTBs and modules, whose warnings are written to
+// resultDir/warnings.txt.
+func compile(overlays []string, makeArgs []string, resultDir string) error {
 	env := append(os.Environ(),
 		"ARCH=arm64",
 		"CROSS_COMPILE=aarch64-linux-gnu-",
@@ -1144,15 +1225,25 @@ func compile() error {
 		"KBUILD_BUILD_HOST=docker",
 		"KBUILD_BUILD_TIMESTAMP=Wed Mar  1 20:57:29 UTC 2017",
 	)
-	make := exec.Command("make", "Image.gz", "dtbs", "modules", "-j"+strconv.Itoa(runtime.NumCPU()))
+	if len(overlays) > 0 {
+		// Include the __symbols__ node in the DTBs so that overlays can
+		// reference their labels.
+		env = append(env, "DTC_FLAGS=-@")
+	}
+	var warnings warningLog
+	make := exec.Command("make", append([]string{"Image.gz", "dtbs", "modules", "-j" + strconv.Itoa(runtime.NumCPU())}, makeArgs...)...)
 	make.Env = env
 	make.Stdout = os.Stdout
-	make.Stderr = os.Stderr
+	// The compiler and the Kbuild tools print their warnings to stderr.
+	make.Stderr = io.MultiWriter(os.Stderr, &warnings)
 	if err := make.Run(); err != nil {
 		return fmt.Errorf("make: %v", err)
 	}
+	if err := warnings.writeWarnings(resultDir); err != nil {
+		return err
+	}
 
-	make = exec.Command("make", "INSTALL_MOD_PATH=/tmp/buildresult", "modules_install", "-j"+strconv.Itoa(runtime.NumCPU()))
+	make = exec.Command("make", "INSTALL_MOD_PATH="+resultDir, "modules_install", "-j"+strconv.Itoa(runtime.NumCPU()))
 	make.Env = env
 	make.Stdout = os.Stdout
 	make.Stderr = os.Stderr
@@ -1163,6 +1254,69 @@ func compile() error {
 	return nil
 }
 
+// compileOverlays compiles the overlay sources in /usr/src/overlays into
+// resultDir/overlays using the dtc from the kernel tree (built as part of make
+// dtbs).
+func compileOverlays(overlays []string, resultDir string) error {
+	if len(overlays) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(resultDir, "overlays"), 0755); err != nil {
+		return err
+	}
+	for _, name := range overlays {
+		log.Printf("compiling overlay %q", name)
+		dtc := exec.Command("scripts/dtc/dtc",
+			"-@",
+			"-I", "dts",
+			"-O", "dtb",
+			"-o", filepath.Join(resultDir, "overlays", name+".dtbo"),
+			filepath.Join("/usr/src/overlays", name+".dts"))
+		dtc.Stdout = os.Stdout
+		dtc.Stderr = os.Stderr
+		if err := dtc.Run(); err != nil {
+			return fmt.Errorf("%v: %v", dtc.Args, err)
+		}
+	}
+	return nil
+}
+
+// dtbs lists the device trees copied to the build result, see -boards.
+var dtbs = board.Boards
+
+// validateOverlays applies each compiled overlay to each of our Raspberry Pi
+// DTBs using fdtoverlay (built alongside dtc), so that overlays referencing
+// labels which do not exist in our device trees fail the build instead of the
+// boot.
+func validateOverlays(overlays []string, resultDir string) error {
+	if len(overlays) == 0 {
+		return nil
+	}
+	tmp, err := ioutil.TempDir("", "overlays")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range overlays {
+		for _, dtb := range dtbs {
+			if dtb.DTB == "" || dtb.UBoot {
+				continue
+			}
+			log.Printf("validating overlay %q against %s", name, dtb.DTB)
+			fdtoverlay := exec.Command("scripts/dtc/fdtoverlay",
+				"-i", dtb.Src,
+				"-o", filepath.Join(tmp, dtb.DTB),
+				filepath.Join(resultDir, "overlays", name+".dtbo"))
+			fdtoverlay.Stdout = os.Stdout
+			fdtoverlay.Stderr = os.Stderr
+			if err := fdtoverlay.Run(); err != nil {
+				return fmt.Errorf("overlay %q does not apply to %s: %v: %v", name, dtb.DTB, fdtoverlay.Args, err)
+			}
+		}
+	}
+	return nil
+}
+
 func copyFile(dest, src string) error {
 	out, err := os.Create(dest)
 	if err != nil {
@@ -1190,58 +1344,296 @@ func copyFile(dest, src string) error {
 	return out.Close()
 }
 
+// debugInfoConfig enables DWARF debug info in vmlinux (see -debug_info). It
+// does not change the code in vmlinuz.
+const debugInfoConfig = `
+# CONFIG_DEBUG_INFO_NONE is not set
+CONFIG_DEBUG_INFO_DWARF_TOOLCHAIN_DEFAULT=y
+# CONFIG_DEBUG_INFO_REDUCED is not set
+# CONFIG_DEBUG_INFO_SPLIT is not set
+`
+
+// ikconfigModes map the values of -ikconfig to the config fragment which
+// disables what configAddendum enables of the embedded config.
+var ikconfigModes = map[string]string{
+	"proc":     "",
+	"embedded": "# CONFIG_IKCONFIG_PROC is not set\n",
+	"off":      "# CONFIG_IKCONFIG is not set\n# CONFIG_IKCONFIG_PROC is not set\n",
+}
+
 func main() {
-	log.Printf("downloading kernel source: %s", latest)
-	if err := downloadKernel(); err != nil {
+	var profilesList = flag.String("profiles",
+		"",
+		fmt.Sprintf("comma-separated list of config profiles to enable on top of the gokrazy defaults, out of %v", profile.Names()))
+	var capabilitiesList = flag.String("capabilities",
+		"",
+		fmt.Sprintf("comma-separated list of capabilities whose drivers to enable, out of %v", capability.Names()))
+	var assertMonolithic = flag.Bool("assert_monolithic",
+		false,
+		"fail the build if any option is built as a module (=m) which neither the gokrazy defaults nor the profiles and capabilities request as one")
+	var assertLockdown = flag.Bool("assert_lockdown",
+		false,
+		"fail the build if kernel lockdown is not enforced from boot")
+	var printConfigOnly = flag.Bool("print_config",
+		false,
+		"print the kernel source URL, exported DTBs and config fragments a build would use, then exit without building")
+	var downloadOnly = flag.Bool("download_only",
+		false,
+		"download the kernel source tarball into the working directory, then exit without building")
+	var checkImage = flag.String("check_image",
+		"",
+		"if non-empty, path to a kernel image whose embedded config to verify against the requirements and assertions, then exit without building")
+	var mirror = flag.String("mirror",
+		"",
+		"if non-empty, comma-separated list of URLs of kernel.org mirrors to download the kernel source from, replacing "+kernelversion.KernelOrg+". The ranges of a parallel download are spread across them, which requires the hash of the kernel source in kernel.lock")
+	var downloadConnections = flag.Int("download_connections",
+		4,
+		"number of ranges to download the kernel source in parallel, if the server supports range requests. 1 downloads a single stream")
+	var ccache = flag.Bool("ccache",
+		false,
+		"compile using ccache, with the cache in /ccache (which should be a volume)")
+	var sourceCacheDir = flag.String("source_cache",
+		"",
+		"if non-empty, directory (e.g. a volume) to cache the unpacked kernel source in, so that subsequent builds of the same version skip unpacking the tarball")
+	var kernelSrc = flag.String("kernel_src",
+		"",
+		"if non-empty, kernel source tree to build in instead of downloading the kernel source, e.g. a checkout with driver changes. The tree is configured and compiled in place")
+	var kernelSrcPatches = flag.Bool("kernel_src_patches",
+		false,
+		"with -kernel_src, apply the patches (those which are not applied yet) to the tree")
+	var exportSrc = flag.Bool("export_src",
+		false,
+		"after compiling, write the patched and configured kernel tree (without object files) to "+exportedSourceFile+" in the build result, e.g. for building out-of-tree modules against it")
+	var compileCommands = flag.Bool("compile_commands",
+		false,
+		"after compiling, generate "+compileCommandsFile+" (for clangd-based editors) and copy it into the build result. Requires python3")
+	var hardeningList = flag.String("hardening",
+		"",
+		fmt.Sprintf("comma-separated list of hardening features which need compiler support to enable, out of %v. The toolchain is checked before configuring the kernel", hardening.Names()))
+	var signModules = flag.Bool("sign_modules",
+		false,
+		"sign all modules and make the kernel refuse to load unsigned ones (CONFIG_MODULE_SIG_FORCE). Unless -module_signing_key is set, the modules are signed with a key generated for the build, which is discarded afterwards. The certificate is copied to "+moduleSigningCert+" in the build result")
+	var moduleKey = flag.String("module_signing_key",
+		"",
+		"with -sign_modules, path of a PEM file with the private key and X.509 certificate to sign the modules with, instead of generating a key")
+	var ikconfig = flag.String("ikconfig",
+		"proc",
+		"whether to embed the config into the kernel: proc (and expose it as /proc/config.gz on the device), embedded (only in the kernel image, saving the memory /proc/config.gz takes) or off")
+	var boards = flag.String("boards",
+		"",
+		"comma-separated list of boards whose DTBs to export (default: all), or none")
+	var localversion = flag.String("localversion",
+		"",
+		"if non-empty, suffix to append to the kernel release (CONFIG_LOCALVERSION)")
+	var preBuildHooks = flag.String("pre_build_hook",
+		"",
+		"comma-separated list of executables to run in the kernel source tree after applying the patches, before configuring the kernel")
+	var debugInfo = flag.Bool("debug_info",
+		false,
+		"build vmlinux with DWARF debug info, so that panics can be symbolized to file:line")
+	var perf = flag.Bool("perf",
+		false,
+		"also build a static perf binary from tools/perf of the kernel source")
+	var selftests = flag.String("selftests",
+		"",
+		"comma-separated list of kselftest targets to build as static binaries into kselftest/")
+	var debugVariant = flag.Bool("debug_variant",
+		false,
+		"also build a debug variant of the kernel with KASAN, UBSAN and lockdep into vmlinuz-debug")
+	var analyzer = flag.String("analyze",
+		"",
+		"if non-empty, analyze the C files the patches touch after compiling, with sparse or w1 (the extra compiler warnings of W=1), and write the findings to analysis-report.txt")
+	var defconfig = flag.String("defconfig",
+		"defconfig",
+		"arm64 defconfig to start from: the name of a make target (e.g. defconfig) or the path of a defconfig file. The gokrazy defaults and fragments are merged on top")
+	var artifacts = flag.String("artifacts",
+		"",
+		"comma-separated list of files in the kernel tree (e.g. arch/arm64/boot/dts/allwinner/sun50i-a64-pine64-plus.dtb) to copy into the build result, in addition to those of -boards")
+	var stage = flag.String("stage",
+		"",
+		"if non-empty, run only a stage of the build, for building in the stages of an image build: "+stageConfigure+" (up to configuring the kernel) or "+stageCompile+" (the remaining steps, in the tree configured by the configure stage)")
+	var sourceDir = flag.String("source_dir",
+		".",
+		"directory to download the kernel source tarball into. If it already contains the tarball, e.g. from a failed build, it is not downloaded again")
+	flag.Parse()
+	selected, err := board.Resolve(*boards)
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	log.Printf("unpacking kernel source")
-	untar := exec.Command("tar", "xf", filepath.Base(latest))
-	untar.Stdout = os.Stdout
-	untar.Stderr = os.Stderr
-	if err := untar.Run(); err != nil {
-		log.Fatalf("untar: %v", err)
+	dtbs = selected
+	var extraArtifacts []string
+	if *artifacts != "" {
+		extraArtifacts = strings.Split(*artifacts, ",")
 	}
-
-	srcdir := strings.TrimSuffix(filepath.Base(latest), ".tar.xz")
-
-	log.Printf("applying patches")
-	if err := applyPatches(srcdir); err != nil {
+	profiles, err := profile.Resolve(*profilesList)
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	if err := os.Chdir(srcdir); err != nil {
+	caps, err := capability.Resolve(*capabilitiesList)
+	if err != nil {
 		log.Fatal(err)
 	}
-
-	log.Printf("compiling kernel")
-	if err := compile(); err != nil {
-		log.Fatal(err)
+	assert := assertions{
+		monolithic: *assertMonolithic,
+		lockdown:   *assertLockdown,
 	}
-
-	if err := copyFile("/tmp/buildresult/vmlinuz", "arch/arm64/boot/Image"); err != nil {
-		log.Fatal(err)
+	var fragments []fragment
+	for _, p := range profiles {
+		fragments = append(fragments, fragment{
+			kind:    "profile",
+			name:    p.Name,
+			config:  p.Config,
+			notes:   p.Notes,
+			record:  p.Record,
+			require: p.Require,
+		})
 	}
-
-	if err := copyFile("/tmp/buildresult/bcm2710-rpi-3-b.dtb", "arch/arm64/boot/dts/broadcom/bcm2837-rpi-3-b.dtb"); err != nil {
+	for _, c := range caps {
+		fragments = append(fragments, fragment{kind: "capability", name: c.Name, config: c.Config})
+	}
+	for _, b := range selected {
+		if b.Config != "" {
+			fragments = append(fragments, fragment{kind: "board", name: b.Name, config: b.Config})
+		}
+	}
+	features, err := hardening.Resolve(*hardeningList)
+	if err != nil {
 		log.Fatal(err)
 	}
+	for _, f := range features {
+		fragments = append(fragments, fragment{
+			kind:    "hardening",
+			name:    f.Name,
+			config:  f.Config,
+			notes:   f.Notes,
+			require: f.Require,
+		})
+	}
+	if *moduleKey != "" && !*signModules {
+		log.Fatal("-module_signing_key requires -sign_modules")
+	}
+	if *signModules {
+		fragments = append(fragments, moduleSigningFragment(*moduleKey))
+	}
+	ikconfigFragment, ok := ikconfigModes[*ikconfig]
+	if !ok {
+		log.Fatalf("unknown -ikconfig=%s, expected proc, embedded or off", *ikconfig)
+	}
+	if ikconfigFragment != "" {
+		fragments = append(fragments, fragment{kind: "ikconfig", name: *ikconfig, config: ikconfigFragment})
+	}
+	if *localversion != "" {
+		fragments = append(fragments, fragment{
+			kind:   "local version",
+			name:   *localversion,
+			config: fmt.Sprintf("CONFIG_LOCALVERSION=%q\n# CONFIG_LOCALVERSION_AUTO is not set\n", *localversion),
+		})
+	}
+	if *debugInfo {
+		fragments = append(fragments, fragment{
+			kind:   "debug info",
+			name:   "dwarf",
+			config: debugInfoConfig,
+		})
+	}
 
-	if err := copyFile("/tmp/buildresult/bcm2710-rpi-3-b-plus.dtb", "arch/arm64/boot/dts/broadcom/bcm2837-rpi-3-b-plus.dtb"); err != nil {
-		log.Fatal(err)
+	if *printConfigOnly {
+		source := sourceURLs(*mirror)[0]
+		if g := kernelversion.GitSource(); g != nil {
+			source = g.Repo + " " + g.Ref
+		}
+		if err := printConfig(os.Stdout, source, *defconfig, extraArtifacts, fragments); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	if err := copyFile("/tmp/buildresult/bcm2710-rpi-cm3.dtb", "arch/arm64/boot/dts/broadcom/bcm2837-rpi-cm3-io3.dtb"); err != nil {
-		log.Fatal(err)
+	if *checkImage != "" {
+		cfg, err := kconfig.FromImage(*checkImage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkRequirements(cfg, fragments); err != nil {
+			log.Fatal(err)
+		}
+		requested, err := requestedModules(fragments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkAssertions(cfg, assert, requested); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s: all requirements and assertions satisfied", *checkImage)
+		return
 	}
 
-	if err := copyFile("/tmp/buildresult/bcm2711-rpi-4-b.dtb", "arch/arm64/boot/dts/broadcom/bcm2711-rpi-4-b.dtb"); err != nil {
+	var makeArgs []string
+	if *ccache {
+		os.Setenv("CCACHE_DIR", "/ccache")
+		makeArgs = append(makeArgs, "CC=ccache aarch64-linux-gnu-gcc")
+	}
+	urls := sourceURLs(*mirror)
+	if len(urls) > 1 && kernelversion.SHA256() == "" && kernelversion.GitSource() == nil {
+		// A range manipulated by one of the mirrors is only caught by
+		// verifying the merged tarball against the pinned hash.
+		log.Fatalf("-mirror lists %d mirrors, but kernel.lock does not record the hash of the kernel source to verify the ranges downloaded from them: pin it with gokr-rebuild-kernel bump -version=%s, or list a single mirror", len(urls), kernelversion.Version())
+	}
+	p := &pipeline{
+		dl:        rangeDownloader{connections: *downloadConnections, mirrors: urls[1:]},
+		url:       urls[0],
+		sha256:    kernelversion.SHA256(),
+		git:       kernelversion.GitSource(),
+		sourceDir: *sourceDir,
+		resultDir: "/tmp/buildresult",
+		defconfig: *defconfig,
+		artifacts: extraArtifacts,
+		profiles:  profiles,
+		fragments: fragments,
+		overlays:  profile.Overlays(profiles),
+		assert:    assert,
+		makeArgs:  makeArgs,
+		perf:      *perf,
+		analyzer:  *analyzer,
+		debug:     *debugVariant,
+		stage:     *stage,
+		cache:     *sourceCacheDir,
+
+		localPatches: *kernelSrcPatches,
+		exportSrc:    *exportSrc,
+		hardening:    features,
+
+		compileCommands: *compileCommands,
+		signModules:     *signModules,
+		moduleKey:       *moduleKey,
+	}
+	if *stage != "" && *stage != stageConfigure && *stage != stageCompile {
+		log.Fatalf("unknown -stage=%s, expected %s or %s", *stage, stageConfigure, stageCompile)
+	}
+	if _, ok := analyzers[*analyzer]; *analyzer != "" && !ok {
+		log.Fatalf("unknown -analyze=%s, expected sparse or w1", *analyzer)
+	}
+	if *selftests != "" {
+		p.selftests = strings.Split(*selftests, ",")
+	}
+	if *preBuildHooks != "" {
+		p.preBuild = strings.Split(*preBuildHooks, ",")
+	}
+	if *kernelSrc != "" {
+		if *downloadOnly {
+			log.Fatal("-download_only cannot be used with -kernel_src")
+		}
+		// The steps change into the tree, so relative paths would break.
+		if p.localSrc, err = filepath.Abs(*kernelSrc); err != nil {
+			log.Fatal(err)
+		}
+		p.url = "file://" + p.localSrc
+	} else if err := p.download(); err != nil {
 		log.Fatal(err)
 	}
-
-	if err := copyFile("/tmp/buildresult/bcm2710-rpi-zero-2-w.dtb", "arch/arm64/boot/dts/broadcom/bcm2837-rpi-zero-2-w.dtb"); err != nil {
+	if *downloadOnly {
+		return
+	}
+	if err := p.run(); err != nil {
 		log.Fatal(err)
 	}
-
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// debugVariantConfig enables the runtime checkers of the debug variant (see
+// -debug_variant) on top of the config of the regular kernel.
+const debugVariantConfig = `
+CONFIG_DEBUG_KERNEL=y
+CONFIG_KASAN=y
+CONFIG_KASAN_GENERIC=y
+CONFIG_KASAN_INLINE=y
+CONFIG_UBSAN=y
+CONFIG_UBSAN_BOUNDS=y
+CONFIG_UBSAN_SHIFT=y
+CONFIG_UBSAN_DIV_ZERO=y
+CONFIG_PROVE_LOCKING=y
+CONFIG_DEBUG_ATOMIC_SLEEP=y
+CONFIG_DEBUG_LIST=y
+`
+
+// debugVariantRequire lists the checkers the debug variant is built for.
+var debugVariantRequire = []string{
+	"CONFIG_KASAN",
+	"CONFIG_UBSAN",
+	"CONFIG_LOCKDEP",
+	"CONFIG_PROVE_LOCKING",
+}
+
+// buildDebugVariant rebuilds the kernel image (the file in arch/arm64/boot,
+// see profile.Image) with debugVariantConfig added to the final config of
+// the regular kernel and copies it to resultDir as vmlinuz-debug. The kernel
+// release gets a -debug suffix, so that the debug variant does not load the
+// modules of the regular kernel, which it is incompatible with.
+func buildDebugVariant(image string, makeArgs []string, resultDir string) error {
+	final, err := kconfig.ParseFile(".config")
+	if err != nil {
+		return err
+	}
+	localversion := strings.Trim(final["CONFIG_LOCALVERSION"], `"`) + "-debug"
+	f, err := os.OpenFile(".config", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%sCONFIG_LOCALVERSION=%q\n", debugVariantConfig, localversion); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	olddefconfig := exec.Command("make", "ARCH=arm64", "olddefconfig")
+	olddefconfig.Stdout = os.Stdout
+	olddefconfig.Stderr = os.Stderr
+	if err := olddefconfig.Run(); err != nil {
+		return fmt.Errorf("make olddefconfig: %v", err)
+	}
+	debug, err := kconfig.ParseFile(".config")
+	if err != nil {
+		return err
+	}
+	for _, sym := range debugVariantRequire {
+		if !debug.Enabled(sym) {
+			return fmt.Errorf("%s is not enabled in the debug variant config (missing dependency?)", sym)
+		}
+	}
+
+	log.Printf("compiling debug variant (kernel release suffix %s)", localversion)
+	env := append(os.Environ(),
+		"ARCH=arm64",
+		"CROSS_COMPILE=aarch64-linux-gnu-",
+		"KBUILD_BUILD_USER=gokrazy",
+		"KBUILD_BUILD_HOST=docker",
+		"KBUILD_BUILD_TIMESTAMP=Wed Mar  1 20:57:29 UTC 2017",
+	)
+	make := exec.Command("make", append([]string{image, "-j" + strconv.Itoa(runtime.NumCPU())}, makeArgs...)...)
+	make.Env = env
+	make.Stdout = os.Stdout
+	make.Stderr = os.Stderr
+	if err := make.Run(); err != nil {
+		return fmt.Errorf("make: %v", err)
+	}
+	return copyFile(filepath.Join(resultDir, "vmlinuz-debug"), filepath.Join("arch/arm64/boot", image))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// sourceURLs returns the URLs of the kernel source tarball on the
+// comma-separated list of kernel.org mirrors, or on kernel.org if the list
+// is empty.
+func sourceURLs(mirrors string) []string {
+	var urls []string
+	for _, mirror := range strings.Split(mirrors, ",") {
+		if mirror = strings.TrimSpace(mirror); mirror != "" {
+			urls = append(urls, kernelversion.MirrorURL(mirror))
+		}
+	}
+	if len(urls) == 0 {
+		urls = []string{kernelversion.MirrorURL("")}
+	}
+	return urls
+}
+
+// minRangeSize is the smallest range rangeDownloader downloads separately;
+// smaller files are downloaded in fewer ranges.
+const minRangeSize = 4 << 20
+
+// rangeDownloader downloads in parallel ranges, as a single HTTPS stream
+// from cdn.kernel.org is often capped well below the available bandwidth.
+// The ranges are spread across the url and the mirrors. If the server does
+// not support ranges (or w does not implement io.WriterAt), it downloads a
+// single stream like httpDownloader.
+type rangeDownloader struct {
+	connections int
+	mirrors     []string // further URLs of the same file
+}
+
+func (d rangeDownloader) download(url string, w io.Writer) error {
+	wa, ok := w.(io.WriterAt)
+	if !ok || d.connections < 2 {
+		return httpDownloader{}.download(url, w)
+	}
+	resp, err := http.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		log.Printf("%s does not support range requests, downloading a single stream", url)
+		return httpDownloader{}.download(url, w)
+	}
+	size := resp.ContentLength
+	n := int64(d.connections)
+	if max := size / minRangeSize; n > max {
+		n = max
+	}
+	if n < 2 {
+		return httpDownloader{}.download(url, w)
+	}
+	urls := append([]string{url}, d.mirrors...)
+	log.Printf("downloading %s (%d bytes) in %d ranges from %d sources", url, size, n, len(urls))
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	chunk := size / n
+	for i := int64(0); i < n; i++ {
+		start, end := i*chunk, (i+1)*chunk-1
+		if i == n-1 {
+			end = size - 1
+		}
+		src := urls[i%int64(len(urls))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fetchRange(src, start, end, wa)
+			if err != nil && src != url {
+				log.Printf("%v, retrying the range from %s", err, url)
+				err = fetchRange(url, start, end, wa)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("downloading %s: %s", url, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fetchRange downloads the bytes start to end (inclusive) of url and writes
+// them at the same offsets to w.
+func fetchRange(url string, start, end int64, w io.WriterAt) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusPartialContent; got != want {
+		return fmt.Errorf("unexpected HTTP status code for range %d-%d of %s: got %d, want %d", start, end, url, got, want)
+	}
+	n, err := io.Copy(&offsetWriter{w: w, off: start}, io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("range %d-%d of %s: got %d bytes, want %d", start, end, url, n, end-start+1)
+	}
+	return nil
+}
+
+// offsetWriter writes to w starting at offset off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+func TestSourceURLs(t *testing.T) {
+	file := strings.TrimPrefix(kernelversion.URL(), kernelversion.KernelOrg)
+	for _, tt := range []struct {
+		mirrors string
+		want    []string
+	}{
+		{"", []string{kernelversion.URL()}},
+		{" , ", []string{kernelversion.URL()}},
+		{"https://a.example/kernel", []string{"https://a.example/kernel" + file}},
+		{
+			"https://a.example/kernel/, https://b.example/linux/kernel",
+			[]string{"https://a.example/kernel" + file, "https://b.example/linux/kernel" + file},
+		},
+	} {
+		if got := sourceURLs(tt.mirrors); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sourceURLs(%q) = %q, want %q", tt.mirrors, got, tt.want)
+		}
+	}
+}
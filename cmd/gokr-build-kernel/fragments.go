@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// fragment is a piece of config which is appended to .config after
+// configAddendum, e.g. from a profile or a capability.
+type fragment struct {
+	// kind and name identify the fragment in the report, e.g. profile
+	// "hardened".
+	kind   string
+	name   string
+	config string
+
+	// notes and record are included in the report: notes verbatim, record
+	// as the final values of the listed config symbols.
+	notes  []string
+	record []string
+
+	// require lists config symbols which must be enabled in the final config,
+	// see checkRequirements.
+	require []string
+}
+
+// configReport returns a human-readable report of which options of each
+// fragment ended up with the requested value after olddefconfig, listing the
+// options which did not (e.g. because they are unavailable on arm64 or with
+// our compiler, or a dependency is missing) and how many there are. If deps
+// is not nil, the report explains why olddefconfig dropped an option.
+func configReport(fragments []fragment, final kconfig.Config, deps *kconfigTree) (string, int, error) {
+	var (
+		report  strings.Builder
+		dropped int
+	)
+	for _, frag := range fragments {
+		requested, err := kconfig.Parse(strings.NewReader(frag.config))
+		if err != nil {
+			return "", 0, err
+		}
+		var unsatisfied []string
+		for _, sym := range requested.Symbols() {
+			want, got := requested[sym], final[sym]
+			if want == got || (want == "n" && !final.Enabled(sym)) {
+				continue
+			}
+			if got == "" {
+				got = "unavailable"
+			}
+			line := fmt.Sprintf("  %s: requested %s, got %s", sym, want, got)
+			if deps != nil && want != "n" {
+				if reason := deps.explain(sym, want, final); reason != "" {
+					line += " (" + reason + ")"
+				}
+			}
+			unsatisfied = append(unsatisfied, line)
+		}
+		dropped += len(unsatisfied)
+		fmt.Fprintf(&report, "%s %q: %d of %d options satisfied\n", frag.kind, frag.name, len(requested)-len(unsatisfied), len(requested))
+		for _, line := range unsatisfied {
+			fmt.Fprintln(&report, line)
+		}
+		for _, sym := range frag.record {
+			val := final[sym]
+			if val == "" {
+				val = "n"
+			}
+			fmt.Fprintf(&report, "  %s=%s\n", sym, val)
+		}
+		for _, note := range frag.notes {
+			fmt.Fprintf(&report, "  note: %s\n", note)
+		}
+	}
+	return report.String(), dropped, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// gitSourceName returns the file name of the tarball which fetchGit exports,
+// which unpacks into the same directory as the kernel.org tarball would.
+func gitSourceName() string {
+	return "linux-" + kernelversion.Version() + ".tar"
+}
+
+// gitSourceURL returns the URL of commit of repo, as recorded in the build
+// info, in the form of SPDX and SLSA, e.g.
+// git+https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git@<commit>.
+func gitSourceURL(repo, commit string) string {
+	return "git+" + repo + "@" + commit
+}
+
+// fetchGit exports the kernel source from the git repository of kernel.lock
+// into a tarball in p.sourceDir, unless a previous (e.g. failed) build
+// already exported the pinned commit. Only the ref is fetched, without
+// history, which is a fraction of the size of a full clone.
+func (p *pipeline) fetchGit() error {
+	path := filepath.Join(p.sourceDir, gitSourceName())
+	commitPath := path + ".commit"
+	if b, err := ioutil.ReadFile(commitPath); err == nil {
+		commit := strings.TrimSpace(string(b))
+		if _, err := os.Stat(path); err == nil && (p.git.Commit == "" || p.git.Commit == commit) {
+			log.Printf("using previously exported %s (commit %s)", path, commit)
+			p.tarball, p.url = path, gitSourceURL(p.git.Repo, commit)
+			return nil
+		}
+	}
+	log.Printf("fetching kernel source: %s %s", p.git.Repo, p.git.Ref)
+	if err := os.MkdirAll(p.sourceDir, 0755); err != nil {
+		return err
+	}
+	repo, err := ioutil.TempDir(p.sourceDir, "git")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(repo)
+	git := func(args ...string) *exec.Cmd {
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Stderr = os.Stderr
+		return cmd
+	}
+	if err := git("init", "-q").Run(); err != nil {
+		return fmt.Errorf("git init: %v", err)
+	}
+	fetch := git("fetch", "--depth=1", "--no-tags", p.git.Repo, p.git.Ref)
+	fetch.Stdout = os.Stdout
+	if err := fetch.Run(); err != nil {
+		return fmt.Errorf("fetching %s from %s: %v", p.git.Ref, p.git.Repo, err)
+	}
+	out, err := git("rev-parse", "FETCH_HEAD^{commit}").Output()
+	if err != nil {
+		return fmt.Errorf("git rev-parse: %v", err)
+	}
+	commit := strings.TrimSpace(string(out))
+	if p.git.Commit == "" {
+		log.Printf("kernel.lock does not pin the commit of %s, building %s (pin it with gokr-rebuild-kernel bump -git_ref=%s)", p.git.Ref, commit, p.git.Ref)
+	} else if commit != p.git.Commit {
+		return fmt.Errorf("%s of %s resolves to commit %s, but kernel.lock pins %s", p.git.Ref, p.git.Repo, commit, p.git.Commit)
+	}
+
+	// Export into a temporary file, so that an interrupted export is not
+	// mistaken for a complete one.
+	f, err := os.Create(path + ".partial")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	archive := git("archive", "--format=tar", "--prefix=linux-"+kernelversion.Version()+"/", commit)
+	archive.Stdout = f
+	if err := archive.Run(); err != nil {
+		return fmt.Errorf("git archive: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(commitPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(path+".partial", path); err != nil {
+		return err
+	}
+	p.tarball, p.url = path, gitSourceURL(p.git.Repo, commit)
+	return ioutil.WriteFile(commitPath, []byte(commit+"\n"), 0644)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/hardening"
+)
+
+// crossCompiler is the compiler the kernel is built with.
+const crossCompiler = "aarch64-linux-gnu-gcc"
+
+// checkHardeningToolchain verifies that the compiler supports the -hardening
+// features, so that an unsupported feature fails the build with a hint
+// instead of Kconfig silently dropping its options.
+func checkHardeningToolchain(features []hardening.Feature) error {
+	for _, f := range features {
+		if f.CompilerFlag != "" {
+			cc := exec.Command(crossCompiler, f.CompilerFlag, "-x", "c", "-c", "-o", "/dev/null", "-")
+			cc.Stdin = strings.NewReader("int x;\n")
+			if out, err := cc.CombinedOutput(); err != nil {
+				return fmt.Errorf("-hardening=%s: %s %s does not support %s (%v: %s)", f.Name, crossCompiler, compilerVersion(), f.CompilerFlag, err, strings.TrimSpace(string(out)))
+			}
+		}
+		if f.Plugin {
+			out, err := exec.Command(crossCompiler, "-print-file-name=plugin").Output()
+			if err != nil {
+				return fmt.Errorf("%s -print-file-name=plugin: %v", crossCompiler, err)
+			}
+			dir := strings.TrimSpace(string(out))
+			if _, err := os.Stat(filepath.Join(dir, "include", "plugin-version.h")); err != nil {
+				return fmt.Errorf("-hardening=%s: the GCC plugin headers of %s %s are not installed (%v); gokr-rebuild-kernel installs them for -hardening, a -toolchain_image needs gcc-%s-plugin-dev-aarch64-linux-gnu (gcc-%[5]s-plugin-dev on arm64)", f.Name, crossCompiler, compilerVersion(), err, compilerVersion())
+			}
+		}
+	}
+	return nil
+}
+
+// compilerVersion returns the major version of crossCompiler, e.g. 12.
+func compilerVersion() string {
+	out, err := exec.Command(crossCompiler, "-dumpversion").Output()
+	if err != nil {
+		return "(unknown version)"
+	}
+	return strings.SplitN(strings.TrimSpace(string(out)), ".", 2)[0]
+}
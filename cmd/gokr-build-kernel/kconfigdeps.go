@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// kconfigDef is a definition of a config symbol in a Kconfig file. A symbol
+// can be defined more than once, e.g. per architecture.
+type kconfigDef struct {
+	// dependsOn are the dependencies of the definition: its depends on
+	// lines and those of the enclosing if blocks, menus and choices.
+	dependsOn []string
+	// prompt is whether the user can set the symbol. Symbols without a
+	// prompt are only enabled by default values or via select.
+	prompt bool
+	// choice is whether the symbol is part of a choice, of which only one
+	// can be enabled.
+	choice bool
+}
+
+// kconfigTree holds the definitions of all config symbols in the Kconfig
+// files of a kernel source tree, for explaining why olddefconfig dropped a
+// requested option.
+type kconfigTree struct {
+	defs map[string][]*kconfigDef // by symbol, including the CONFIG_ prefix
+}
+
+// parseKconfig reads the Kconfig files of the kernel source tree in srcDir
+// for the architecture arch (e.g. arm64), following source statements.
+func parseKconfig(srcDir, arch string) (*kconfigTree, error) {
+	t := &kconfigTree{defs: make(map[string][]*kconfigDef)}
+	p := &kconfigParser{
+		tree:   t,
+		srcDir: srcDir,
+		arch:   arch,
+		seen:   make(map[string]bool),
+	}
+	if err := p.file(filepath.Join(srcDir, "Kconfig"), false); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// kconfigBlock is an if block, menu or choice whose dependencies apply to
+// the entries within.
+type kconfigBlock struct {
+	keyword   string // if, menu or choice
+	dependsOn []string
+}
+
+type kconfigParser struct {
+	tree   *kconfigTree
+	srcDir string
+	arch   string
+	seen   map[string]bool
+	blocks []*kconfigBlock
+}
+
+func (p *kconfigParser) expand(s string) string {
+	s = strings.ReplaceAll(s, "$(SRCARCH)", p.arch)
+	return strings.ReplaceAll(s, "$(ARCH)", p.arch)
+}
+
+// indentation returns the width of the leading whitespace of line, with
+// tabs counting as 8 like in Kconfig help texts.
+func indentation(line string) int {
+	width := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			width++
+		case '\t':
+			width = (width/8 + 1) * 8
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+func (p *kconfigParser) file(path string, optional bool) error {
+	if p.seen[path] {
+		return nil
+	}
+	p.seen[path] = true
+	f, err := os.Open(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var (
+		lines []string
+		cont  string
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			cont += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		lines = append(lines, cont+line)
+		cont = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var (
+		// deps receives the depends on lines: those of the current entry,
+		// menu or choice.
+		deps *[]string
+		def  *kconfigDef
+	)
+	for idx := 0; idx < len(lines); idx++ {
+		line := strings.TrimSpace(lines[idx])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		keyword, rest := fields[0], strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		switch keyword {
+		case "config", "menuconfig":
+			def = &kconfigDef{}
+			for _, b := range p.blocks {
+				def.dependsOn = append(def.dependsOn, b.dependsOn...)
+				if b.keyword == "choice" {
+					def.choice = true
+				}
+			}
+			sym := "CONFIG_" + rest
+			p.tree.defs[sym] = append(p.tree.defs[sym], def)
+			deps = &def.dependsOn
+
+		case "bool", "tristate", "string", "int", "hex", "def_bool", "def_tristate", "prompt":
+			if def != nil && rest != "" && (keyword == "prompt" || strings.HasPrefix(rest, `"`)) {
+				def.prompt = true
+			}
+
+		case "depends":
+			if deps != nil {
+				*deps = append(*deps, strings.TrimSpace(strings.TrimPrefix(rest, "on")))
+			}
+
+		case "help", "---help---":
+			// Skip the help text, which ends at the first line indented less
+			// than its first line (or not more than the help keyword).
+			width := -1
+			for idx+1 < len(lines) {
+				next := lines[idx+1]
+				if strings.TrimSpace(next) != "" {
+					if width == -1 {
+						width = indentation(next)
+						if width <= indentation(lines[idx]) {
+							break
+						}
+					}
+					if indentation(next) < width {
+						break
+					}
+				}
+				idx++
+			}
+
+		case "if":
+			p.blocks = append(p.blocks, &kconfigBlock{keyword: "if", dependsOn: []string{rest}})
+			def, deps = nil, nil
+
+		case "menu", "choice":
+			b := &kconfigBlock{keyword: keyword}
+			p.blocks = append(p.blocks, b)
+			def, deps = nil, &b.dependsOn
+
+		case "endif", "endmenu", "endchoice":
+			if len(p.blocks) > 0 {
+				p.blocks = p.blocks[:len(p.blocks)-1]
+			}
+			def, deps = nil, nil
+
+		case "comment", "mainmenu":
+			var ignored []string
+			def, deps = nil, &ignored
+
+		case "source", "rsource", "osource", "orsource":
+			pattern := p.expand(strings.Trim(rest, `"`))
+			if strings.HasPrefix(keyword, "r") || strings.HasPrefix(keyword, "or") {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			} else {
+				pattern = filepath.Join(p.srcDir, pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return err
+			}
+			optional := strings.HasPrefix(keyword, "o") || strings.Contains(pattern, "*")
+			if len(matches) == 0 {
+				matches = []string{pattern}
+			}
+			// The blocks of the sourcing file apply to the sourced files.
+			for _, match := range matches {
+				if err := p.file(match, optional); err != nil {
+					return err
+				}
+			}
+			def, deps = nil, nil
+		}
+	}
+	return nil
+}
+
+// tristate values of Kconfig expressions.
+const (
+	triN = 0
+	triM = 1
+	triY = 2
+)
+
+func tristate(value string) int {
+	switch value {
+	case "y":
+		return triY
+	case "m":
+		return triM
+	}
+	return triN
+}
+
+// exprEval evaluates a Kconfig expression against a config.
+type exprEval struct {
+	tokens []string
+	pos    int
+	cfg    kconfig.Config
+	// unset collects the symbols the expression references which are not
+	// enabled.
+	unset []string
+}
+
+func tokenizeExpr(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "!="), strings.HasPrefix(expr[i:], "<="),
+			strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case strings.ContainsRune("!()=<>", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			j := len(expr)
+			if end := strings.IndexByte(expr[i+1:], c); end > -1 {
+				j = i + end + 2
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		case strings.HasPrefix(expr[i:], "$("):
+			// A macro, e.g. $(cc-option,...), which depends on the
+			// compiler: a single token up to the matching parenthesis.
+			depth, j := 0, i+1
+			for ; j < len(expr); j++ {
+				if expr[j] == '(' {
+					depth++
+				} else if expr[j] == ')' {
+					if depth--; depth == 0 {
+						j++
+						break
+					}
+				}
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t!()=<>&|\"'", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				j++ // skip a stray character like a single &
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (e *exprEval) peek() string {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return ""
+}
+
+func (e *exprEval) next() string {
+	tok := e.peek()
+	e.pos++
+	return tok
+}
+
+// or := and { "||" and }
+func (e *exprEval) or() int {
+	v := e.and()
+	for e.peek() == "||" {
+		e.next()
+		if w := e.and(); w > v {
+			v = w
+		}
+	}
+	return v
+}
+
+// and := unary { "&&" unary }
+func (e *exprEval) and() int {
+	v := e.unary()
+	for e.peek() == "&&" {
+		e.next()
+		if w := e.unary(); w < v {
+			v = w
+		}
+	}
+	return v
+}
+
+// unary := "!" unary | "(" or ")" | operand [ comparison operand ]
+func (e *exprEval) unary() int {
+	switch e.peek() {
+	case "!":
+		e.next()
+		return triY - e.unary()
+	case "(":
+		e.next()
+		v := e.or()
+		if e.peek() == ")" {
+			e.next()
+		}
+		return v
+	}
+	left := e.next()
+	switch op := e.peek(); op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		e.next()
+		right := e.next()
+		l, r := e.value(left), e.value(right)
+		var result bool
+		switch op {
+		case "=":
+			result = l == r
+		case "!=":
+			result = l != r
+		default:
+			// Numeric comparisons (e.g. of GCC_VERSION) are assumed to
+			// hold, as the values depend on the toolchain.
+			result = true
+		}
+		if result {
+			return triY
+		}
+		return triN
+	}
+	if strings.HasPrefix(left, "$(") {
+		return triY
+	}
+	v := tristate(e.value(left))
+	if v == triN && isSymbolName(left) {
+		e.unset = append(e.unset, "CONFIG_"+left)
+	}
+	return v
+}
+
+func isSymbolName(tok string) bool {
+	if tok == "" || tok == "y" || tok == "m" || tok == "n" {
+		return false
+	}
+	for _, c := range tok {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return !(tok[0] >= '0' && tok[0] <= '9')
+}
+
+// value returns the value of the operand tok: a constant or symbol.
+func (e *exprEval) value(tok string) string {
+	switch {
+	case tok == "y" || tok == "m" || tok == "n":
+		if tok == "m" && !e.cfg.Enabled("CONFIG_MODULES") {
+			return "n"
+		}
+		return tok
+	case strings.HasPrefix(tok, `"`) || strings.HasPrefix(tok, "'"):
+		return strings.Trim(tok, `"'`)
+	case isSymbolName(tok):
+		v := e.cfg["CONFIG_"+tok]
+		if v == "" {
+			return "n"
+		}
+		return strings.Trim(v, `"`)
+	}
+	return tok
+}
+
+// evalExpr returns the tristate value of the Kconfig expression expr in cfg
+// and the referenced symbols which are not enabled.
+func evalExpr(expr string, cfg kconfig.Config) (int, []string) {
+	e := &exprEval{tokens: tokenizeExpr(expr), cfg: cfg}
+	v := e.or()
+	return v, e.unset
+}
+
+// explain returns why sym did not end up with the value want in final, or
+// the empty string if the Kconfig files do not tell.
+func (t *kconfigTree) explain(sym, want string, final kconfig.Config) string {
+	defs, ok := t.defs[sym]
+	if !ok {
+		return "not defined in this kernel's Kconfig files (renamed or removed?)"
+	}
+	var reasons []string
+	for _, def := range defs {
+		limit := triY
+		var unset []string
+		for _, dep := range def.dependsOn {
+			v, u := evalExpr(dep, final)
+			if v < limit {
+				limit = v
+			}
+			if v < triY {
+				unset = append(unset, u...)
+			}
+		}
+		switch {
+		case limit == triN:
+			reason := "missing dependency"
+			if len(unset) > 0 {
+				reason = "depends on " + strings.Join(dedup(unset), ", ") + ", which " + pluralIs(len(dedup(unset))) + " not enabled"
+			}
+			reasons = append(reasons, reason)
+		case limit == triM && want == "y":
+			reasons = append(reasons, "a dependency is only built as module, which limits it to m")
+		case !def.prompt:
+			reasons = append(reasons, "not user-selectable: only enabled by default or when selected by another option")
+		case def.choice:
+			reasons = append(reasons, "part of a choice, in which another option is selected")
+		}
+	}
+	return strings.Join(dedup(reasons), "; ")
+}
+
+func dedup(list []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func pluralIs(n int) string {
+	if n == 1 {
+		return "is"
+	}
+	return "are"
+}
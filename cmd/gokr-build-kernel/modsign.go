@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// generatedSigningKey is where Kbuild generates the module signing key
+// (certs/Makefile) if CONFIG_MODULE_SIG_KEY is left at this default and the
+// file does not exist, and signingCert is where it extracts the certificate
+// which is embedded into the kernel.
+const (
+	generatedSigningKey = "certs/signing_key.pem"
+	signingCert         = "certs/signing_key.x509"
+)
+
+// moduleSigningCert is the file in the build result into which
+// exportSigningCert copies the (DER-encoded) certificate of the module
+// signing key.
+const moduleSigningCert = "module-signing.x509"
+
+// moduleSignatureMagic ends every signed module (include/linux/module_signature.h).
+const moduleSignatureMagic = "~Module signature appended~\n"
+
+// moduleSigningFragment returns the config which makes the kernel refuse
+// to load modules which are not signed by key (see CONFIG_MODULE_SIG_KEY),
+// and makes modules_install sign all modules. If key is empty, Kbuild
+// generates a key for the build.
+func moduleSigningFragment(key string) fragment {
+	name := key
+	notes := []string{
+		"the modules are signed at modules_install, and the kernel loads no other modules",
+	}
+	if key == "" {
+		name = "generated key"
+		key = generatedSigningKey
+		notes = append(notes,
+			"the signing key is discarded after the build, so that no modules but those of this build can be signed for this kernel (and builds are not reproducible)")
+	}
+	return fragment{
+		kind: "module signing",
+		name: name,
+		config: fmt.Sprintf(`CONFIG_MODULES=y
+CONFIG_MODULE_SIG=y
+CONFIG_MODULE_SIG_FORCE=y
+CONFIG_MODULE_SIG_ALL=y
+CONFIG_MODULE_SIG_SHA512=y
+CONFIG_MODULE_SIG_KEY=%q
+`, key),
+		notes:   notes,
+		require: []string{"MODULE_SIG", "MODULE_SIG_FORCE", "MODULE_SIG_ALL"},
+	}
+}
+
+// removeSigningKey removes the generated module signing key (and its
+// certificate) from the kernel tree, so that a -kernel_src tree built in
+// before does not sign with the key of a previous build.
+func removeSigningKey() error {
+	for _, path := range []string{generatedSigningKey, signingCert} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSignedModules returns an error unless all modules installed into
+// resultDir end with a signature, and returns how many there are.
+func checkSignedModules(resultDir string) (int, error) {
+	var (
+		signed   int
+		unsigned []string
+	)
+	err := filepath.Walk(filepath.Join(resultDir, "lib", "modules"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".ko") {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(b, []byte(moduleSignatureMagic)) {
+			unsigned = append(unsigned, path)
+			return nil
+		}
+		signed++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(unsigned) > 0 {
+		return 0, fmt.Errorf("%d modules are not signed, the kernel would refuse to load them: %s", len(unsigned), strings.Join(unsigned, ", "))
+	}
+	return signed, nil
+}
+
+// exportSigningCert checks that the installed modules are signed and copies
+// the certificate of the signing key into the build result.
+func (p *pipeline) exportSigningCert() error {
+	if !p.signModules {
+		return nil
+	}
+	n, err := checkSignedModules(p.resultDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d modules signed", n)
+	return copyFile(filepath.Join(p.resultDir, moduleSigningCert), signingCert)
+}
+
+// discardSigningKey removes the generated module signing key from the
+// kernel tree once nothing needs to be signed anymore.
+func (p *pipeline) discardSigningKey() error {
+	if !p.signModules || p.moduleKey != "" {
+		return nil
+	}
+	log.Printf("removing %s", generatedSigningKey)
+	return os.Remove(generatedSigningKey)
+}
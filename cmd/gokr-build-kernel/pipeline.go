@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/hardening"
+	"github.com/alf632/gokrazy-kernel/kconfig"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+	"github.com/alf632/gokrazy-kernel/profile"
+	"github.com/alf632/gokrazy-kernel/symbols"
+)
+
+// downloader fetches the kernel source tarball.
+type downloader interface {
+	download(url string, w io.Writer) error
+}
+
+// httpDownloader downloads via HTTP(S).
+type httpDownloader struct{}
+
+func (httpDownloader) download(url string, w io.Writer) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Printf("HTTP GET %s: %s (Content-Length: %d)", url, resp.Status, resp.ContentLength)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// pipeline is a kernel build: the source tarball is downloaded into
+// sourceDir, then the steps run in order, each working in the kernel tree
+// and writing to resultDir.
+type pipeline struct {
+	dl        downloader
+	url       string
+	sha256    string             // expected hash of the tarball; empty skips verification
+	git       *kernelversion.Git // if non-nil, fetch the source from git instead of url
+	sourceDir string
+	resultDir string
+
+	defconfig string   // see defconfigTarget
+	artifacts []string // files in the kernel tree to copy into resultDir
+	profiles  []profile.Profile
+	fragments []fragment
+	overlays  []string
+	assert    assertions
+	makeArgs  []string
+	preBuild  []string // hooks to run in the kernel tree before compiling
+	perf      bool     // build a static perf binary from tools/perf
+	selftests []string // kselftest targets to build, e.g. timers
+	analyzer  string   // if non-empty, see analyzers
+	debug     bool     // also build the debug variant, see buildDebugVariant
+	stage     string   // if non-empty, the stage of the steps to run
+	cache     string   // if non-empty, see sourceCache
+
+	// localSrc is a kernel source tree to build in, instead of the
+	// downloaded tarball. The patches are only applied to it if
+	// localPatches is true.
+	localSrc     string
+	localPatches bool
+
+	exportSrc       bool                // see exportSource
+	hardening       []hardening.Feature // checked by configure
+	compileCommands bool                // see writeCompileCommands
+
+	// signModules signs the modules with moduleKey or, if empty, with a
+	// key Kbuild generates for the build, see moduleSigningFragment.
+	signModules bool
+	moduleKey   string
+
+	tarball string                // populated by download
+	patches []kernelversion.Patch // populated by patch
+}
+
+// Stages of the pipeline (see -stage), so that the host can build the kernel
+// in the stages of an image build, which caches the configured kernel tree
+// as a layer.
+const (
+	stageConfigure = "configure" // the steps up to configuring the kernel
+	stageCompile   = "compile"   // the remaining steps
+)
+
+// step is a stage of the pipeline.
+type step struct {
+	name string
+	fn   func(*pipeline) error
+	// configure marks the steps of stageConfigure. In stageCompile, they
+	// are skipped, running resume (if non-nil) instead.
+	configure bool
+	resume    func(*pipeline) error
+}
+
+var steps = []step{
+	{"unpacking kernel source", (*pipeline).unpack, true, nil},
+	{"applying patches", (*pipeline).patch, true, (*pipeline).enterTree},
+	{"running pre-build hooks", (*pipeline).runPreBuildHooks, true, nil},
+	{"configuring kernel", (*pipeline).configure, true, nil},
+	{"compiling kernel", (*pipeline).compile, false, nil},
+	{"exporting module signing certificate", (*pipeline).exportSigningCert, false, nil},
+	{"generating compile_commands.json", (*pipeline).writeCompileCommands, false, nil},
+	{"exporting source tree", (*pipeline).exportSource, false, nil},
+	{"analyzing patched files", (*pipeline).analyze, false, nil},
+	{"building perf", (*pipeline).buildPerf, false, nil},
+	{"building selftests", (*pipeline).buildSelftests, false, nil},
+	{"compiling overlays", (*pipeline).compileOverlays, false, nil},
+	{"validating overlays", (*pipeline).validateOverlays, false, nil},
+	{"listing wireless firmware", (*pipeline).listWirelessFirmware, false, nil},
+	{"copying build result", (*pipeline).copyResult, false, nil},
+	{"writing build info", (*pipeline).writeBuildInfo, false, nil},
+	// The debug variant is built last, as it reconfigures the kernel tree.
+	{"building debug variant", (*pipeline).buildDebugVariant, false, nil},
+	// The debug variant embeds the module signing certificate, too.
+	{"discarding module signing key", (*pipeline).discardSigningKey, false, nil},
+}
+
+// download downloads the kernel source tarball into p.sourceDir, unless a
+// previous (e.g. failed) build already did.
+func (p *pipeline) download() error {
+	log.Printf("%sdownloading kernel source", stepPrefix)
+	if p.git != nil {
+		return p.fetchGit()
+	}
+	path := filepath.Join(p.sourceDir, filepath.Base(p.url))
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("using previously downloaded %s", path)
+		p.tarball = path
+		return p.verify()
+	}
+	log.Printf("downloading kernel source: %s", p.url)
+	if err := os.MkdirAll(p.sourceDir, 0755); err != nil {
+		return err
+	}
+	// Download into a temporary file, so that an interrupted download is
+	// not mistaken for a complete one.
+	out, err := os.Create(path + ".partial")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := p.dl.download(p.url, out); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".partial", path); err != nil {
+		return err
+	}
+	p.tarball = path
+	return p.verify()
+}
+
+// verify verifies the hash of the downloaded tarball against kernel.lock.
+// If kernel.lock does not record it, the hash published by kernel.org is
+// used instead, so that the tarball is never used unverified.
+func (p *pipeline) verify() error {
+	want, from := p.sha256, "kernel.lock"
+	if want == "" {
+		log.Printf("kernel.lock does not record the hash of the kernel source (pin it with gokr-rebuild-kernel bump -version=%s), verifying against kernel.org", kernelversion.Version())
+		var err error
+		if want, from, err = publishedHash(kernelversion.URL()); err != nil {
+			return fmt.Errorf("verifying %s: %v", p.tarball, err)
+		}
+	}
+	got, err := fileHash(p.tarball)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s: SHA-256 hash mismatch: got %s, want %s (from %s)", p.tarball, got, want, from)
+	}
+	return nil
+}
+
+// publishedHash returns the SHA-256 hash of the tarball at url as published
+// by kernel.org in sha256sums.asc next to it, and the URL of that file.
+func publishedHash(url string) (hash, sumsURL string, _ error) {
+	sumsURL = url[:strings.LastIndex(url, "/")] + "/sha256sums.asc"
+	resp, err := http.Get(sumsURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", sumsURL, got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	base := filepath.Base(url)
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == base {
+			return fields[0], sumsURL, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s: no hash found for %s", sumsURL, base)
+}
+
+// stepPrefix marks the log lines with which the steps start, from which
+// gokr-rebuild-kernel tells the current step when streaming the output.
+const stepPrefix = "step: "
+
+// run runs all steps, stopping at the first error.
+func (p *pipeline) run() error {
+	for _, s := range steps {
+		fn := s.fn
+		switch {
+		case p.stage == stageConfigure && !s.configure:
+			continue
+		case p.stage == stageCompile && s.configure:
+			if s.resume == nil {
+				continue
+			}
+			fn = s.resume
+		}
+		log.Printf("%s%s", stepPrefix, s.name)
+		if err := fn(p); err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// srcdir returns the directory the tarball unpacks into, or the local
+// kernel source tree.
+func (p *pipeline) srcdir() string {
+	if p.localSrc != "" {
+		return p.localSrc
+	}
+	base := filepath.Base(p.tarball)
+	if strings.HasSuffix(base, ".tar.xz") {
+		return strings.TrimSuffix(base, ".tar.xz")
+	}
+	return strings.TrimSuffix(base, ".tar") // see fetchGit
+}
+
+// unpack unpacks the tarball, or copies the unpacked tree from the source
+// cache. A failure to populate the cache does not fail the build.
+func (p *pipeline) unpack() error {
+	if p.localSrc != "" {
+		log.Printf("building in the kernel source tree %s", p.localSrc)
+		return nil
+	}
+	var hash string
+	if p.cache != "" {
+		var err error
+		if hash, err = fileHash(p.tarball); err != nil {
+			return err
+		}
+		ok, err := sourceCache{p.cache}.restore(p.srcdir(), hash)
+		if err != nil {
+			log.Printf("warning: restoring the kernel source from the cache: %v", err)
+			if err := os.RemoveAll(p.srcdir()); err != nil {
+				return err
+			}
+		} else if ok {
+			return nil
+		}
+	}
+	// Do not restore the owners of the tarball: when building as root (with
+	// rootless container backends), the container has no CAP_CHOWN by
+	// default (see gokr-rebuild-kernel -cap_drop).
+	untar := exec.Command("tar", "--no-same-owner", "-xf", p.tarball)
+	untar.Stdout = os.Stdout
+	untar.Stderr = os.Stderr
+	if err := untar.Run(); err != nil {
+		return err
+	}
+	if p.cache != "" {
+		if err := (sourceCache{p.cache}).store(p.srcdir(), hash); err != nil {
+			log.Printf("warning: caching the unpacked kernel source: %v", err)
+		}
+	}
+	return nil
+}
+
+// patch applies the patches and changes into the kernel tree, in which the
+// remaining steps work.
+func (p *pipeline) patch() error {
+	if p.localSrc != "" && !p.localPatches {
+		log.Printf("not applying the patches to the local kernel source tree")
+		return os.Chdir(p.srcdir())
+	}
+	if err := p.recordPatches(); err != nil {
+		return err
+	}
+	// A local tree is built repeatedly, so the patches of an earlier
+	// build are already applied.
+	if err := applyPatches(p.srcdir(), p.localSrc != ""); err != nil {
+		return err
+	}
+	return os.Chdir(p.srcdir())
+}
+
+// recordPatches records the hashes of the patches for the build info.
+func (p *pipeline) recordPatches() error {
+	patches, err := filepath.Glob("*.patch")
+	if err != nil {
+		return err
+	}
+	for _, patch := range patches {
+		hash, err := fileHash(patch)
+		if err != nil {
+			return err
+		}
+		p.patches = append(p.patches, kernelversion.Patch{Name: patch, SHA256: hash})
+	}
+	return nil
+}
+
+// enterTree changes into the kernel tree patched by an earlier
+// stageConfigure run, in place of patch.
+func (p *pipeline) enterTree() error {
+	if err := p.recordPatches(); err != nil {
+		return err
+	}
+	return os.Chdir(p.srcdir())
+}
+
+// runPreBuildHooks runs the -pre_build_hook executables in the kernel tree.
+func (p *pipeline) runPreBuildHooks() error {
+	for _, hook := range p.preBuild {
+		log.Printf("running pre-build hook %s", hook)
+		cmd := exec.Command(hook)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", hook, err)
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) configure() error {
+	if err := checkHardeningToolchain(p.hardening); err != nil {
+		return err
+	}
+	return configure(p.defconfig, p.fragments, p.assert, p.resultDir)
+}
+
+func (p *pipeline) compile() error {
+	if p.signModules && p.moduleKey == "" {
+		if err := removeSigningKey(); err != nil {
+			return err
+		}
+	}
+	return compile(p.overlays, p.makeArgs, p.resultDir)
+}
+
+// compileCommandsFile is the compilation database of the kernel build in
+// the kernel tree and the build result.
+const compileCommandsFile = "compile_commands.json"
+
+// writeCompileCommands generates the compilation database of the kernel
+// build, for clangd-based editors, from the .cmd files which Kbuild leaves
+// next to the object files (scripts/clang-tools/gen_compile_commands.py),
+// and copies it into the build result.
+func (p *pipeline) writeCompileCommands() error {
+	if !p.compileCommands {
+		return nil
+	}
+	make := exec.Command("make", "ARCH=arm64", "CROSS_COMPILE=aarch64-linux-gnu-", compileCommandsFile)
+	make.Stdout = os.Stdout
+	make.Stderr = os.Stderr
+	if err := make.Run(); err != nil {
+		return fmt.Errorf("make: %v", err)
+	}
+	return copyFile(filepath.Join(p.resultDir, compileCommandsFile), compileCommandsFile)
+}
+
+// exportedSourceFile is the file in the build result into which
+// exportSource writes the kernel tree.
+const exportedSourceFile = "source.tar.gz"
+
+// exportSource writes the kernel tree as it was compiled (patched and
+// configured, with the generated headers and Module.symvers) without the
+// build outputs to the build result, e.g. for inspecting what was compiled
+// or building out-of-tree modules against it later.
+func (p *pipeline) exportSource() error {
+	if !p.exportSrc {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(wd)
+	args := []string{"-czf", filepath.Join(p.resultDir, exportedSourceFile), "-C", filepath.Dir(wd)}
+	for _, pattern := range []string{".git", "*.o", "*.a", "*.ko", ".*.cmd", base + "/vmlinux", base + "/arch/arm64/boot/Image*", base + "/" + generatedSigningKey} {
+		args = append(args, "--exclude="+pattern)
+	}
+	tar := exec.Command("tar", append(args, base)...)
+	tar.Stdout = os.Stdout
+	tar.Stderr = os.Stderr
+	if err := tar.Run(); err != nil {
+		return err
+	}
+	log.Printf("exported the kernel tree to %s", exportedSourceFile)
+	return nil
+}
+
+// analyze runs p.analyzer over the files the patches touch.
+func (p *pipeline) analyze() error {
+	if p.analyzer == "" {
+		return nil
+	}
+	var patches []string
+	for _, patch := range p.patches {
+		// The patches are next to the kernel tree.
+		patches = append(patches, filepath.Join("..", patch.Name))
+	}
+	return analyze(p.analyzer, patches, p.resultDir)
+}
+
+func (p *pipeline) listWirelessFirmware() error {
+	return listWirelessFirmware(p.resultDir)
+}
+
+func (p *pipeline) buildDebugVariant() error {
+	if !p.debug {
+		return nil
+	}
+	return buildDebugVariant(profile.Image(p.profiles), p.makeArgs, p.resultDir)
+}
+
+// perfMakeArgs build perf as a static binary without the optional
+// features which need libraries (e.g. libelf, libtraceevent) or Python,
+// which are not available for arm64 in the build container.
+var perfMakeArgs = []string{
+	"LDFLAGS=-static",
+	"NO_LIBELF=1",
+	"NO_LIBTRACEEVENT=1",
+	"NO_JEVENTS=1",
+	"NO_LIBPERL=1",
+	"NO_LIBPYTHON=1",
+	"NO_SLANG=1",
+	"NO_GTK2=1",
+	"NO_LIBUNWIND=1",
+	"NO_LIBDW_DWARF_UNWIND=1",
+	"NO_LIBBPF=1",
+	"NO_BPF_SKEL=1",
+	"NO_JVMTI=1",
+	"NO_LIBNUMA=1",
+	"NO_LIBAUDIT=1",
+	"NO_LIBCRYPTO=1",
+	"NO_LIBCAP=1",
+	"NO_LIBZSTD=1",
+	"NO_LZMA=1",
+	"NO_DEMANGLE=1",
+	"NO_LIBBABELTRACE=1",
+	"NO_SDT=1",
+}
+
+// buildPerf builds tools/perf from the same source as the kernel, so that
+// it exactly matches the running kernel, and copies it to p.resultDir.
+func (p *pipeline) buildPerf() error {
+	if !p.perf {
+		return nil
+	}
+	args := append([]string{
+		"-C", "tools/perf",
+		"ARCH=arm64",
+		"CROSS_COMPILE=aarch64-linux-gnu-",
+		"-j" + strconv.Itoa(runtime.NumCPU()),
+	}, perfMakeArgs...)
+	make := exec.Command("make", args...)
+	make.Stdout = os.Stdout
+	make.Stderr = os.Stderr
+	if err := make.Run(); err != nil {
+		return fmt.Errorf("make -C tools/perf: %v", err)
+	}
+	return copyFile(filepath.Join(p.resultDir, "perf"), "tools/perf/perf")
+}
+
+// buildSelftests builds the selftests in p.selftests as static binaries and
+// installs them (with kselftest-list.txt, see gokr-kselftest) into
+// p.resultDir/kselftest.
+func (p *pipeline) buildSelftests() error {
+	if len(p.selftests) == 0 {
+		return nil
+	}
+	make := exec.Command("make",
+		"-C", "tools/testing/selftests",
+		"ARCH=arm64",
+		"CROSS_COMPILE=aarch64-linux-gnu-",
+		"CC=aarch64-linux-gnu-gcc -static",
+		"TARGETS="+strings.Join(p.selftests, " "),
+		"INSTALL_PATH="+filepath.Join(p.resultDir, "kselftest"),
+		"-j"+strconv.Itoa(runtime.NumCPU()),
+		"install")
+	make.Stdout = os.Stdout
+	make.Stderr = os.Stderr
+	if err := make.Run(); err != nil {
+		return fmt.Errorf("make -C tools/testing/selftests: %v", err)
+	}
+	return nil
+}
+
+func (p *pipeline) compileOverlays() error {
+	return compileOverlays(p.overlays, p.resultDir)
+}
+
+func (p *pipeline) validateOverlays() error {
+	return validateOverlays(p.overlays, p.resultDir)
+}
+
+func (p *pipeline) copyResult() error {
+	if err := copyFile(filepath.Join(p.resultDir, "vmlinuz"), filepath.Join("arch/arm64/boot", profile.Image(p.profiles))); err != nil {
+		return err
+	}
+	for _, dtb := range dtbs {
+		if dtb.DTB == "" {
+			continue
+		}
+		if err := copyFile(filepath.Join(p.resultDir, dtb.DTB), dtb.Src); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.artifacts {
+		if err := copyFile(filepath.Join(p.resultDir, filepath.Base(path)), path); err != nil {
+			return err
+		}
+	}
+	// Keep the symbols for symbolizing panics (see gokr-symbolize), outside
+	// of the artifacts.
+	if err := os.MkdirAll(filepath.Join(p.resultDir, "symbols"), 0755); err != nil {
+		return err
+	}
+	for _, name := range []string{symbols.Vmlinux, symbols.SystemMap} {
+		if err := copyFile(filepath.Join(p.resultDir, "symbols", name), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kernelVersion returns the version of the kernel source, e.g. 6.5.7. It
+// must be called in the kernel tree.
+func (p *pipeline) kernelVersion() string {
+	if p.localSrc == "" {
+		return strings.TrimPrefix(p.srcdir(), "linux-")
+	}
+	out, err := exec.Command("make", "-s", "kernelversion").Output()
+	if err != nil {
+		log.Printf("warning: make kernelversion: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeBuildInfo writes build-info.json to p.resultDir. The GitDescribe
+// field is left for gokr-rebuild-kernel to fill in, as the repository is not
+// available in the container.
+func (p *pipeline) writeBuildInfo() error {
+	bi := &buildinfo.BuildInfo{
+		KernelVersion: p.kernelVersion(),
+		SourceURL:     p.url,
+		Patches:       p.patches,
+		Compiler:      compiler(),
+		BuildTime:     time.Now().UTC(),
+	}
+	for _, frag := range p.fragments {
+		switch frag.kind {
+		case "profile":
+			bi.Profiles = append(bi.Profiles, frag.name)
+		case "capability":
+			bi.Capabilities = append(bi.Capabilities, frag.name)
+		}
+	}
+	var err error
+	if bi.KernelRelease, err = kernelRelease(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(p.resultDir, "lib", "modules", bi.KernelRelease)); err != nil {
+		return fmt.Errorf("modules of kernel release %s: %v", bi.KernelRelease, err)
+	}
+	if bi.ConfigSHA256, err = fileHash(".config"); err != nil {
+		return err
+	}
+	final, err := kconfig.ParseFile(".config")
+	if err != nil {
+		return err
+	}
+	for _, frag := range p.fragments {
+		for _, sym := range frag.record {
+			if bi.RecordedConfig == nil {
+				bi.RecordedConfig = make(map[string]string)
+			}
+			val := final[sym]
+			if val == "" {
+				val = "n"
+			}
+			bi.RecordedConfig[sym] = val
+		}
+		if frag.kind == "profile" && len(frag.notes) > 0 {
+			if bi.Notes == nil {
+				bi.Notes = make(map[string][]string)
+			}
+			bi.Notes[frag.name] = frag.notes
+		}
+	}
+	if bi.ReproducibilityHash, err = buildinfo.HashArtifacts(p.resultDir); err != nil {
+		return err
+	}
+	return bi.Write(filepath.Join(p.resultDir, buildinfo.FileName))
+}
+
+// kernelRelease returns the release of the configured kernel tree (uname -r
+// of the built kernel, including CONFIG_LOCALVERSION), as printed by make
+// kernelrelease.
+func kernelRelease() (string, error) {
+	out, err := exec.Command("make", "-s", "ARCH=arm64", "kernelrelease").Output()
+	if err != nil {
+		return "", fmt.Errorf("make kernelrelease: %v", err)
+	}
+	release := strings.TrimSpace(string(out))
+	if release == "" {
+		return "", fmt.Errorf("make kernelrelease printed nothing")
+	}
+	return release, nil
+}
+
+// compiler returns the compiler the kernel was built with, as recorded by
+// the kernel build in include/generated/compile.h.
+func compiler() string {
+	b, err := ioutil.ReadFile("include/generated/compile.h")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		const prefix = "#define LINUX_COMPILER "
+		if strings.HasPrefix(line, prefix) {
+			return strings.Trim(strings.TrimPrefix(line, prefix), `"`)
+		}
+	}
+	return ""
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
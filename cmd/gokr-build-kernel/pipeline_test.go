@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublishedHash(t *testing.T) {
+	const sums = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+1111111111111111111111111111111111111111111111111111111111111111  linux-6.5.6.tar.xz
+2222222222222222222222222222222222222222222222222222222222222222  linux-6.5.7.tar.xz
+-----BEGIN PGP SIGNATURE-----
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v6.x/sha256sums.asc" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, sums)
+	}))
+	defer srv.Close()
+
+	hash, sumsURL, err := publishedHash(srv.URL + "/v6.x/linux-6.5.7.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("2", 64); hash != want {
+		t.Errorf("publishedHash = %s, want %s", hash, want)
+	}
+	if want := srv.URL + "/v6.x/sha256sums.asc"; sumsURL != want {
+		t.Errorf("sums URL = %s, want %s", sumsURL, want)
+	}
+
+	if _, _, err := publishedHash(srv.URL + "/v6.x/linux-6.5.8.tar.xz"); err == nil {
+		t.Errorf("publishedHash of an unlisted tarball succeeded unexpectedly")
+	}
+	if _, _, err := publishedHash(srv.URL + "/v5.x/linux-5.15.tar.xz"); err == nil {
+		t.Errorf("publishedHash without sha256sums.asc succeeded unexpectedly")
+	}
+}
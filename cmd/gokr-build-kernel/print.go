@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// printConfig writes the inputs of the kernel configuration step to w: the
+// kernel source, the DTBs and other artifacts which are exported and the
+// config which is appended to the defconfig (after mod2noconfig), in the
+// order in which it is appended. The final config is the result of running
+// olddefconfig on it.
+func printConfig(w io.Writer, source, defconfig string, artifacts []string, fragments []fragment) error {
+	fmt.Fprintf(w, "# kernel source: %s\n", source)
+	fmt.Fprintf(w, "#\n# boards (exported DTB ← kernel tree path):\n")
+	for _, dtb := range dtbs {
+		if dtb.DTB == "" {
+			fmt.Fprintf(w, "#   %s: no DTB\n", dtb.Name)
+			continue
+		}
+		fmt.Fprintf(w, "#   %s: %s ← %s\n", dtb.Name, dtb.DTB, dtb.Src)
+	}
+	for _, path := range artifacts {
+		fmt.Fprintf(w, "#   artifact: %s\n", path)
+	}
+	fmt.Fprintf(w, "#\n# appended to %s after mod2noconfig:\n", defconfig)
+	fmt.Fprintf(w, "\n# gokrazy defaults\n%s\n", strings.TrimSpace(configAddendum))
+	for _, frag := range fragments {
+		fmt.Fprintf(w, "\n# %s %q\n%s\n", frag.kind, frag.name, strings.TrimSpace(frag.config))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// gokrazyRequirements lists the config symbols which gokrazy needs to boot
+// and set up networking. Profiles which disable options (e.g. tiny or
+// nftables) must not remove any of these.
+var gokrazyRequirements = []string{
+	// Root file system (squashfs), boot partition (vfat), permanent data
+	// partition (ext4) and /dev:
+	"CONFIG_SQUASHFS",
+	"CONFIG_VFAT_FS",
+	"CONFIG_EXT4_FS",
+	"CONFIG_DEVTMPFS",
+
+	// gokrazy’s network setup: DHCPv4 uses packet sockets, the interface
+	// and route configuration uses netlink, IPv6 uses SLAAC.
+	"CONFIG_NET",
+	"CONFIG_INET",
+	"CONFIG_IPV6",
+	"CONFIG_PACKET",
+	"CONFIG_UNIX",
+
+	// The gokrazy supervisor feeds the hardware watchdog, and the hardware
+	// RNG seeds the entropy pool early in boot:
+	"CONFIG_WATCHDOG",
+	"CONFIG_BCM2835_WDT",
+	"CONFIG_HW_RANDOM",
+	"CONFIG_HW_RANDOM_BCM2835",
+}
+
+// checkRequirements returns an error if final lacks any of the
+// gokrazyRequirements or the symbols required by fragments.
+func checkRequirements(final kconfig.Config, fragments []fragment) error {
+	var missing []string
+	for _, sym := range gokrazyRequirements {
+		if !final.Enabled(sym) {
+			missing = append(missing, sym+" (required by gokrazy)")
+		}
+	}
+	for _, frag := range fragments {
+		for _, sym := range frag.require {
+			if !final.Enabled(sym) {
+				missing = append(missing, fmt.Sprintf("%s (required by %s %q)", sym, frag.kind, frag.name))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the resulting kernel config lacks required options:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// assertions are optional properties of the resulting kernel config which
+// fail the build when violated, protecting gokrazy’s model of not loading
+// modules at runtime from config drift.
+type assertions struct {
+	// monolithic requires that no option is built as a module, except for
+	// those which the gokrazy defaults or the fragments request as =m (see
+	// requestedModules).
+	monolithic bool
+
+	// lockdown requires that kernel lockdown is enforced from boot.
+	lockdown bool
+}
+
+// lockdownSymbols enforce kernel lockdown (integrity mode or stricter)
+// without relying on the kernel command line.
+var lockdownSymbols = []string{
+	"CONFIG_SECURITY_LOCKDOWN_LSM",
+	"CONFIG_SECURITY_LOCKDOWN_LSM_EARLY",
+}
+
+// requestedModules returns the config symbols which configAddendum or the
+// fragments explicitly build as modules (e.g. the Wi-Fi and Bluetooth
+// drivers, which gokrazy ships in lib/modules). Other modules are config
+// drift, e.g. a new option defaulting to =m.
+func requestedModules(fragments []fragment) (map[string]bool, error) {
+	configs := []string{configAddendum}
+	for _, frag := range fragments {
+		configs = append(configs, frag.config)
+	}
+	requested := make(map[string]bool)
+	for _, config := range configs {
+		cfg, err := kconfig.Parse(strings.NewReader(config))
+		if err != nil {
+			return nil, err
+		}
+		for _, sym := range cfg.Symbols() {
+			// Later fragments override earlier ones, e.g. the bluetooth
+			// profile builds the drivers into the kernel.
+			requested[sym] = cfg[sym] == "m"
+		}
+	}
+	return requested, nil
+}
+
+// checkAssertions returns an error if final violates any of the enabled
+// assertions. Modules in requested do not violate the monolithic assertion.
+func checkAssertions(final kconfig.Config, a assertions, requested map[string]bool) error {
+	var violations []string
+	if a.monolithic {
+		for _, sym := range final.Symbols() {
+			if final[sym] == "m" && !requested[sym] {
+				violations = append(violations, sym+"=m (kernel must be monolithic)")
+			}
+		}
+	}
+	if a.lockdown {
+		for _, sym := range lockdownSymbols {
+			if !final.Enabled(sym) {
+				violations = append(violations, sym+" is not set (lockdown required)")
+			}
+		}
+		if !final.Enabled("CONFIG_LOCK_DOWN_KERNEL_FORCE_INTEGRITY") &&
+			!final.Enabled("CONFIG_LOCK_DOWN_KERNEL_FORCE_CONFIDENTIALITY") {
+			violations = append(violations, "neither CONFIG_LOCK_DOWN_KERNEL_FORCE_INTEGRITY nor CONFIG_LOCK_DOWN_KERNEL_FORCE_CONFIDENTIALITY is set (lockdown required)")
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("the resulting kernel config violates assertions:\n  %s", strings.Join(violations, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sourceCache keeps unpacked kernel trees, so that repeated builds copy the
+// tree instead of decompressing the tarball (xz decompression is single
+// threaded and takes about a minute). Each tree is stored as
+// dir/linux-<version>, with the SHA-256 hash of the tarball it was unpacked
+// from in dir/linux-<version>.sha256. The trees are pristine: patches are
+// applied to the copy.
+type sourceCache struct {
+	dir string
+}
+
+func (c sourceCache) treePath(srcdir string) string   { return filepath.Join(c.dir, srcdir) }
+func (c sourceCache) markerPath(srcdir string) string { return c.treePath(srcdir) + ".sha256" }
+
+// restore copies the cached tree of srcdir into the current directory, if
+// the cache holds a tree unpacked from a tarball with hash.
+func (c sourceCache) restore(srcdir, hash string) (bool, error) {
+	marker, err := ioutil.ReadFile(c.markerPath(srcdir))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(string(marker)) != hash {
+		log.Printf("cached %s was unpacked from a different tarball, unpacking again", c.treePath(srcdir))
+		return false, nil
+	}
+	log.Printf("copying cached kernel source from %s", c.treePath(srcdir))
+	if err := copyTree(c.treePath(srcdir), srcdir); err != nil {
+		return false, err
+	}
+	// Mark the tree as used, for gokr-rebuild-kernel gc.
+	now := time.Now()
+	return true, os.Chtimes(c.markerPath(srcdir), now, now)
+}
+
+// store copies the freshly unpacked srcdir into the cache. The copy is made
+// under a temporary name and renamed into place, so that an interrupted
+// copy is never mistaken for a complete tree.
+func (c sourceCache) store(srcdir, hash string) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	partial := filepath.Join(c.dir, ".partial-"+srcdir)
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if err := copyTree(srcdir, partial); err != nil {
+		return err
+	}
+	if err := os.Remove(c.markerPath(srcdir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(c.treePath(srcdir)); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, c.treePath(srcdir)); err != nil {
+		return err
+	}
+	log.Printf("cached the unpacked kernel source in %s", c.treePath(srcdir))
+	return ioutil.WriteFile(c.markerPath(srcdir), []byte(hash+"\n"), 0644)
+}
+
+// copyTree copies the directory src to dst, preserving modes and times, so
+// that make does not consider the copy newer than its build artifacts. The
+// owners are not preserved, which needs CAP_CHOWN when building as root.
+func copyTree(src, dst string) error {
+	cp := exec.Command("cp", "-a", "--no-preserve=ownership", src, dst)
+	cp.Stdout = os.Stdout
+	cp.Stderr = os.Stderr
+	return cp.Run()
+}
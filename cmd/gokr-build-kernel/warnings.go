@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// warningsFile is the file in the build result listing the warnings of the
+// kernel build, which gokr-rebuild-kernel compares against the warnings of
+// the previous build.
+const warningsFile = "warnings.txt"
+
+var (
+	// compilerWarningRe matches compiler warnings, e.g.
+	// drivers/spi/spidev.c:42:7: warning: unused variable 'x' [-Wunused-variable]
+	compilerWarningRe = regexp.MustCompile(`^(\S+?):\d+:(?:\d+:)? warning: (.*)$`)
+	// kbuildWarningRe matches warnings of Kbuild tools, e.g. modpost
+	// (WARNING: modpost: ...) and dtc (....dts:12.3-20: Warning (reg_format): ...).
+	kbuildWarningRe = regexp.MustCompile(`^(?:(\S+?):[\d.-]+: )?(WARNING: .*|Warning \(.*)$`)
+)
+
+// normalizeWarning returns the warning in line without its line and column
+// numbers, so that unrelated changes moving the code around (e.g. a kernel
+// version bump) do not make the warning look new, or the empty string if line
+// is not a warning.
+func normalizeWarning(line string) string {
+	line = strings.TrimSpace(line)
+	if m := compilerWarningRe.FindStringSubmatch(line); m != nil {
+		return m[1] + ": warning: " + m[2]
+	}
+	if m := kbuildWarningRe.FindStringSubmatch(line); m != nil {
+		if m[1] == "" {
+			return m[2]
+		}
+		return m[1] + ": " + m[2]
+	}
+	return ""
+}
+
+// warningLog is an io.Writer which collects the warnings of the output
+// written to it.
+type warningLog struct {
+	partial  []byte
+	warnings map[string]bool
+}
+
+func (w *warningLog) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		w.add(string(w.partial[:idx]))
+		w.partial = w.partial[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (w *warningLog) add(line string) {
+	if warning := normalizeWarning(line); warning != "" {
+		if w.warnings == nil {
+			w.warnings = make(map[string]bool)
+		}
+		w.warnings[warning] = true
+	}
+}
+
+// writeWarnings writes the collected warnings, sorted, to
+// resultDir/warnings.txt.
+func (w *warningLog) writeWarnings(resultDir string) error {
+	if len(w.partial) > 0 {
+		w.add(string(w.partial))
+		w.partial = nil
+	}
+	var lines []string
+	for warning := range w.warnings {
+		lines = append(lines, warning+"\n")
+	}
+	sort.Strings(lines)
+	return ioutil.WriteFile(filepath.Join(resultDir, warningsFile), []byte(strings.Join(lines, "")), 0644)
+}
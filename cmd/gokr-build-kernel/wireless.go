@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// wirelessFirmwareList is the file in the build result with the firmware
+// names which the Broadcom Wi-Fi and Bluetooth drivers request, one
+// “<driver> <name>” per line.
+const wirelessFirmwareList = "wireless-firmware.txt"
+
+// wirelessSources are the driver sources which define the firmware names,
+// with the pattern matching a name.
+var wirelessSources = []struct {
+	driver, path string
+	re           *regexp.Regexp
+}{
+	// e.g. BRCMF_FW_DEF(43455, "brcmfmac43455-sdio");
+	{"brcmfmac", "drivers/net/wireless/broadcom/brcm80211/brcmfmac/sdio.c", regexp.MustCompile(`BRCMF_FW_(?:CLM_)?DEF\(\w+,\s*"([^"]+)"\)`)},
+	// e.g. { 0x6119, "BCM4345C0" },
+	{"btbcm", "drivers/bluetooth/btbcm.c", regexp.MustCompile(`\{\s*0x[0-9a-fA-F]+,\s*"(BCM[0-9A-Z]+)"\s*\}`)},
+}
+
+// listWirelessFirmware writes the firmware names which the drivers in the
+// kernel tree request to wirelessFirmwareList in resultDir, if the kernel
+// is built with brcmfmac.
+func listWirelessFirmware(resultDir string) error {
+	cfg, err := kconfig.ParseFile(".config")
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled("CONFIG_BRCMFMAC") {
+		return nil
+	}
+	var lines []string
+	for _, src := range wirelessSources {
+		b, err := ioutil.ReadFile(src.path)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, m := range src.re.FindAllStringSubmatch(string(b), -1) {
+			if seen[m[1]] {
+				continue
+			}
+			seen[m[1]] = true
+			lines = append(lines, src.driver+" "+m[1])
+		}
+		if len(seen) == 0 {
+			return fmt.Errorf("%s: no firmware names found, the driver source changed", src.path)
+		}
+	}
+	sort.Strings(lines)
+	return ioutil.WriteFile(filepath.Join(resultDir, wirelessFirmwareList), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,349 @@
+// gokr-diff-kernels compares two kernel builds (directories laid out like this
+// repository) and prints a markdown report suitable for the description of a
+// kernel bump pull request.
+//
+// By default, the working directory (e.g. after running gokr-rebuild-kernel)
+// is compared against the artifacts committed in git HEAD:
+//
+//	gokr-diff-kernels > report.md
+//	gokr-diff-kernels -old=/tmp/kernel-a -new=/tmp/kernel-b
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// kernelDir is a directory containing kernel build artifacts.
+type kernelDir struct {
+	label string
+	path  string
+}
+
+// checkout extracts the tree of the specified git revision into a temporary
+// directory. The caller is responsible for removing the directory.
+func checkout(rev string) (_ string, err error) {
+	tmp, err := ioutil.TempDir("", "gokr-diff-kernels")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+	archive := exec.Command("git", "archive", "--format=tar", rev)
+	archive.Stderr = os.Stderr
+	untar := exec.Command("tar", "xf", "-", "-C", tmp)
+	untar.Stderr = os.Stderr
+	pipe, err := archive.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	untar.Stdin = pipe
+	if err := untar.Start(); err != nil {
+		return "", err
+	}
+	if err := archive.Run(); err != nil {
+		untar.Wait() // before removing tmp
+		return "", fmt.Errorf("%v: %v", archive.Args, err)
+	}
+	if err := untar.Wait(); err != nil {
+		return "", fmt.Errorf("%v: %v", untar.Args, err)
+	}
+	return tmp, nil
+}
+
+func resolve(spec string) (kernelDir, func(), error) {
+	if rev := strings.TrimPrefix(spec, "git:"); rev != spec {
+		tmp, err := checkout(rev)
+		if err != nil {
+			return kernelDir{}, nil, err
+		}
+		return kernelDir{label: spec, path: tmp}, func() { os.RemoveAll(tmp) }, nil
+	}
+	if _, err := os.Stat(spec); err != nil {
+		return kernelDir{}, nil, err
+	}
+	return kernelDir{label: spec, path: spec}, func() {}, nil
+}
+
+var linuxVersion = []byte("Linux version ")
+
+// versionString returns the linux_banner contained in the (possibly
+// gzip-compressed) kernel image.
+func versionString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		rd, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		if b, err = ioutil.ReadAll(rd); err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	idx := bytes.Index(b, linuxVersion)
+	if idx == -1 {
+		return "", fmt.Errorf("%s: no version string found", path)
+	}
+	banner := b[idx:]
+	if end := bytes.IndexAny(banner, "\x00\n"); end > -1 {
+		banner = banner[:end]
+	}
+	return string(banner), nil
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashes returns the SHA-256 hash of all files matching pattern in dir, keyed
+// by file name.
+func hashes(dir, pattern string) (map[string]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for _, match := range matches {
+		h, err := fileHash(match)
+		if err != nil {
+			return nil, err
+		}
+		result[filepath.Base(match)] = h
+	}
+	return result, nil
+}
+
+// sizes returns the size of all files matching any of patterns in dir, keyed
+// by file name.
+func sizes(dir string, patterns ...string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			st, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			result[filepath.Base(match)] = st.Size()
+		}
+	}
+	return result, nil
+}
+
+// moduleStats returns the number and total size of kernel modules in dir.
+func moduleStats(dir string) (count int, size int64, _ error) {
+	root := filepath.Join(dir, "lib", "modules")
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".ko") {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	return count, size, err
+}
+
+func union(maps ...map[string]string) []string {
+	keys := make(map[string]bool)
+	for _, m := range maps {
+		for key := range m {
+			keys[key] = true
+		}
+	}
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func humanDelta(old, new int64) string {
+	delta := new - old
+	if old == 0 {
+		return fmt.Sprintf("%+d", delta)
+	}
+	return fmt.Sprintf("%+d (%+.2f%%)", delta, float64(delta)*100/float64(old))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "—"
+	}
+	return s
+}
+
+func writeReport(w io.Writer, old, new kernelDir) error {
+	fmt.Fprintf(w, "## Kernel diff: `%s` → `%s`\n\n", old.label, new.label)
+
+	fmt.Fprintf(w, "### Version\n\n")
+	oldVersion, err := versionString(filepath.Join(old.path, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	newVersion, err := versionString(filepath.Join(new.path, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "- old: `%s`\n- new: `%s`\n\n", oldVersion, newVersion)
+
+	fmt.Fprintf(w, "### Patches\n\n")
+	oldPatches, err := hashes(old.path, "*.patch")
+	if err != nil {
+		return err
+	}
+	newPatches, err := hashes(new.path, "*.patch")
+	if err != nil {
+		return err
+	}
+	var patchLines []string
+	for _, name := range union(oldPatches, newPatches) {
+		oldHash, newHash := oldPatches[name], newPatches[name]
+		switch {
+		case oldHash == "":
+			patchLines = append(patchLines, fmt.Sprintf("- added: `%s`", name))
+		case newHash == "":
+			patchLines = append(patchLines, fmt.Sprintf("- removed: `%s`", name))
+		case oldHash != newHash:
+			patchLines = append(patchLines, fmt.Sprintf("- changed: `%s`", name))
+		}
+	}
+	if len(patchLines) == 0 {
+		fmt.Fprintf(w, "No patch changes.\n\n")
+	} else {
+		fmt.Fprintf(w, "%s\n\n", strings.Join(patchLines, "\n"))
+	}
+
+	fmt.Fprintf(w, "### Config\n\n")
+	oldConfig, err := kconfig.FromImage(filepath.Join(old.path, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	newConfig, err := kconfig.FromImage(filepath.Join(new.path, "vmlinuz"))
+	if err != nil {
+		return err
+	}
+	changes := kconfig.Diff(oldConfig, newConfig)
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "No config changes.\n\n")
+	} else {
+		fmt.Fprintf(w, "<details><summary>%d symbols changed</summary>\n\n", len(changes))
+		fmt.Fprintf(w, "| Symbol | Old | New |\n|---|---|---|\n")
+		for _, c := range changes {
+			fmt.Fprintf(w, "| `%s` | %s | %s |\n", c.Symbol, orDash(c.Old), orDash(c.New))
+		}
+		fmt.Fprintf(w, "\n</details>\n\n")
+	}
+
+	fmt.Fprintf(w, "### Sizes\n\n")
+	fmt.Fprintf(w, "| File | Old | New | Delta |\n|---|---:|---:|---:|\n")
+	oldSizes, err := sizes(old.path, "vmlinuz", "*.dtb")
+	if err != nil {
+		return err
+	}
+	newSizes, err := sizes(new.path, "vmlinuz", "*.dtb")
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for name := range oldSizes {
+		names[name] = name
+	}
+	for name := range newSizes {
+		names[name] = name
+	}
+	for _, name := range union(names) {
+		o, n := oldSizes[name], newSizes[name]
+		fmt.Fprintf(w, "| `%s` | %d | %d | %s |\n", name, o, n, humanDelta(o, n))
+	}
+	oldCount, oldModSize, err := moduleStats(old.path)
+	if err != nil {
+		return err
+	}
+	newCount, newModSize, err := moduleStats(new.path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "| modules (%d → %d) | %d | %d | %s |\n", oldCount, newCount, oldModSize, newModSize, humanDelta(oldModSize, newModSize))
+	return nil
+}
+
+func main() {
+	var (
+		oldSpec = flag.String("old",
+			"git:HEAD",
+			"directory containing the old kernel artifacts, or git:<rev> to use the artifacts committed in the specified revision")
+		newSpec = flag.String("new",
+			".",
+			"directory containing the new kernel artifacts, or git:<rev>")
+		output = flag.String("output",
+			"",
+			"path to write the markdown report to (default: stdout)")
+	)
+	flag.Parse()
+	if err := run(*oldSpec, *newSpec, *output); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run writes the report comparing oldSpec with newSpec to output. It returns
+// errors instead of exiting, so that the git checkouts are removed.
+func run(oldSpec, newSpec, output string) error {
+	old, cleanupOld, err := resolve(oldSpec)
+	if err != nil {
+		return err
+	}
+	defer cleanupOld()
+	new, cleanupNew, err := resolve(newSpec)
+	if err != nil {
+		return err
+	}
+	defer cleanupNew()
+
+	var buf bytes.Buffer
+	if err := writeReport(&buf, old, new); err != nil {
+		return err
+	}
+	if output == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(output, buf.Bytes(), 0644)
+}
@@ -0,0 +1,109 @@
+// gokr-dm-verity computes the dm-verity hash tree of a gokrazy root file
+// system image and prints the kernel command line parameters to boot it with
+// verified integrity:
+//
+//	gokr-dm-verity -image=root.squashfs -append
+//
+// The printed parameters replace the root= parameter in cmdline.txt. The
+// kernel must be built with the verity profile.
+//
+// To check an image against a known root hash:
+//
+//	gokr-dm-verity -image=root.squashfs -size=… -salt=… -root_hash=…
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/alf632/gokrazy-kernel/dmverity"
+)
+
+func main() {
+	var (
+		image = flag.String("image",
+			"",
+			"path to the root file system image (e.g. the squashfs written by gokr-packer -overwrite_root)")
+		size = flag.Int64("size",
+			0,
+			"number of data bytes at the beginning of -image to cover (default: the whole file, which must be block-aligned)")
+		appendTree = flag.Bool("append",
+			false,
+			"append the hash tree to -image, so that data and hashes reside on the same partition")
+		device = flag.String("device",
+			"/dev/mmcblk0p2",
+			"device containing the root file system on the gokrazy device")
+		saltHex = flag.String("salt",
+			"",
+			"hex-encoded salt (default: random)")
+		rootHashHex = flag.String("root_hash",
+			"",
+			"if set, verify -image against this hex-encoded root hash instead of printing the command line")
+	)
+	flag.Parse()
+	if *image == "" {
+		log.Fatalf("-image is required")
+	}
+
+	// Only appending the hash tree writes to the image, which may be
+	// read-only otherwise (e.g. a mounted partition).
+	flags := os.O_RDONLY
+	if *appendTree && *rootHashHex == "" {
+		flags = os.O_RDWR
+	}
+	f, err := os.OpenFile(*image, flags, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if *size == 0 {
+		st, err := f.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*size = st.Size()
+	}
+
+	var salt []byte
+	if *saltHex != "" {
+		if salt, err = hex.DecodeString(*saltHex); err != nil {
+			log.Fatalf("-salt: %v", err)
+		}
+	} else if *rootHashHex != "" {
+		log.Fatalf("-salt is required for verification")
+	} else if salt, err = dmverity.NewSalt(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *rootHashHex != "" {
+		rootHash, err := hex.DecodeString(*rootHashHex)
+		if err != nil {
+			log.Fatalf("-root_hash: %v", err)
+		}
+		if err := dmverity.Verify(f, *size, salt, rootHash); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s: root hash verified", *image)
+		return
+	}
+
+	tree, err := dmverity.Compute(f, *size, salt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *appendTree {
+		if _, err := f.WriteAt(tree.Hashes, *size); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("appended %d bytes of hash tree to %s", len(tree.Hashes), *image)
+	}
+	log.Printf("root hash: %x", tree.RootHash)
+	log.Printf("salt: %x", tree.Salt)
+	fmt.Println(tree.Cmdline(*device))
+}
@@ -0,0 +1,276 @@
+// gokr-dtb-inspect decompiles the device tree blobs (and overlays) which
+// gokr-rebuild-kernel builds, and verifies that they contain what our device
+// tree patches add, so that a patch which no longer applies as intended (e.g.
+// after a kernel bump moved a node) is noticed before it reaches devices:
+//
+//	gokr-dtb-inspect bcm2711-rpi-4-b.dtb            # decompile
+//	gokr-dtb-inspect -lookup=serial1 *.dtb          # print a node
+//	gokr-dtb-inspect -lookup=serial0:status *.dtb   # print a property
+//	gokr-dtb-inspect -check *.dtb                   # verify the patches
+//
+// -check verifies the assertions built into gokr-dtb-inspect (see
+// patchAssertions) and those in -assertions files. Each line of such a file
+// asserts that a node exists, that a property of it exists, that the
+// property has a value, or (prefixed with !) that a node or property does
+// not exist. A [glob ...] line restricts the following assertions to the
+// files matching one of the globs:
+//
+//	# the SPI controller is enabled on all boards
+//	[*.dtb]
+//	/soc/spi@7e204000
+//	/soc/spi@7e204000 status
+//	/soc/spi@7e204000 status = "okay"
+//	[bcm2710-rpi-3-b.dtb]
+//	!/aliases ethernet0
+//
+// Paths which do not start with a slash start with an alias (e.g. serial0).
+// Values use device tree source syntax: "strings", <cells> and [bytes].
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/fdt"
+)
+
+// patchAssertions verify the device tree patches in this repository.
+const patchAssertions = `
+[*.dtb]
+# 0201-enable-spidev.patch: SPI0 is enabled with a spidev device per chip select.
+/soc/spi@7e204000 status = "okay"
+/soc/spi@7e204000/spidev@0 compatible = "brcm,bcm2835-spi"
+/soc/spi@7e204000/spidev@1 compatible = "brcm,bcm2835-spi"
+
+# The UART aliases gokrazy's console (serial1, see cmdline.txt) relies on.
+/aliases serial0 = "/soc/serial@7e201000"
+/aliases serial1 = "/soc/serial@7e215040"
+
+[bcm2710-rpi-3-b.dtb]
+# 0001-Revert-add-index-to-the-ethernet-alias.patch: the firmware only adds
+# local-mac-address if the ethernet alias has no index.
+/aliases ethernet
+!/aliases ethernet0
+`
+
+// assertion is a line of an assertions file.
+type assertion struct {
+	source   string   // file:line, for error messages
+	globs    []string // file names the assertion applies to
+	negate   bool
+	path     string
+	property string // empty: the node itself
+	value    []byte // nil: any value
+	text     string
+}
+
+func parseAssertions(source string, b []byte) ([]assertion, error) {
+	var (
+		assertions []assertion
+		globs      = []string{"*"}
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		// Comments only start at the beginning of a line, as values may
+		// contain #, e.g. #address-cells.
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", source, lineno)
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s: unterminated section %q", where, line)
+			}
+			globs = strings.Fields(line[1 : len(line)-1])
+			for _, glob := range globs {
+				if _, err := filepath.Match(glob, ""); err != nil {
+					return nil, fmt.Errorf("%s: %v", where, err)
+				}
+			}
+			continue
+		}
+		a := assertion{source: where, globs: globs, text: line}
+		if strings.HasPrefix(line, "!") {
+			a.negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+		fields := strings.SplitN(line, " ", 2)
+		a.path = fields[0]
+		if len(fields) == 2 {
+			rest := strings.TrimSpace(fields[1])
+			if idx := strings.Index(rest, "="); idx > -1 {
+				v, err := fdt.ParseValue(rest[idx+1:])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", where, err)
+				}
+				if v == nil {
+					v = []byte{}
+				}
+				a.value = v
+				rest = strings.TrimSpace(rest[:idx])
+			}
+			a.property = rest
+		}
+		if a.negate && a.value != nil {
+			return nil, fmt.Errorf("%s: negated assertions cannot have a value", where)
+		}
+		assertions = append(assertions, a)
+	}
+	return assertions, scanner.Err()
+}
+
+func (a *assertion) appliesTo(path string) bool {
+	for _, glob := range a.globs {
+		if matched, _ := filepath.Match(glob, filepath.Base(path)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the assertion does not hold in t.
+func (a *assertion) check(t *fdt.Tree) error {
+	n, err := t.Lookup(a.path)
+	if err != nil {
+		if a.negate && a.property == "" {
+			return nil
+		}
+		return err
+	}
+	if a.property == "" {
+		if a.negate {
+			return fmt.Errorf("node %s exists", a.path)
+		}
+		return nil
+	}
+	p, ok := n.Property(a.property)
+	switch {
+	case a.negate && ok:
+		return fmt.Errorf("property %s exists: %s", a.property, fdt.FormatValue(p.Value))
+	case a.negate:
+		return nil
+	case !ok:
+		return fmt.Errorf("no property %s", a.property)
+	case a.value != nil && !bytes.Equal(p.Value, a.value):
+		return fmt.Errorf("%s = %s", a.property, fdt.FormatValue(p.Value))
+	}
+	return nil
+}
+
+// lookup prints the node or property spec (path[:property]) of t.
+func lookup(t *fdt.Tree, spec string) error {
+	path, property := spec, ""
+	if idx := strings.LastIndexByte(spec, ':'); idx > -1 {
+		path, property = spec[:idx], spec[idx+1:]
+	}
+	n, err := t.Lookup(path)
+	if err != nil {
+		return err
+	}
+	if property == "" {
+		return n.WriteSource(os.Stdout)
+	}
+	p, ok := n.Property(property)
+	if !ok {
+		return fmt.Errorf("%s: no property %s", path, property)
+	}
+	fmt.Println(fdt.FormatValue(p.Value))
+	return nil
+}
+
+func inspect(paths []string, lookupSpec string, check bool, assertionFiles []string) error {
+	assertions, err := parseAssertions("builtin", []byte(patchAssertions))
+	if err != nil {
+		return err
+	}
+	for _, fn := range assertionFiles {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		more, err := parseAssertions(fn, b)
+		if err != nil {
+			return err
+		}
+		assertions = append(assertions, more...)
+	}
+
+	failed := 0
+	for _, path := range paths {
+		t, err := fdt.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case check:
+			checked := 0
+			for _, a := range assertions {
+				if !a.appliesTo(path) {
+					continue
+				}
+				checked++
+				if err := a.check(t); err != nil {
+					failed++
+					fmt.Printf("FAIL %s: %s (%s): %v\n", path, a.text, a.source, err)
+				}
+			}
+			fmt.Printf("%s: %d assertions checked\n", path, checked)
+
+		case lookupSpec != "":
+			if len(paths) > 1 {
+				fmt.Printf("// %s\n", path)
+			}
+			if err := lookup(t, lookupSpec); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+
+		default:
+			if len(paths) > 1 {
+				fmt.Printf("// %s\n", path)
+			}
+			if err := t.WriteSource(os.Stdout); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d assertions failed", failed)
+	}
+	return nil
+}
+
+func main() {
+	var lookupSpec = flag.String("lookup",
+		"",
+		"print the node (path or alias, e.g. /soc/spi@7e204000 or serial0) or property (path:property) instead of decompiling the whole tree")
+	var check = flag.Bool("check",
+		false,
+		"verify the assertions about our device tree patches, and those in -assertions")
+	var assertions = flag.String("assertions",
+		"",
+		"comma-separated list of files with additional assertions for -check")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-dtb-inspect [flags] <file.dtb>...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var assertionFiles []string
+	if *assertions != "" {
+		assertionFiles = strings.Split(*assertions, ",")
+	}
+	if err := inspect(flag.Args(), *lookupSpec, *check || len(assertionFiles) > 0, assertionFiles); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,281 @@
+// gokr-export-patch turns the commits of a local kernel git checkout into
+// patch files of this repository: it formats the commits on top of the
+// pinned kernel version into numbered patch files, verifies that all patches
+// (the existing ones and the new ones) apply to the pinned kernel source
+// tarball in the order in which gokr-build-kernel applies them, and records
+// the new patches in kernel.lock.
+//
+// Run it in this repository, after committing your changes in a linux
+// checkout based on the tag of the pinned version:
+//
+//	gokr-export-patch -src=~/linux
+//	gokr-export-patch -src=~/linux -base=v6.5.7 -tarball=linux-6.5.7.tar.xz
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// patchNameRe matches the names of patch files, which start with a number
+// determining the order in which they are applied.
+var patchNameRe = regexp.MustCompile(`^(\d{4})-.*\.patch$`)
+
+// nextNumber returns the number following the highest-numbered patch file
+// in dir.
+func nextNumber(dir string) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.patch"))
+	if err != nil {
+		return 0, err
+	}
+	next := 1
+	for _, match := range matches {
+		m := patchNameRe.FindStringSubmatch(filepath.Base(match))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if n+1 > next {
+			next = n + 1
+		}
+	}
+	return next, nil
+}
+
+// formatPatches formats the commits in base..HEAD of the git checkout src
+// into dest, numbered from start. The patches do not depend on the commit
+// hashes or the git version, so that re-exporting the same commits yields
+// the same files.
+func formatPatches(src, base, dest string, start int) ([]string, error) {
+	cmd := exec.Command("git", "-C", src, "format-patch",
+		"--zero-commit",
+		"--no-signature",
+		"--no-numbered",
+		fmt.Sprintf("--start-number=%d", start),
+		"-o", dest,
+		base+"..HEAD")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	var names []string
+	for _, path := range strings.Fields(string(out)) {
+		names = append(names, filepath.Base(path))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no commits in %s..HEAD of %s", base, src)
+	}
+	return names, nil
+}
+
+// fetchTarball downloads the kernel source tarball at url into dir and
+// verifies its SHA-256 hash against want (unless empty).
+func fetchTarball(url, want, dir string) (string, error) {
+	log.Printf("downloading %s", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	dest := filepath.Join(dir, path.Base(url))
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); want != "" && got != want {
+		return "", fmt.Errorf("%s: SHA-256 hash mismatch: got %s, want %s (from kernel.lock)", url, got, want)
+	}
+	return dest, nil
+}
+
+// verifyPatches unpacks tarball into a temporary directory and applies the
+// patches (paths of patch files) in the order of their file names, like
+// gokr-build-kernel does.
+func verifyPatches(tarball string, patches []string) error {
+	tmp, err := ioutil.TempDir("", "gokr-export-patch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	log.Printf("unpacking %s", tarball)
+	untar := exec.Command("tar", "xf", tarball, "-C", tmp, "--strip-components=1")
+	untar.Stderr = os.Stderr
+	if err := untar.Run(); err != nil {
+		return fmt.Errorf("%v: %v", untar.Args, err)
+	}
+	sorted := append([]string(nil), patches...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return filepath.Base(sorted[i]) < filepath.Base(sorted[j])
+	})
+	for _, patch := range sorted {
+		f, err := os.Open(patch)
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command("patch", "-p1", "--quiet", "--batch", "--forward")
+		cmd.Dir = tmp
+		cmd.Stdin = f
+		out, err := cmd.CombinedOutput()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s does not apply: %v\n%s", filepath.Base(patch), err, out)
+		}
+		log.Printf("%s applies", filepath.Base(patch))
+	}
+	return nil
+}
+
+func fileHash(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// exportPatches adds the commits in base..HEAD of the git checkout src as
+// patches to the repository directory repo, numbered from start.
+func exportPatches(src, base, repo, tarball string, start int, dryRun bool) error {
+	lockPath := filepath.Join(repo, "kernel.lock")
+	b, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return err
+	}
+	lock, err := kernelversion.ParseLock(b)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		base = "v" + lock.Version
+	}
+	if start == 0 {
+		if start, err = nextNumber(repo); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "gokr-export-patch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	names, err := formatPatches(src, base, tmp, start)
+	if err != nil {
+		return err
+	}
+	var patches []string
+	for _, p := range lock.Patches {
+		patches = append(patches, filepath.Join(repo, p.Name))
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(repo, name)); err == nil {
+			return fmt.Errorf("%s already exists in %s, use -start to number the new patches differently", name, repo)
+		}
+		patches = append(patches, filepath.Join(tmp, name))
+	}
+
+	if tarball == "" {
+		if tarball, err = fetchTarball(lock.URL, lock.SHA256, tmp); err != nil {
+			return err
+		}
+	}
+	if err := verifyPatches(tarball, patches); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		hash, err := fileHash(filepath.Join(tmp, name))
+		if err != nil {
+			return err
+		}
+		lock.Patches = append(lock.Patches, kernelversion.Patch{Name: name, SHA256: hash})
+		if dryRun {
+			log.Printf("[dry-run] would add %s (sha256 %s)", name, hash)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(tmp, name))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(repo, name), content, 0644); err != nil {
+			return err
+		}
+		log.Printf("added %s", name)
+	}
+	if dryRun {
+		return nil
+	}
+	lockContent, err := lock.Marshal()
+	if err != nil {
+		return err
+	}
+	generated, err := lock.Source()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(lockPath, lockContent, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo, "kernelversion", "lock.go"), generated, 0644); err != nil {
+		return err
+	}
+	log.Printf("recorded %d new patches in %s, rebuild the kernel to apply them", len(names), lockPath)
+	return nil
+}
+
+func main() {
+	var (
+		src = flag.String("src",
+			"",
+			"path to a linux git checkout whose commits on top of -base to export")
+		base = flag.String("base",
+			"",
+			"git revision in -src which corresponds to the pinned kernel version (default: the v<version> tag of the version in kernel.lock)")
+		repo = flag.String("repo",
+			".",
+			"directory of this repository, containing kernel.lock and the patches")
+		tarball = flag.String("tarball",
+			"",
+			"path to the pinned kernel source tarball to verify the patches against (default: download it from kernel.org)")
+		start = flag.Int("start",
+			0,
+			"number of the first new patch (default: following the highest-numbered existing patch)")
+		dryRun = flag.Bool("dry_run",
+			false,
+			"format and verify the patches, but do not add them to the repository")
+	)
+	flag.Parse()
+	if *src == "" {
+		log.Fatal("-src is required")
+	}
+	if err := exportPatches(*src, *base, *repo, *tarball, *start, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+// gokr-kconfig-drift compares the config of the running kernel
+// (/proc/config.gz, see CONFIG_IKCONFIG_PROC) on a gokrazy device against a
+// reference config and logs the symbols which differ, e.g. to detect devices
+// of a fleet which still run an older kernel. Add it to your gokrazy
+// instance:
+//
+//	gok add github.com/alf632/gokrazy-kernel/cmd/gokr-kconfig-drift
+//
+// By default, the reference is the kernel on the boot partition, i.e. the
+// one the next boot runs. To compare against the current build of the
+// kernel repository instead, serve it on the build host:
+//
+//	gokr-rebuild-kernel serve
+//
+// and pass -reference=http://<build host>:8097/config. With -interval, the
+// configs are compared periodically, logging only when the drift changes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// dontRestartExitStatus tells the gokrazy supervisor not to restart us.
+const dontRestartExitStatus = 125
+
+// fetch returns the config at src (an HTTP(S) URL or a path): a .config
+// file, optionally gzip-compressed, or a kernel image with an embedded
+// config.
+func fetch(src string) (kconfig.Config, error) {
+	var b []byte
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := http.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: unexpected HTTP status %s", src, resp.Status)
+		}
+		if b, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if b, err = ioutil.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := kconfig.ParseBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", src, err)
+	}
+	if len(cfg) == 0 {
+		return nil, fmt.Errorf("%s: no config symbols found", src)
+	}
+	return cfg, nil
+}
+
+// drift returns the symbols whose values differ between the running kernel
+// and the reference, formatted one per line.
+func drift(reference string) ([]string, error) {
+	running, err := kconfig.FromProc()
+	if err != nil {
+		return nil, err
+	}
+	ref, err := fetch(reference)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, c := range kconfig.Diff(running, ref) {
+		lines = append(lines, fmt.Sprintf("%s: running %s, reference %s", c.Symbol, orN(c.Old), orN(c.New)))
+	}
+	return lines, nil
+}
+
+// orN returns v, or n for an absent symbol.
+func orN(v string) string {
+	if v == "" {
+		return "n"
+	}
+	return v
+}
+
+// report logs the drift against reference.
+func report(reference string, lines []string) {
+	if len(lines) == 0 {
+		log.Printf("the config of the running kernel matches %s", reference)
+		return
+	}
+	log.Printf("the config of the running kernel differs from %s in %d symbols:\n%s", reference, len(lines), strings.Join(lines, "\n"))
+}
+
+func main() {
+	var reference = flag.String("reference",
+		"/boot/vmlinuz",
+		"config to compare the running kernel against: an HTTP(S) URL (e.g. http://<build host>:8097/config of gokr-rebuild-kernel serve) or a path, of a .config file (optionally gzip-compressed) or a kernel image")
+	var interval = flag.Duration("interval",
+		0,
+		"if non-zero, compare periodically at this interval instead of once")
+	flag.Parse()
+
+	if *interval == 0 {
+		lines, err := drift(*reference)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report(*reference, lines)
+		os.Exit(dontRestartExitStatus)
+	}
+
+	var (
+		last     string
+		reported bool
+	)
+	for ; ; time.Sleep(*interval) {
+		lines, err := drift(*reference)
+		if err != nil {
+			// The build host may be unreachable for a while.
+			log.Print(err)
+			continue
+		}
+		if current := strings.Join(lines, "\n"); !reported || current != last {
+			report(*reference, lines)
+			last, reported = current, true
+		}
+	}
+}
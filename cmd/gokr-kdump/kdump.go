@@ -0,0 +1,140 @@
+// gokr-kdump collects kernel crash dumps on gokrazy devices, with a kernel
+// built with the kdump profile (which reserves memory for a crash kernel via
+// crashkernel= in cmdline.txt). Add it to your gokrazy instance:
+//
+//	gok add github.com/alf632/gokrazy-kernel/cmd/gokr-kdump
+//
+// After a normal boot, it loads the running kernel (from the boot partition)
+// as crash kernel and exits. When the kernel panics, it boots the crash
+// kernel, which starts gokrazy (and gokr-kdump) again: gokr-kdump then finds
+// /proc/vmcore, saves it (gzip-compressed) to /perm/vmcore and reboots into
+// the normal kernel.
+//
+// Analyze dumps with crash(8) and the vmlinux of the build (see
+// gokr-symbolize for where gokr-rebuild-kernel keeps it).
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/kexec"
+)
+
+// dontRestartExitStatus tells the gokrazy supervisor not to restart us.
+const dontRestartExitStatus = 125
+
+// loadCrashKernel loads kernel as crash kernel with the current command
+// line, without crashkernel= (no memory can be reserved within the reserved
+// memory), limited to one CPU and resetting devices the crashed kernel left
+// in an unknown state. It returns the command line.
+func loadCrashKernel(kernel string) (string, error) {
+	if b, err := ioutil.ReadFile("/sys/kernel/kexec_crash_size"); err != nil || strings.TrimSpace(string(b)) == "0" {
+		return "", fmt.Errorf("no memory reserved for a crash kernel: build the kernel with the kdump profile, which adds crashkernel= to cmdline.txt")
+	}
+	cmdline, err := kexec.Cmdline([]string{"crashkernel", "maxcpus"}, "maxcpus=1", "reset_devices")
+	if err != nil {
+		return "", err
+	}
+	return cmdline, kexec.FileLoad(kernel, cmdline, kexec.FileOnCrash)
+}
+
+// saveVmcore compresses /proc/vmcore into dir and returns the path of the
+// dump.
+func saveVmcore(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	in, err := os.Open("/proc/vmcore")
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	path := filepath.Join(dir, "vmcore-"+time.Now().UTC().Format("20060102T150405Z")+".gz")
+	out, err := os.Create(path + ".partial")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	gw, err := gzip.NewWriterLevel(out, gzip.BestSpeed)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(gw, in); err != nil {
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(path+".partial", path)
+}
+
+// removeOldDumps removes all but the newest keep dumps in dir.
+func removeOldDumps(dir string, keep int) error {
+	dumps, err := filepath.Glob(filepath.Join(dir, "vmcore-*.gz"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(dumps) // names start with the time
+	for len(dumps) > keep {
+		log.Printf("removing old dump %s (keeping the newest %d)", dumps[0], keep)
+		if err := os.Remove(dumps[0]); err != nil {
+			return err
+		}
+		dumps = dumps[1:]
+	}
+	return nil
+}
+
+func main() {
+	var kernel = flag.String("kernel",
+		"/boot/vmlinuz",
+		"kernel image to load as crash kernel")
+	var dir = flag.String("dir",
+		"/perm/vmcore",
+		"directory to save crash dumps in")
+	var keep = flag.Int("keep",
+		3,
+		"number of crash dumps to keep")
+	flag.Parse()
+
+	if _, err := os.Stat("/proc/vmcore"); err == nil {
+		// We are running in the crash kernel.
+		log.Printf("crash kernel: saving /proc/vmcore to %s", *dir)
+		path, err := saveVmcore(*dir)
+		if err != nil {
+			log.Printf("saving crash dump: %v", err)
+		} else {
+			log.Printf("saved crash dump to %s", path)
+			if err := removeOldDumps(*dir, *keep); err != nil {
+				log.Print(err)
+			}
+		}
+		syscall.Sync()
+		log.Printf("rebooting")
+		if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cmdline, err := loadCrashKernel(*kernel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %s as crash kernel (cmdline %q)", *kernel, cmdline)
+	os.Exit(dontRestartExitStatus)
+}
@@ -0,0 +1,345 @@
+// gokr-kernel-cves reports the known CVEs which are fixed or still open in a
+// kernel build, based on the data set maintained at
+// https://github.com/nluedtke/linux_kernel_cves (linuxkernelcves.com).
+//
+// CVEs in subsystems which are disabled in the kernel’s config (as extracted
+// from vmlinuz) are not counted. The subsystem of a CVE is derived from the
+// subject prefix of its fix commit (e.g. “Bluetooth:” → CONFIG_BT), so
+// the filtering is a heuristic, not a guarantee.
+//
+//	gokr-kernel-cves -fail_on_critical
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+const dataURL = "https://raw.githubusercontent.com/nluedtke/linux_kernel_cves/master/data/"
+
+// criticalScore is the CVSS v3 base score from which on a CVE is rated
+// critical.
+const criticalScore = 9.0
+
+// subsystems maps fix commit subject prefixes to the config symbol which
+// must be enabled for the CVE to apply.
+var subsystems = map[string]string{
+	"bluetooth":   "CONFIG_BT",
+	"nfc":         "CONFIG_NFC",
+	"kvm":         "CONFIG_KVM",
+	"ext4":        "CONFIG_EXT4_FS",
+	"btrfs":       "CONFIG_BTRFS_FS",
+	"xfs":         "CONFIG_XFS_FS",
+	"f2fs":        "CONFIG_F2FS_FS",
+	"nfs":         "CONFIG_NFS_FS",
+	"nfsd":        "CONFIG_NFSD",
+	"cifs":        "CONFIG_CIFS",
+	"smb":         "CONFIG_CIFS",
+	"ksmbd":       "CONFIG_SMB_SERVER",
+	"fuse":        "CONFIG_FUSE_FS",
+	"ovl":         "CONFIG_OVERLAY_FS",
+	"overlayfs":   "CONFIG_OVERLAY_FS",
+	"squashfs":    "CONFIG_SQUASHFS",
+	"netfilter":   "CONFIG_NETFILTER",
+	"wireguard":   "CONFIG_WIREGUARD",
+	"sctp":        "CONFIG_IP_SCTP",
+	"tipc":        "CONFIG_TIPC",
+	"rds":         "CONFIG_RDS",
+	"can":         "CONFIG_CAN",
+	"ax25":        "CONFIG_AX25",
+	"netrom":      "CONFIG_NETROM",
+	"rose":        "CONFIG_ROSE",
+	"atm":         "CONFIG_ATM",
+	"io_uring":    "CONFIG_IO_URING",
+	"bpf":         "CONFIG_BPF_SYSCALL",
+	"hid":         "CONFIG_HID",
+	"media":       "CONFIG_MEDIA_SUPPORT",
+	"alsa":        "CONFIG_SND",
+	"sound":       "CONFIG_SND",
+	"usb":         "CONFIG_USB",
+	"brcmfmac":    "CONFIG_BRCMFMAC",
+	"drm/amdgpu":  "CONFIG_DRM_AMDGPU",
+	"drm/amd":     "CONFIG_DRM_AMDGPU",
+	"drm/i915":    "CONFIG_DRM_I915",
+	"drm/nouveau": "CONFIG_DRM_NOUVEAU",
+	"drm/vmwgfx":  "CONFIG_DRM_VMWGFX",
+	"drm/vc4":     "CONFIG_DRM_VC4",
+	"xen":         "CONFIG_XEN",
+	"x86":         "CONFIG_X86",
+	"powerpc":     "CONFIG_PPC",
+	"s390":        "CONFIG_S390",
+	"mips":        "CONFIG_MIPS",
+	"riscv":       "CONFIG_RISCV",
+}
+
+// cve is an entry of kernel_cves.json.
+type cve struct {
+	AffectedVersions string `json:"affected_versions"`
+	CmtMsg           string `json:"cmt_msg"`
+	Fixes            string `json:"fixes"`
+	NVDText          string `json:"nvd_text"`
+	CVSS3            struct {
+		Score float64 `json:"score"`
+	} `json:"cvss3"`
+}
+
+// streamFix is an entry of stream_fixes.json.
+type streamFix struct {
+	CmtID        string `json:"cmt_id"`
+	FixedVersion string `json:"fixed_version"`
+}
+
+// version is a parsed kernel version like 6.5.7 or 6.6-rc1.
+type version struct {
+	nums [3]int
+	rc   int // 0 for releases
+}
+
+// parseVersion parses a kernel version or a kernel release (uname -r), whose
+// local version (e.g. -gokrazy-1a2b3c4 or +) is ignored.
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	var v version
+	if idx := strings.Index(s, "-rc"); idx > -1 {
+		rc := s[idx+len("-rc"):]
+		if end := strings.IndexAny(rc, "-+"); end > -1 {
+			rc = rc[:end]
+		}
+		n, err := strconv.Atoi(rc)
+		if err != nil {
+			return version{}, false
+		}
+		v.rc = n
+		s = s[:idx]
+	} else if idx := strings.IndexAny(s, "-+"); idx > -1 {
+		s = s[:idx]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return version{}, false
+	}
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return version{}, false
+		}
+		v.nums[idx] = n
+	}
+	return v, true
+}
+
+func (v version) less(o version) bool {
+	for idx := range v.nums {
+		if v.nums[idx] != o.nums[idx] {
+			return v.nums[idx] < o.nums[idx]
+		}
+	}
+	if v.rc == 0 || o.rc == 0 {
+		// A release candidate precedes the release.
+		return v.rc != 0 && o.rc == 0
+	}
+	return v.rc < o.rc
+}
+
+func (v version) stream() string {
+	return fmt.Sprintf("%d.%d", v.nums[0], v.nums[1])
+}
+
+type status int
+
+const (
+	notAffected status = iota
+	fixed
+	open
+)
+
+// classify returns whether the kernel at version v is affected by c, and
+// whether the fix is included in v.
+func classify(v version, c cve, fixes map[string]streamFix) status {
+	parts := strings.SplitN(c.AffectedVersions, " to ", 2)
+	if len(parts) != 2 {
+		return open // unknown range, err on the side of caution
+	}
+	if introduced, ok := parseVersion(parts[0]); ok && v.less(introduced) {
+		return notAffected
+	}
+	if mainlineFix, ok := parseVersion(parts[1]); ok && !v.less(mainlineFix) {
+		return fixed
+	}
+	if fix, ok := fixes[v.stream()]; ok {
+		if fixedIn, ok := parseVersion(fix.FixedVersion); ok && !v.less(fixedIn) {
+			return fixed
+		}
+	}
+	return open
+}
+
+// subsystemSymbol returns the config symbol guarding the subsystem of the
+// CVE’s fix commit, or the empty string if the subsystem is unknown.
+func subsystemSymbol(c cve) string {
+	components := strings.Split(c.CmtMsg, ":")
+	if len(components) > 3 {
+		components = components[:3]
+	}
+	for _, component := range components[:len(components)-1] {
+		if sym, ok := subsystems[strings.ToLower(strings.TrimSpace(component))]; ok {
+			return sym
+		}
+	}
+	return ""
+}
+
+func readData(dataDir, filename string, v interface{}) error {
+	var rd io.Reader
+	if dataDir != "" {
+		f, err := os.Open(filepath.Join(dataDir, filename))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rd = f
+	} else {
+		url := dataURL + filename
+		log.Printf("fetching %s", url)
+		resp, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			return fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+		}
+		rd = resp.Body
+	}
+	if err := json.NewDecoder(rd).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+type finding struct {
+	id     string
+	cve    cve
+	status status
+}
+
+func main() {
+	var (
+		dir = flag.String("dir",
+			".",
+			"directory containing the kernel artifacts (vmlinuz, lib/modules) to scan")
+		dataDir = flag.String("data_dir",
+			"",
+			"directory containing kernel_cves.json and stream_fixes.json (default: download from "+dataURL+")")
+		output = flag.String("output",
+			"cve-report.md",
+			"path to write the markdown security report to")
+		failOnCritical = flag.Bool("fail_on_critical",
+			false,
+			fmt.Sprintf("exit with a non-zero status if any open CVE has a CVSS v3 score of %.1f or higher", criticalScore))
+	)
+	flag.Parse()
+
+	// Prefer the upstream version over the kernel release, which includes
+	// the local version.
+	release := ""
+	if bi, err := buildinfo.Read(filepath.Join(*dir, buildinfo.FileName)); err == nil {
+		release = bi.KernelVersion
+	}
+	if release == "" {
+		var err error
+		if release, err = buildinfo.Release(*dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	v, ok := parseVersion(release)
+	if !ok {
+		log.Fatalf("cannot parse kernel release %q", release)
+	}
+	cfg, err := kconfig.FromImage(filepath.Join(*dir, "vmlinuz"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		cves        map[string]cve
+		streamFixes map[string]map[string]streamFix
+	)
+	if err := readData(*dataDir, "kernel_cves.json", &cves); err != nil {
+		log.Fatal(err)
+	}
+	if err := readData(*dataDir, "stream_fixes.json", &streamFixes); err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		findings []finding
+		disabled int
+	)
+	for id, c := range cves {
+		st := classify(v, c, streamFixes[id])
+		if st == notAffected {
+			continue
+		}
+		if sym := subsystemSymbol(c); sym != "" && !cfg.Enabled(sym) {
+			disabled++
+			continue
+		}
+		findings = append(findings, finding{id: id, cve: c, status: st})
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if a, b := findings[i].cve.CVSS3.Score, findings[j].cve.CVSS3.Score; a != b {
+			return a > b
+		}
+		return findings[i].id < findings[j].id
+	})
+
+	var (
+		buf                   bytes.Buffer
+		numFixed, numCritical int
+		openFindings          []finding
+	)
+	for _, f := range findings {
+		if f.status == fixed {
+			numFixed++
+			continue
+		}
+		openFindings = append(openFindings, f)
+		if f.cve.CVSS3.Score >= criticalScore {
+			numCritical++
+		}
+	}
+	fmt.Fprintf(&buf, "# CVE report for Linux %s\n\n", release)
+	fmt.Fprintf(&buf, "- fixed: %d\n", numFixed)
+	fmt.Fprintf(&buf, "- open: %d (%d critical)\n", len(openFindings), numCritical)
+	fmt.Fprintf(&buf, "- skipped (subsystem disabled in config): %d\n\n", disabled)
+	if len(openFindings) > 0 {
+		fmt.Fprintf(&buf, "## Open\n\n")
+		fmt.Fprintf(&buf, "| CVE | CVSS v3 | Fix commit |\n|---|---:|---|\n")
+		for _, f := range openFindings {
+			fmt.Fprintf(&buf, "| [%s](https://www.linuxkernelcves.com/cves/%s) | %.1f | %s |\n",
+				f.id, f.id, f.cve.CVSS3.Score, strings.ReplaceAll(f.cve.CmtMsg, "|", `\|`))
+		}
+	}
+	if err := ioutil.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d CVEs fixed, %d open (%d critical), report written to %s", numFixed, len(openFindings), numCritical, *output)
+	if *failOnCritical && numCritical > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	for _, tt := range []struct {
+		s      string
+		want   version
+		wantOK bool
+	}{
+		{"6.5.7", version{nums: [3]int{6, 5, 7}}, true},
+		{"v6.6", version{nums: [3]int{6, 6, 0}}, true},
+		{"6.6-rc1", version{nums: [3]int{6, 6, 0}, rc: 1}, true},
+		{"6.5.7-gokrazy-1a2b3c4", version{nums: [3]int{6, 5, 7}}, true},
+		{"6.5.7+", version{nums: [3]int{6, 5, 7}}, true},
+		{"6.6.0-rc5-gokrazy", version{nums: [3]int{6, 6, 0}, rc: 5}, true},
+		{"6", version{}, false},
+		{"6.5.x", version{}, false},
+		{"6.6-rcX", version{}, false},
+	} {
+		got, ok := parseVersion(tt.s)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("parseVersion(%q) = %+v, %v, want %+v, %v", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"6.5.7", "6.5.9", true},
+		{"6.5.9", "6.5.7", false},
+		{"6.6-rc1", "6.6", true},
+		{"6.6", "6.6-rc1", false},
+		{"6.6-rc1", "6.6-rc2", true},
+		{"6.5.7-gokrazy", "6.5.7", false},
+	} {
+		a, _ := parseVersion(tt.a)
+		b, _ := parseVersion(tt.b)
+		if got := a.less(b); got != tt.want {
+			t.Errorf("%s < %s = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
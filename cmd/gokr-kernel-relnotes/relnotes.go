@@ -0,0 +1,281 @@
+// gokr-kernel-relnotes lists the upstream changes between two kernel versions
+// which are relevant to gokrazy (arm64, Raspberry Pi SoC drivers, Wi-Fi, …)
+// and writes them to RELNOTES.md, to be reviewed when bumping the kernel.
+//
+// For stable releases within the same series (e.g. 6.5.7 → 6.5.9), the
+// ChangeLog files from kernel.org are used:
+//
+//	gokr-kernel-relnotes -new=6.5.9
+//
+// For bumps across series, point the tool to a linux git checkout
+// (containing the release tags) to use git shortlog instead:
+//
+//	gokr-kernel-relnotes -new=6.6.1 -git_dir=~/src/linux
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+)
+
+// defaultMatch lists the commit subject keywords which are relevant to the
+// hardware and features gokrazy kernels are used with.
+var defaultMatch = []string{
+	"arm64",
+	"bcm2835",
+	"bcm2711",
+	"bcm283x",
+	"raspberrypi",
+	"brcmfmac",
+	"brcm80211",
+	"vc4",
+	"dwc2",
+	"genet",
+	"lan78xx",
+	"smsc95xx",
+	"pcie-brcmstb",
+	"squashfs",
+	"wireguard",
+	"netfilter",
+	"cve",
+}
+
+type release struct {
+	major, minor, patch int
+}
+
+func parseRelease(s string) (release, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return release{}, fmt.Errorf("malformed kernel version %q", s)
+	}
+	var nums [3]int
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return release{}, fmt.Errorf("malformed kernel version %q: %v", s, err)
+		}
+		nums[idx] = n
+	}
+	return release{nums[0], nums[1], nums[2]}, nil
+}
+
+func (r release) String() string {
+	if r.patch == 0 {
+		return fmt.Sprintf("%d.%d", r.major, r.minor)
+	}
+	return fmt.Sprintf("%d.%d.%d", r.major, r.minor, r.patch)
+}
+
+// committedRelease returns the upstream kernel version of the artifacts
+// committed to this repository: the KernelVersion recorded in their
+// build-info.json or, for builds predating it, the kernel release (the name
+// of the lib/modules directory) without its local version.
+func committedRelease() (string, error) {
+	if bi, err := buildinfo.Read(buildinfo.FileName); err == nil && bi.KernelVersion != "" {
+		return bi.KernelVersion, nil
+	}
+	rel, err := buildinfo.Release(".")
+	if err != nil {
+		return "", err
+	}
+	return upstreamVersion(rel), nil
+}
+
+// upstreamVersion strips the local version from the kernel release rel, e.g.
+// 6.5.7 from 6.5.7-gokrazy-1a2b3c4 or 6.5.7+.
+func upstreamVersion(rel string) string {
+	if idx := strings.IndexAny(rel, "-+"); idx > -1 {
+		return rel[:idx]
+	}
+	return rel
+}
+
+type entry struct {
+	release string
+	commit  string
+	subject string
+}
+
+func fetchChangeLog(r release) ([]byte, error) {
+	url := fmt.Sprintf("https://cdn.kernel.org/pub/linux/kernel/v%d.x/ChangeLog-%s", r.major, r)
+	log.Printf("fetching %s", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseChangeLog extracts commit hashes and subjects from a kernel.org
+// ChangeLog file, which is formatted like git log --no-merges.
+func parseChangeLog(rel string, changelog []byte) []entry {
+	var (
+		entries []entry
+		commit  string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(changelog))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "commit ") {
+			commit = strings.TrimSpace(strings.TrimPrefix(line, "commit "))
+			continue
+		}
+		if commit == "" || !strings.HasPrefix(line, "    ") {
+			continue
+		}
+		// The first indented line after the commit header is the subject.
+		entries = append(entries, entry{
+			release: rel,
+			commit:  commit,
+			subject: strings.TrimSpace(line),
+		})
+		commit = ""
+	}
+	return entries
+}
+
+func stableEntries(old, new release) ([]entry, error) {
+	if old.major != new.major || old.minor != new.minor {
+		return nil, fmt.Errorf("%s and %s are not in the same stable series, use -git_dir", old, new)
+	}
+	var entries []entry
+	for patch := old.patch + 1; patch <= new.patch; patch++ {
+		r := release{new.major, new.minor, patch}
+		changelog, err := fetchChangeLog(r)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parseChangeLog(r.String(), changelog)...)
+	}
+	return entries, nil
+}
+
+func gitEntries(dir string, old, new release) ([]entry, error) {
+	rng := fmt.Sprintf("v%s..v%s", old, new)
+	shortlog := exec.Command("git", "-C", dir, "log", "--no-merges", "--format=%H %s", rng)
+	shortlog.Stderr = os.Stderr
+	out, err := shortlog.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", shortlog.Args, err)
+	}
+	var entries []entry
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entries = append(entries, entry{
+			release: new.String(),
+			commit:  parts[0],
+			subject: parts[1],
+		})
+	}
+	return entries, nil
+}
+
+func filter(entries []entry, match []string) []entry {
+	var result []entry
+	for _, e := range entries {
+		subject := strings.ToLower(e.subject)
+		for _, m := range match {
+			if strings.Contains(subject, strings.ToLower(m)) {
+				result = append(result, e)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func writeRelnotes(w io.Writer, old, new release, total int, entries []entry, match []string) {
+	fmt.Fprintf(w, "# Kernel %s → %s\n\n", old, new)
+	fmt.Fprintf(w, "%d of %d upstream commits match %s.\n", len(entries), total, strings.Join(match, ", "))
+	last := ""
+	for _, e := range entries {
+		if e.release != last {
+			fmt.Fprintf(w, "\n## %s\n\n", e.release)
+			last = e.release
+		}
+		commit := e.commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		fmt.Fprintf(w, "- %s ([%s](https://git.kernel.org/stable/c/%s))\n", e.subject, commit, e.commit)
+	}
+}
+
+func main() {
+	var (
+		oldVersion = flag.String("old",
+			"",
+			"kernel version to start from (default: the version of the committed kernel, from build-info.json or lib/modules)")
+		newVersion = flag.String("new",
+			"",
+			"kernel version to bump to, e.g. 6.5.9")
+		gitDir = flag.String("git_dir",
+			"",
+			"path to a linux git checkout with release tags. If set, git log is used instead of the kernel.org ChangeLog files")
+		match = flag.String("match",
+			strings.Join(defaultMatch, ","),
+			"comma-separated list of keywords. Commits whose subject contains any of these (case-insensitive) are included")
+		output = flag.String("output",
+			"RELNOTES.md",
+			"path to write the release notes to")
+	)
+	flag.Parse()
+	if *newVersion == "" {
+		log.Fatalf("-new is required")
+	}
+	if *oldVersion == "" {
+		v, err := committedRelease()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*oldVersion = v
+	}
+	old, err := parseRelease(*oldVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	new, err := parseRelease(*newVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var entries []entry
+	if *gitDir != "" {
+		entries, err = gitEntries(*gitDir, old, new)
+	} else {
+		entries, err = stableEntries(old, new)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	keywords := strings.Split(*match, ",")
+	relevant := filter(entries, keywords)
+
+	var buf bytes.Buffer
+	writeRelnotes(&buf, old, new, len(entries), relevant, keywords)
+	if err := ioutil.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d relevant changes to %s", len(relevant), *output)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamVersion(t *testing.T) {
+	for _, tt := range []struct {
+		rel  string
+		want string
+	}{
+		{"6.5.7", "6.5.7"},
+		{"6.5.7-gokrazy-1a2b3c4", "6.5.7"},
+		{"6.5.7+", "6.5.7"},
+		{"6.6.0-v8", "6.6.0"},
+	} {
+		if got := upstreamVersion(tt.rel); got != tt.want {
+			t.Errorf("upstreamVersion(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestCommittedRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-kernel-relnotes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.MkdirAll(filepath.Join("lib", "modules", "6.5.7-gokrazy-1a2b3c4"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	got, err := committedRelease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "6.5.7" {
+		t.Errorf("committedRelease (from lib/modules) = %q, want 6.5.7", got)
+	}
+	if _, err := parseRelease(got); err != nil {
+		t.Errorf("parseRelease(%q): %v", got, err)
+	}
+
+	if err := ioutil.WriteFile("build-info.json", []byte(`{"KernelVersion": "6.5.9", "KernelRelease": "6.5.9-gokrazy"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := committedRelease(); err != nil || got != "6.5.9" {
+		t.Errorf("committedRelease (from build-info.json) = %q, %v, want 6.5.9", got, err)
+	}
+}
@@ -0,0 +1,198 @@
+// gokr-kernel-smoketest verifies that the kernel it runs on provides the
+// devices gokrazy relies on, e.g. the watchdog which the gokrazy supervisor
+// uses for self-healing. Add it to a gokrazy instance (on hardware or in
+// QEMU) and check its output:
+//
+//	gokr-kernel-smoketest: PASS
+//
+// The last line of output is always either PASS or FAIL, so that a test
+// harness can watch the serial console for it.
+//
+// If the kernel command line contains gokr_bench (as set by gokr-rebuild-kernel
+// boot-test -bench), benchmarks run before the final line and print their
+// results as lines like:
+//
+//	gokr-kernel-smoketest: bench timer_latency_max 42 us
+//
+// gokr_bench=host:port additionally measures the network throughput by
+// sending data to a TCP sink at host:port.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// check is a single smoke test.
+type check struct {
+	name string
+	fn   func() error
+}
+
+var checks = []check{
+	{"watchdog", func() error { return charDevice("/dev/watchdog") }},
+	{"hwrng", hwrng},
+}
+
+func charDevice(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s: not a character device (mode %v)", path, st.Mode())
+	}
+	return nil
+}
+
+// hwrng verifies that /dev/hwrng exists and yields random bytes. The device
+// is not opened for /dev/watchdog, as opening it arms the watchdog (and fails
+// with EBUSY while gokrazy’s init holds it).
+func hwrng() error {
+	const path = "/dev/hwrng"
+	if err := charDevice(path); err != nil {
+		return err
+	}
+	if b, err := ioutil.ReadFile("/sys/class/misc/hw_random/rng_current"); err == nil {
+		fmt.Printf("  hwrng: current rng is %s\n", strings.TrimSpace(string(b)))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		_, err := io.ReadFull(f, buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("reading %s: timeout", path)
+	}
+}
+
+// benchParam returns the value of the gokr_bench kernel command line
+// parameter and whether it is present.
+func benchParam() (string, bool) {
+	b, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", false
+	}
+	for _, field := range strings.Fields(string(b)) {
+		if field == "gokr_bench" {
+			return "", true
+		}
+		if strings.HasPrefix(field, "gokr_bench=") {
+			return strings.TrimPrefix(field, "gokr_bench="), true
+		}
+	}
+	return "", false
+}
+
+func printBench(name string, value float64, unit string) {
+	fmt.Printf("gokr-kernel-smoketest: bench %s %g %s\n", name, value, unit)
+}
+
+// timerLatency measures how late the thread wakes up from sleeping for
+// interval, like cyclictest does (with less precision, as it runs without
+// real-time priority).
+func timerLatency(interval time.Duration, loops int) (max, avg time.Duration) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var sum time.Duration
+	ts := syscall.NsecToTimespec(interval.Nanoseconds())
+	for i := 0; i < loops; i++ {
+		start := time.Now()
+		syscall.Nanosleep(&ts, nil)
+		late := time.Since(start) - interval
+		if late < 0 {
+			late = 0
+		}
+		sum += late
+		if late > max {
+			max = late
+		}
+	}
+	return max, sum / time.Duration(loops)
+}
+
+// throughput sends size bytes to the TCP sink at addr and returns the
+// throughput in Mbit/s.
+func throughput(addr string, size int) (float64, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 64*1024)
+	start := time.Now()
+	for sent := 0; sent < size; sent += len(buf) {
+		if _, err := conn.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	if err := conn.Close(); err != nil {
+		return 0, err
+	}
+	return float64(size) * 8 / 1e6 / time.Since(start).Seconds(), nil
+}
+
+// bench runs the benchmarks. The timer latency is only measured on
+// PREEMPT_RT kernels, where it is what the kernel is built for.
+func bench(sink string) {
+	if b, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		var uptime float64
+		if _, err := fmt.Sscan(string(b), &uptime); err == nil {
+			printBench("uptime_at_start", uptime*1000, "ms")
+		}
+	}
+	if b, err := ioutil.ReadFile("/sys/kernel/realtime"); err == nil && strings.TrimSpace(string(b)) == "1" {
+		max, avg := timerLatency(time.Millisecond, 5000)
+		printBench("timer_latency_max", float64(max.Microseconds()), "us")
+		printBench("timer_latency_avg", float64(avg.Microseconds()), "us")
+	}
+	if sink != "" {
+		mbits, err := throughput(sink, 256<<20)
+		if err != nil {
+			fmt.Printf("  bench: network throughput: %v\n", err)
+		} else {
+			printBench("net_tx", float64(int(mbits)), "Mbit/s")
+		}
+	}
+}
+
+func main() {
+	failed := false
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("ok   %s\n", c.name)
+	}
+	if sink, ok := benchParam(); ok {
+		bench(sink)
+	}
+	if failed {
+		fmt.Println("gokr-kernel-smoketest: FAIL")
+	} else {
+		fmt.Println("gokr-kernel-smoketest: PASS")
+	}
+	// Exit status 125 tells the gokrazy supervisor not to restart us.
+	os.Exit(125)
+}
@@ -0,0 +1,128 @@
+// gokr-kexec boots a new kernel on a running gokrazy device via kexec,
+// skipping the firmware, bootloader and SD card update of a full reboot
+// cycle, for quick kernel iteration on hardware. The running kernel must be
+// built with the kexec profile. Add it to your gokrazy instance:
+//
+//	gok add github.com/alf632/gokrazy-kernel/cmd/gokr-kexec
+//
+// with the flag -kernel=http://<build host>:8097/vmlinuz, and serve each
+// new build on the build host:
+//
+//	gokr-rebuild-kernel serve
+//
+// After a cold boot, gokr-kexec downloads the kernel and kexecs into it
+// (with the same command line), once: the kexec’d kernel is marked with
+// gokr_kexec=1 on its command line, so that gokr-kexec does not loop. To
+// try the next build, reboot the device (or run gokr-kexec -force, e.g. via
+// breakglass). Modules are not updated, and the device tree remains the one
+// the firmware loaded.
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kexec"
+)
+
+// marker is appended to the command line of the kexec’d kernel. Unknown
+// parameters are passed to init as environment variables, so it is harmless.
+const marker = "gokr_kexec=1"
+
+// dontRestartExitStatus tells the gokrazy supervisor not to restart us.
+const dontRestartExitStatus = 125
+
+// fetch stores the kernel at src (an HTTP(S) URL or a path) in a temporary
+// file and returns its path and SHA-256 hash.
+func fetch(src string) (string, string, error) {
+	var r io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := http.Get(src)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", "", fmt.Errorf("%s: unexpected HTTP status %s", src, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return "", "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	tmp, err := ioutil.TempFile("", "gokr-kexec")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func main() {
+	var kernel = flag.String("kernel",
+		"",
+		"kernel image to boot: an HTTP(S) URL (e.g. of gokr-rebuild-kernel serve) or a path")
+	var wantHash = flag.String("sha256",
+		"",
+		"if non-empty, expected hex-encoded SHA-256 hash of the kernel image")
+	var appendParams = flag.String("append",
+		"",
+		"space-separated kernel command line parameters to append")
+	var force = flag.Bool("force",
+		false,
+		"kexec even if the running kernel was kexec’d already")
+	flag.Parse()
+
+	if *kernel == "" {
+		log.Printf("no -kernel specified, nothing to do")
+		os.Exit(dontRestartExitStatus)
+	}
+	current, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*force && strings.Contains(" "+strings.TrimSpace(string(current))+" ", " "+marker+" ") {
+		log.Printf("running kernel was kexec’d already (%s), not kexecing again", marker)
+		os.Exit(dontRestartExitStatus)
+	}
+
+	path, hash, err := fetch(*kernel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(path)
+	if *wantHash != "" && hash != *wantHash {
+		log.Fatalf("%s: SHA-256 hash mismatch: got %s, want %s", *kernel, hash, *wantHash)
+	}
+	cmdline, err := kexec.Cmdline([]string{"gokr_kexec"}, append(strings.Fields(*appendParams), marker)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := kexec.FileLoad(path, cmdline, 0); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %s (sha256 %s), booting it with cmdline %q", *kernel, hash, cmdline)
+	if err := kexec.Reboot(); err != nil {
+		log.Fatal(err)
+	}
+}
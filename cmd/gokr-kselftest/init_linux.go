@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// setupInit mounts the file systems which the tests need when
+// gokr-kselftest runs as init, e.g. in the initramfs of gokr-rebuild-kernel
+// boot-test -selftests.
+func setupInit() error {
+	for _, m := range []struct{ source, target, fstype string }{
+		{"proc", "/proc", "proc"},
+		{"sysfs", "/sys", "sysfs"},
+		{"devtmpfs", "/dev", "devtmpfs"},
+		{"tmpfs", "/tmp", "tmpfs"},
+	} {
+		if err := os.MkdirAll(m.target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.source, m.target, m.fstype, 0, ""); err != nil {
+			return fmt.Errorf("mounting %s: %v", m.target, err)
+		}
+	}
+	return nil
+}
+
+// powerOff turns the machine off, as init must not exit.
+func powerOff() {
+	syscall.Sync()
+	syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func setupInit() error {
+	return fmt.Errorf("running as init is only supported on Linux")
+}
+
+func powerOff() {}
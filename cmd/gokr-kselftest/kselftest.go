@@ -0,0 +1,166 @@
+// gokr-kselftest runs the kernel selftests which gokr-rebuild-kernel
+// -selftests built, on a gokrazy device or in QEMU, to catch regressions our
+// patches might introduce. Include the kselftest directory in your gokrazy
+// image (e.g. via ExtraFilePaths) and add the runner:
+//
+//	gok add github.com/alf632/gokrazy-kernel/cmd/gokr-kselftest
+//
+// Like gokr-kernel-smoketest, the last line of output is always either
+// “gokr-kselftest: PASS” or “gokr-kselftest: FAIL”. Tests which are shell
+// scripts are skipped, as gokrazy has no shell.
+//
+// gokr-rebuild-kernel boot-test -selftests runs it as init of an initramfs
+// in QEMU instead. It then mounts /proc, /sys, /dev and /tmp itself and
+// powers the machine off when done.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// skipExitStatus is KSFT_SKIP, with which tests report that they do not
+// apply (e.g. a missing kernel feature).
+const skipExitStatus = 4
+
+// test is an entry of kselftest-list.txt, e.g. timers:posix_timers.
+type test struct {
+	collection string
+	name       string
+}
+
+func (t test) String() string { return t.collection + ":" + t.name }
+
+func readList(dir string) ([]test, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "kselftest-list.txt"))
+	if err != nil {
+		return nil, err
+	}
+	var tests []test
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		tests = append(tests, test{collection: parts[0], name: parts[1]})
+	}
+	return tests, nil
+}
+
+func isELF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := f.Read(magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("\x7fELF"))
+}
+
+// result is ok, skip or fail.
+type result string
+
+func run(dir string, t test, timeout time.Duration) (result, string) {
+	path := filepath.Join(dir, t.collection, t.name)
+	if !isELF(path) {
+		return "skip", "not a static binary (shell scripts cannot run on gokrazy)"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = filepath.Join(dir, t.collection)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "fail", fmt.Sprintf("timeout after %v\n%s", timeout, out)
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == skipExitStatus {
+			return "skip", string(out)
+		}
+		return "fail", fmt.Sprintf("%v\n%s", err, out)
+	}
+	return "ok", string(out)
+}
+
+func main() {
+	var dir = flag.String("dir",
+		"/kselftest",
+		"directory containing kselftest-list.txt and the tests, as installed by gokr-rebuild-kernel -selftests")
+	var timeout = flag.Duration("timeout",
+		45*time.Second,
+		"timeout per test (the kselftest default)")
+	var filter = flag.String("run",
+		"",
+		"if non-empty, regular expression selecting the tests (collection:name) to run")
+	var verbose = flag.Bool("v",
+		false,
+		"print the output of passing tests, too")
+	flag.Parse()
+
+	failed := false
+	isInit := os.Getpid() == 1
+	if isInit {
+		if err := setupInit(); err != nil {
+			fmt.Println(err)
+			failed = true
+		}
+	}
+	tests, err := readList(*dir)
+	if err != nil {
+		fmt.Println(err)
+		failed = true
+	}
+	var re *regexp.Regexp
+	if *filter != "" {
+		if re, err = regexp.Compile(*filter); err != nil {
+			fmt.Println(err)
+			failed = true
+			tests = nil
+		}
+	}
+	n := 0
+	for _, t := range tests {
+		if re != nil && !re.MatchString(t.String()) {
+			continue
+		}
+		n++
+		res, out := run(*dir, t, *timeout)
+		switch res {
+		case "ok":
+			fmt.Printf("ok %d %s\n", n, t)
+		case "skip":
+			fmt.Printf("ok %d %s # SKIP\n", n, t)
+		default:
+			fmt.Printf("not ok %d %s\n", n, t)
+			failed = true
+		}
+		if res != "ok" || *verbose {
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				fmt.Printf("# %s\n", line)
+			}
+		}
+	}
+	fmt.Printf("1..%d\n", n)
+	if failed {
+		fmt.Println("gokr-kselftest: FAIL")
+	} else {
+		fmt.Println("gokr-kselftest: PASS")
+	}
+	if isInit {
+		powerOff()
+	}
+	// Exit status 125 tells the gokrazy supervisor not to restart us.
+	os.Exit(125)
+}
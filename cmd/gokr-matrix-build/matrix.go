@@ -0,0 +1,289 @@
+// gokr-matrix-build builds a kernel for each combination of board (from the
+// board manifest) and config profile, e.g. to validate a kernel bump across
+// everything this repository supports:
+//
+//	gokr-matrix-build -jobs=2 -output_dir=/tmp/matrix
+//
+// Each cell is built into its own directory below -output_dir, containing
+// the artifacts and the build log. A summary is printed and written to
+// report.md; the exit code is non-zero if any cell failed.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/board"
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+	"github.com/alf632/gokrazy-kernel/notify"
+	"github.com/alf632/gokrazy-kernel/profile"
+)
+
+// defaultProfile names the cell which enables no profile.
+const defaultProfile = "default"
+
+var (
+	boards = flag.String("boards",
+		"",
+		fmt.Sprintf("comma-separated list of boards to build for, out of %v (default: all)", board.Names()))
+	profiles = flag.String("profiles",
+		"",
+		fmt.Sprintf("comma-separated list of profiles to build with (one per cell), out of %v and %q for no profile (default: all)", profile.Names(), defaultProfile))
+	jobs = flag.Int("jobs",
+		1,
+		"number of cells to build concurrently. Each build uses all CPUs and about 25 GiB of disk space")
+	outputDir = flag.String("output_dir",
+		"matrix",
+		"directory to create the cell directories in")
+	notifyTargets = flag.String("notify",
+		os.Getenv("GOKR_NOTIFY"),
+		"comma-separated list of targets to notify of the matrix result, see gokr-rebuild-kernel build -help. Defaults to $GOKR_NOTIFY")
+	buildFlags = flag.String("build_flags",
+		"",
+		"space-separated flags to pass to each gokr-rebuild-kernel build, e.g. -ccache_dir=/var/cache/ccache")
+)
+
+// cell is one build of the matrix.
+type cell struct {
+	board   board.Board
+	profile string
+
+	dir      string
+	err      error
+	duration time.Duration
+	hash     string // reproducibility hash from build-info.json
+}
+
+func (c *cell) name() string {
+	return c.board.Name + "-" + c.profile
+}
+
+// repoFiles are copied from the repository into each cell directory, as
+// gokr-rebuild-kernel updates them.
+var repoFiles = []string{"config.txt", "cmdline.txt"}
+
+// prepare creates the cell directory, laid out like this repository:
+// the files the build reads (patches, overlay sources, config.txt and
+// cmdline.txt) are copied, the artifacts it replaces are created empty.
+func (c *cell) prepare() error {
+	if err := os.MkdirAll(filepath.Join(c.dir, "lib"), 0755); err != nil {
+		return err
+	}
+	files := append([]string(nil), repoFiles...)
+	for _, p := range kernelversion.Patches() {
+		files = append(files, p.Name)
+	}
+	overlays, err := filepath.Glob(filepath.Join("dts", "overlays", "*.dts"))
+	if err != nil {
+		return err
+	}
+	files = append(files, overlays...)
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Join(c.dir, filepath.Dir(file)), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(c.dir, file), file); err != nil {
+			return err
+		}
+	}
+	for _, placeholder := range []string{"vmlinuz", c.board.Committed} {
+		if placeholder == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(c.dir, placeholder), nil, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build runs gokr-rebuild-kernel for the cell, logging to build.log in the
+// cell directory.
+func (c *cell) build(rebuildKernel string) error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+	logFile, err := os.Create(filepath.Join(c.dir, "build.log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	profiles := c.profile
+	if profiles == defaultProfile {
+		profiles = ""
+	}
+	args := []string{
+		"build",
+		"-output_dir=" + c.dir,
+		"-boards=" + c.board.Name,
+		"-profiles=" + profiles,
+		// Concurrent cells build different images (e.g. containing
+		// different overlays).
+		"-image_tag=gokr-rebuild-kernel:" + c.name(),
+		"-v",
+	}
+	args = append(args, strings.Fields(*buildFlags)...)
+	cmd := exec.Command(rebuildKernel, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v (see %s)", err, logFile.Name())
+	}
+	if bi, err := buildinfo.Read(filepath.Join(c.dir, buildinfo.FileName)); err == nil {
+		c.hash = bi.ReproducibilityHash
+	}
+	return logFile.Close()
+}
+
+func copyFile(dest, src string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func resolveProfiles(list string) ([]string, error) {
+	if list == "" {
+		return append([]string{defaultProfile}, profile.Names()...), nil
+	}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != defaultProfile {
+			if _, err := profile.Resolve(name); err != nil {
+				return nil, err
+			}
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// report writes a markdown summary of the cells to w and returns the number
+// of failed cells.
+func report(w io.Writer, cells []*cell) int {
+	failed := 0
+	fmt.Fprintf(w, "# kernel %s build matrix\n\n", kernelversion.Version())
+	fmt.Fprintf(w, "| Board | Profile | Result | Duration | Reproducibility hash |\n")
+	fmt.Fprintf(w, "|---|---|---|---|---|\n")
+	for _, c := range cells {
+		result := "PASS"
+		if c.err != nil {
+			result = "FAIL: " + c.err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %v | %s |\n", c.board.Name, c.profile, result, c.duration.Round(time.Second), c.hash)
+	}
+	fmt.Fprintf(w, "\n%d of %d cells passed\n", len(cells)-failed, len(cells))
+	return failed
+}
+
+func main() {
+	flag.Parse()
+	bs, err := board.Resolve(*boards)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ps, err := resolveProfiles(*profiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jobs < 1 {
+		log.Fatalf("-jobs must be at least 1")
+	}
+	outDir, err := filepath.Abs(*outputDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "gokr-matrix-build")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	rebuildKernel := filepath.Join(tmp, "gokr-rebuild-kernel")
+	goBuild := exec.Command("go", "build", "-o", rebuildKernel, "github.com/alf632/gokrazy-kernel/cmd/gokr-rebuild-kernel")
+	goBuild.Stderr = os.Stderr
+	if err := goBuild.Run(); err != nil {
+		log.Fatalf("%v: %v", goBuild.Args, err)
+	}
+
+	var cells []*cell
+	for _, b := range bs {
+		for _, p := range ps {
+			c := &cell{board: b, profile: p}
+			c.dir = filepath.Join(outDir, c.name())
+			cells = append(cells, c)
+		}
+	}
+	log.Printf("building %d cells (%d boards × %d profiles), %d at a time", len(cells), len(bs), len(ps), *jobs)
+	start := time.Now()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *jobs)
+	for _, c := range cells {
+		wg.Add(1)
+		go func(c *cell) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			log.Printf("%s: building in %s", c.name(), c.dir)
+			start := time.Now()
+			c.err = c.build(rebuildKernel)
+			c.duration = time.Since(start)
+			if c.err != nil {
+				log.Printf("%s: FAIL: %v", c.name(), c.err)
+				return
+			}
+			log.Printf("%s: PASS (%v)", c.name(), c.duration.Round(time.Second))
+		}(c)
+	}
+	wg.Wait()
+
+	f, err := os.Create(filepath.Join(outDir, "report.md"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var summary bytes.Buffer
+	failed := report(io.MultiWriter(os.Stdout, f, &summary), cells)
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	m := notify.Message{
+		Subject:       fmt.Sprintf("kernel %s build matrix", kernelversion.Version()),
+		Duration:      time.Since(start),
+		KernelVersion: kernelversion.Version(),
+		Details:       summary.String(),
+	}
+	if failed > 0 {
+		m.Err = fmt.Errorf("%d of %d cells failed", failed, len(cells))
+	}
+	if err := notify.SendAll(notify.Split(*notifyTargets), m); err != nil {
+		log.Print(err)
+	}
+	if failed > 0 {
+		os.RemoveAll(tmp)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// actions performs the side effects of a build which modify the repository
+// or run containers, or only logs them in dry-run mode.
+type actions struct {
+	dryRun bool
+}
+
+// fileSystem modifies the repository. It is implemented by actions.
+type fileSystem interface {
+	copyFile(dest, src string) error
+	mkdirAll(dir string) error
+	// replaceDir replaces the directory dest with a copy of src.
+	replaceDir(dest, src string) error
+	// rename replaces the file or directory dest with src by renaming it.
+	rename(dest, src string) error
+	removeAll(path string) error
+}
+
+// containerRunner builds and runs the build container. The builds and
+// containers are stopped when ctx is done.
+type containerRunner interface {
+	// buildImage builds the image tagged tag from the build context in dir.
+	// If target is non-empty, only the Dockerfile stage target is built.
+	buildImage(ctx context.Context, dir, platform, tag, target string) error
+	// exportStage builds the Dockerfile stage target from the build context
+	// in dir and exports its files to the directory dest.
+	exportStage(ctx context.Context, dir, platform, target, dest string) error
+	// runContainer runs image with the container options opts (e.g.
+	// volumes) and passes args to its entrypoint.
+	runContainer(ctx context.Context, dir string, opts []string, image string, args []string) error
+}
+
+// cliRunner is a containerRunner using the docker (or podman, or nerdctl)
+// CLI.
+type cliRunner struct {
+	executable string
+	act        *actions
+	buildkit   bool     // whether to build with BuildKit
+	secrets    []string // --secret flags for building, e.g. id=apt,src=/path
+
+	// idleTimeout is how long a container may print nothing before it is
+	// considered hung, killed and retried (up to idleRetries times). 0
+	// disables the timeout.
+	idleTimeout time.Duration
+	idleRetries int
+	// downloadTimeout limits how long the build container may take to
+	// download the kernel source. 0 disables the timeout.
+	downloadTimeout time.Duration
+}
+
+func (r *cliRunner) buildImage(ctx context.Context, dir, platform, tag, target string) error {
+	args := []string{
+		"build",
+		"--platform=" + platform,
+		"--rm=true",
+		"--tag=" + tag,
+	}
+	if target != "" {
+		args = append(args, "--target="+target)
+	}
+	for _, secret := range r.secrets {
+		args = append(args, "--secret="+secret)
+	}
+	cmd := containerCommandContext(ctx, r.executable, append(args, ".")...)
+	cmd.Dir = dir
+	if r.buildkit && runtimeName(r.executable) == "docker" {
+		// Older docker versions only use BuildKit if asked to.
+		cmd.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
+	}
+	return r.act.run(cmd)
+}
+
+func (r *cliRunner) exportStage(ctx context.Context, dir, platform, target, dest string) error {
+	args := []string{"build"}
+	if runtimeName(r.executable) == "docker" {
+		// Only buildx supports exporting files with --output.
+		args = []string{"buildx", "build"}
+	}
+	args = append(args,
+		"--platform="+platform,
+		"--target="+target,
+		"--output=type=local,dest="+dest)
+	for _, secret := range r.secrets {
+		args = append(args, "--secret="+secret)
+	}
+	cmd := containerCommandContext(ctx, r.executable, append(args, ".")...)
+	cmd.Dir = dir
+	return r.act.run(cmd)
+}
+
+func (r *cliRunner) runContainer(ctx context.Context, dir string, opts []string, image string, args []string) error {
+	if r.act.dryRun {
+		cmdArgs := append(append(append([]string{"run"}, opts...), image), args...)
+		cmd := containerCommand(r.executable, cmdArgs...)
+		cmd.Dir = dir
+		return r.act.run(cmd)
+	}
+	for attempt := 0; ; attempt++ {
+		// Name the container so that it can be killed: killing the CLI
+		// does not stop the container.
+		name := fmt.Sprintf("gokr-rebuild-kernel-%d-%d", os.Getpid(), attempt)
+		cmdArgs := append(append(append([]string{"run", "--name=" + name}, opts...), image), args...)
+		cmd := containerCommand(r.executable, cmdArgs...)
+		cmd.Dir = dir
+		limits := streamLimits{
+			idleTimeout:  r.idleTimeout,
+			stepTimeouts: map[string]time.Duration{builderDownloadStep: r.downloadTimeout},
+		}
+		err := runStreamed(ctx, cmd, limits, func() {
+			if err := containerCommand(r.executable, "kill", name).Run(); err != nil {
+				log.Printf("%s kill %s: %v", r.executable, name, err)
+			}
+			cmd.Process.Kill()
+		})
+		if _, ok := err.(*idleError); ok && attempt < r.idleRetries && ctx.Err() == nil {
+			log.Printf("%v, retrying (attempt %d of %d)", err, attempt+2, r.idleRetries+1)
+			continue
+		}
+		return err
+	}
+}
+
+// shellQuote formats args as a command line which can be pasted into a
+// shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for idx, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`|&;<>()*?[]{}~#!") {
+			quoted[idx] = arg
+			continue
+		}
+		quoted[idx] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (a *actions) run(cmd *exec.Cmd) error {
+	if a.dryRun {
+		if cmd.Dir != "" {
+			log.Printf("[dry-run] would run (in %s): %s", cmd.Dir, shellQuote(cmd.Args))
+		} else {
+			log.Printf("[dry-run] would run: %s", shellQuote(cmd.Args))
+		}
+		return nil
+	}
+	return runCommand(cmd)
+}
+
+func (a *actions) copyFile(dest, src string) error {
+	if a.dryRun {
+		log.Printf("[dry-run] would copy %s to %s", src, dest)
+		return nil
+	}
+	// Copy to a temporary name next to dest and rename it into place, so
+	// that dest is never left half-written and hard links to the previous
+	// file (see backupArtifacts) keep its contents.
+	tmp := dest + ".gokr-new"
+	if err := copyFile(tmp, src); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (a *actions) mkdirAll(dir string) error {
+	if a.dryRun {
+		log.Printf("[dry-run] would create directory %s", dir)
+		return nil
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// replaceDir replaces the directory dest with a copy of src. The copy is
+// made next to dest first, so that dest is only replaced (by two renames)
+// once the copy is complete.
+func (a *actions) replaceDir(dest, src string) error {
+	if a.dryRun {
+		log.Printf("[dry-run] would replace %s with %s", dest, src)
+		return nil
+	}
+	tmp := dest + ".gokr-new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := copyDir(tmp, src); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return a.rename(dest, tmp)
+}
+
+// rename replaces dest with src. A directory dest is moved aside first, as
+// renaming over it fails unless it is empty.
+func (a *actions) rename(dest, src string) error {
+	if a.dryRun {
+		log.Printf("[dry-run] would rename %s to %s", src, dest)
+		return nil
+	}
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return os.Rename(src, dest)
+	}
+	old := dest + ".gokr-old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dest, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		// Put the previous directory back.
+		os.Rename(old, dest)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func (a *actions) removeAll(path string) error {
+	if a.dryRun {
+		log.Printf("[dry-run] would remove %s", path)
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// stagingFS is a fileSystem which copies files and directories to a
+// temporary name next to their destination. commit renames all of them into
+// place, so that a failure while copying leaves the repository as it was
+// instead of with a mix of old and new artifacts.
+type stagingFS struct {
+	fs     fileSystem
+	staged []string // destinations, in the order they were staged
+}
+
+// stagedName is where stagingFS stages dest.
+func stagedName(dest string) string { return dest + ".gokr-staged" }
+
+func (s *stagingFS) stage(dest string) {
+	for _, d := range s.staged {
+		if d == dest {
+			return
+		}
+	}
+	s.staged = append(s.staged, dest)
+}
+
+func (s *stagingFS) copyFile(dest, src string) error {
+	if err := s.fs.copyFile(stagedName(dest), src); err != nil {
+		return err
+	}
+	s.stage(dest)
+	return nil
+}
+
+func (s *stagingFS) mkdirAll(dir string) error {
+	return s.fs.mkdirAll(dir)
+}
+
+func (s *stagingFS) replaceDir(dest, src string) error {
+	if err := s.fs.replaceDir(stagedName(dest), src); err != nil {
+		return err
+	}
+	s.stage(dest)
+	return nil
+}
+
+func (s *stagingFS) rename(dest, src string) error {
+	return s.fs.rename(dest, src)
+}
+
+func (s *stagingFS) removeAll(path string) error {
+	return s.fs.removeAll(path)
+}
+
+// commit renames the staged files and directories into place.
+func (s *stagingFS) commit() error {
+	for _, dest := range s.staged {
+		if err := s.fs.rename(dest, stagedName(dest)); err != nil {
+			return err
+		}
+	}
+	s.staged = nil
+	return nil
+}
+
+// abort removes the staged files and directories.
+func (s *stagingFS) abort() {
+	for _, dest := range s.staged {
+		if err := s.fs.removeAll(stagedName(dest)); err != nil {
+			log.Printf("removing %s: %v", stagedName(dest), err)
+		}
+	}
+	s.staged = nil
+}
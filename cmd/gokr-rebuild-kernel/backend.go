@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Backends of the container runtime, which differ in how they map user IDs
+// and share host directories with containers. The executable name alone
+// does not tell them apart: docker may be the podman-docker wrapper, or
+// talk to podman's docker-compatible API, Docker Desktop or colima.
+const (
+	backendMoby          = "moby"           // docker with a native dockerd
+	backendDockerDesktop = "Docker Desktop" // dockerd in a VM
+	backendColima        = "colima"         // dockerd in a Lima VM
+	backendPodman        = "podman"         // the podman CLI, also installed as docker
+	backendPodmanAPI     = "podman API"     // docker talking to podman's docker-compatible API
+	backendNerdctl       = "nerdctl"        // containerd
+)
+
+// detectBackend returns the backend of the container runtime executable,
+// from its version output and the server details of docker version.
+func detectBackend(executable string) string {
+	switch runtimeName(executable) {
+	case "podman":
+		return backendPodman
+	case "nerdctl":
+		return backendNerdctl
+	}
+	if out, err := exec.Command(executable, "--version").Output(); err == nil && strings.Contains(strings.ToLower(string(out)), "podman") {
+		return backendPodman // e.g. the podman-docker wrapper script
+	}
+	var server struct {
+		Platform struct {
+			Name string
+		}
+		Components []struct {
+			Name string
+		}
+	}
+	out, err := exec.Command(executable, "version", "--format", "{{json .Server}}").Output()
+	if err == nil {
+		json.Unmarshal(out, &server) // best effort, e.g. the server is down
+	}
+	for _, c := range server.Components {
+		if strings.Contains(c.Name, "Podman") {
+			return backendPodmanAPI
+		}
+	}
+	if strings.Contains(server.Platform.Name, "Docker Desktop") {
+		return backendDockerDesktop
+	}
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		out, _ := exec.Command(executable, "context", "inspect", "--format", "{{.Endpoints.docker.Host}}").Output()
+		host = string(out)
+	}
+	if strings.Contains(host, "colima") {
+		return backendColima
+	}
+	return backendMoby
+}
+
+// backendShares returns the host directories the VM of backend shares with
+// containers by default, or nil if containers run on the host (or the
+// shares are unknown).
+func backendShares(backend string) []string {
+	home, _ := os.UserHomeDir()
+	switch backend {
+	case backendDockerDesktop:
+		if runtime.GOOS == "darwin" {
+			return dockerDesktopShares
+		}
+		if runtime.GOOS == "linux" && home != "" {
+			return []string{home}
+		}
+	case backendColima:
+		if home != "" {
+			return []string{home, filepath.Join(os.TempDir(), "colima")}
+		}
+	}
+	return nil
+}
+
+// backendInVM reports whether backend runs containers in a VM, where the
+// SELinux policy of the host does not apply to volume mounts.
+func backendInVM(backend string) bool {
+	return backend == backendDockerDesktop || backend == backendColima
+}
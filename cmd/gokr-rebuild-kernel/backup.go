@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// backupDirName is the directory in the repository which keeps the
+// artifacts replaced by build, pull and rollback, in a directory per backup
+// named like uploads (build time and kernel release), so that they sort
+// chronologically.
+const backupDirName = ".gokr-backup"
+
+const keepBackupsUsage = "number of backups of the replaced artifacts to keep in " + backupDirName + " for gokr-rebuild-kernel rollback, or 0 to not back them up"
+
+func addKeepBackupsFlag(fset *flag.FlagSet) *int {
+	return fset.Int("keep_backups", 3, keepBackupsUsage)
+}
+
+// linkTree recreates the file or directory src at dest, hard linking files
+// where possible (the artifacts are replaced by renaming, so the links keep
+// the previous contents) and copying them otherwise.
+func linkTree(dest, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		default:
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			return copyRegular(target, path, info.Mode().Perm())
+		}
+	})
+}
+
+// listBackups returns the names of the backups in the repository directory
+// dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(dir, backupDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() && uploadNameRe.MatchString(fi.Name()) && !strings.HasSuffix(fi.Name(), ".partial") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// backupArtifacts backs up the artifacts in the repository directory dir
+// into a new directory in backupDirName, before they are replaced, and
+// removes all but the newest keep backups. It returns the backup directory,
+// or "" if nothing was backed up. keep <= 0 disables backups.
+func backupArtifacts(dir string, keep int, act *actions) (string, error) {
+	if keep <= 0 {
+		return "", nil
+	}
+	paths, err := presentArtifacts(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", nil
+	}
+	release := "unknown"
+	built := time.Now().UTC()
+	if bi, err := buildinfo.Read(filepath.Join(dir, buildinfo.FileName)); err == nil {
+		if bi.KernelRelease != "" {
+			release = bi.KernelRelease
+		}
+		if !bi.BuildTime.IsZero() {
+			built = bi.BuildTime.UTC()
+		}
+	}
+	name := built.Format("20060102T150405Z") + "-" + release
+	backup := filepath.Join(dir, backupDirName, name)
+	if act.dryRun {
+		log.Printf("[dry-run] would back up the artifacts to %s", backup)
+		return "", nil
+	}
+	if _, err := os.Stat(backup); err == nil {
+		// Already backed up, e.g. by a build which failed after it.
+		log.Printf("artifacts already backed up in %s", backup)
+	} else {
+		staging := backup + ".partial"
+		if err := os.RemoveAll(staging); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(staging, 0755); err != nil {
+			return "", err
+		}
+		for _, path := range paths {
+			if err := linkTree(filepath.Join(staging, path), filepath.Join(dir, path)); err != nil {
+				return "", err
+			}
+		}
+		if err := os.Rename(staging, backup); err != nil {
+			return "", err
+		}
+		log.Printf("backed up the artifacts to %s", backup)
+	}
+	names, err := listBackups(dir)
+	if err != nil {
+		return "", err
+	}
+	for len(names) > keep {
+		log.Printf("removing old backup %s (keeping the newest %d)", names[0], keep)
+		if err := os.RemoveAll(filepath.Join(dir, backupDirName, names[0])); err != nil {
+			return "", err
+		}
+		names = names[1:]
+	}
+	return backup, nil
+}
+
+// restoreArtifacts replaces the artifacts in the repository directory dir
+// with those of the backup directory backup, removing artifacts which the
+// backup does not contain (e.g. the DTB of a board added since).
+func restoreArtifacts(dir, backup string, act *actions) error {
+	current, err := presentArtifacts(dir)
+	if err != nil {
+		return err
+	}
+	restored, err := presentArtifacts(backup)
+	if err != nil {
+		return err
+	}
+	inBackup := make(map[string]bool)
+	for _, path := range restored {
+		inBackup[path] = true
+		src := filepath.Join(backup, path)
+		st, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if st.IsDir() {
+			err = act.replaceDir(filepath.Join(dir, path), src)
+		} else {
+			err = act.copyFile(filepath.Join(dir, path), src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range current {
+		if inBackup[path] {
+			continue
+		}
+		if act.dryRun {
+			log.Printf("[dry-run] would remove %s", filepath.Join(dir, path))
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAfterFailure restores the artifacts of backup (as returned by
+// backupArtifacts) after replacing them failed with err partway.
+func restoreAfterFailure(dir, backup string, act *actions, err error) error {
+	if backup == "" {
+		return fmt.Errorf("%v (no backup to restore, the artifacts in %s may be incomplete)", err, dir)
+	}
+	log.Printf("replacing the artifacts failed, restoring %s: %v", backup, err)
+	if rerr := restoreArtifacts(dir, backup, act); rerr != nil {
+		return fmt.Errorf("%v (restoring %s failed too: %v, see gokr-rebuild-kernel rollback)", err, backup, rerr)
+	}
+	return fmt.Errorf("%v (restored the previous artifacts from %s)", err, backup)
+}
+
+// rollback restores the artifacts of a backup made before a build or pull
+// replaced them.
+func rollback(args []string) error {
+	fset := flag.NewFlagSet("rollback", flag.ExitOnError)
+	var list = fset.Bool("list",
+		false,
+		"list the backups, newest last, instead of restoring one")
+	var to = fset.String("to",
+		"",
+		"name of the backup to restore (see -list). Defaults to the newest")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the files which would be replaced, without replacing them")
+	keepBackups := addKeepBackupsFlag(fset)
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kernelPath)
+	names, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	if *list {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no backups in %s", filepath.Join(dir, backupDirName))
+	}
+	name := names[len(names)-1]
+	if *to != "" {
+		name = ""
+		for _, n := range names {
+			if n == *to {
+				name = n
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("no backup %q in %s (see -list)", *to, filepath.Join(dir, backupDirName))
+		}
+	}
+	// Move the backup out of the way before backing up the current
+	// artifacts, which could otherwise replace it if they are the same
+	// build, or remove it as the oldest.
+	act := &actions{dryRun: *dryRun}
+	backup := filepath.Join(dir, backupDirName, name)
+	if *dryRun {
+		return restoreArtifacts(dir, backup, act)
+	}
+	restoring := filepath.Join(dir, backupDirName, "restoring-"+name)
+	if err := os.Rename(backup, restoring); err != nil {
+		return err
+	}
+	if _, err := backupArtifacts(dir, *keepBackups, act); err != nil {
+		os.Rename(restoring, backup)
+		return err
+	}
+	if err := restoreArtifacts(dir, restoring, act); err != nil {
+		os.Rename(restoring, backup)
+		return err
+	}
+	if err := os.RemoveAll(restoring); err != nil {
+		return err
+	}
+	log.Printf("restored the artifacts of %s", name)
+	if bi, err := buildinfo.Read(filepath.Join(dir, buildinfo.FileName)); err == nil && bi.KernelVersion != kernelversion.Version() {
+		log.Printf("warning: the restored artifacts are of kernel %s, but kernel.lock pins %s; run gokr-rebuild-kernel bump -version=%s before the next build", bi.KernelVersion, kernelversion.Version(), bi.KernelVersion)
+	}
+	return nil
+}
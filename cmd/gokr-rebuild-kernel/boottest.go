@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// bootFailures are console output which fails a boot test.
+var bootFailures = []string{"Kernel panic", "Internal error: Oops", "BUG: ", "WARNING: CPU: ", "gokr-kselftest: FAIL"}
+
+// qemuArgs returns the arguments for booting kernel in the QEMU virt
+// machine, with image (a gokrazy disk image) as virtio disk if non-empty.
+func qemuArgs(kernel, image, cmdline string) []string {
+	args := []string{
+		"-M", "virt",
+		"-cpu", "cortex-a72",
+		"-smp", "2",
+		"-m", "1G",
+		"-nographic",
+		"-no-reboot",
+		"-kernel", kernel,
+		"-append", cmdline,
+		"-device", "virtio-rng-pci",
+		"-device", "i6300esb",
+		"-netdev", "user,id=net0",
+		"-device", "virtio-net-pci,netdev=net0",
+	}
+	if image != "" {
+		args = append(args,
+			"-drive", "file="+image+",format=raw,if=none,id=disk0",
+			"-device", "virtio-blk-pci,drive=disk0")
+	}
+	return args
+}
+
+// watchConsole reads the console output from r until a line contains
+// expect (success) or one of bootFailures (failure), or r ends. The output
+// is copied to log.
+func watchConsole(r io.Reader, expect string, out io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(out, line)
+		if strings.Contains(line, expect) {
+			return nil
+		}
+		for _, failure := range bootFailures {
+			if strings.Contains(line, failure) {
+				return fmt.Errorf("console: %s", strings.TrimSpace(line))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("QEMU exited before printing %q", expect)
+}
+
+var (
+	benchRe = regexp.MustCompile(`gokr-kernel-smoketest: bench (\S+) (\S+) (\S+)`)
+	// initRe matches the kernel starting init, with the printk timestamp.
+	initRe = regexp.MustCompile(`^\[\s*(\d+\.\d+)\] Run \S+ as init process`)
+)
+
+// bootToUserspace returns the time until the kernel started init according
+// to the console output, or 0 if it did not.
+func bootToUserspace(console string) time.Duration {
+	for _, line := range strings.Split(console, "\n") {
+		if m := initRe.FindStringSubmatch(strings.TrimRight(line, "\r")); m != nil {
+			secs, _ := strconv.ParseFloat(m[1], 64)
+			return time.Duration(secs * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// parseBenchmarks returns the benchmark results in the console output: the
+// time until the kernel starts init (boot_to_userspace) and the results
+// printed by gokr-kernel-smoketest.
+func parseBenchmarks(console string) []buildinfo.Benchmark {
+	var results []buildinfo.Benchmark
+	if d := bootToUserspace(console); d > 0 {
+		results = append(results, buildinfo.Benchmark{Name: "boot_to_userspace", Value: float64(d.Milliseconds()), Unit: "ms"})
+	}
+	for _, line := range strings.Split(console, "\n") {
+		m := benchRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		results = append(results, buildinfo.Benchmark{Name: m[1], Value: value, Unit: m[3]})
+	}
+	return results
+}
+
+// benchSink accepts TCP connections on ln and discards what it receives,
+// for gokr-kernel-smoketest to measure the network throughput.
+func benchSink(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}()
+	}
+}
+
+// recordBenchmarks logs the results next to those of the previous run (e.g.
+// before a kernel bump) and records them in the build-info.json next to
+// kernelPath.
+func recordBenchmarks(kernelPath string, results []buildinfo.Benchmark) error {
+	path := filepath.Join(filepath.Dir(kernelPath), buildinfo.FileName)
+	bi, err := buildinfo.Read(path)
+	if err != nil {
+		return err
+	}
+	previous := make(map[string]buildinfo.Benchmark)
+	for _, b := range bi.Benchmarks {
+		previous[b.Name] = b
+	}
+	for _, b := range results {
+		if prev, ok := previous[b.Name]; ok && prev.Unit == b.Unit && prev.Value != 0 {
+			log.Printf("bench %s: %g %s (previously %g %s, %+.1f%%)", b.Name, b.Value, b.Unit, prev.Value, prev.Unit, (b.Value-prev.Value)/prev.Value*100)
+		} else {
+			log.Printf("bench %s: %g %s", b.Name, b.Value, b.Unit)
+		}
+	}
+	bi.Benchmarks = results
+	return bi.Write(path)
+}
+
+// bootTest boots the kernel in QEMU and watches its console output.
+func bootTest(args []string) error {
+	fset := flag.NewFlagSet("boot-test", flag.ExitOnError)
+	var image = fset.String("image",
+		"",
+		"if non-empty, gokrazy disk image (e.g. from gok overwrite --full) to boot from a virtio disk")
+	var expect = fset.String("expect",
+		"",
+		"console output which passes the test (default: gokr-kernel-smoketest: PASS with -image, or the kernel reaching the root file system mount without)")
+	var appendParams = fset.String("append",
+		"",
+		"kernel command line parameters to append")
+	var timeout = fset.Duration("timeout",
+		5*time.Minute,
+		"time after which the test fails")
+	var qemu = fset.String("qemu",
+		"qemu-system-aarch64",
+		"QEMU executable for arm64")
+	var bench = fset.Bool("bench",
+		false,
+		"run the benchmarks of gokr-kernel-smoketest (requires -image) and record the results in build-info.json")
+	var initcallDebug = fset.Bool("initcall_debug",
+		false,
+		"boot with initcall_debug and write a report of the slowest initcalls to "+initcallReport+" next to vmlinuz")
+	var initcallTop = fset.Int("initcall_top",
+		20,
+		"number of slowest initcalls to list with -initcall_debug")
+	var serial = fset.String("serial",
+		"",
+		"if non-empty, serial console device (e.g. /dev/ttyUSB0) of a device booting the kernel to watch instead of booting it in QEMU")
+	var baud = fset.Int("baud",
+		115200,
+		"baud rate of -serial")
+	var selftests = fset.Bool("selftests",
+		false,
+		"run the kernel selftests which build -selftests installed into kselftest/ next to vmlinuz: boot an initramfs containing them and gokr-kselftest (built for arm64 with the go tool) as init, and wait for gokr-kselftest: PASS. Consider raising -timeout, as the tests take a while")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	if *serial != "" && (*image != "" || *bench) {
+		return fmt.Errorf("-serial cannot be combined with -image or -bench")
+	}
+	if *selftests && (*image != "" || *serial != "" || *bench) {
+		return fmt.Errorf("-selftests cannot be combined with -image, -serial or -bench")
+	}
+	cfg, cfgErr := kconfig.FromImage(kernelPath)
+	if *serial == "" && cfgErr == nil && !cfg.Enabled("CONFIG_VIRTIO_PCI") {
+		log.Printf("warning: %s lacks virtio drivers, build it with -boards=qemu-virt (or e.g. -boards=rpi4b,qemu-virt)", kernelPath)
+	}
+	var initrd string
+	if *selftests {
+		if cfgErr == nil && !cfg.Enabled("CONFIG_BLK_DEV_INITRD") {
+			return fmt.Errorf("-selftests: %s was built without initramfs support (CONFIG_BLK_DEV_INITRD)", kernelPath)
+		}
+		tmp, err := ioutil.TempDir("", "gokr-rebuild-kernel-selftests")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if initrd, err = selftestInitramfs(tmp, filepath.Join(filepath.Dir(kernelPath), "kselftest")); err != nil {
+			return fmt.Errorf("-selftests: %v", err)
+		}
+		if *expect == "" {
+			*expect = "gokr-kselftest: PASS"
+		}
+	}
+	cmdline := "console=ttyAMA0 panic=-1"
+	if *image != "" {
+		// gokrazy images contain the root file system in the second
+		// partition.
+		cmdline += " root=/dev/vda2 rootfstype=squashfs rootwait init=/gokrazy/init"
+		if *expect == "" {
+			*expect = "gokr-kernel-smoketest: PASS"
+		}
+	} else if *serial != "" && *expect == "" {
+		*expect = "gokr-kernel-smoketest: PASS"
+	} else if *expect == "" {
+		// Without root file system, the kernel panics after initializing
+		// all drivers, which is as far as it can get.
+		*expect = "VFS: Unable to mount root fs"
+	}
+	if *bench {
+		if *image == "" {
+			return fmt.Errorf("-bench requires -image")
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		go benchSink(ln)
+		// QEMU user networking makes the host reachable as 10.0.2.2.
+		cmdline += fmt.Sprintf(" gokr_bench=10.0.2.2:%d", ln.Addr().(*net.TCPAddr).Port)
+	}
+	if *initcallDebug {
+		cmdline += " " + initcallParams
+	}
+	if *appendParams != "" {
+		cmdline += " " + *appendParams
+	}
+
+	var (
+		stdout io.Reader
+		stop   func()
+		stderr = &tailBuffer{max: 1 << 20}
+	)
+	if *serial != "" {
+		stty := exec.Command("stty", "-F", *serial, strconv.Itoa(*baud), "raw", "-echo")
+		if err := runCommand(stty); err != nil {
+			return err
+		}
+		f, err := os.Open(*serial)
+		if err != nil {
+			return err
+		}
+		stdout = f
+		stop = func() { f.Close() }
+		msg := "watching " + *serial + ", boot the device now"
+		if *initcallDebug {
+			msg += " (with " + initcallParams + " in its kernel command line, e.g. cmdline.txt)"
+		}
+		log.Print(msg)
+	} else {
+		qargs := qemuArgs(kernelPath, *image, cmdline)
+		if initrd != "" {
+			qargs = append(qargs, "-initrd", initrd)
+		}
+		cmd := exec.Command(*qemu, qargs...)
+		if verbosity >= 1 {
+			log.Printf("running %s", shellQuote(cmd.Args))
+		}
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("%s: %v", *qemu, err)
+		}
+		stdout = pipe
+		stop = func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	// initcall_debug prints a few lines for every initcall.
+	tail := &tailBuffer{max: 4 << 20}
+	console := io.Writer(tail)
+	if verbosity >= 2 {
+		console = io.MultiWriter(tail, logWriter{})
+	}
+	result := make(chan error, 1)
+	go func() { result <- watchConsole(stdout, *expect, console) }()
+	timer := time.NewTimer(*timeout)
+	defer timer.Stop()
+	select {
+	case err = <-result:
+		stop()
+	case <-timer.C:
+		stop()
+		<-result // wait for the console output to be consumed
+		err = fmt.Errorf("timeout after %v waiting for %q", *timeout, *expect)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.lastLines(10)); msg != "" {
+			err = fmt.Errorf("%v (QEMU: %s)", err, msg)
+		}
+		return fmt.Errorf("%v, last lines of console output:\n%s", err, tail.lastLines(50))
+	}
+	log.Printf("boot test passed: console printed %q", *expect)
+	if *initcallDebug {
+		calls := parseInitcalls(string(tail.buf))
+		if len(calls) == 0 {
+			return fmt.Errorf("-initcall_debug: no initcall timings in the console output")
+		}
+		report := formatInitcallReport(calls, bootToUserspace(string(tail.buf)), *initcallTop)
+		log.Printf("%s", strings.TrimSpace(report))
+		path := filepath.Join(filepath.Dir(kernelPath), initcallReport)
+		if err := ioutil.WriteFile(path, []byte(report), 0644); err != nil {
+			return err
+		}
+	}
+	if *bench {
+		results := parseBenchmarks(string(tail.buf))
+		if len(results) == 0 {
+			return fmt.Errorf("-bench: no benchmark results in the console output (is gokr-kernel-smoketest in the image?)")
+		}
+		return recordBenchmarks(kernelPath, results)
+	}
+	return nil
+}
+
+// selftestInitramfs builds gokr-kselftest for arm64 and writes an
+// initramfs running it on the kselftest directory at kselftestDir into dir.
+// It returns the path of the initramfs.
+func selftestInitramfs(dir, kselftestDir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(kselftestDir, "kselftest-list.txt")); err != nil {
+		return "", fmt.Errorf("%v (build the kernel with -selftests)", err)
+	}
+	init := filepath.Join(dir, "gokr-kselftest")
+	goBuild := exec.Command("go", "build", "-o", init, "github.com/alf632/gokrazy-kernel/cmd/gokr-kselftest")
+	goBuild.Dir = goBuildDir()
+	goBuild.Env = append(os.Environ(), "GOOS=linux", "GOARCH=arm64", "CGO_ENABLED=0")
+	if err := runCommand(goBuild); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "initramfs.cpio")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := writeSelftestInitramfs(f, init, kselftestDir); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// logWriter writes to the log.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
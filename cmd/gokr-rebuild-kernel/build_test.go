@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStartPaths(t *testing.T) {
+	abs := filepath.Join(startDir, "abs")
+	opts := buildOptions{
+		workdir:             "work",
+		resume:              "work/gokr-rebuild-kernel123",
+		ccacheDir:           abs,
+		wirelessFirmwareDir: "../wifi",
+		symbolsDir:          "none",
+	}
+	opts.startPaths()
+	for _, tt := range []struct {
+		flag, got, want string
+	}{
+		{"workdir", opts.workdir, filepath.Join(startDir, "work")},
+		{"resume", opts.resume, filepath.Join(startDir, "work", "gokr-rebuild-kernel123")},
+		{"ccache_dir", opts.ccacheDir, abs},
+		{"source_cache_dir", opts.sourceCacheDir, ""},
+		{"wireless_firmware_dir", opts.wirelessFirmwareDir, filepath.Join(filepath.Dir(startDir), "wifi")},
+		{"symbols_dir", opts.symbolsDir, "none"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("-%s = %q, want %q", tt.flag, tt.got, tt.want)
+		}
+	}
+}
+
+func TestResolveDefconfig(t *testing.T) {
+	// Like -output_dir, change the working directory away from the package
+	// directory (startDir), which contains build.go.
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(startDir)
+
+	for _, tt := range []struct {
+		defconfig string
+		want      string
+		wantPath  string
+		wantErr   bool
+	}{
+		{defconfig: "build.go", want: "/usr/src/defconfig", wantPath: filepath.Join(startDir, "build.go")},
+		{defconfig: "bcm2711_defconfig", want: "bcm2711_defconfig"},
+		{defconfig: "missing/my.config", wantErr: true},
+	} {
+		b := &kernelBuild{}
+		got, err := b.resolveDefconfig(tt.defconfig)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("resolveDefconfig(%q): err = %v, want error: %v", tt.defconfig, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want || b.defconfigPath != tt.wantPath {
+			t.Errorf("resolveDefconfig(%q) = %q (file %q), want %q (file %q)", tt.defconfig, got, b.defconfigPath, tt.want, tt.wantPath)
+		}
+	}
+}
+
+func TestPreBuildHookRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hook := filepath.Join(dir, "fix.sh")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(startDir, hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like -output_dir, change the working directory away from startDir,
+	// which the relative path refers to.
+	if err := os.Chdir(filepath.Dir(startDir)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(startDir)
+
+	hooks := splitHooks(rel + ",sh")
+	if len(hooks) != 2 || hooks[1] != "sh" {
+		t.Fatalf("splitHooks = %q, want [%s sh]", hooks, hook)
+	}
+	path, err := exec.LookPath(hooks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != hook {
+		t.Errorf("LookPath(%q) = %q, want %q", hooks[0], path, hook)
+	}
+}
+
+func TestResolveRefusesDryRunResume(t *testing.T) {
+	b := &kernelBuild{opts: buildOptions{dryRun: true, resume: "gokr-rebuild-kernel123"}}
+	if err := b.resolve(); err == nil || !strings.Contains(err.Error(), "-resume") {
+		t.Errorf("resolve: err = %v, want an error about -resume", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Values of -buildkit.
+const (
+	buildkitAuto = "auto"
+	buildkitOn   = "on"
+	buildkitOff  = "off"
+)
+
+// aptSecretID is the id of the -apt_secret build secret, as mounted in the
+// Dockerfile.
+const aptSecretID = "apt"
+
+// hasBuildKit reports whether executable builds images with a builder which
+// supports RUN --mount in Dockerfiles: BuildKit for docker (which the buildx
+// plugin ships with) and nerdctl, buildah for podman 4 and newer.
+func hasBuildKit(executable string) bool {
+	switch runtimeName(executable) {
+	case "docker":
+		return containerCommand(executable, "buildx", "version").Run() == nil
+	case "nerdctl":
+		return true // nerdctl build always uses BuildKit
+	case "podman":
+		out, err := exec.Command(executable, "version", "--format", "{{.Client.Version}}").Output()
+		if err != nil {
+			return false
+		}
+		major, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(string(out)), ".", 2)[0])
+		return err == nil && major >= 4
+	}
+	return false
+}
+
+// useBuildKit returns whether to use BuildKit features for -buildkit=mode.
+func useBuildKit(mode, executable string) (bool, error) {
+	switch mode {
+	case buildkitOn:
+		return true, nil
+	case buildkitOff:
+		return false, nil
+	case buildkitAuto:
+		return hasBuildKit(executable), nil
+	}
+	return false, fmt.Errorf("-buildkit: unknown mode %q, expected %s, %s or %s", mode, buildkitAuto, buildkitOn, buildkitOff)
+}
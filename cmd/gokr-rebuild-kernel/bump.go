@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// bump updates kernel.lock (and the kernelversion package generated from it)
+// to a new kernel version, recording the hashes of the kernel source tarball
+// and the patches. Run build afterwards to build the new version.
+func bump(args []string) error {
+	fset := flag.NewFlagSet("bump", flag.ExitOnError)
+	var version = fset.String("version",
+		"",
+		"kernel version to bump to, e.g. 6.5.9")
+	var verify = fset.Bool("verify",
+		true,
+		"verify that the kernel source tarball exists on kernel.org and record its SHA-256 hash (published by kernel.org) in kernel.lock")
+	var dropApplied = fset.Bool("drop_applied",
+		true,
+		"download the new kernel source and drop the patches which it already contains (because they are already applied), keeping the patch stack minimal. Patches whose upstream status in kernel.lock is merged in the new version or older are dropped regardless")
+	var interactive = fset.Bool("interactive",
+		false,
+		"with -drop_applied, when a patch does not apply to the new kernel source, start a shell in the source tree to resolve the rejected hunks, then refresh the patch file from the result")
+	var firmware = fset.String("firmware",
+		"",
+		"release (git tag, e.g. 1.20230405) of the Raspberry Pi firmware to pin for build -firmware, recording the hashes of its files, or none to unpin it (default: keep the pinned release). Without -version, only the firmware is bumped")
+	var gitRef = fset.String("git_ref",
+		"",
+		"if non-empty, tag or branch (e.g. v6.6-rc5) of -git_repo to build the kernel source from, instead of the kernel.org tarball of -version (e.g. for release candidates, which have no tarball). Only the ref is fetched, without history")
+	var gitRepo = fset.String("git_repo",
+		torvaldsRepo,
+		"git repository of -git_ref")
+	var pinCommit = fset.Bool("pin_commit",
+		true,
+		"with -git_ref, record the commit it currently resolves to in kernel.lock, so that builds fail if the ref moves, instead of building different sources")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *version == "" && *firmware == "" {
+		return fmt.Errorf("-version or -firmware is required")
+	}
+	fw := kernelversion.PinnedFirmware()
+	switch *firmware {
+	case "":
+	case "none":
+		fw = nil
+	default:
+		var err error
+		if fw, err = firmwareRelease(context.Background(), *firmware); err != nil {
+			return err
+		}
+	}
+	if *version == "" {
+		lock := kernelversion.Lock{
+			Version:  kernelversion.Version(),
+			URL:      kernelversion.URL(),
+			SHA256:   kernelversion.SHA256(),
+			Patches:  kernelversion.Patches(),
+			Firmware: fw,
+			Git:      kernelversion.GitSource(),
+		}
+		if err := writeLock(lock); err != nil {
+			return err
+		}
+		log.Printf("updated the firmware in kernel.lock to %s", *firmware)
+		return nil
+	}
+	url, err := kernelversion.TarballURL(*version)
+	if err != nil {
+		return err
+	}
+	lock := kernelversion.Lock{
+		Version:  *version,
+		URL:      url,
+		Firmware: fw,
+	}
+	if *gitRef != "" {
+		lock.Git = &kernelversion.Git{Repo: *gitRepo, Ref: *gitRef}
+		if *pinCommit {
+			if lock.Git.Commit, err = resolveGitRef(*gitRepo, *gitRef); err != nil {
+				return err
+			}
+			log.Printf("pinning %s to commit %s", *gitRef, lock.Git.Commit)
+		}
+		// The tarball is not used, so there is nothing to verify, and the
+		// patches are checked by the first build.
+		*verify, *dropApplied = false, false
+	}
+	if *verify {
+		resp, err := http.Head(url)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %v", url, err)
+		}
+		resp.Body.Close()
+		logResponse(resp)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			return fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+		}
+		if lock.SHA256, err = tarballHash(url); err != nil {
+			return err
+		}
+	}
+	// Plan which patches to drop and run all checks first, so that a failed
+	// check leaves the patches and kernel.lock as they are.
+	var patches []kernelversion.Patch
+	var drop []string
+	for _, p := range kernelversion.Patches() {
+		if merged := p.MergedIn(); merged != "" && kernelversion.AtLeast(*version, merged) {
+			log.Printf("dropping %s: merged upstream in %s", p.Name, merged)
+			drop = append(drop, p.Name)
+			continue
+		}
+		patches = append(patches, p)
+	}
+	if *dropApplied {
+		applied, err := appliedPatches(url, lock.SHA256, patches, *interactive)
+		if err != nil {
+			return err
+		}
+		var keep []kernelversion.Patch
+		for _, p := range patches {
+			if !applied[p.Name] {
+				keep = append(keep, p)
+				continue
+			}
+			log.Printf("dropping %s: already applied in %s", p.Name, *version)
+			drop = append(drop, p.Name)
+		}
+		patches = keep
+	}
+	// Hash the patches only now, as -interactive might have refreshed them.
+	for idx, p := range patches {
+		path, err := find(p.Name)
+		if err != nil {
+			return err
+		}
+		if patches[idx].SHA256, err = fileHash(path); err != nil {
+			return err
+		}
+	}
+	lock.Patches = patches
+	if err := writeLock(lock); err != nil {
+		return err
+	}
+	// kernel.lock no longer references the dropped patches, so a failure
+	// to remove one only leaves an unused file behind.
+	for _, name := range drop {
+		if err := removePatch(name); err != nil {
+			return err
+		}
+	}
+	if lock.Git != nil {
+		log.Printf("updated kernel.lock to %s %s of %s", *version, lock.Git.Ref, lock.Git.Repo)
+		return nil
+	}
+	log.Printf("updated kernel.lock to %s", url)
+	return nil
+}
+
+// torvaldsRepo is the mainline kernel repository, the default of -git_repo.
+const torvaldsRepo = "https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git"
+
+// resolveGitRef returns the commit which ref (a tag or branch) of repo
+// currently resolves to, without cloning repo.
+func resolveGitRef(repo, ref string) (string, error) {
+	lsRemote := exec.Command("git", "ls-remote", repo, ref, ref+"^{}")
+	lsRemote.Stderr = os.Stderr
+	out, err := lsRemote.Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote %s: %v", repo, err)
+	}
+	var commit string
+	var refs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.HasSuffix(fields[1], "^{}") {
+			// The commit an annotated tag points to.
+			return fields[0], nil
+		}
+		commit = fields[0]
+		refs = append(refs, fields[1])
+	}
+	switch len(refs) {
+	case 0:
+		return "", fmt.Errorf("%s not found in %s", ref, repo)
+	case 1:
+		return commit, nil
+	}
+	return "", fmt.Errorf("%s is ambiguous in %s: %s", ref, repo, strings.Join(refs, ", "))
+}
+
+// removePatch removes the patch file name from the repository.
+func removePatch(name string) error {
+	path, err := find(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// appliedPatches downloads the kernel source tarball at url (verifying its
+// hash against want, unless empty) and tries the patches on it in the
+// order in which gokr-build-kernel applies them. It returns the names of
+// the patches which are already applied, i.e. which apply in reverse.
+// Patches which only apply with fuzz are reported, patches which do not
+// apply at all fail with an error, as they need to be rebased, unless
+// interactive is true, in which case they are resolved by the user (see
+// resolvePatch).
+func appliedPatches(url, want string, patches []kernelversion.Patch, interactive bool) (map[string]bool, error) {
+	tmp, err := ioutil.TempDir("", "gokr-rebuild-kernel-bump")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	log.Printf("downloading %s to check the patches against it", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	logResponse(resp)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	tarball := filepath.Join(tmp, path.Base(url))
+	f, err := os.Create(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if want != "" {
+		got, err := fileHash(tarball)
+		if err != nil {
+			return nil, err
+		}
+		if got != want {
+			return nil, fmt.Errorf("%s: SHA-256 hash mismatch: got %s, want %s", url, got, want)
+		}
+	}
+	srcdir := filepath.Join(tmp, "src")
+	if err := os.Mkdir(srcdir, 0755); err != nil {
+		return nil, err
+	}
+	untar := exec.Command("tar", "xf", tarball, "-C", srcdir, "--strip-components=1")
+	untar.Stderr = os.Stderr
+	if err := untar.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %v", untar.Args, err)
+	}
+
+	if interactive {
+		// Track the tree in git, so that the refreshed patches can be
+		// generated by git diff.
+		if err := treeGit(srcdir, "init", "-q"); err != nil {
+			return nil, err
+		}
+		if err := commitTree(srcdir, "linux-"+strings.TrimSuffix(path.Base(url), ".tar.xz")); err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := append([]kernelversion.Patch(nil), patches...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	applied := make(map[string]bool)
+	for _, p := range sorted {
+		file, err := find(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := runPatch(srcdir, file, "--dry-run", "--reverse"); err == nil {
+			applied[p.Name] = true
+			continue
+		}
+		out, err := runPatchOutput(srcdir, file, "--forward")
+		if err != nil {
+			if !interactive {
+				return nil, fmt.Errorf("%s does not apply to %s, rebase it (or mark it merged in kernel.lock, or use -interactive): %v\n%s", p.Name, path.Base(url), err, out)
+			}
+			if err := resolvePatch(srcdir, file, out); err != nil {
+				return nil, fmt.Errorf("%s: %v", p.Name, err)
+			}
+		} else if strings.Contains(out, "with fuzz") {
+			log.Printf("warning: %s only applies with fuzz, consider rebasing it:\n%s", p.Name, out)
+		}
+		if interactive {
+			if err := commitTree(srcdir, p.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return applied, nil
+}
+
+// treeGit runs git with args in the kernel source tree dir.
+func treeGit(dir string, args ...string) error {
+	cmd := exec.Command("git", append([]string{
+		"-c", "user.name=gokr-rebuild-kernel",
+		"-c", "user.email=gokr-rebuild-kernel@localhost",
+	}, args...)...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// commitTree commits all files of the kernel source tree dir.
+func commitTree(dir, msg string) error {
+	if err := treeGit(dir, "add", "-A"); err != nil {
+		return err
+	}
+	return treeGit(dir, "commit", "-q", "--allow-empty", "--no-verify", "-m", msg)
+}
+
+// resolvePatch starts a shell in the kernel source tree dir, to which the
+// patch file was partially applied (with output out), for the user to
+// resolve the rejected hunks. Once the shell exits successfully, the patch
+// file is refreshed with the changes to the tree, keeping its header (e.g.
+// the commit message).
+func resolvePatch(dir, file, out string) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	log.Printf("%s does not apply cleanly:\n%s", filepath.Base(file), out)
+	log.Printf("starting %s in %s: apply the rejected hunks (*.rej) by hand, remove the *.rej files and exit the shell. Exit with a non-zero status to abort the bump", shell, dir)
+	cmd := exec.Command(shell)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("aborted: %v", err)
+	}
+	var rejects []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		switch filepath.Ext(path) {
+		case ".rej":
+			rel, _ := filepath.Rel(dir, path)
+			rejects = append(rejects, rel)
+		case ".orig":
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(rejects) > 0 {
+		return fmt.Errorf("unresolved rejects remain: %v", rejects)
+	}
+	if err := treeGit(dir, "add", "-A"); err != nil {
+		return err
+	}
+	diff := exec.Command("git", "diff", "--cached", "--no-color", "--no-ext-diff", "HEAD")
+	diff.Dir = dir
+	diff.Stderr = os.Stderr
+	body, err := diff.Output()
+	if err != nil {
+		return fmt.Errorf("git diff: %v", err)
+	}
+	if len(body) == 0 {
+		return fmt.Errorf("no changes, drop the patch instead")
+	}
+	old, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, append(patchHeader(old), body...), 0644); err != nil {
+		return err
+	}
+	log.Printf("refreshed %s", file)
+	return nil
+}
+
+// patchHeader returns the part of the patch content b before the first
+// diff, e.g. the mail headers and commit message of git format-patch (up to
+// its --- separator).
+func patchHeader(b []byte) []byte {
+	lines := strings.SplitAfter(string(b), "\n")
+	for idx, line := range lines {
+		if line == "---\n" {
+			// The diffstat following the separator is outdated.
+			return []byte(strings.Join(lines[:idx+1], ""))
+		}
+		if strings.HasPrefix(line, "diff ") || strings.HasPrefix(line, "--- ") && idx+1 < len(lines) && strings.HasPrefix(lines[idx+1], "+++ ") {
+			return []byte(strings.Join(lines[:idx], ""))
+		}
+	}
+	return nil
+}
+
+// runPatch applies the patch file to the tree in dir with patch -p1 and the
+// additional args.
+func runPatch(dir, patch string, args ...string) error {
+	_, err := runPatchOutput(dir, patch, args...)
+	return err
+}
+
+// runPatchOutput is like runPatch, but returns the output of patch.
+func runPatchOutput(dir, patch string, args ...string) (string, error) {
+	f, err := os.Open(patch)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cmd := exec.Command("patch", append([]string{"-p1", "--force"}, args...)...)
+	cmd.Dir = dir
+	cmd.Stdin = f
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// tarballHash returns the SHA-256 hash of the kernel source tarball at url,
+// as published by kernel.org in sha256sums.asc next to it.
+func tarballHash(url string) (string, error) {
+	sumsURL := url[:strings.LastIndex(url, "/")] + "/sha256sums.asc"
+	resp, err := http.Get(sumsURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	logResponse(resp)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", sumsURL, got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	base := path.Base(url)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == base {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("%s: no hash found for %s", sumsURL, base)
+}
+
+func fileHash(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// writeLock writes kernel.lock and the kernelversion package generated from
+// it.
+func writeLock(lock kernelversion.Lock) error {
+	lockPath, err := find("kernel.lock")
+	if err != nil {
+		return err
+	}
+	b, err := lock.Marshal()
+	if err != nil {
+		return err
+	}
+	src, err := lock.Source()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(lockPath, b, 0644); err != nil {
+		return err
+	}
+	if _, err := os.Stat(lockPath + lockSignatureSuffix); err == nil {
+		log.Printf("warning: %s%s no longer matches, sign kernel.lock again with gokr-rebuild-kernel sign", lockPath, lockSignatureSuffix)
+	}
+	return ioutil.WriteFile(filepath.Join(filepath.Dir(lockPath), "kernelversion", "lock.go"), src, 0644)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+)
+
+// check verifies the config embedded in a kernel image (e.g. the committed
+// vmlinuz) against gokrazy's requirements, the requirements of the specified
+// profiles and the enabled assertions, without building.
+func check(args []string) error {
+	fset := flag.NewFlagSet("check", flag.ExitOnError)
+	var cfg = addConfigFlags(fset)
+	var image = fset.String("image",
+		"",
+		"path to the kernel image to check (default: the committed vmlinuz)")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *image == "" {
+		path, err := find("vmlinuz")
+		if err != nil {
+			return err
+		}
+		*image = path
+	}
+	abs, err := filepath.Abs(*image)
+	if err != nil {
+		return err
+	}
+	if err := runHostBuilder(context.Background(), "", append(cfg.buildArgs(), "-check_image="+abs)...); err != nil {
+		return fmt.Errorf("checking %s: %v", abs, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// paramName returns the name of a kernel command line parameter, i.e. the
+// part before the first equals sign.
+func paramName(param string) string {
+	if idx := strings.IndexByte(param, '='); idx > -1 {
+		return param[:idx]
+	}
+	return param
+}
+
+// updateCmdline sets params in the cmdline.txt file at path, replacing
+// existing parameters of the same name. It returns the parameters which
+// were added or changed.
+func updateCmdline(path string, params []string) ([]string, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	var changed []string
+	for _, param := range params {
+		found := false
+		for idx, field := range fields {
+			if paramName(field) != paramName(param) {
+				continue
+			}
+			found = true
+			if field != param {
+				fields[idx] = param
+				changed = append(changed, param)
+			}
+		}
+		if !found {
+			fields = append(fields, param)
+			changed = append(changed, param)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(fields, " ")+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/board"
+	"github.com/alf632/gokrazy-kernel/capability"
+	"github.com/alf632/gokrazy-kernel/profile"
+)
+
+// command is a gokr-rebuild-kernel subcommand.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{"build", "build a new kernel in a container and replace the committed artifacts (default)", build},
+	{"download", "download the kernel source tarball a build would use", download},
+	{"bump", "update the kernel version a build uses", bump},
+	{"sign", "sign kernel.lock (which pins the patches) with an SSH key, for build -verify_patches", sign},
+	{"check", "verify the config of a kernel image against gokrazy's requirements", check},
+	{"config", "query the config of the committed kernel image, e.g. config get CONFIG_I2C", config},
+	{"publish", "commit the rebuilt kernel artifacts to git", publish},
+	{"upload", "upload the kernel artifacts to S3, GCS or via rsync", upload},
+	{"push", "push the kernel artifacts to an OCI registry", push},
+	{"pull", "replace the kernel artifacts with those pulled from an OCI registry", pull},
+	{"overlay", "compile device tree overlay sources and install them without rebuilding the kernel", overlay},
+	{"rollback", "restore the kernel artifacts replaced by the last build or pull", rollback},
+	{"netboot", "lay out the kernel artifacts for Raspberry Pi network boot via TFTP", netboot},
+	{"flash", "copy the kernel artifacts onto the boot partition of a gokrazy SD card", flash},
+	{"ensure", "make sure the artifacts of a kernel version are present, pulling or rebuilding them", ensure},
+	{"fleet", "build or fetch the kernels of a fleet manifest and lay them out per device", fleet},
+	{"delta", "generate a differential update from the previous build to the current one", deltaCommand},
+	{"serve", "serve the kernel image over HTTP for gokr-kexec", serve},
+	{"boot-test", "boot the kernel in QEMU and check its console output", bootTest},
+	{"gc", "remove leftover temporary directories and container images", gc},
+	{"doctor", "check the environment for the requirements of a build and print fix hints", doctor},
+	{"print-config", "print the inputs a build would use, without building", printConfigCommand},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun gokr-rebuild-kernel <command> -help for the flags of a command.\n")
+}
+
+// configFlags are the flags which select the kernel config, shared by all
+// commands which build or inspect a kernel config.
+type configFlags struct {
+	profiles         *string
+	capabilities     *string
+	assertMonolithic *bool
+	assertLockdown   *bool
+	boards           *string
+}
+
+func addConfigFlags(fset *flag.FlagSet) *configFlags {
+	return &configFlags{
+		profiles: fset.String("profiles",
+			"",
+			fmt.Sprintf("comma-separated list of config profiles to enable on top of the gokrazy defaults, out of %v", profile.Names())),
+		capabilities: fset.String("capabilities",
+			"",
+			fmt.Sprintf("comma-separated list of capabilities your gokrazy applications need, out of %v. The required drivers are enabled and config.txt is updated", capability.Names())),
+		assertMonolithic: fset.Bool("assert_monolithic",
+			false,
+			"fail the build if any option is built as a module (=m) which neither the gokrazy defaults (e.g. the Wi-Fi and Bluetooth drivers in lib/modules) nor the profiles and capabilities request as one, i.e. if config drift would make the kernel load more modules at runtime"),
+		assertLockdown: fset.Bool("assert_lockdown",
+			false,
+			"fail the build if kernel lockdown is not enforced from boot (see the hardened profile)"),
+		boards: fset.String("boards",
+			"",
+			fmt.Sprintf("comma-separated list of boards whose DTBs to build and update, out of %v (default: all, or none with -defconfig), or none", board.Names())),
+	}
+}
+
+// buildArgs returns the gokr-build-kernel flags corresponding to c.
+func (c *configFlags) buildArgs() []string {
+	return []string{
+		"-profiles=" + *c.profiles,
+		"-capabilities=" + *c.capabilities,
+		fmt.Sprintf("-assert_monolithic=%v", *c.assertMonolithic),
+		fmt.Sprintf("-assert_lockdown=%v", *c.assertLockdown),
+		"-boards=" + *c.boards,
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	warnUnknownConfigKeys(commands)
+	// For compatibility with scripts predating subcommands, running without
+	// a command (or with flags only) builds a kernel.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-help" && args[0] != "-h" {
+		if err := build(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			if err := c.run(args[1:]); err != nil {
+				log.Fatalf("%s: %v", c.name, err)
+			}
+			return
+		}
+	}
+	if args[0] != "help" && args[0] != "-help" && args[0] != "-h" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	}
+	usage()
+	os.Exit(2)
+}
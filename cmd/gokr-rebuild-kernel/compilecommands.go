@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// compileCommandsName is the compilation database which gokr-build-kernel
+// -compile_commands writes into the build result.
+const compileCommandsName = "compile_commands.json"
+
+// compileCommand is an entry of a compilation database, of which only the
+// directory is of interest.
+type compileCommand struct {
+	Directory string `json:"directory"`
+}
+
+// rewriteCompileCommands returns the compilation database b with the
+// kernel tree it was generated in (in the build container) replaced by root.
+func rewriteCompileCommands(b []byte, root string) ([]byte, error) {
+	var commands []compileCommand
+	if err := json.Unmarshal(b, &commands); err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("no compile commands")
+	}
+	// gen_compile_commands.py uses the root of the kernel tree as the
+	// directory of all commands, and refers to the files relative to it,
+	// or by their absolute path.
+	tree, err := json.Marshal(commands[0].Directory)
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := json.Marshal(root)
+	if err != nil {
+		return nil, err
+	}
+	// Without the quotes, so that paths within the tree are replaced, too.
+	tree, replacement = bytes.Trim(tree, `"`), bytes.Trim(replacement, `"`)
+	return bytes.Replace(b, tree, replacement, -1), nil
+}
+
+// installCompileCommands stores the compilation database of the build at
+// the -compile_commands path, with its paths rewritten to the directory of
+// that path.
+func (b *kernelBuild) installCompileCommands() error {
+	if b.opts.compileCommands == "" {
+		return nil
+	}
+	if b.opts.dryRun {
+		log.Printf("[dry-run] would store %s in %s", compileCommandsName, b.opts.compileCommands)
+		return nil
+	}
+	db, err := ioutil.ReadFile(filepath.Join(b.tmp, compileCommandsName))
+	if err != nil {
+		return err
+	}
+	root := filepath.Dir(b.opts.compileCommands)
+	if db, err = rewriteCompileCommands(db, root); err != nil {
+		return fmt.Errorf("-compile_commands: %v", err)
+	}
+	if err := ioutil.WriteFile(b.opts.compileCommands, db, 0644); err != nil {
+		return err
+	}
+	log.Printf("stored %s in %s (for the kernel tree in %s)", compileCommandsName, b.opts.compileCommands, root)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alf632/gokrazy-kernel/kconfig"
+)
+
+// config queries the config embedded in a kernel image (by default the
+// committed vmlinuz), e.g. for scripts checking whether the shipped kernel
+// enables an option:
+//
+//	gokr-rebuild-kernel config get -q CONFIG_I2C && echo enabled
+func config(args []string) error {
+	fset := flag.NewFlagSet("config", flag.ExitOnError)
+	var image = fset.String("image",
+		"",
+		"path to the kernel image to query (default: the committed vmlinuz)")
+	var quiet = fset.Bool("q",
+		false,
+		"get: print nothing, only exit with status 1 unless all symbols are enabled (built in or as module)")
+	var jsonOutput = fset.Bool("json",
+		false,
+		"print the symbols and their values as a JSON object")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel config get [flags] <symbol>...\n")
+		fmt.Fprintf(os.Stderr, "       gokr-rebuild-kernel config grep [flags] <regexp>\n")
+		fmt.Fprintf(os.Stderr, "       gokr-rebuild-kernel config list [flags]\n")
+		fmt.Fprintf(os.Stderr, "Symbols may omit the CONFIG_ prefix. grep matches symbol names case-insensitively.\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	// Flags may also follow the subcommand.
+	sub := fset.Arg(0)
+	fset.Parse(fset.Args()[1:])
+	applyVerbosity(v, vv)
+	operands := fset.Args()
+	if *image == "" {
+		path, err := find("vmlinuz")
+		if err != nil {
+			return err
+		}
+		*image = path
+	}
+	cfg, err := kconfig.FromImage(*image)
+	if err != nil {
+		return err
+	}
+
+	var syms []string
+	switch sub {
+	case "get":
+		if len(operands) == 0 {
+			fset.Usage()
+			os.Exit(2)
+		}
+		for _, name := range operands {
+			syms = append(syms, kconfig.Symbol(name))
+		}
+		if *quiet {
+			for _, sym := range syms {
+				if !cfg.Enabled(sym) {
+					os.Exit(1)
+				}
+			}
+			return nil
+		}
+
+	case "grep":
+		if len(operands) != 1 {
+			fset.Usage()
+			os.Exit(2)
+		}
+		if syms, err = cfg.Grep(operands[0]); err != nil {
+			return err
+		}
+
+	case "list":
+		syms = cfg.Symbols()
+
+	default:
+		return fmt.Errorf("unknown config subcommand %q, expected get, grep or list", sub)
+	}
+
+	if *jsonOutput {
+		values := make(map[string]string)
+		for _, sym := range syms {
+			values[sym], _ = cfg.Get(sym)
+		}
+		b, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	for _, sym := range syms {
+		fmt.Println(cfg.Line(sym))
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configFileName is looked for in /etc and in the user’s config directory
+// (e.g. ~/.config). Settings in the latter take precedence.
+const configFileName = "gokr-kernel.toml"
+
+// configAliases maps config file keys to the flag names they set, where the
+// flag name is not self-explanatory.
+var configAliases = map[string]string{
+	"container_runtime": "overwrite_container_executable",
+}
+
+// configFilePaths returns the config files to read, in increasing order of
+// precedence.
+func configFilePaths() []string {
+	paths := []string{filepath.Join("/etc", configFileName)}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, configFileName))
+	}
+	return paths
+}
+
+// parseConfigFile parses the subset of TOML used by gokr-kernel.toml:
+// key = value pairs, where value is a string (basic or literal), boolean,
+// integer or array of strings (which may span several lines), optionally
+// within [command] tables, and # comments. Keys outside of a table apply to
+// all commands. The returned map is keyed by table (empty for the top
+// level), then key.
+func parseConfigFile(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := map[string]map[string]string{"": {}}
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := result[table]; !ok {
+				result[table] = make(map[string]string)
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		for start := lineNum; strings.HasPrefix(value, "[") && openBrackets(value) > 0; {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("%s:%d: unterminated array", path, start)
+			}
+			lineNum++
+			value += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		value, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		result[table][key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// stringEnd returns the length of the basic ("…") or literal ('…') TOML
+// string s starts with, or false if it is unterminated.
+func stringEnd(s string) (int, bool) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++ // skip the escaped character
+		case s[i] == quote:
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// stripComment removes a # comment from line, unless the # is in a string.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '#':
+			return line[:i]
+		case '"', '\'':
+			end, ok := stringEnd(line[i:])
+			if !ok {
+				return line // reported as a malformed string
+			}
+			i += end - 1
+		}
+	}
+	return line
+}
+
+// openBrackets returns the number of brackets in value which are not
+// closed, ignoring those in strings.
+func openBrackets(value string) int {
+	depth := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '"', '\'':
+			end, ok := stringEnd(value[i:])
+			if !ok {
+				return 0 // reported as a malformed array element
+			}
+			i += end - 1
+		}
+	}
+	return depth
+}
+
+// parseConfigString returns the content of a basic or literal TOML string.
+func parseConfigString(value string) (string, error) {
+	if end, ok := stringEnd(value); !ok || end != len(value) {
+		return "", fmt.Errorf("malformed string %s", value)
+	}
+	if value[0] == '\'' {
+		return value[1 : len(value)-1], nil // literal strings have no escapes
+	}
+	s, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("malformed string %s: %v", value, err)
+	}
+	return s, nil
+}
+
+// parseConfigValue converts a TOML value into its flag representation.
+// Arrays become comma-separated lists, so their elements cannot contain
+// commas.
+func parseConfigValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+		return parseConfigString(value)
+
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") || openBrackets(value) != 0 {
+			return "", fmt.Errorf("malformed array %s", value)
+		}
+		var elems []string
+		inner := value[1 : len(value)-1]
+		for len(inner) > 0 {
+			inner = strings.TrimSpace(inner)
+			if inner == "" {
+				break // trailing comma
+			}
+			if inner[0] != '"' && inner[0] != '\'' {
+				return "", fmt.Errorf("malformed array %s: elements must be strings", value)
+			}
+			end, ok := stringEnd(inner)
+			if !ok {
+				return "", fmt.Errorf("malformed array element %s", inner)
+			}
+			s, err := parseConfigString(inner[:end])
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("array element %s contains a comma, which the comma-separated flag value cannot represent", inner[:end])
+			}
+			elems = append(elems, s)
+			inner = strings.TrimSpace(inner[end:])
+			if inner != "" && !strings.HasPrefix(inner, ",") {
+				return "", fmt.Errorf("malformed array %s: expected , after %s", value, elems[len(elems)-1])
+			}
+			inner = strings.TrimPrefix(inner, ",")
+		}
+		return strings.Join(elems, ","), nil
+
+	case value == "true" || value == "false":
+		return value, nil
+
+	default:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("unsupported value %s", value)
+		}
+		return value, nil
+	}
+}
+
+// applyConfigFile sets the defaults of the flags in fset from the config
+// files, so that flags specified on the command line take precedence. Must
+// be called before fset.Parse.
+func applyConfigFile(fset *flag.FlagSet) error {
+	if collectFlags != nil {
+		collectFlags(fset)
+		return errFlagsCollected
+	}
+	for _, path := range configFilePaths() {
+		tables, err := parseConfigFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, table := range []string{"", fset.Name()} {
+			for key, value := range tables[table] {
+				name := key
+				if alias, ok := configAliases[key]; ok {
+					name = alias
+				}
+				f := fset.Lookup(name)
+				if f == nil {
+					if table != "" {
+						return fmt.Errorf("%s: [%s]: unknown setting %q", path, table, key)
+					}
+					continue // applies to another command
+				}
+				// fset.Set (unlike f.Value.Set) records the flag as set,
+				// so that it counts as explicit for fset.Visit.
+				if err := fset.Set(name, value); err != nil {
+					return fmt.Errorf("%s: %s: %v", path, key, err)
+				}
+				f.DefValue = value
+			}
+		}
+	}
+	return nil
+}
+
+// collectFlags, if non-nil, is called by applyConfigFile with the flags of a
+// command instead of applying the config files, see knownConfigKeys.
+var collectFlags func(fset *flag.FlagSet)
+
+// errFlagsCollected stops a command once applyConfigFile collected its flags.
+var errFlagsCollected = errors.New("flags collected")
+
+// knownConfigKeys returns the names of the flags of cmds (and the config
+// aliases). Each command defines its flags and calls applyConfigFile before
+// doing anything else, so running it while collecting flags stops it there.
+func knownConfigKeys(cmds []command) map[string]bool {
+	known := make(map[string]bool)
+	for key := range configAliases {
+		known[key] = true
+	}
+	collectFlags = func(fset *flag.FlagSet) {
+		fset.VisitAll(func(f *flag.Flag) { known[f.Name] = true })
+	}
+	defer func() { collectFlags = nil }()
+	for _, c := range cmds {
+		c.run(nil)
+	}
+	return known
+}
+
+// unknownConfigKeys returns the top-level keys of tables which no command
+// has a flag for, and the tables which are not named after a command, so
+// that typos do not go unnoticed (applyConfigFile skips top-level keys a
+// command does not know, as they may apply to another command).
+func unknownConfigKeys(tables map[string]map[string]string, cmds []command, known map[string]bool) []string {
+	var unknown []string
+	for key := range tables[""] {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	for table := range tables {
+		if table == "" {
+			continue
+		}
+		found := false
+		for _, c := range cmds {
+			found = found || c.name == table
+		}
+		if !found {
+			unknown = append(unknown, "["+table+"]")
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// warnUnknownConfigKeys logs the settings of the config files which no
+// command knows. Errors are left to applyConfigFile.
+func warnUnknownConfigKeys(cmds []command) {
+	var known map[string]bool
+	for _, path := range configFilePaths() {
+		tables, err := parseConfigFile(path)
+		if err != nil {
+			continue
+		}
+		if known == nil {
+			known = knownConfigKeys(cmds)
+		}
+		for _, key := range unknownConfigKeys(tables, cmds, known) {
+			log.Printf("warning: %s: ignoring unknown setting %s, which no command knows", path, key)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: `"podman"`, want: "podman"},
+		{value: `"with \"quotes\""`, want: `with "quotes"`},
+		{value: `"unterminated`, wantErr: true},
+		{value: `'C:\podman'`, want: `C:\podman`},
+		{value: `'unterminated`, wantErr: true},
+		{value: `"a" "b"`, wantErr: true},
+		{value: `["camera", "fan"]`, want: "camera,fan"},
+		{value: `["camera",]`, want: "camera"},
+		{value: `[]`, want: ""},
+		{value: `["camera",`, wantErr: true},
+		{value: `[camera]`, wantErr: true},
+		{value: `['camera', "fan"]`, want: "camera,fan"},
+		{value: `["camera]", "fan"]`, want: "camera],fan"},
+		{value: `["camera" "fan"]`, wantErr: true},
+		{value: `["camera,fan"]`, wantErr: true},
+		{value: "true", want: "true"},
+		{value: "false", want: "false"},
+		{value: "42", want: "42"},
+		{value: "-1", want: "-1"},
+		{value: "1.5", wantErr: true},
+		{value: "yes", wantErr: true},
+	} {
+		got, err := parseConfigValue(tt.value)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("parseConfigValue(%s): err = %v, want error: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseConfigValue(%s) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    map[string]map[string]string
+		wantErr bool
+	}{
+		{
+			name: "tables",
+			content: `# defaults for all commands
+container_runtime = "podman"
+
+[build]
+profiles = ["camera", "fan"]
+keep_backups = 3
+skip_preflight = true
+
+[gc]
+dry_run = false
+`,
+			want: map[string]map[string]string{
+				"":      {"container_runtime": "podman"},
+				"build": {"profiles": "camera,fan", "keep_backups": "3", "skip_preflight": "true"},
+				"gc":    {"dry_run": "false"},
+			},
+		},
+		{
+			name:    "empty",
+			content: "\n# nothing\n",
+			want:    map[string]map[string]string{"": {}},
+		},
+		{
+			name:    "missing value",
+			content: "[build]\nprofiles\n",
+			wantErr: true,
+		},
+		{
+			name: "comments",
+			content: `container_runtime = "podman" # or docker
+[build] # build only
+mirror = "https://mirror.example/#kernel" # not a comment in the string
+`,
+			want: map[string]map[string]string{
+				"":      {"container_runtime": "podman"},
+				"build": {"mirror": "https://mirror.example/#kernel"},
+			},
+		},
+		{
+			name: "multi-line array",
+			content: `profiles = [
+  "camera", # Camera Module v2
+  'fan',
+]
+keep_backups = 3
+`,
+			want: map[string]map[string]string{
+				"": {"profiles": "camera,fan", "keep_backups": "3"},
+			},
+		},
+		{
+			name:    "unterminated array",
+			content: "profiles = [\n  \"camera\",\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, configFileName)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseConfigFile(path)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("parseConfigFile: err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfigFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+	known := knownConfigKeys(commands)
+	for _, key := range []string{"container_runtime", "profiles", "keep_backups", "older_than"} {
+		if !known[key] {
+			t.Errorf("knownConfigKeys lacks %q", key)
+		}
+	}
+	tables := map[string]map[string]string{
+		"":      {"container_runtime": "podman", "profile": "camera"},
+		"build": {"profiles": "camera"},
+		"biuld": {"profiles": "camera"},
+	}
+	got := unknownConfigKeys(tables, commands, known)
+	if want := []string{"[biuld]", "profile"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unknownConfigKeys = %q, want %q", got, want)
+	}
+}
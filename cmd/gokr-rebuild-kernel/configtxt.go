@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// updateConfigTxt modifies the Raspberry Pi config.txt file at path: entries
+// of add which the file does not yet contain are appended, lines equal to an
+// entry of remove are deleted. An entry of add may span multiple lines
+// (e.g. a conditional [pi3] section), in which case it is added unless the
+// file already contains it verbatim; such an entry of remove is deleted if
+// the file contains it verbatim.
+func updateConfigTxt(path string, add, remove []string) (added, removed []string, _ error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	content := string(b)
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	toRemove := make(map[string]bool)
+	for _, entry := range remove {
+		if !strings.Contains(entry, "\n") {
+			toRemove[entry] = true
+			continue
+		}
+		block := strings.TrimSuffix(entry, "\n") + "\n"
+		if strings.HasPrefix(content, block) {
+			content = strings.TrimPrefix(content, block)
+			removed = append(removed, entry)
+		} else if idx := strings.Index(content, "\n"+block); idx != -1 {
+			content = content[:idx+1] + content[idx+1+len(block):]
+			removed = append(removed, entry)
+		}
+	}
+	var kept []string
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		if toRemove[strings.TrimSpace(line)] {
+			removed = append(removed, line)
+			continue
+		}
+		kept = append(kept, line)
+		existing[strings.TrimSpace(line)] = true
+	}
+	content = strings.Join(kept, "\n") + "\n"
+	for _, entry := range add {
+		if strings.Contains(entry, "\n") {
+			if strings.Contains(content, entry) {
+				continue
+			}
+		} else if existing[entry] {
+			continue
+		}
+		added = append(added, entry)
+		content += strings.TrimSuffix(entry, "\n") + "\n"
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil, nil, nil
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
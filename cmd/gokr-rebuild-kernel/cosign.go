@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/alf632/gokrazy-kernel/oci"
+	"github.com/alf632/gokrazy-kernel/provenance"
+)
+
+// cosignSign signs the manifest digest of ref using the cosign CLI, which
+// stores the signature in the same repository. key is a cosign key
+// reference (a file, or e.g. awskms://…) or “keyless” for sigstore keyless
+// signing with an OIDC identity (e.g. of a CI job).
+func cosignSign(ref oci.Reference, digest, key string, insecure bool, act *actions) error {
+	args := []string{"sign", "--yes"}
+	if key != "keyless" {
+		args = append(args, "--key="+key)
+	}
+	if insecure {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, ref.Registry+"/"+ref.Repository+"@"+digest)
+	if err := act.run(exec.Command("cosign", args...)); err != nil {
+		return fmt.Errorf("signing: %v", err)
+	}
+	return nil
+}
+
+// cosignAttest attaches the SLSA provenance predicate of the statement at
+// provenancePath to the manifest digest of ref as a signed attestation,
+// which e.g. slsa-verifier and cosign verify-attestation can check. key is as
+// for cosignSign.
+func cosignAttest(ref oci.Reference, digest, key, provenancePath string, insecure bool, act *actions) error {
+	st, err := provenance.Read(provenancePath)
+	if err != nil {
+		return err
+	}
+	predicate, err := ioutil.TempFile("", "gokr-rebuild-kernel-predicate")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(predicate.Name())
+	if err := json.NewEncoder(predicate).Encode(st.Predicate); err != nil {
+		predicate.Close()
+		return err
+	}
+	if err := predicate.Close(); err != nil {
+		return err
+	}
+	args := []string{"attest", "--yes", "--type=slsaprovenance1", "--predicate=" + predicate.Name()}
+	if key != "keyless" {
+		args = append(args, "--key="+key)
+	}
+	if insecure {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, ref.Registry+"/"+ref.Repository+"@"+digest)
+	if err := act.run(exec.Command("cosign", args...)); err != nil {
+		return fmt.Errorf("attesting provenance: %v", err)
+	}
+	return nil
+}
+
+// verifyFlags are the flags which configure the verification of cosign
+// signatures when pulling.
+type verifyFlags struct {
+	key      *string
+	identity *string
+	issuer   *string
+}
+
+func addVerifyFlags(fset *flag.FlagSet) *verifyFlags {
+	return &verifyFlags{
+		key: fset.String("verify_key",
+			"",
+			"cosign public key reference (a file, or e.g. awskms://…) with which the artifact must be signed"),
+		identity: fset.String("verify_identity",
+			"",
+			"regular expression matching the identity (e.g. the CI workflow URI or email) which must have signed the artifact with sigstore keyless signing"),
+		issuer: fset.String("verify_issuer",
+			"https://token.actions.githubusercontent.com",
+			"OIDC issuer of -verify_identity"),
+	}
+}
+
+// enabled returns whether a signature must be verified.
+func (v *verifyFlags) enabled() bool {
+	return *v.key != "" || *v.identity != ""
+}
+
+// verify verifies the cosign signature of the manifest digest of ref,
+// failing if it is missing or invalid. If attestation is true, the SLSA
+// provenance attestation is verified, too.
+func (v *verifyFlags) verify(ref oci.Reference, digest string, insecure, attestation bool) error {
+	if err := v.cosignVerify(ref, digest, insecure, "verify"); err != nil {
+		return fmt.Errorf("verifying signature: %v", err)
+	}
+	if !attestation {
+		return nil
+	}
+	if err := v.cosignVerify(ref, digest, insecure, "verify-attestation", "--type=slsaprovenance1"); err != nil {
+		return fmt.Errorf("verifying provenance attestation: %v", err)
+	}
+	return nil
+}
+
+func (v *verifyFlags) cosignVerify(ref oci.Reference, digest string, insecure bool, args ...string) error {
+	if *v.key != "" {
+		args = append(args, "--key="+*v.key)
+	} else {
+		args = append(args,
+			"--certificate-identity-regexp="+*v.identity,
+			"--certificate-oidc-issuer="+*v.issuer)
+	}
+	if insecure {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, ref.Registry+"/"+ref.Repository+"@"+digest)
+	return runCommand(exec.Command("cosign", args...))
+}
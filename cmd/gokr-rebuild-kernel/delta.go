@@ -0,0 +1,263 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/delta"
+)
+
+// artifactFiles returns the files (slash-separated, relative to dir) of the
+// artifacts in the repository directory dir (see presentArtifacts),
+// descending into directories such as lib and overlays.
+func artifactFiles(dir string) ([]string, error) {
+	paths, err := presentArtifacts(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(filepath.Join(dir, p), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// oldModulePath returns the path of rel in the older build: the modules
+// directory is named after the kernel release, which differs between builds
+// (e.g. with -localversion=auto).
+func oldModulePath(rel, from, to string) string {
+	prefix := "lib/modules/" + to + "/"
+	if from != to && strings.HasPrefix(rel, prefix) {
+		return "lib/modules/" + from + "/" + strings.TrimPrefix(rel, prefix)
+	}
+	return rel
+}
+
+// gzipFile writes the gzip-compressed src to dest and returns its size.
+func gzipFile(dest, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	zw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(zw, in); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	st, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), out.Close()
+}
+
+// makeDelta writes the differences of the artifacts in the repository
+// directory newDir to those in oldDir into outDir: a bsdiff patch for each
+// changed file (or the gzip-compressed file, if smaller or new) and the
+// manifest.
+func makeDelta(oldDir, newDir, outDir string) (*delta.Manifest, error) {
+	from, err := buildinfo.Release(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	to, err := buildinfo.Release(newDir)
+	if err != nil {
+		return nil, err
+	}
+	oldFiles, err := artifactFiles(oldDir)
+	if err != nil {
+		return nil, err
+	}
+	oldHashes := make(map[string]string)
+	for _, rel := range oldFiles {
+		if oldHashes[rel], err = fileHash(filepath.Join(oldDir, filepath.FromSlash(rel))); err != nil {
+			return nil, err
+		}
+	}
+	newFiles, err := artifactFiles(newDir)
+	if err != nil {
+		return nil, err
+	}
+	m := &delta.Manifest{From: from, To: to}
+	for _, rel := range newFiles {
+		newPath := filepath.Join(newDir, filepath.FromSlash(rel))
+		st, err := os.Stat(newPath)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := fileHash(newPath)
+		if err != nil {
+			return nil, err
+		}
+		f := delta.File{
+			Path:    rel,
+			SHA256:  hash,
+			Size:    st.Size(),
+			OldPath: oldModulePath(rel, from, to),
+		}
+		f.OldSHA256 = oldHashes[f.OldPath]
+		if f.OldSHA256 == hash {
+			f.Op = delta.OpSame
+			m.Files = append(m.Files, f)
+			continue
+		}
+		f.Delta = path.Join("files", rel+".gz")
+		fullPath := filepath.Join(outDir, filepath.FromSlash(f.Delta))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return nil, err
+		}
+		if f.DeltaSize, err = gzipFile(fullPath, newPath); err != nil {
+			return nil, err
+		}
+		f.Op = delta.OpFull
+		if f.OldSHA256 != "" {
+			patch := path.Join("files", rel+".bsdiff")
+			patchPath := filepath.Join(outDir, filepath.FromSlash(patch))
+			bsdiff := exec.Command("bsdiff", filepath.Join(oldDir, filepath.FromSlash(f.OldPath)), newPath, patchPath)
+			if err := runCommand(bsdiff); err != nil {
+				return nil, fmt.Errorf("bsdiff %s: %v", rel, err)
+			}
+			pst, err := os.Stat(patchPath)
+			if err != nil {
+				return nil, err
+			}
+			if pst.Size() < f.DeltaSize {
+				if err := os.Remove(fullPath); err != nil {
+					return nil, err
+				}
+				f.Op, f.Delta, f.DeltaSize = delta.OpPatch, patch, pst.Size()
+			} else if err := os.Remove(patchPath); err != nil {
+				return nil, err
+			}
+		}
+		if f.Op == delta.OpFull {
+			f.OldPath, f.OldSHA256 = "", ""
+		}
+		log.Printf("%s: %s (%d bytes for %d)", rel, f.Op, f.DeltaSize, f.Size)
+		m.Files = append(m.Files, f)
+	}
+	return m, m.Write(filepath.Join(outDir, delta.ManifestName))
+}
+
+// deltaCommand generates a differential update from the artifacts of the
+// previous build (the newest backup) to the current ones, for devices
+// which apply it with the delta package.
+func deltaCommand(args []string) error {
+	fset := flag.NewFlagSet("delta", flag.ExitOnError)
+	var oldDir = fset.String("old",
+		"",
+		"directory with the artifacts to generate the update from, laid out like the repository (default: the newest backup, i.e. the artifacts the last build replaced)")
+	var newDir = fset.String("new",
+		"",
+		"directory with the artifacts to update to, laid out like the repository (default: the repository)")
+	var outDir = fset.String("o",
+		"",
+		"directory to write the update into, which must not exist yet (default: delta-<old release>-to-<new release>)")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	if _, err := exec.LookPath("bsdiff"); err != nil {
+		return fmt.Errorf("bsdiff not found, install it (e.g. apt install bsdiff): %v", err)
+	}
+	if *newDir == "" {
+		kernelPath, err := find("vmlinuz")
+		if err != nil {
+			return err
+		}
+		*newDir = filepath.Dir(kernelPath)
+	}
+	if *oldDir == "" {
+		names, err := listBackups(*newDir)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no backups in %s, pass -old", filepath.Join(*newDir, backupDirName))
+		}
+		*oldDir = filepath.Join(*newDir, backupDirName, names[len(names)-1])
+	}
+	if *outDir == "" {
+		from, err := buildinfo.Release(*oldDir)
+		if err != nil {
+			return err
+		}
+		to, err := buildinfo.Release(*newDir)
+		if err != nil {
+			return err
+		}
+		*outDir = "delta-" + from + "-to-" + to
+	}
+	if _, err := os.Stat(*outDir); err == nil {
+		return fmt.Errorf("%s already exists", *outDir)
+	}
+	staging := strings.TrimSuffix(*outDir, "/") + ".partial"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	m, err := makeDelta(*oldDir, *newDir, staging)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staging, *outDir); err != nil {
+		return err
+	}
+	var total int64
+	counts := make(map[string]int)
+	for _, f := range m.Files {
+		total += f.Size
+		counts[f.Op]++
+	}
+	log.Printf("wrote the update from %s to %s to %s: %d files unchanged, %d patched, %d in full; %d bytes to download instead of %d",
+		m.From, m.To, *outDir, counts[delta.OpSame], counts[delta.OpPatch], counts[delta.OpFull], m.DownloadSize(), total)
+	b, err := ioutil.ReadFile(filepath.Join(*outDir, delta.ManifestName))
+	if err != nil {
+		return err
+	}
+	log.Printf("SHA-256 of %s, which devices must receive through a trusted channel (see delta.ReadManifest): %x", delta.ManifestName, sha256.Sum256(b))
+	return nil
+}
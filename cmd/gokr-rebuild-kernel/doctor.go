@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// diagnosis is the result of a doctor check.
+type diagnosis struct {
+	warning bool   // not required for building, e.g. only for boot tests
+	problem string // empty if the check passed
+	hint    string // how to fix the problem
+}
+
+type doctorCheck struct {
+	name string
+	fn   func() diagnosis
+}
+
+// doctorWorkdir is the -workdir flag of the doctor command.
+var doctorWorkdir string
+
+var doctorChecks = []doctorCheck{
+	{"container runtime", checkContainerRuntime},
+	{"disk space", checkDiskSpace},
+	{"kernel.org reachable", checkKernelOrg},
+	{"user namespaces (podman)", checkUserNamespaces},
+	{"QEMU (boot tests)", checkQEMU},
+}
+
+func checkContainerRuntime() diagnosis {
+	executable, err := getContainerExecutable()
+	if err != nil {
+		return diagnosis{
+			problem: err.Error(),
+			hint:    "install podman, docker or nerdctl, e.g. sudo apt install podman",
+		}
+	}
+	info := containerCommand(executable, "info")
+	if out, err := info.CombinedOutput(); err != nil {
+		hint := "ensure the daemon is running, e.g. sudo systemctl start docker"
+		if strings.Contains(string(out), "permission denied") {
+			hint = "add your user to the docker group: sudo addgroup $USER docker && newgrp docker"
+		}
+		return diagnosis{
+			problem: fmt.Sprintf("%v: %v", info.Args, err),
+			hint:    hint,
+		}
+	}
+	return diagnosis{}
+}
+
+func checkDiskSpace() diagnosis {
+	hint := "free up space, or run gokr-rebuild-kernel gc to remove leftovers of interrupted builds"
+	if err := checkSpace(workDir(doctorWorkdir), "build result", resultSpace); err != nil {
+		return diagnosis{problem: err.Error(), hint: hint}
+	}
+	executable, err := getContainerExecutable()
+	if err != nil {
+		return diagnosis{} // reported by checkContainerRuntime
+	}
+	storage := containerStorage(executable)
+	if storage == "" {
+		return diagnosis{
+			warning: true,
+			problem: "cannot determine the container storage location to check its free space",
+		}
+	}
+	if err := checkSpace(storage, "container storage", buildSpace); err != nil {
+		return diagnosis{problem: err.Error(), hint: hint}
+	}
+	return diagnosis{}
+}
+
+func checkKernelOrg() diagnosis {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Head("https://cdn.kernel.org/pub/linux/kernel/")
+	if err != nil {
+		return diagnosis{
+			problem: err.Error(),
+			hint:    "check your network connection and proxy settings, or use -mirror",
+		}
+	}
+	resp.Body.Close()
+	logResponse(resp)
+	return diagnosis{}
+}
+
+func checkUserNamespaces() diagnosis {
+	executable, err := getContainerExecutable()
+	if err != nil || detectBackend(executable) != backendPodman {
+		return diagnosis{} // only relevant for rootless podman
+	}
+	if b, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil {
+		if strings.TrimSpace(string(b)) == "0" {
+			return diagnosis{
+				problem: "user namespaces are disabled",
+				hint:    "sudo sysctl -w user.max_user_namespaces=15000",
+			}
+		}
+	}
+	u, err := user.Current()
+	if err != nil {
+		return diagnosis{problem: err.Error()}
+	}
+	if u.Uid == "0" {
+		return diagnosis{}
+	}
+	for _, path := range []string{"/etc/subuid", "/etc/subgid"} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return diagnosis{problem: err.Error()}
+		}
+		found := false
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(line, u.Username+":") || strings.HasPrefix(line, u.Uid+":") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return diagnosis{
+				problem: fmt.Sprintf("no entry for %s in %s", u.Username, path),
+				hint:    fmt.Sprintf("sudo usermod --add-subuids 100000-165535 --add-subgids 100000-165535 %s", u.Username),
+			}
+		}
+	}
+	return diagnosis{}
+}
+
+func checkQEMU() diagnosis {
+	if _, err := exec.LookPath("qemu-system-aarch64"); err != nil {
+		return diagnosis{
+			warning: true,
+			problem: "qemu-system-aarch64 not found in $PATH",
+			hint:    "install QEMU to run boot tests, e.g. sudo apt install qemu-system-arm",
+		}
+	}
+	return diagnosis{}
+}
+
+// doctor checks the environment for the requirements of a kernel build and
+// prints hints for fixing problems, instead of failing in the middle of a
+// build with a cryptic error.
+func doctor(args []string) error {
+	fset := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var workdir = addWorkdirFlag(fset)
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	doctorWorkdir = *workdir
+	failed := false
+	for _, c := range doctorChecks {
+		d := c.fn()
+		switch {
+		case d.problem == "":
+			fmt.Printf("ok    %s\n", c.name)
+			continue
+		case d.warning:
+			fmt.Printf("WARN  %s: %s\n", c.name, d.problem)
+		default:
+			fmt.Printf("FAIL  %s: %s\n", c.name, d.problem)
+			failed = true
+		}
+		if d.hint != "" {
+			fmt.Printf("      hint: %s\n", d.hint)
+		}
+	}
+	if failed {
+		return fmt.Errorf("some checks failed, see above")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// download downloads the kernel source tarball a build would use, e.g. to
+// inspect it or to make it available to an offline machine.
+func download(args []string) error {
+	fset := flag.NewFlagSet("download", flag.ExitOnError)
+	var outputDir = fset.String("output_dir",
+		".",
+		"directory to store the kernel source tarball in")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	ctx, cancel := interruptContext()
+	defer cancel()
+	if err := runHostBuilder(ctx, *outputDir, "-download_only"); err != nil {
+		return fmt.Errorf("downloading kernel source: %v", err)
+	}
+	return nil
+}
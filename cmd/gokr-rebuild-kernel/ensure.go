@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/alf632/gokrazy-kernel/packer"
+)
+
+// ensure makes sure the repository contains the artifacts of a kernel
+// version, for gokr-packer and other tools driving this repository.
+func ensure(args []string) error {
+	fset := flag.NewFlagSet("ensure", flag.ExitOnError)
+	var dir = fset.String("dir",
+		".",
+		"kernel repository directory containing kernel.lock and the artifacts")
+	var version = fset.String("version",
+		"",
+		"kernel version, e.g. 6.5.7 (default: the version pinned in kernel.lock)")
+	var from = fset.String("from",
+		"",
+		"if non-empty, OCI reference to pull prebuilt artifacts from, with "+packer.VersionPlaceholder+" replaced by the version, e.g. ghcr.io/example/kernel:"+packer.VersionPlaceholder)
+	var rebuild = fset.Bool("rebuild",
+		false,
+		"rebuild the kernel (bumping kernel.lock, if necessary) if the artifacts cannot be pulled")
+	var printJSON = fset.Bool("json",
+		false,
+		"print the result (action taken and build info) as JSON")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	res, err := packer.Ensure(packer.Request{
+		Dir:        *dir,
+		Version:    *version,
+		Source:     *from,
+		Rebuild:    *rebuild,
+		Executable: executable,
+		Output:     os.Stderr,
+	})
+	if err != nil {
+		return err
+	}
+	if *printJSON {
+		b, err := json.MarshalIndent(res, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+	}
+	fmt.Printf("kernel %s (%s): %s\n", res.BuildInfo.KernelVersion, res.BuildInfo.KernelRelease, res.Action)
+	return nil
+}
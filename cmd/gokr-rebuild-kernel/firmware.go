@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// fetchFirmwareFile downloads url to dest and returns its SHA-256 hash,
+// which must match want (unless empty).
+func fetchFirmwareFile(ctx context.Context, url, want, dest string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	logResponse(resp)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("unexpected HTTP status code for %s: got %d, want %d", url, got, want)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	got := fmt.Sprintf("%x", h.Sum(nil))
+	if want != "" && got != want {
+		os.Remove(dest)
+		return "", fmt.Errorf("%s: SHA-256 hash mismatch: got %s, want %s (from kernel.lock)", url, got, want)
+	}
+	return got, nil
+}
+
+// firmwareRelease downloads the default firmware files of release and
+// returns them with their hashes, for pinning them in kernel.lock.
+func firmwareRelease(ctx context.Context, release string) (*kernelversion.Firmware, error) {
+	tmp, err := ioutil.TempDir("", "gokr-rebuild-kernel-firmware")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	fw := &kernelversion.Firmware{Release: release}
+	for _, name := range kernelversion.FirmwareFiles {
+		hash, err := fetchFirmwareFile(ctx, fw.URL(name), "", filepath.Join(tmp, name))
+		if err != nil {
+			return nil, err
+		}
+		fw.Files = append(fw.Files, kernelversion.FirmwareFile{Name: name, SHA256: hash})
+	}
+	return fw, nil
+}
+
+// downloadFirmware downloads the files of the pinned firmware fw into dir,
+// verifying their hashes.
+func downloadFirmware(ctx context.Context, fw *kernelversion.Firmware, dir string) error {
+	for _, file := range fw.Files {
+		if _, err := fetchFirmwareFile(ctx, fw.URL(file.Name), file.SHA256, filepath.Join(dir, file.Name)); err != nil {
+			return err
+		}
+	}
+	log.Printf("downloaded Raspberry Pi firmware %s (%d files)", fw.Release, len(fw.Files))
+	return nil
+}
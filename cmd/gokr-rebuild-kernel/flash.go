@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// bootPartition returns the first partition of the block device dev, which
+// is the boot partition on gokrazy SD cards, e.g. /dev/sdb1 for /dev/sdb and
+// /dev/mmcblk0p1 for /dev/mmcblk0.
+func bootPartition(dev string) string {
+	if last := dev[len(dev)-1]; last >= '0' && last <= '9' {
+		return dev + "p1"
+	}
+	return dev + "1"
+}
+
+// mountedDevices returns the devices in /proc/mounts.
+func mountedDevices() (map[string]bool, error) {
+	b, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			mounted[fields[0]] = true
+		}
+	}
+	return mounted, nil
+}
+
+// describeDevice returns the model and size of the block device dev, and
+// whether it is removable, from sysfs.
+func describeDevice(dev string) (desc string, removable bool) {
+	sys := filepath.Join("/sys/block", filepath.Base(dev))
+	read := func(name string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(sys, name))
+		return strings.TrimSpace(string(b))
+	}
+	desc = read("device/model")
+	if desc == "" {
+		desc = "unknown model"
+	}
+	if sectors, err := strconv.ParseInt(read("size"), 10, 64); err == nil {
+		desc += fmt.Sprintf(", %.1f GB", float64(sectors*512)/1e9)
+	}
+	return desc, read("removable") == "1"
+}
+
+// confirm asks the user to confirm the question on stdin.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// flashBootFiles copies the kernel image, DTBs and overlays from the
+// repository directory dir to the mounted boot partition mnt.
+func flashBootFiles(dir, mnt string, act *actions) error {
+	if err := act.copyFile(filepath.Join(mnt, "vmlinuz"), filepath.Join(dir, "vmlinuz")); err != nil {
+		return err
+	}
+	dtbs, err := filepath.Glob(filepath.Join(dir, "*.dtb"))
+	if err != nil {
+		return err
+	}
+	for _, dtb := range dtbs {
+		if err := act.copyFile(filepath.Join(mnt, filepath.Base(dtb)), dtb); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "overlays")); err == nil {
+		if err := act.replaceDir(filepath.Join(mnt, "overlays"), filepath.Join(dir, "overlays")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flash copies the kernel artifacts onto the boot partition of a gokrazy SD
+// card.
+func flash(args []string) error {
+	fset := flag.NewFlagSet("flash", flag.ExitOnError)
+	var yes = fset.Bool("yes",
+		false,
+		"do not ask for confirmation before modifying the SD card")
+	var force = fset.Bool("force",
+		false,
+		"flash even if the device is not removable or its first partition does not look like a gokrazy boot partition")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the files which would be modified, without modifying them")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel flash [flags] <device, e.g. /dev/sdb>\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	dev := fset.Arg(0)
+	act := &actions{dryRun: *dryRun}
+
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kernelPath)
+	st, err := os.Stat(dev)
+	if err != nil {
+		return err
+	}
+	if st.Mode()&os.ModeDevice == 0 || st.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", dev)
+	}
+	part := bootPartition(dev)
+	mounted, err := mountedDevices()
+	if err != nil {
+		return err
+	}
+	if mounted[dev] || mounted[part] {
+		return fmt.Errorf("%s is mounted, unmount it first", dev)
+	}
+	desc, removable := describeDevice(dev)
+	if !removable && !*force {
+		return fmt.Errorf("%s (%s) is not removable, refusing to flash it (use -force if it is an SD card)", dev, desc)
+	}
+
+	mnt, err := ioutil.TempDir("", "gokr-rebuild-kernel-flash")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+	// The quiet option makes chmod succeed on FAT, which copyFile uses.
+	if err := act.run(exec.Command("mount", "-t", "vfat", "-o", "quiet", part, mnt)); err != nil {
+		return err
+	}
+	defer func() {
+		if err := act.run(exec.Command("umount", mnt)); err != nil {
+			log.Printf("unmounting %s: %v", mnt, err)
+		}
+	}()
+	if !*dryRun {
+		for _, name := range []string{"vmlinuz", "cmdline.txt"} {
+			if _, err := os.Stat(filepath.Join(mnt, name)); err != nil && !*force {
+				return fmt.Errorf("%s does not look like a gokrazy boot partition (no %s), refusing to flash it (use -force to flash anyway)", part, name)
+			}
+		}
+		if !*yes && !confirm(fmt.Sprintf("Replace the kernel, DTBs and overlays on %s (%s) with those in %s?", part, desc, dir)) {
+			return fmt.Errorf("aborted")
+		}
+	}
+	if err := flashBootFiles(dir, mnt, act); err != nil {
+		return err
+	}
+	if err := act.run(exec.Command("sync", "-f", mnt)); err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+	log.Printf("flashed %s, the kernel modules on the root partition are only updated with the next gok update (or image build)", part)
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/board"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+	"github.com/alf632/gokrazy-kernel/packer"
+)
+
+// hostnameRe matches the hostnames of fleet devices, which are used as
+// directory names.
+var hostnameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.-]*$`)
+
+// fleetDevice is a device of the fleet manifest.
+type fleetDevice struct {
+	hostname string
+	board    board.Board
+	version  string
+	overlays []string
+}
+
+// parseFleet parses the fleet manifest at path, in the same TOML subset as
+// gokr-kernel.toml: a [hostname] table per device with the keys board,
+// version and overlays (an array of overlay names). Keys outside of a table
+// are defaults for all devices. The version defaults to the pinned version.
+func parseFleet(path string) ([]fleetDevice, error) {
+	tables, err := parseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defaults := tables[""]
+	var devices []fleetDevice
+	for hostname, settings := range tables {
+		if hostname == "" {
+			continue
+		}
+		if !hostnameRe.MatchString(hostname) || hostname == "kernels" {
+			return nil, fmt.Errorf("%s: [%s]: invalid hostname", path, hostname)
+		}
+		get := func(key string) string {
+			if value, ok := settings[key]; ok {
+				return value
+			}
+			return defaults[key]
+		}
+		for key := range settings {
+			if key != "board" && key != "version" && key != "overlays" {
+				return nil, fmt.Errorf("%s: [%s]: unknown setting %q", path, hostname, key)
+			}
+		}
+		if get("board") == "" {
+			return nil, fmt.Errorf("%s: [%s]: board is required", path, hostname)
+		}
+		boards, err := board.Resolve(get("board"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: [%s]: %v", path, hostname, err)
+		}
+		if len(boards) != 1 || boards[0].DTB == "" {
+			return nil, fmt.Errorf("%s: [%s]: board must name a single board with device tree", path, hostname)
+		}
+		dev := fleetDevice{
+			hostname: hostname,
+			board:    boards[0],
+			version:  get("version"),
+		}
+		if dev.version == "" {
+			dev.version = kernelversion.Version()
+		}
+		if overlays := get("overlays"); overlays != "" {
+			dev.overlays = strings.Split(overlays, ",")
+			if dev.board.UBoot {
+				return nil, fmt.Errorf("%s: [%s]: overlays are not supported on U-Boot board %s", path, hostname, dev.board.Name)
+			}
+		}
+		devices = append(devices, dev)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%s: no devices", path)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].hostname < devices[j].hostname })
+	return devices, nil
+}
+
+// copyRepo copies the kernel repository directory src to dest, except for
+// the .git directory and skip (e.g. the output directory within it). src and
+// skip must be absolute.
+func copyRepo(dest, src, skip string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == ".git" || path == skip) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(target, path)
+	})
+}
+
+// fleetKernelDir returns the kernel repository directory for version: the
+// repository repo itself for the pinned version, otherwise a copy of it in
+// outputDir, which packer.Ensure then bumps.
+func fleetKernelDir(repo, outputDir, version string) (string, error) {
+	if version == kernelversion.Version() {
+		return repo, nil
+	}
+	dir := filepath.Join(outputDir, "kernels", version)
+	if _, err := os.Stat(filepath.Join(dir, "kernel.lock")); err == nil {
+		return dir, nil // from an earlier run
+	}
+	absRepo, err := filepath.Abs(repo)
+	if err != nil {
+		return "", err
+	}
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("copying %s to %s for kernel %s", repo, dir, version)
+	if err := copyRepo(dir, absRepo, absOutput); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// layoutDevice lays out the boot files of dev from the kernel repository
+// directory kernelDir in outputDir/<hostname>: the kernel, the board’s DTB
+// (under the name the firmware loads), the overlays, config.txt with the
+// device’s overlays enabled, cmdline.txt and the modules.
+func layoutDevice(dev fleetDevice, kernelDir, outputDir string, act *actions) error {
+	staging, err := ioutil.TempDir("", "gokr-rebuild-kernel-fleet")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	copies := []struct{ dest, src string }{
+		{"vmlinuz", "vmlinuz"},
+		{dev.board.DTB, dev.board.Committed},
+		{"cmdline.txt", "cmdline.txt"},
+	}
+	for _, c := range copies {
+		src := filepath.Join(kernelDir, c.src)
+		if _, err := os.Stat(src); err != nil {
+			if c.src == dev.board.Committed {
+				return fmt.Errorf("%s: kernel %s lacks the DTB of board %s (optional boards must be listed in -boards when building, e.g. in gokr-kernel.toml)", dev.hostname, dev.version, dev.board.Name)
+			}
+			return err
+		}
+		if err := copyFile(filepath.Join(staging, c.dest), src); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"lib", "overlays"} {
+		if _, err := os.Stat(filepath.Join(kernelDir, dir)); err != nil {
+			continue
+		}
+		if err := copyDir(filepath.Join(staging, dir), filepath.Join(kernelDir, dir)); err != nil {
+			return err
+		}
+	}
+	if !dev.board.UBoot {
+		configTxt, err := ioutil.ReadFile(filepath.Join(kernelDir, "config.txt"))
+		if err != nil {
+			return err
+		}
+		if len(dev.overlays) > 0 {
+			configTxt = append(configTxt, "\n[all]\n"...)
+			for _, overlay := range dev.overlays {
+				if _, err := os.Stat(filepath.Join(staging, "overlays", overlay+".dtbo")); err != nil {
+					return fmt.Errorf("%s: overlay %s not found in kernel %s", dev.hostname, overlay, dev.version)
+				}
+				configTxt = append(configTxt, "dtoverlay="+overlay+"\n"...)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(staging, "config.txt"), configTxt, 0644); err != nil {
+			return err
+		}
+	}
+	if err := act.mkdirAll(outputDir); err != nil {
+		return err
+	}
+	return act.replaceDir(filepath.Join(outputDir, dev.hostname), staging)
+}
+
+// fleet builds or fetches the kernels of all devices in a fleet manifest and
+// lays them out per device.
+func fleet(args []string) error {
+	fset := flag.NewFlagSet("fleet", flag.ExitOnError)
+	var manifest = fset.String("manifest",
+		"fleet.toml",
+		"fleet manifest: a [hostname] table per device with board, version and overlays")
+	var outputDir = fset.String("output_dir",
+		"fleet",
+		"directory to lay out the boot files in, in a directory per hostname. Kernels of versions other than the pinned one are built in its kernels subdirectory")
+	var from = fset.String("from",
+		"",
+		"if non-empty, OCI reference to pull prebuilt artifacts from, with "+packer.VersionPlaceholder+" replaced by the version")
+	var rebuild = fset.Bool("rebuild",
+		false,
+		"rebuild kernels which are not present (or cannot be pulled)")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the kernels and devices which would be laid out, without building, pulling or laying out anything")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	devices, err := parseFleet(*manifest)
+	if err != nil {
+		return err
+	}
+	lockPath, err := find("kernel.lock")
+	if err != nil {
+		return err
+	}
+	repo := filepath.Dir(lockPath)
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	kernelDirs := make(map[string]string)
+	for _, dev := range devices {
+		if _, ok := kernelDirs[dev.version]; ok {
+			continue
+		}
+		if *dryRun {
+			kernelDirs[dev.version] = "(kernel " + dev.version + ")"
+			continue
+		}
+		dir, err := fleetKernelDir(repo, *outputDir, dev.version)
+		if err != nil {
+			return err
+		}
+		res, err := packer.Ensure(packer.Request{
+			Dir:        dir,
+			Version:    dev.version,
+			Source:     *from,
+			Rebuild:    *rebuild,
+			Executable: executable,
+			Output:     os.Stderr,
+		})
+		if err != nil {
+			return fmt.Errorf("kernel %s (needed by %s): %v", dev.version, dev.hostname, err)
+		}
+		log.Printf("kernel %s in %s: %s", dev.version, dir, res.Action)
+		kernelDirs[dev.version] = dir
+	}
+
+	act := &actions{dryRun: *dryRun}
+	for _, dev := range devices {
+		if *dryRun {
+			log.Printf("[dry-run] would lay out %s: board %s, kernel %s, overlays %v", dev.hostname, dev.board.Name, dev.version, dev.overlays)
+			continue
+		}
+		if err := layoutDevice(dev, kernelDirs[dev.version], *outputDir, act); err != nil {
+			return err
+		}
+		log.Printf("laid out %s: board %s, kernel %s, overlays %v", dev.hostname, dev.board.Name, dev.version, dev.overlays)
+	}
+	return nil
+}
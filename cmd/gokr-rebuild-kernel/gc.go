@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+	"github.com/alf632/gokrazy-kernel/symbols"
+)
+
+// gc removes what interrupted builds leave behind: temporary directories
+// (which contain a full set of kernel artifacts) and the build container
+// and toolchain images. It also prunes the symbols store (see build -symbols_dir), and with
+// -source_cache_dir, removes the cached kernel sources of versions other than
+// the one in kernel.lock.
+func gc(args []string) error {
+	fset := flag.NewFlagSet("gc", flag.ExitOnError)
+	var overwriteContainerExecutable = fset.String("overwrite_container_executable",
+		"",
+		"E.g. docker, podman, nerdctl or nerdctl.lima to overwrite the automatically detected container executable")
+	var olderThan = fset.Duration("older_than",
+		24*time.Hour,
+		"only remove temporary directories last modified longer than this ago, so that running builds are unaffected")
+	var workdir = addWorkdirFlag(fset)
+	var namespace = addNamespaceFlag(fset)
+	var images = fset.Bool("images",
+		true,
+		"remove the build container image and its toolchain image (see -image_tag)")
+	var imageTag = fset.String("image_tag",
+		"gokr-rebuild-kernel",
+		"the -image_tag of build, whose build container image and <image_tag>-toolchain image to remove")
+	var sourceCacheDir = fset.String("source_cache_dir",
+		"",
+		"if non-empty, the -source_cache_dir of build, from which to remove the kernel sources of versions other than the one in kernel.lock")
+	var symbolsDir = fset.String("symbols_dir",
+		symbols.DefaultDir(),
+		"the -symbols_dir of build, from which to remove the symbols of all but the -symbols_keep most recent builds, or none")
+	var symbolsKeep = fset.Int("symbols_keep",
+		5,
+		"number of builds whose symbols to keep in -symbols_dir. 0 keeps all")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	containerNamespace = *namespace
+
+	executable, execErr := getContainerExecutable()
+	if *overwriteContainerExecutable != "" {
+		executable, execErr = *overwriteContainerExecutable, nil
+	}
+	dir := workDir(*workdir)
+	if *workdir == "" && execErr == nil && isLima(executable) {
+		dir = limaWritableDir // see build
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "gokr-rebuild-kernel*"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		// This includes the work directories of failed builds, which are
+		// kept for resuming them with build -resume.
+		st, err := os.Stat(match)
+		if err != nil {
+			return err
+		}
+		if !st.IsDir() || time.Since(st.ModTime()) < *olderThan {
+			continue
+		}
+		log.Printf("removing %s", match)
+		if err := os.RemoveAll(match); err != nil {
+			return err
+		}
+	}
+
+	if *symbolsDir != "none" && *symbolsDir != "" {
+		removed, err := symbols.Prune(*symbolsDir, *symbolsKeep)
+		if err != nil {
+			return err
+		}
+		for _, dir := range removed {
+			log.Printf("removed the symbols of %s", dir)
+		}
+	}
+
+	if *sourceCacheDir != "" {
+		if err := gcSourceCache(*sourceCacheDir, "linux-"+kernelversion.Version()); err != nil {
+			return err
+		}
+	}
+
+	if !*images {
+		return nil
+	}
+	if execErr != nil {
+		return execErr
+	}
+	for _, tag := range []string{*imageTag, toolchainTag(*imageTag)} {
+		log.Printf("removing the container image %s", tag)
+		rmi := containerCommand(executable, "rmi", tag)
+		if err := runCommand(rmi); err != nil {
+			// Not fatal: the image does not exist after a successful gc,
+			// or was never built (e.g. with build -toolchain_image).
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// gcSourceCache removes the kernel trees (and their hash files) from the
+// source cache in dir, except for keep (e.g. linux-6.5.7), as well as the
+// leftovers of interrupted copies into the cache.
+func gcSourceCache(dir, keep string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "linux-") && !strings.HasPrefix(name, ".partial-") {
+			continue // not created by gokr-build-kernel
+		}
+		if name == keep || name == keep+".sha256" {
+			continue
+		}
+		log.Printf("removing %s", filepath.Join(dir, name))
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// splitHooks returns the hooks in the comma-separated list. Relative paths
+// (e.g. ./script.sh) are relative to the working directory at startup.
+func splitHooks(list string) []string {
+	var hooks []string
+	for _, hook := range strings.Split(list, ",") {
+		hook = strings.TrimSpace(hook)
+		if hook == "" {
+			continue
+		}
+		// Only paths: exec.LookPath searches $PATH for bare names.
+		if strings.ContainsRune(hook, filepath.Separator) {
+			hook = startPath(hook)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// hookEnv returns the environment variables describing a build to a hook.
+func hookEnv(outputDir string) []string {
+	return []string{
+		"GOKR_KERNEL_OUTPUT_DIR=" + outputDir,
+		"GOKR_KERNEL_BUILD_INFO=" + filepath.Join(outputDir, buildinfo.FileName),
+		"GOKR_KERNEL_VERSION=" + kernelversion.Version(),
+	}
+}
+
+// runHooks runs the executables in hooks in order, with outputDir as working
+// directory, the hookEnv and the content of stdinPath (if non-empty) on
+// stdin. The output of hooks is passed through. A hook still running when
+// ctx is done is killed.
+func runHooks(ctx context.Context, kind string, hooks []string, outputDir, stdinPath string, dryRun bool) error {
+	for _, hook := range hooks {
+		if dryRun {
+			log.Printf("[dry-run] would run %s hook %s", kind, hook)
+			continue
+		}
+		log.Printf("running %s hook %s", kind, hook)
+		cmd := exec.CommandContext(ctx, hook)
+		cmd.Dir = outputDir
+		cmd.Env = append(os.Environ(), hookEnv(outputDir)...)
+		if stdinPath != "" {
+			b, err := ioutil.ReadFile(stdinPath)
+			if err != nil {
+				return err
+			}
+			cmd.Stdin = bytes.NewReader(b)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %s: %v", kind, hook, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// runHostBuilder builds gokr-build-kernel for the host and runs it with args
+// in dir. This is used for the parts of the pipeline which do not need the
+// container, e.g. printing or checking the config. It is killed when ctx is
+// done.
+func runHostBuilder(ctx context.Context, dir string, args ...string) error {
+	tmp, err := ioutil.TempDir("", "gokr-rebuild-kernel")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	buildPath := filepath.Join(tmp, "gokr-build-kernel")
+	if runtime.GOOS == "windows" {
+		buildPath += ".exe"
+	}
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", buildPath, "github.com/alf632/gokrazy-kernel/cmd/gokr-build-kernel")
+	cmd.Dir = goBuildDir()
+	if err := runCommand(cmd); err != nil {
+		return err
+	}
+	builder := exec.CommandContext(ctx, buildPath, args...)
+	if verbosity >= 1 {
+		log.Printf("running %s", shellQuote(builder.Args))
+	}
+	builder.Dir = dir
+	builder.Stdout = os.Stdout
+	builder.Stderr = os.Stderr
+	if err := builder.Run(); err != nil {
+		return fmt.Errorf("%v: %v", builder.Args, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// runtimeName returns the name of the container runtime (e.g. docker, podman
+// or nerdctl) for the executable path, which carries an .exe suffix on
+// Windows and when using Docker Desktop from within WSL, and a .lima suffix
+// for the wrappers running it within a Lima VM (e.g. nerdctl.lima).
+func runtimeName(executable string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filepath.Base(executable), ".exe"), ".lima")
+}
+
+// osreleasePath is the kernel release of the running kernel, which names
+// WSL kernels after Microsoft. It is a variable for the tests.
+var osreleasePath = "/proc/sys/kernel/osrelease"
+
+// isWSL reports whether we are running within the Windows Subsystem for
+// Linux.
+func isWSL() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	b, err := ioutil.ReadFile(osreleasePath)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(b)), "microsoft")
+}
+
+// windowsVolumePath converts a Windows path (e.g. C:\Users\x\AppData\Local\Temp)
+// into the form Docker Desktop accepts as the source of a volume mount
+// (e.g. C:/Users/x/AppData/Local/Temp), which avoids the backslashes being
+// interpreted as escapes.
+func windowsVolumePath(path string) string {
+	return strings.ReplaceAll(path, `\`, "/")
+}
+
+// volumePath returns path (on the machine running gokr-rebuild-kernel) in
+// the form the container runtime expects as the source of a volume mount.
+func volumePath(executable, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case runtime.GOOS == "windows":
+		return windowsVolumePath(abs), nil
+
+	case isWSL() && strings.HasSuffix(executable, ".exe"):
+		// The Windows docker.exe (Docker Desktop without WSL integration)
+		// runs outside of WSL and needs Windows paths.
+		out, err := exec.Command("wslpath", "-w", abs).Output()
+		if err != nil {
+			return "", fmt.Errorf("wslpath -w %s: %v", abs, err)
+		}
+		return windowsVolumePath(strings.TrimSpace(string(out))), nil
+
+	default:
+		return abs, nil
+	}
+}
+
+// containerIDs returns the uid and gid to run the build as within the
+// container. On Windows, user IDs are SIDs (e.g. S-1-5-21-…), which cannot
+// be used in /etc/passwd; the ownership of files in bind mounts is not
+// enforced by Docker Desktop, so any unprivileged ID works.
+func containerIDs(uid, gid string) (string, string) {
+	if _, err := strconv.Atoi(uid); err != nil {
+		uid = "1000"
+	}
+	if _, err := strconv.Atoi(gid); err != nil {
+		gid = "1000"
+	}
+	return uid, gid
+}
+
+// copyDir recursively copies the directory src to dest (which must not
+// exist), preserving symbolic links. Unlike cp -r, this works on Windows.
+func copyDir(dest, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		default:
+			return copyRegular(target, path, info.Mode().Perm())
+		}
+	})
+}
+
+func copyRegular(dest, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeName(t *testing.T) {
+	for _, tt := range []struct {
+		executable string
+		want       string
+	}{
+		{"/usr/bin/docker", "docker"},
+		{"/usr/bin/podman", "podman"},
+		{"/mnt/c/Program Files/Docker/Docker/resources/bin/docker.exe", "docker"},
+		{"/usr/local/bin/nerdctl.lima", "nerdctl"},
+		{"nerdctl", "nerdctl"},
+	} {
+		if got := runtimeName(tt.executable); got != tt.want {
+			t.Errorf("runtimeName(%q) = %q, want %q", tt.executable, got, tt.want)
+		}
+	}
+}
+
+func TestWindowsVolumePath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{`C:\Users\x\AppData\Local\Temp`, "C:/Users/x/AppData/Local/Temp"},
+		{`\\wsl.localhost\Ubuntu\tmp\build`, "//wsl.localhost/Ubuntu/tmp/build"},
+		{"C:/already/forward", "C:/already/forward"},
+	} {
+		if got := windowsVolumePath(tt.path); got != tt.want {
+			t.Errorf("windowsVolumePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestContainerIDs(t *testing.T) {
+	for _, tt := range []struct {
+		uid, gid         string
+		wantUid, wantGid string
+	}{
+		{"1000", "1000", "1000", "1000"},
+		{"501", "20", "501", "20"},
+		// Windows SIDs cannot be used in /etc/passwd.
+		{"S-1-5-21-1004336348-1177238915-682003330-1001", "S-1-5-21-1004336348-1177238915-682003330-513", "1000", "1000"},
+	} {
+		uid, gid := containerIDs(tt.uid, tt.gid)
+		if uid != tt.wantUid || gid != tt.wantGid {
+			t.Errorf("containerIDs(%q, %q) = %q, %q, want %q, %q", tt.uid, tt.gid, uid, gid, tt.wantUid, tt.wantGid)
+		}
+	}
+}
+
+// fakeWSL makes isWSL report a WSL kernel (if wsl is true) and puts a fake
+// wslpath, which prints script's output, first in $PATH. The returned
+// function restores both.
+func fakeWSL(t *testing.T, wsl bool, script string) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gokr-hostpath-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := "6.5.0-1-amd64\n"
+	if wsl {
+		release = "5.15.90.1-microsoft-standard-WSL2\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "osrelease"), []byte(release), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "wslpath"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldRelease, oldPath := osreleasePath, os.Getenv("PATH")
+	osreleasePath = filepath.Join(dir, "osrelease")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() {
+		osreleasePath = oldRelease
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestVolumePathWSL(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("WSL runs Linux binaries")
+	}
+	// Like wslpath -w, print the path as seen from Windows.
+	const toWindows = `[ "$1" = -w ] || exit 2
+printf '\\\\wsl.localhost\\Ubuntu%s\n' "$(echo "$2" | tr / '\\\\')"
+`
+	for _, tt := range []struct {
+		name       string
+		wsl        bool
+		executable string
+		script     string
+		want       string // %s is replaced by the absolute path
+		wantErr    bool
+	}{
+		{
+			name:       "Linux",
+			executable: "/usr/bin/docker",
+			script:     "exit 1\n",
+			want:       "%s",
+		},
+		{
+			name:       "WSL with Docker Desktop WSL integration",
+			wsl:        true,
+			executable: "/usr/bin/docker",
+			script:     "exit 1\n",
+			want:       "%s",
+		},
+		{
+			name:       "WSL with docker.exe",
+			wsl:        true,
+			executable: "/mnt/c/Program Files/Docker/Docker/resources/bin/docker.exe",
+			script:     toWindows,
+			want:       "//wsl.localhost/Ubuntu%s",
+		},
+		{
+			name:       "Linux with docker.exe",
+			executable: "/opt/docker.exe",
+			script:     "exit 1\n",
+			want:       "%s",
+		},
+		{
+			name:       "WSL with failing wslpath",
+			wsl:        true,
+			executable: "/mnt/c/docker.exe",
+			script:     "exit 1\n",
+			wantErr:    true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeWSL(t, tt.wsl, tt.script)()
+			abs, err := filepath.Abs("work")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := volumePath(tt.executable, "work")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("volumePath() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Replace(tt.want, "%s", abs, 1); got != want {
+				t.Errorf("volumePath(%q, work) = %q, want %q", tt.executable, got, want)
+			}
+		})
+	}
+}
+
+// TestVolumePathRealWSL converts a path with the real wslpath when run
+// within WSL.
+func TestVolumePathRealWSL(t *testing.T) {
+	if !isWSL() {
+		t.Skip("not running within WSL")
+	}
+	if _, err := exec.LookPath("wslpath"); err != nil {
+		t.Skip("wslpath not found")
+	}
+	got, err := volumePath("docker.exe", os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(got, `\`) || !(strings.HasPrefix(got, "//") || (len(got) > 2 && got[1] == ':')) {
+		t.Errorf("volumePath(docker.exe, %s) = %q, want a Windows path with forward slashes", os.TempDir(), got)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "gokr-copydir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := os.MkdirAll(filepath.Join(src, "lib", "modules", "6.5.7"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "lib", "modules", "6.5.7", "modules.dep"), []byte("dep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("/usr/src/linux", filepath.Join(src, "lib", "modules", "6.5.7", "build")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dest := src + "-copy"
+	defer os.RemoveAll(dest)
+	if err := copyDir(dest, src); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dest, "lib", "modules", "6.5.7", "modules.dep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "dep\n" {
+		t.Errorf("modules.dep = %q, want %q", b, "dep\n")
+	}
+	if runtime.GOOS != "windows" {
+		link, err := os.Readlink(filepath.Join(dest, "lib", "modules", "6.5.7", "build"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link != "/usr/src/linux" {
+			t.Errorf("build symlink = %q, want /usr/src/linux", link)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// initcallParams make the kernel print how long each initcall takes. The
+// messages are logged at debug level, hence the loglevel.
+const initcallParams = "initcall_debug loglevel=8"
+
+// initcallReport is the file next to vmlinuz with the slowest initcalls.
+const initcallReport = "initcall-report.txt"
+
+var initcallRe = regexp.MustCompile(`initcall (\S+) returned (-?\d+) after (\d+) usecs`)
+
+// initcall is the result of an initcall as printed with initcall_debug.
+type initcall struct {
+	fn       string
+	ret      int
+	duration time.Duration
+}
+
+// parseInitcalls returns the initcalls in the console output, in the order
+// in which they ran.
+func parseInitcalls(console string) []initcall {
+	var calls []initcall
+	for _, line := range strings.Split(console, "\n") {
+		m := initcallRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ret, _ := strconv.Atoi(m[2])
+		usecs, _ := strconv.ParseInt(m[3], 10, 64)
+		calls = append(calls, initcall{
+			fn:       m[1],
+			ret:      ret,
+			duration: time.Duration(usecs) * time.Microsecond,
+		})
+	}
+	return calls
+}
+
+// formatInitcallReport summarizes the initcalls: the total time spent in
+// them, the top slowest ones (the candidates for trimming the config or
+// building them as modules) and those which failed.
+func formatInitcallReport(calls []initcall, bootToUserspace time.Duration, top int) string {
+	var b strings.Builder
+	var total time.Duration
+	for _, c := range calls {
+		total += c.duration
+	}
+	fmt.Fprintf(&b, "%d initcalls took %v in total\n", len(calls), total)
+	if bootToUserspace > 0 {
+		fmt.Fprintf(&b, "the kernel started init after %v\n", bootToUserspace)
+	}
+	sorted := append([]initcall(nil), calls...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].duration > sorted[j].duration })
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	fmt.Fprintf(&b, "\nslowest %d initcalls:\n", len(sorted))
+	for _, c := range sorted {
+		share := 0.0
+		if total > 0 {
+			share = float64(c.duration) / float64(total) * 100
+		}
+		fmt.Fprintf(&b, "  %10v  %5.1f%%  %s\n", c.duration, share, c.fn)
+	}
+	var failed []initcall
+	for _, c := range calls {
+		if c.ret != 0 {
+			failed = append(failed, c)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, "\n%d initcalls failed:\n", len(failed))
+		for _, c := range failed {
+			fmt.Fprintf(&b, "  %s returned %d after %v\n", c.fn, c.ret, c.duration)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cpioWriter writes an archive in the “new” (SVR4, newc) cpio format, which
+// the kernel unpacks as initramfs. Only what the initramfs of boot-test
+// needs is supported: directories, regular files, symlinks and character
+// devices, all owned by root.
+type cpioWriter struct {
+	w   io.Writer
+	ino int
+	err error
+}
+
+func (c *cpioWriter) write(b []byte) {
+	if c.err != nil {
+		return
+	}
+	_, c.err = c.w.Write(b)
+}
+
+// pad writes zero bytes up to the next multiple of 4 of n.
+func (c *cpioWriter) pad(n int) {
+	if rem := n % 4; rem != 0 {
+		c.write(make([]byte, 4-rem))
+	}
+}
+
+// entry writes the header of name (without leading slash) and data.
+func (c *cpioWriter) entry(name string, mode uint32, rdevMajor, rdevMinor int, data []byte) error {
+	c.ino++
+	nlink := 1
+	if mode&cpioTypeMask == cpioDir {
+		nlink = 2
+	}
+	hdr := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		c.ino, mode, 0, 0, nlink, 0, len(data), 0, 0, rdevMajor, rdevMinor, len(name)+1, 0)
+	c.write([]byte(hdr))
+	c.write(append([]byte(name), 0))
+	c.pad(len(hdr) + len(name) + 1)
+	c.write(data)
+	c.pad(len(data))
+	return c.err
+}
+
+const (
+	cpioTypeMask = 0170000
+	cpioDir      = 0040000
+	cpioReg      = 0100000
+	cpioSymlink  = 0120000
+	cpioChar     = 0020000
+)
+
+func (c *cpioWriter) dir(name string) error {
+	return c.entry(name, cpioDir|0755, 0, 0, nil)
+}
+
+func (c *cpioWriter) file(name string, perm os.FileMode, data []byte) error {
+	return c.entry(name, cpioReg|uint32(perm.Perm()), 0, 0, data)
+}
+
+func (c *cpioWriter) symlink(name, target string) error {
+	return c.entry(name, cpioSymlink|0777, 0, 0, []byte(target))
+}
+
+func (c *cpioWriter) charDevice(name string, major, minor int) error {
+	return c.entry(name, cpioChar|0600, major, minor, nil)
+}
+
+// close writes the trailer which ends the archive.
+func (c *cpioWriter) close() error {
+	return c.entry("TRAILER!!!", 0, 0, 0, nil)
+}
+
+// addTree adds the directory tree at src to the archive as name.
+func (c *cpioWriter) addTree(name, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dest := name
+		if rel != "." {
+			dest += "/" + filepath.ToSlash(rel)
+		}
+		switch {
+		case info.IsDir():
+			return c.dir(dest)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return c.symlink(dest, target)
+		case info.Mode().IsRegular():
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return c.file(dest, info.Mode(), b)
+		}
+		return fmt.Errorf("%s: unsupported file type %v", path, info.Mode())
+	})
+}
+
+// writeSelftestInitramfs writes an initramfs to w which runs init (the
+// gokr-kselftest binary for arm64) on the kselftest directory at
+// kselftestDir, installed as /kselftest.
+func writeSelftestInitramfs(w io.Writer, init, kselftestDir string) error {
+	c := &cpioWriter{w: w}
+	for _, dir := range []string{"dev", "proc", "sys", "tmp"} {
+		if err := c.dir(dir); err != nil {
+			return err
+		}
+	}
+	// The kernel opens /dev/console as stdin, stdout and stderr of init,
+	// before init can mount devtmpfs.
+	if err := c.charDevice("dev/console", 5, 1); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(init)
+	if err != nil {
+		return err
+	}
+	if err := c.file("init", 0755, b); err != nil {
+		return err
+	}
+	if err := c.addTree(strings.TrimPrefix(selftestDir, "/"), kselftestDir); err != nil {
+		return err
+	}
+	return c.close()
+}
+
+// selftestDir is where the initramfs of boot-test -selftests contains the
+// kselftest directory, the default of gokr-kselftest -dir.
+const selftestDir = "/kselftest"
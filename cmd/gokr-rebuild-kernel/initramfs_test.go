@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type cpioEntry struct {
+	name string
+	mode uint64
+	rdev [2]uint64
+	data string
+}
+
+// readCPIO parses the newc archive b up to its trailer.
+func readCPIO(t *testing.T, b []byte) []cpioEntry {
+	var entries []cpioEntry
+	off := 0
+	field := func(idx int) uint64 {
+		v, err := strconv.ParseUint(string(b[off+6+8*idx:off+6+8*idx+8]), 16, 32)
+		if err != nil {
+			t.Fatalf("offset %d: field %d: %v", off, idx, err)
+		}
+		return v
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for {
+		if off%4 != 0 {
+			t.Fatalf("entry at unaligned offset %d", off)
+		}
+		if got := string(b[off : off+6]); got != "070701" {
+			t.Fatalf("offset %d: magic %q, want 070701", off, got)
+		}
+		size, nameSize := int(field(6)), int(field(11))
+		name := string(b[off+110 : off+110+nameSize-1])
+		if b[off+110+nameSize-1] != 0 {
+			t.Fatalf("%s: name not NUL-terminated", name)
+		}
+		dataOff := align(off + 110 + nameSize)
+		e := cpioEntry{
+			name: name,
+			mode: field(1),
+			rdev: [2]uint64{field(9), field(10)},
+			data: string(b[dataOff : dataOff+size]),
+		}
+		off = align(dataOff + size)
+		if name == "TRAILER!!!" {
+			if off != len(b) {
+				t.Errorf("%d bytes after the trailer", len(b)-off)
+			}
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestSelftestInitramfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	init := filepath.Join(dir, "gokr-kselftest")
+	if err := ioutil.WriteFile(init, []byte("\x7fELF init"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	kselftest := filepath.Join(dir, "kselftest")
+	if err := os.MkdirAll(filepath.Join(kselftest, "timers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(kselftest, "kselftest-list.txt"), []byte("timers:posix_timers\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(kselftest, "timers", "posix_timers"), []byte("\x7fELF test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("posix_timers", filepath.Join(kselftest, "timers", "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeSelftestInitramfs(&buf, init, kselftest); err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		name string
+		mode uint64
+		rdev [2]uint64
+		data string
+	}
+	var got []summary
+	for _, e := range readCPIO(t, buf.Bytes()) {
+		got = append(got, summary{e.name, e.mode, e.rdev, e.data})
+	}
+	want := []summary{
+		{"dev", 040755, [2]uint64{}, ""},
+		{"proc", 040755, [2]uint64{}, ""},
+		{"sys", 040755, [2]uint64{}, ""},
+		{"tmp", 040755, [2]uint64{}, ""},
+		{"dev/console", 020600, [2]uint64{5, 1}, ""},
+		{"init", 0100755, [2]uint64{}, "\x7fELF init"},
+		{"kselftest", 040755, [2]uint64{}, ""},
+		{"kselftest/kselftest-list.txt", 0100644, [2]uint64{}, "timers:posix_timers\n"},
+		{"kselftest/timers", 040755, [2]uint64{}, ""},
+		{"kselftest/timers/alias", 0120777, [2]uint64{}, "posix_timers"},
+		{"kselftest/timers/posix_timers", 0100755, [2]uint64{}, "\x7fELF test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("initramfs:\n got %+v\nwant %+v", got, want)
+	}
+
+	if _, err := selftestInitramfs(dir, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("selftestInitramfs without kselftest directory succeeded unexpectedly")
+	}
+}
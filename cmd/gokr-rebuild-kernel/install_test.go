@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alf632/gokrazy-kernel/board"
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelrelease"
+)
+
+// fakeFS records the modifications of the repository instead of making them.
+type fakeFS struct {
+	ops []string
+}
+
+func (f *fakeFS) copyFile(dest, src string) error {
+	f.ops = append(f.ops, "copy "+src+" "+dest)
+	return nil
+}
+
+func (f *fakeFS) mkdirAll(dir string) error {
+	f.ops = append(f.ops, "mkdir "+dir)
+	return nil
+}
+
+func (f *fakeFS) replaceDir(dest, src string) error {
+	f.ops = append(f.ops, "replace "+src+" "+dest)
+	return nil
+}
+
+func (f *fakeFS) rename(dest, src string) error {
+	f.ops = append(f.ops, "rename "+src+" "+dest)
+	return nil
+}
+
+func (f *fakeFS) removeAll(path string) error {
+	f.ops = append(f.ops, "remove "+path)
+	return nil
+}
+
+func TestInstallArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "dist")
+	tmp := filepath.Join(dir, "tmp")
+
+	boards := []board.Board{
+		{Name: "pi4", DTB: "bcm2711-rpi-4-b.dtb"},
+		{Name: "pi3", DTB: "bcm2710-rpi-3-b.dtb"},
+		{Name: "qemu"},
+	}
+	for _, tt := range []struct {
+		name   string
+		modify func(b *kernelBuild)
+		want   []string
+	}{
+		{
+			name: "kernel, DTBs and modules",
+			want: []string{
+				"copy tmp/vmlinuz dist/vmlinuz",
+				"copy tmp/bcm2711-rpi-4-b.dtb dist/bcm2711-rpi-4-b.dtb",
+				"copy tmp/bcm2710-rpi-3-b.dtb dist/bcm2710-rpi-3-b.dtb",
+				"copy tmp/" + kernelrelease.FileName + " dist/" + kernelrelease.FileName,
+				"copy tmp/" + buildinfo.FileName + " dist/" + buildinfo.FileName,
+				"copy tmp/" + warningsFileName + " dist/" + warningsFileName,
+				"replace tmp/lib/modules dist/lib/modules",
+			},
+		},
+		{
+			name: "artifacts and overlays",
+			modify: func(b *kernelBuild) {
+				b.artifacts = []string{"/usr/src/linux/System.map"}
+				b.overlays = []string{"fan"}
+				b.hostOverlays = []hostOverlay{{name: "custom"}}
+			},
+			want: []string{
+				"copy tmp/vmlinuz dist/vmlinuz",
+				"copy tmp/bcm2711-rpi-4-b.dtb dist/bcm2711-rpi-4-b.dtb",
+				"copy tmp/bcm2710-rpi-3-b.dtb dist/bcm2710-rpi-3-b.dtb",
+				"copy tmp/System.map dist/System.map",
+				"mkdir dist/overlays",
+				"copy tmp/overlays/fan.dtbo dist/overlays/fan.dtbo",
+				"copy tmp/overlays/custom.dtbo dist/overlays/custom.dtbo",
+				"copy tmp/" + kernelrelease.FileName + " dist/" + kernelrelease.FileName,
+				"copy tmp/" + buildinfo.FileName + " dist/" + buildinfo.FileName,
+				"copy tmp/" + warningsFileName + " dist/" + warningsFileName,
+				"replace tmp/lib/modules dist/lib/modules",
+			},
+		},
+		{
+			name: "debug variant, perf and selftests",
+			modify: func(b *kernelBuild) {
+				b.opts.debugVariant = true
+				b.opts.perf = true
+				b.opts.selftests = "net"
+			},
+			want: []string{
+				"copy tmp/vmlinuz dist/vmlinuz",
+				"copy tmp/bcm2711-rpi-4-b.dtb dist/bcm2711-rpi-4-b.dtb",
+				"copy tmp/bcm2710-rpi-3-b.dtb dist/bcm2710-rpi-3-b.dtb",
+				"copy tmp/vmlinuz-debug dist/vmlinuz-debug",
+				"copy tmp/perf dist/perf",
+				"replace tmp/kselftest dist/kselftest",
+				"copy tmp/" + kernelrelease.FileName + " dist/" + kernelrelease.FileName,
+				"copy tmp/" + buildinfo.FileName + " dist/" + buildinfo.FileName,
+				"copy tmp/" + warningsFileName + " dist/" + warningsFileName,
+				"replace tmp/lib/modules dist/lib/modules",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeFS{}
+			b := &kernelBuild{
+				opts:       buildOptions{dryRun: true},
+				fs:         fs,
+				boards:     boards,
+				kernelPath: filepath.Join(repo, "vmlinuz"),
+				dtbPaths: map[string]string{
+					"pi4": filepath.Join(repo, "bcm2711-rpi-4-b.dtb"),
+					"pi3": filepath.Join(repo, "bcm2710-rpi-3-b.dtb"),
+				},
+				libPath: filepath.Join(repo, "lib"),
+				tmp:     tmp,
+			}
+			if tt.modify != nil {
+				tt.modify(b)
+			}
+			if err := b.install(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(fs.ops))
+			for i, op := range fs.ops {
+				got[i] = strings.Replace(op, dir+string(filepath.Separator), "", -1)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("install:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeTree creates the files (slash-separated path to content) in dir.
+// Existing files are replaced, not modified, like the artifacts are, so that
+// backups (which hard link them) keep their contents.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for path, content := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the files (slash-separated path to content) in dir.
+func readTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestStagingFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo := filepath.Join(dir, "dist")
+	tmp := filepath.Join(dir, "tmp")
+	old := map[string]string{
+		"vmlinuz":                "old kernel",
+		"lib/modules/6.5.7/a.ko": "old module",
+		"bcm2711-rpi-4-b.dtb":    "old dtb",
+	}
+	writeTree(t, repo, old)
+	writeTree(t, tmp, map[string]string{
+		"vmlinuz":                "new kernel",
+		"lib/modules/6.5.9/a.ko": "new module",
+	})
+
+	stage := func(s *stagingFS) {
+		if err := s.copyFile(filepath.Join(repo, "vmlinuz"), filepath.Join(tmp, "vmlinuz")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.replaceDir(filepath.Join(repo, "lib", "modules"), filepath.Join(tmp, "lib", "modules")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failure after staging some artifacts leaves the repository as it was.
+	s := &stagingFS{fs: &actions{}}
+	stage(s)
+	if err := s.copyFile(filepath.Join(repo, "bcm2711-rpi-4-b.dtb"), filepath.Join(tmp, "missing.dtb")); err == nil {
+		t.Fatal("copying a missing file succeeded unexpectedly")
+	}
+	s.abort()
+	if got := readTree(t, repo); !reflect.DeepEqual(got, old) {
+		t.Errorf("after abort: repository = %q, want %q", got, old)
+	}
+
+	s = &stagingFS{fs: &actions{}}
+	stage(s)
+	if err := s.commit(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"vmlinuz":                "new kernel",
+		"lib/modules/6.5.9/a.ko": "new module",
+		"bcm2711-rpi-4-b.dtb":    "old dtb",
+	}
+	if got := readTree(t, repo); !reflect.DeepEqual(got, want) {
+		t.Errorf("after commit: repository = %q, want %q", got, want)
+	}
+}
+
+func TestRestoreAfterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := map[string]string{
+		"vmlinuz":                "old kernel",
+		"lib/modules/6.5.7/a.ko": "old module",
+	}
+	writeTree(t, dir, old)
+	act := &actions{}
+	backup, err := backupArtifacts(dir, 1, act)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partially replaced build: the new kernel, the old modules, and the
+	// DTB of a board which the backup does not have.
+	writeTree(t, dir, map[string]string{
+		"vmlinuz":             "new kernel",
+		"bcm2711-rpi-4-b.dtb": "new dtb",
+	})
+
+	err = restoreAfterFailure(dir, backup, act, fmt.Errorf("rename failed"))
+	if err == nil || !strings.Contains(err.Error(), "rename failed") || !strings.Contains(err.Error(), "restored") {
+		t.Errorf("restoreAfterFailure: err = %v, want the original error and that the artifacts were restored", err)
+	}
+	got := readTree(t, dir)
+	for path := range got {
+		if strings.HasPrefix(path, backupDirName+"/") {
+			delete(got, path)
+		}
+	}
+	if !reflect.DeepEqual(got, old) {
+		t.Errorf("after restoring: repository = %q, want %q", got, old)
+	}
+}
@@ -1,35 +1,81 @@
 package main
 
 import (
-	"flag"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"strings"
 	"text/template"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
 )
 
 const dockerFileContents = `
-FROM debian:buster
+{{- if .ToolchainImage }}
+FROM {{ .ToolchainImage }} AS builder
+{{- else }}
+FROM {{ .BaseImage }} AS toolchain
+{{ if .BuildKit }}
+RUN --mount=type=cache,target=/var/cache/apt,sharing=locked \
+    --mount=type=cache,target=/var/lib/apt/lists,sharing=locked \
+{{- if .AptSecret }}
+    --mount=type=secret,id=apt,target=/etc/apt/apt.conf.d/99gokr-secret \
+{{- end }}
+    rm -f /etc/apt/apt.conf.d/docker-clean && \
+    apt-get update && apt-get install -y {{ template "packages" . }}{{ template "plugins" . }}
+{{- else }}
+RUN apt-get update && apt-get install -y {{ template "packages" . }}{{ template "plugins" . }}
+{{- end }}
 
-RUN apt-get update && apt-get install -y crossbuild-essential-arm64 bc libssl-dev bison flex kmod
+FROM toolchain AS builder
+{{- end }}
 
 COPY gokr-build-kernel /usr/bin/gokr-build-kernel
 {{- range $idx, $path := .Patches }}
 COPY {{ $path }} /usr/src/{{ $path }}
 {{- end }}
+{{- range $idx, $name := .Overlays }}
+COPY overlays/{{ $name }}.dts /usr/src/overlays/{{ $name }}.dts
+{{- end }}
+{{- range $idx, $name := .Hooks }}
+COPY hooks/{{ $name }} /usr/src/hooks/{{ $name }}
+{{- end }}
+{{- if .Defconfig }}
+COPY defconfig /usr/src/defconfig
+{{- end }}
+
+{{- if ne .Uid "0" }}
 
 RUN echo 'builduser:x:{{ .Uid }}:{{ .Gid }}:nobody:/:/bin/sh' >> /etc/passwd && \
     chown -R {{ .Uid }}:{{ .Gid }} /usr/src
 
 USER builduser
+{{- end }}
 WORKDIR /usr/src
-ENTRYPOINT /usr/bin/gokr-build-kernel
+ENTRYPOINT ["/usr/bin/gokr-build-kernel"]
+{{- with .Stages }}
+
+FROM builder AS source
+RUN {{ .Download }}
+
+FROM source AS configured
+RUN mkdir -p /tmp/buildresult
+RUN {{ .Configure }}
+
+FROM configured AS compiled
+RUN --mount=type=cache,id=gokr-rebuild-kernel-ccache,target=/ccache,uid={{ $.Uid }},gid={{ $.Gid }} \
+    {{ .Compile }}
+
+FROM scratch AS artifacts
+COPY --from=compiled /tmp/buildresult/ /
+{{- end }}
+{{- define "plugins" }}{{ with .GCCPluginDev }} && \
+    apt-get install -y {{ . }}{{ end }}{{ end }}
+{{- define "packages" }}{{ .Toolchain }} bc libssl-dev bison flex kmod ccache{{ if .Sparse }} sparse{{ end }}{{ if .Python }} python3{{ end }}{{ if .Git }} git{{ end }}{{ if .OpenSSL }} openssl{{ end }}{{ end }}
 `
 
 var dockerFileTmpl = template.Must(template.New("dockerfile").
@@ -40,12 +86,104 @@ var dockerFileTmpl = template.Must(template.New("dockerfile").
 	}).
 	Parse(dockerFileContents))
 
-var patchFiles = []string{
-	"0001-Revert-add-index-to-the-ethernet-alias.patch",
-	// spi
-	"0201-enable-spidev.patch",
-	// logo
-	"0001-gokrazy-logo.patch",
+// dockerfile are the parameters of the Dockerfile of the build container.
+//
+// The Dockerfile has two stages: the toolchain stage installs the compiler
+// and build tools into the base image, and only changes with the base image
+// and the installed packages, so that its layers stay cached across kernel
+// bumps. The final stage adds the builder, patches, overlays etc. on top of
+// it. If ToolchainImage is set, it is used instead of the toolchain stage.
+// With -compile_stage, further stages download the source, configure and
+// compile the kernel, see compileStages.
+// With BuildKit, apt keeps its downloads in cache mounts, and the apt
+// configuration with credentials (-apt_secret) is only mounted while
+// installing, so that it does not end up in a layer.
+type dockerfile struct {
+	BaseImage      string
+	ToolchainImage string // prebuilt toolchain image, see -toolchain_image
+	Toolchain      string // Debian packages providing an arm64 compiler
+	Uid            string // user to build as; 0 builds as root
+	Gid            string
+	BuildPath      string
+	Patches        []string // file names of the patches in the build context
+	Overlays       []string // names of the overlays in the build context
+	Hooks          []string // file names of the pre-build hooks in the build context
+	Defconfig      bool     // whether the build context contains a -defconfig file
+	Sparse         bool     // whether to install sparse, for -analyze=sparse
+	Python         bool     // whether to install python3, for -compile_commands
+	GCCPluginDev   string   // if non-empty, packages for building GCC plugins, see gccPluginDev
+	Git            bool     // whether to install git, for a kernel.lock Git source
+	OpenSSL        bool     // whether to install openssl, for generating a module signing key
+	BuildKit       bool     // whether to use RUN --mount, see -buildkit
+	AptSecret      bool     // whether the build has the -apt_secret secret
+	Stages         *compileStages
+}
+
+// compileStages are the gokr-build-kernel invocations of the Dockerfile
+// stages which build the kernel with -compile_stage, in exec form. Each
+// stage is a cached layer: the downloaded source, the configured kernel
+// tree, and the compiled kernel, whose build result the artifacts stage
+// exports.
+type compileStages struct {
+	Download  string
+	Configure string
+	Compile   string
+}
+
+// stageSourceDir is the directory the source stage downloads the kernel
+// source into.
+const stageSourceDir = "/usr/src/dl"
+
+// builderStages returns the compileStages running gokr-build-kernel with
+// args.
+func builderStages(args []string) (*compileStages, error) {
+	execForm := func(extra ...string) (string, error) {
+		cmd := append([]string{"/usr/bin/gokr-build-kernel"}, extra...)
+		b, err := json.Marshal(cmd)
+		return string(b), err
+	}
+	// Only the mirrors and connections affect the download, so that
+	// changing other flags keeps the cached source.
+	downloadArgs := []string{"-download_only", "-source_dir=" + stageSourceDir}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-mirror=") || strings.HasPrefix(arg, "-download_connections=") {
+			downloadArgs = append(downloadArgs, arg)
+		}
+	}
+	download, err := execForm(downloadArgs...)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "-source_dir="+stageSourceDir)
+	configure, err := execForm(append([]string{"-stage=configure"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	compile, err := execForm(append([]string{"-stage=compile"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &compileStages{
+		Download:  download,
+		Configure: configure,
+		Compile:   compile,
+	}, nil
+}
+
+// writeDockerfile writes the Dockerfile of the build container to w.
+func writeDockerfile(w io.Writer, d dockerfile) error {
+	return dockerFileTmpl.Execute(w, d)
+}
+
+// patchFiles are the file names of the patches listed in kernel.lock.
+var patchFiles = lockedPatchFiles()
+
+func lockedPatchFiles() []string {
+	var names []string
+	for _, p := range kernelversion.Patches() {
+		names = append(names, p.Name)
+	}
+	return names
 }
 
 func copyFile(dest, src string) error {
@@ -85,6 +223,30 @@ func mustGetGopath() string {
 	return strings.TrimSpace(string(gopathb))
 }
 
+// startDir is the working directory at startup, before -output_dir changes
+// it.
+var startDir, _ = os.Getwd()
+
+// startPath returns path, if relative, relative to startDir, as -output_dir
+// changes the working directory.
+func startPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(startDir, path)
+}
+
+// goBuildDir returns the directory to build gokr-build-kernel in: the
+// working directory at startup if it is the root of a Go module (e.g. a
+// checkout of this repository, when building into a different -output_dir),
+// or the current working directory.
+func goBuildDir() string {
+	if _, err := os.Stat(filepath.Join(startDir, "go.mod")); err == nil {
+		return startDir
+	}
+	return ""
+}
+
 func find(filename string) (string, error) {
 	if _, err := os.Stat(filename); err == nil {
 		return filename, nil
@@ -100,8 +262,10 @@ func find(filename string) (string, error) {
 
 func getContainerExecutable() (string, error) {
 	// Probe podman first, because the docker binary might actually
-	// be a thin podman wrapper with podman behavior.
-	choices := []string{"podman", "docker"}
+	// be a thin podman wrapper with podman behavior. nerdctl comes last,
+	// as setups with nerdctl in addition to docker usually build with
+	// docker.
+	choices := []string{"podman", "docker", "nerdctl", "nerdctl.lima"}
 	for _, exe := range choices {
 		p, err := exec.LookPath(exe)
 		if err != nil {
@@ -115,197 +279,3 @@ func getContainerExecutable() (string, error) {
 	}
 	return "", fmt.Errorf("none of %v found in $PATH", choices)
 }
-
-func main() {
-	var overwriteContainerExecutable = flag.String("overwrite_container_executable",
-		"",
-		"E.g. docker or podman to overwrite the automatically detected container executable")
-	flag.Parse()
-	executable, err := getContainerExecutable()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if *overwriteContainerExecutable != "" {
-		executable = *overwriteContainerExecutable
-	}
-	execName := filepath.Base(executable)
-	// We explicitly use /tmp, because Docker only allows volume mounts under
-	// certain paths on certain platforms, see
-	// e.g. https://docs.docker.com/docker-for-mac/osxfs/#namespaces for macOS.
-	tmp, err := ioutil.TempDir("/tmp", "gokr-rebuild-kernel")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer os.RemoveAll(tmp)
-
-	buildPath := filepath.Join(tmp, "gokr-build-kernel")
-
-	cmd := exec.Command("go", "build", "-o", buildPath, "github.com/alf632/gokrazy-kernel/cmd/gokr-build-kernel")
-	cmd.Env = append(os.Environ(), "GOOS=linux", "CGO_ENABLED=0")
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("%v: %v", cmd.Args, err)
-	}
-
-	var patchPaths []string
-	for _, filename := range patchFiles {
-		path, err := find(filename)
-		if err != nil {
-			log.Fatal(err)
-		}
-		patchPaths = append(patchPaths, path)
-	}
-
-	kernelPath, err := find("vmlinuz")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dtbPath, err := find("bcm2710-rpi-3-b.dtb")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dtbPlusPath, err := find("bcm2710-rpi-3-b-plus.dtb")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dtbZero2WPath, err := find("bcm2710-rpi-zero-2.dtb")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dtbCM3Path, err := find("bcm2710-rpi-cm3.dtb")
-	if err != nil {
-		log.Fatal(err)
-	}
-	dtb4Path, err := find("bcm2711-rpi-4-b.dtb")
-	if err != nil {
-		log.Fatal(err)
-	}
-	libPath, err := find("lib")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Copy all files into the temporary directory so that docker
-	// includes them in the build context.
-	for _, path := range patchPaths {
-		if err := copyFile(filepath.Join(tmp, filepath.Base(path)), path); err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	u, err := user.Current()
-	if err != nil {
-		log.Fatal(err)
-	}
-	dockerFile, err := os.Create(filepath.Join(tmp, "Dockerfile"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := dockerFileTmpl.Execute(dockerFile, struct {
-		Uid       string
-		Gid       string
-		BuildPath string
-		Patches   []string
-	}{
-		Uid:       u.Uid,
-		Gid:       u.Gid,
-		BuildPath: buildPath,
-		Patches:   patchFiles,
-	}); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := dockerFile.Close(); err != nil {
-		log.Fatal(err)
-	}
-
-	log.Printf("building %s container for kernel compilation", execName)
-
-	dockerBuild := exec.Command(execName,
-		"build",
-		"--rm=true",
-		"--tag=gokr-rebuild-kernel",
-		".")
-	dockerBuild.Dir = tmp
-	dockerBuild.Stdout = os.Stdout
-	dockerBuild.Stderr = os.Stderr
-	if err := dockerBuild.Run(); err != nil {
-		log.Fatalf("%s build: %v (cmd: %v)", execName, err, dockerBuild.Args)
-	}
-
-	log.Printf("compiling kernel")
-
-	var dockerRun *exec.Cmd
-	if execName == "podman" {
-		dockerRun = exec.Command(executable,
-			"run",
-			"--userns=keep-id",
-			"--rm",
-			"--volume", tmp+":/tmp/buildresult:Z",
-			"gokr-rebuild-kernel")
-	} else {
-		dockerRun = exec.Command(executable,
-			"run",
-			"--rm",
-			"--volume", tmp+":/tmp/buildresult:Z",
-			"gokr-rebuild-kernel")
-	}
-	dockerRun.Dir = tmp
-	dockerRun.Stdout = os.Stdout
-	dockerRun.Stderr = os.Stderr
-	if err := dockerRun.Run(); err != nil {
-		log.Fatalf("%s run: %v (cmd: %v)", execName, err, dockerRun.Args)
-	}
-
-	if err := copyFile(kernelPath, filepath.Join(tmp, "vmlinuz")); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := copyFile(dtbPath, filepath.Join(tmp, "bcm2710-rpi-3-b.dtb")); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := copyFile(dtbZero2WPath, filepath.Join(tmp, "bcm2710-rpi-zero-2-w.dtb")); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := copyFile(dtbPlusPath, filepath.Join(tmp, "bcm2710-rpi-3-b-plus.dtb")); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := copyFile(dtbCM3Path, filepath.Join(tmp, "bcm2710-rpi-cm3.dtb")); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := copyFile(dtb4Path, filepath.Join(tmp, "bcm2711-rpi-4-b.dtb")); err != nil {
-		log.Fatal(err)
-	}
-
-	// remove symlinks that only work when source/build directory are present
-	for _, subdir := range []string{"build", "source"} {
-		matches, err := filepath.Glob(filepath.Join(tmp, "lib/modules", "*", subdir))
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, match := range matches {
-			if err := os.Remove(match); err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
-
-	// replace kernel modules directory
-	rm := exec.Command("rm", "-rf", filepath.Join(libPath, "modules"))
-	rm.Stdout = os.Stdout
-	rm.Stderr = os.Stderr
-	if err := rm.Run(); err != nil {
-		log.Fatalf("%v: %v", rm.Args, err)
-	}
-	cp := exec.Command("cp", "-r", filepath.Join(tmp, "lib/modules"), libPath)
-	cp.Stdout = os.Stdout
-	cp.Stderr = os.Stderr
-	if err := cp.Run(); err != nil {
-		log.Fatalf("%v: %v", cp.Args, err)
-	}
-}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteDockerfile(t *testing.T) {
+	base := dockerfile{
+		BaseImage: "debian:bookworm@sha256:0123",
+		Toolchain: "crossbuild-essential-arm64",
+		Uid:       "1000",
+		Gid:       "1000",
+		Patches:   []string{"0001-fix.patch", "0002-feature.patch"},
+	}
+	for _, tt := range []struct {
+		name    string
+		modify  func(d *dockerfile)
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "default",
+			want: []string{
+				"FROM debian:bookworm@sha256:0123 AS toolchain\n",
+				"RUN apt-get update && apt-get install -y crossbuild-essential-arm64 bc libssl-dev bison flex kmod ccache\n",
+				"FROM toolchain AS builder\n",
+				"COPY 0001-fix.patch /usr/src/0001-fix.patch\n",
+				"COPY 0002-feature.patch /usr/src/0002-feature.patch\n",
+				"RUN echo 'builduser:x:1000:1000:nobody:/:/bin/sh' >> /etc/passwd",
+				"USER builduser\n",
+				`ENTRYPOINT ["/usr/bin/gokr-build-kernel"]`,
+			},
+			notWant: []string{"--mount", "FROM scratch AS artifacts", "sparse", "openssl"},
+		},
+		{
+			name:    "rootless",
+			modify:  func(d *dockerfile) { d.Uid, d.Gid = "0", "0" },
+			notWant: []string{"builduser"},
+		},
+		{
+			name: "optional packages",
+			modify: func(d *dockerfile) {
+				d.Sparse, d.Python, d.Git, d.OpenSSL = true, true, true, true
+				d.GCCPluginDev = "gcc-12-plugin-dev-aarch64-linux-gnu"
+			},
+			want: []string{
+				"kmod ccache sparse python3 git openssl && \\\n    apt-get install -y gcc-12-plugin-dev-aarch64-linux-gnu\n",
+			},
+		},
+		{
+			name:   "toolchain image",
+			modify: func(d *dockerfile) { d.ToolchainImage = "registry.example/toolchain@sha256:4567" },
+			want:   []string{"FROM registry.example/toolchain@sha256:4567 AS builder\n"},
+			notWant: []string{
+				"AS toolchain",
+				"apt-get",
+			},
+		},
+		{
+			name: "buildkit with apt secret",
+			modify: func(d *dockerfile) {
+				d.BuildKit, d.AptSecret = true, true
+			},
+			want: []string{
+				"RUN --mount=type=cache,target=/var/cache/apt,sharing=locked",
+				"--mount=type=secret,id=apt,target=/etc/apt/apt.conf.d/99gokr-secret",
+				"rm -f /etc/apt/apt.conf.d/docker-clean",
+			},
+		},
+		{
+			name: "build context files",
+			modify: func(d *dockerfile) {
+				d.Overlays = []string{"fan"}
+				d.Hooks = []string{"0-hook.sh"}
+				d.Defconfig = true
+			},
+			want: []string{
+				"COPY overlays/fan.dts /usr/src/overlays/fan.dts\n",
+				"COPY hooks/0-hook.sh /usr/src/hooks/0-hook.sh\n",
+				"COPY defconfig /usr/src/defconfig\n",
+			},
+		},
+		{
+			name: "compile stages",
+			modify: func(d *dockerfile) {
+				d.Stages = &compileStages{Download: `["dl"]`, Configure: `["configure"]`, Compile: `["compile"]`}
+			},
+			want: []string{
+				"FROM builder AS source\nRUN [\"dl\"]\n",
+				"RUN [\"configure\"]\n",
+				"target=/ccache,uid=1000,gid=1000 \\\n    [\"compile\"]\n",
+				"FROM scratch AS artifacts\nCOPY --from=compiled /tmp/buildresult/ /",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := base
+			if tt.modify != nil {
+				tt.modify(&d)
+			}
+			var buf bytes.Buffer
+			if err := writeDockerfile(&buf, d); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Dockerfile does not contain %q:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("Dockerfile unexpectedly contains %q:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBuilderStages(t *testing.T) {
+	stages, err := builderStages([]string{"-profiles=camera", "-mirror=https://mirror.example/linux", "-download_connections=4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		got  string
+		want []string
+	}{
+		{"download", stages.Download, []string{"/usr/bin/gokr-build-kernel", "-download_only", "-source_dir=/usr/src/dl", "-mirror=https://mirror.example/linux", "-download_connections=4"}},
+		{"configure", stages.Configure, []string{"/usr/bin/gokr-build-kernel", "-stage=configure", "-profiles=camera", "-mirror=https://mirror.example/linux", "-download_connections=4", "-source_dir=/usr/src/dl"}},
+		{"compile", stages.Compile, []string{"/usr/bin/gokr-build-kernel", "-stage=compile", "-profiles=camera", "-mirror=https://mirror.example/linux", "-download_connections=4", "-source_dir=/usr/src/dl"}},
+	} {
+		var got []string
+		if err := json.Unmarshal([]byte(tt.got), &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s stage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// localVersion returns the suffix to append to the kernel release
+// (CONFIG_LOCALVERSION) for the -localversion flag value mode: for "auto",
+// -gokrazy-<short commit hash> of the repository in dir (with -dirty if it
+// has uncommitted changes), so that uname -r identifies the commit which
+// produced a kernel. "none" disables the suffix; any other value is used
+// verbatim.
+func localVersion(mode, dir string) (string, error) {
+	switch mode {
+	case "none", "":
+		return "", nil
+	case "auto":
+	default:
+		if strings.ContainsAny(mode, " \t\n\"/") {
+			return "", fmt.Errorf("invalid -localversion %q: must not contain whitespace, quotes or slashes", mode)
+		}
+		return mode, nil
+	}
+	revParse := exec.Command("git", "rev-parse", "--short=12", "HEAD")
+	revParse.Dir = dir
+	out, err := revParse.Output()
+	if err != nil {
+		log.Printf("%s is not a git checkout, not setting a local version", dir)
+		return "", nil
+	}
+	suffix := "-gokrazy-" + strings.TrimSpace(string(out))
+	status := exec.Command("git", "status", "--porcelain", "--untracked-files=no")
+	status.Dir = dir
+	if out, err := status.Output(); err == nil && len(strings.TrimSpace(string(out))) > 0 {
+		suffix += "-dirty"
+	}
+	return suffix, nil
+}
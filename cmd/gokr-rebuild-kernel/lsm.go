@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+)
+
+// selinuxEnabled reports whether SELinux is enabled on the host, in which
+// case volumes need to be relabeled for the container to access them.
+func selinuxEnabled() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// volumeSuffix returns the options to append to a --volume specification
+// for the volume label mode (auto, Z, z or none). shared volumes (e.g. the
+// ccache) are used by multiple containers and get a shared label.
+//
+// With auto, volumes are only relabeled if SELinux is enabled (e.g. Fedora),
+// where it is required: some docker setups with AppArmor (e.g. Ubuntu)
+// reject the :Z option.
+func volumeSuffix(mode string, shared bool) (string, error) {
+	switch mode {
+	case "auto":
+		if !selinuxEnabled() {
+			return "", nil
+		}
+		if shared {
+			return ":z", nil
+		}
+		return ":Z", nil
+	case "Z", "z":
+		return ":" + mode, nil
+	case "none":
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid volume label mode %q, expected one of auto, Z, z, none", mode)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// moduleKeyMount is where the -module_signing_key file is mounted
+// (read-only) in the build container.
+const moduleKeyMount = "/module-signing-key.pem"
+
+// moduleCertName is the certificate of the module signing key which
+// gokr-build-kernel -sign_modules writes into the build result, and which
+// install copies next to vmlinuz.
+const moduleCertName = "module-signing.x509"
+
+// checkModuleSigningKey checks that path is usable as CONFIG_MODULE_SIG_KEY:
+// a PEM file with an unencrypted private key (Kbuild cannot prompt for a
+// passphrase) and the X.509 certificate to embed into the kernel, which it
+// returns.
+func checkModuleSigningKey(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cert *x509.Certificate
+		key  bool
+	)
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		case block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] != "":
+			return nil, fmt.Errorf("%s: the private key is encrypted, which the kernel build does not support", path)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			key = true
+		}
+	}
+	if !key {
+		return nil, fmt.Errorf("%s contains no private key", path)
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("%s contains no certificate, append it to the private key (e.g. openssl req -new -x509 -key key.pem -subj /CN=modules -days 36500 >> key.pem)", path)
+	}
+	// The kernel does not check the validity period of the certificate,
+	// but an expired one is likely a mistake.
+	if time.Now().After(cert.NotAfter) {
+		log.Printf("warning: the module signing certificate %q expired on %s", cert.Subject, cert.NotAfter.Format("2006-01-02"))
+	}
+	return cert, nil
+}
+
+// installModuleCert copies the certificate of the module signing key next
+// to vmlinuz, for verifying modules against it (e.g. with openssl x509
+// -inform der -fingerprint).
+func (b *kernelBuild) installModuleCert() error {
+	dest := filepath.Join(filepath.Dir(b.kernelPath), moduleCertName)
+	if !b.opts.signModules {
+		if _, err := os.Stat(dest); err == nil {
+			log.Printf("warning: %s was exported for a previous kernel, rebuild with -sign_modules or remove it", dest)
+		}
+		return nil
+	}
+	path := filepath.Join(b.tmp, moduleCertName)
+	if err := b.fs.copyFile(dest, path); err != nil {
+		return err
+	}
+	if b.opts.dryRun {
+		return nil
+	}
+	der, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	log.Printf("modules signed, certificate stored in %s (SHA-256 fingerprint %x)", dest, sha256.Sum256(der))
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// containerNamespace is the containerd namespace in which nerdctl builds and
+// runs the build container, see addNamespaceFlag.
+var containerNamespace string
+
+// limaWritableDir is the only host directory the default Lima template
+// mounts writable into the VM (the home directory is mounted read-only).
+const limaWritableDir = "/tmp/lima"
+
+func addNamespaceFlag(fset *flag.FlagSet) *string {
+	return fset.String("namespace",
+		"",
+		"containerd namespace to use with nerdctl, e.g. k8s.io to share images with Kubernetes (default: $CONTAINERD_NAMESPACE, or nerdctl's default)")
+}
+
+// containerCommand returns a command running the container runtime
+// executable with args. nerdctl gets the -namespace flag, which (unlike
+// $CONTAINERD_NAMESPACE) also reaches nerdctl within a Lima VM.
+func containerCommand(executable string, args ...string) *exec.Cmd {
+	return containerCommandContext(context.Background(), executable, args...)
+}
+
+// containerCommandContext is like containerCommand, but the command is
+// killed when ctx is done.
+func containerCommandContext(ctx context.Context, executable string, args ...string) *exec.Cmd {
+	if containerNamespace != "" && runtimeName(executable) == "nerdctl" {
+		args = append([]string{"--namespace=" + containerNamespace}, args...)
+	}
+	return exec.CommandContext(ctx, executable, args...)
+}
+
+// isLima reports whether executable runs the container runtime within a Lima
+// VM, e.g. nerdctl.lima.
+func isLima(executable string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(filepath.Base(executable), ".exe"), ".lima")
+}
+
+// warnIfNotLimaWritable logs a warning if dir (used for purpose) is likely
+// not mounted writable into the Lima VM, in which case the build container
+// cannot write to it.
+func warnIfNotLimaWritable(dir, purpose string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	if abs == limaWritableDir || strings.HasPrefix(abs, limaWritableDir+"/") {
+		return
+	}
+	log.Printf("warning: %s (%s) is not in %s, the only directory the default Lima template mounts writable. Add a writable mount to your Lima instance, or use a directory in %s", abs, purpose, limaWritableDir, limaWritableDir)
+}
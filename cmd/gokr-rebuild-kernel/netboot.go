@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// serialRe matches a Raspberry Pi serial number as used for the
+// per-device TFTP directories: the last 8 hex digits, lower case.
+var serialRe = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// netbootFiles are the artifacts the Raspberry Pi firmware loads over TFTP:
+// everything on the boot partition except the kernel modules.
+var netbootFiles = []string{"vmlinuz", "*.dtb", "overlays", "config.txt", "cmdline.txt"}
+
+// firmwareFiles match the firmware files (e.g. from a checkout of
+// github.com/gokrazy/firmware) which must be served next to the kernel.
+var firmwareFiles = []string{"start*.elf", "fixup*.dat", "bootcode.bin"}
+
+// netbootLayout lays out the artifacts in the repository directory dir for
+// Raspberry Pi network boot in tftpRoot: in a directory per serial number,
+// or in tftpRoot itself if serials is empty. Firmware files are copied from
+// firmwareDir, if non-empty.
+func netbootLayout(dir, tftpRoot string, serials []string, firmwareDir string, act *actions) error {
+	for _, serial := range serials {
+		if !serialRe.MatchString(serial) {
+			return fmt.Errorf("invalid serial number %q: expected the last 8 hex digits (lower case) of the serial in /proc/cpuinfo", serial)
+		}
+	}
+	staging, err := ioutil.TempDir("", "gokr-rebuild-kernel-netboot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	stage := func(srcDir string, patterns []string) (int, error) {
+		n := 0
+		for _, pattern := range patterns {
+			matches, err := filepath.Glob(filepath.Join(srcDir, pattern))
+			if err != nil {
+				return 0, err
+			}
+			for _, src := range matches {
+				st, err := os.Stat(src)
+				if err != nil {
+					return 0, err
+				}
+				dest := filepath.Join(staging, filepath.Base(src))
+				if st.IsDir() {
+					err = copyDir(dest, src)
+				} else {
+					err = copyFile(dest, src)
+				}
+				if err != nil {
+					return 0, err
+				}
+				n++
+			}
+		}
+		return n, nil
+	}
+	if _, err := stage(dir, netbootFiles); err != nil {
+		return err
+	}
+	hasFirmware := false
+	if firmwareDir != "" {
+		n, err := stage(firmwareDir, firmwareFiles)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no firmware files (%s) found in %s", strings.Join(firmwareFiles, ", "), firmwareDir)
+		}
+		hasFirmware = true
+	}
+
+	if err := act.mkdirAll(tftpRoot); err != nil {
+		return err
+	}
+	targets := []string{tftpRoot}
+	if len(serials) > 0 {
+		targets = nil
+		for _, serial := range serials {
+			targets = append(targets, filepath.Join(tftpRoot, serial))
+		}
+	}
+	for _, target := range targets {
+		if target == tftpRoot {
+			// Do not replace the TFTP root, which might serve other
+			// files, too: only copy the artifacts.
+			fis, err := ioutil.ReadDir(staging)
+			if err != nil {
+				return err
+			}
+			for _, fi := range fis {
+				src := filepath.Join(staging, fi.Name())
+				if fi.IsDir() {
+					err = act.replaceDir(filepath.Join(target, fi.Name()), src)
+				} else {
+					err = act.copyFile(filepath.Join(target, fi.Name()), src)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		} else if err := act.replaceDir(target, staging); err != nil {
+			return err
+		}
+		log.Printf("laid out netboot files in %s", target)
+	}
+
+	log.Printf("netboot hints:")
+	if !hasFirmware {
+		log.Printf("  - serve the firmware (start*.elf, fixup*.dat from github.com/gokrazy/firmware) next to the kernel, or use -firmware_dir")
+	}
+	log.Printf("  - Pi 4: set BOOT_ORDER=0xf21 (network boot after SD card) with rpi-eeprom-config; the firmware requests <serial>/ unless TFTP_PREFIX is changed")
+	log.Printf("  - Pi 3B/3B+: serve bootcode.bin from the TFTP root (or put it on an otherwise empty SD card); the Pi 3B needs program_usb_boot_mode=1 once")
+	log.Printf("  - cmdline.txt is served as-is: point root= at storage the device has, e.g. a USB drive or an NFS export")
+	return nil
+}
+
+// netboot lays out the kernel artifacts for Raspberry Pi network boot.
+func netboot(args []string) error {
+	fset := flag.NewFlagSet("netboot", flag.ExitOnError)
+	var tftpRoot = fset.String("tftp_root",
+		"",
+		"directory served by the TFTP server")
+	var serials = fset.String("serials",
+		"",
+		"comma-separated list of Raspberry Pi serial numbers (last 8 hex digits) to lay out a directory for each. If empty, the files are copied into -tftp_root itself")
+	var firmwareDir = fset.String("firmware_dir",
+		"",
+		"if non-empty, directory containing the Raspberry Pi firmware (e.g. a checkout of github.com/gokrazy/firmware) to serve along with the kernel")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the files which would be modified, without modifying them")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *tftpRoot == "" {
+		return fmt.Errorf("-tftp_root is required")
+	}
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	return netbootLayout(filepath.Dir(kernelPath), *tftpRoot, splitSerials(*serials), *firmwareDir, &actions{dryRun: *dryRun})
+}
+
+// splitSerials splits the comma-separated list of serial numbers.
+func splitSerials(list string) []string {
+	var serials []string
+	for _, serial := range strings.Split(list, ",") {
+		if serial = strings.ToLower(strings.TrimSpace(serial)); serial != "" {
+			serials = append(serials, serial)
+		}
+	}
+	return serials
+}
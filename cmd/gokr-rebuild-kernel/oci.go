@@ -0,0 +1,531 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/oci"
+	"github.com/alf632/gokrazy-kernel/provenance"
+)
+
+// Media types of the kernel OCI artifact. Layers follow the ORAS
+// conventions (a file per layer, directories as tar+gzip marked for
+// unpacking), so that the oras CLI can pull it, too.
+const (
+	ociArtifactType      = "application/vnd.gokrazy.kernel.v1"
+	ociConfigMediaType   = "application/vnd.gokrazy.kernel.buildinfo.v1+json"
+	ociFileMediaType     = "application/vnd.gokrazy.kernel.file.v1"
+	ociDirMediaType      = "application/vnd.gokrazy.kernel.dir.v1.tar+gzip"
+	orasUnpackAnnotation = "io.deis.oras.content.unpack"
+)
+
+// ociLayer is a layer of the kernel artifact, staged in a temporary file.
+type ociLayer struct {
+	desc oci.Descriptor
+	path string
+}
+
+// tarDir writes the directory dir (whose entries are named relative to the
+// parent of dir) to w as tar+gzip. All timestamps are set to mtime and
+// ownership is omitted, so that the same artifacts result in the same
+// digest.
+func tarDir(w io.Writer, dir string, mtime time.Time) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	parent := filepath.Dir(dir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.ModTime = mtime
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// stageOCILayers stages the artifacts paths (relative to dir) as layers in
+// staging.
+func stageOCILayers(dir, staging string, paths []string, mtime time.Time) ([]ociLayer, error) {
+	var layers []ociLayer
+	for _, path := range paths {
+		src := filepath.Join(dir, path)
+		st, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		layer := ociLayer{
+			desc: oci.Descriptor{
+				MediaType:   ociFileMediaType,
+				Annotations: map[string]string{oci.AnnotationTitle: path},
+			},
+			path: src,
+		}
+		if st.IsDir() {
+			layer.desc.MediaType = ociDirMediaType
+			layer.desc.Annotations[orasUnpackAnnotation] = "true"
+			layer.path = filepath.Join(staging, path+".tar.gz")
+			f, err := os.Create(layer.path)
+			if err != nil {
+				return nil, err
+			}
+			if err := tarDir(f, src, mtime); err != nil {
+				f.Close()
+				return nil, err
+			}
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+		}
+		if layer.desc.Digest, layer.desc.Size, err = digestFile(layer.path); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+func digestFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), n, nil
+}
+
+// pushArtifacts pushes the kernel artifacts in the repository directory dir
+// as an OCI artifact to ref and returns the digest of its manifest.
+func pushArtifacts(dir string, ref oci.Reference, insecure, dryRun bool) (string, error) {
+	paths, release, err := artifactPaths(dir)
+	if err != nil {
+		return "", err
+	}
+	config := []byte("{}")
+	mtime := time.Unix(0, 0)
+	biPath := filepath.Join(dir, buildinfo.FileName)
+	if b, err := ioutil.ReadFile(biPath); err == nil {
+		config = b
+		if bi, err := buildinfo.Read(biPath); err == nil && !bi.BuildTime.IsZero() {
+			mtime = bi.BuildTime
+		}
+	}
+
+	staging, err := ioutil.TempDir("", "gokr-rebuild-kernel-push")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	layers, err := stageOCILayers(dir, staging, paths, mtime)
+	if err != nil {
+		return "", err
+	}
+	m := &oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeManifest,
+		ArtifactType:  ociArtifactType,
+		Config: oci.Descriptor{
+			MediaType: ociConfigMediaType,
+			Digest:    oci.Digest(config),
+			Size:      int64(len(config)),
+		},
+		Annotations: map[string]string{
+			"org.opencontainers.image.version": release,
+			"org.opencontainers.image.created": mtime.UTC().Format(time.RFC3339),
+		},
+	}
+	for _, l := range layers {
+		m.Layers = append(m.Layers, l.desc)
+	}
+	if dryRun {
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		log.Printf("[dry-run] would push to %s:\n%s", ref, b)
+		return "", nil
+	}
+
+	c := oci.NewClient(ref)
+	c.Insecure = insecure
+	if _, err := c.PushBytes(ociConfigMediaType, config); err != nil {
+		return "", err
+	}
+	for _, l := range layers {
+		if verbosity >= 1 {
+			log.Printf("pushing %s (%s, %d bytes)", l.desc.Annotations[oci.AnnotationTitle], l.desc.Digest, l.desc.Size)
+		}
+		path := l.path
+		err := c.PushBlob(l.desc.Digest, l.desc.Size, func() (io.ReadCloser, error) {
+			return os.Open(path)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.PushManifest(m, "")
+}
+
+// push pushes the kernel artifacts in the repository to an OCI registry,
+// e.g. to distribute them using existing registry infrastructure.
+func push(args []string) error {
+	fset := flag.NewFlagSet("push", flag.ExitOnError)
+	var insecure = fset.Bool("insecure",
+		false,
+		"use HTTP instead of HTTPS, e.g. for a local registry")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the manifest which would be pushed, without pushing")
+	var sign = fset.String("sign",
+		"",
+		"sign the artifact with cosign: a cosign key reference (a file, or e.g. awskms://…), or keyless for sigstore keyless signing")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel push [flags] <registry/repository[:tag]>\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	ref, err := oci.ParseReference(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	digest, err := pushArtifacts(filepath.Dir(kernelPath), ref, *insecure, *dryRun)
+	if err != nil {
+		return err
+	}
+	if digest == "" {
+		return nil // dry run
+	}
+	log.Printf("pushed %s@%s", ref, digest)
+	if *sign != "" {
+		if err := cosignSign(ref, digest, *sign, *insecure, &actions{}); err != nil {
+			return err
+		}
+		log.Printf("signed %s@%s", ref, digest)
+		provenancePath := filepath.Join(filepath.Dir(kernelPath), provenance.FileName)
+		if _, err := os.Stat(provenancePath); err == nil {
+			if err := cosignAttest(ref, digest, *sign, provenancePath, *insecure, &actions{}); err != nil {
+				return err
+			}
+			log.Printf("attested the provenance of %s@%s", ref, digest)
+		}
+	}
+	return nil
+}
+
+// untarDir extracts the tar+gzip stream r into dir, refusing entries outside
+// of dir. Symlinks may only point to their directory or below (relative
+// targets without ..), and no entry is written through a symlink, so that
+// a malicious artifact cannot write or point outside of dir.
+func untarDir(r io.Reader, dir string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || hasDotDot(name) {
+			return fmt.Errorf("refusing to extract %q: outside of the destination", hdr.Name)
+		}
+		if err := checkNoSymlink(dir, name); err != nil {
+			return fmt.Errorf("refusing to extract %q: %v", hdr.Name, err)
+		}
+		path := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if link := filepath.FromSlash(hdr.Linkname); filepath.IsAbs(link) || hasDotDot(filepath.Clean(link)) {
+				return fmt.Errorf("refusing to extract %q: symlink to %q outside of its directory", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported tar entry %q (type %c)", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// hasDotDot reports whether the clean relative path name has a .. component.
+func hasDotDot(name string) bool {
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNoSymlink returns an error if name (relative to dir) or one of its
+// parent directories is an existing symlink.
+func checkNoSymlink(dir, name string) error {
+	path := dir
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", path)
+		}
+	}
+	return nil
+}
+
+// pullArtifacts pulls the kernel OCI artifact ref into the repository
+// directory dir. All layers are downloaded and verified into a staging
+// directory before any artifact in dir is replaced. If verify is enabled,
+// the signature of the manifest is verified before any layer is downloaded.
+// The replaced artifacts are backed up first, see backupArtifacts, and
+// restored if replacing them fails partway.
+func pullArtifacts(dir string, ref oci.Reference, insecure bool, verify *verifyFlags, keepBackups int, act *actions) (string, error) {
+	c := oci.NewClient(ref)
+	c.Insecure = insecure
+	m, digest, err := c.Manifest("")
+	if err != nil {
+		return "", err
+	}
+	if verify.enabled() {
+		// Verify the digest we fetched, not the tag, which could have
+		// been moved in the meantime.
+		hasProvenance := false
+		for _, l := range m.Layers {
+			if l.Annotations[oci.AnnotationTitle] == provenance.FileName {
+				hasProvenance = true
+			}
+		}
+		if err := verify.verify(ref, digest, insecure, hasProvenance); err != nil {
+			return "", err
+		}
+		log.Printf("verified the signature of %s@%s", ref, digest)
+	}
+	if m.ArtifactType != ociArtifactType && m.Config.MediaType != ociConfigMediaType {
+		return "", fmt.Errorf("%s is not a gokrazy kernel artifact (artifact type %q)", ref, m.ArtifactType)
+	}
+	staging, err := ioutil.TempDir("", "gokr-rebuild-kernel-pull")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	// The titles name the files replaced in dir, so anything but a kernel
+	// artifact (e.g. .git or a patch) is refused before downloading.
+	for _, l := range m.Layers {
+		name := l.Annotations[oci.AnnotationTitle]
+		if name == "" || name != filepath.Base(name) || !isArtifactName(name) {
+			return "", fmt.Errorf("layer %s: title %q is not a kernel artifact", l.Digest, name)
+		}
+	}
+	var names []string
+	for _, l := range m.Layers {
+		name := l.Annotations[oci.AnnotationTitle]
+		if verbosity >= 1 {
+			log.Printf("pulling %s (%s, %d bytes)", name, l.Digest, l.Size)
+		}
+		blob, err := os.Create(filepath.Join(staging, name+".blob"))
+		if err != nil {
+			return "", err
+		}
+		if err := c.FetchBlob(l, blob); err != nil {
+			blob.Close()
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		if l.Annotations[orasUnpackAnnotation] == "true" {
+			if _, err := blob.Seek(0, io.SeekStart); err != nil {
+				blob.Close()
+				return "", err
+			}
+			if err := untarDir(blob, staging); err != nil {
+				blob.Close()
+				return "", fmt.Errorf("%s: %v", name, err)
+			}
+			blob.Close()
+		} else {
+			if err := blob.Close(); err != nil {
+				return "", err
+			}
+			if err := os.Rename(blob.Name(), filepath.Join(staging, name)); err != nil {
+				return "", err
+			}
+		}
+		names = append(names, name)
+	}
+
+	backup, err := backupArtifacts(dir, keepBackups, act)
+	if err != nil {
+		return "", fmt.Errorf("backing up the artifacts: %v", err)
+	}
+	var fs fileSystem = act
+	replaced := &stagingFS{fs: act}
+	if !act.dryRun {
+		fs = replaced
+	}
+	for _, name := range names {
+		src := filepath.Join(staging, name)
+		st, err := os.Stat(src)
+		if err != nil {
+			replaced.abort()
+			return "", fmt.Errorf("%s: not contained in its layer: %v", name, err)
+		}
+		if st.IsDir() {
+			err = fs.replaceDir(filepath.Join(dir, name), src)
+		} else {
+			err = fs.copyFile(filepath.Join(dir, name), src)
+		}
+		if err != nil {
+			replaced.abort()
+			return "", err
+		}
+	}
+	if err := replaced.commit(); err != nil {
+		replaced.abort()
+		return "", restoreAfterFailure(dir, backup, act, err)
+	}
+	return digest, nil
+}
+
+// pull replaces the kernel artifacts in the repository with those of an OCI
+// artifact pushed by push.
+func pull(args []string) error {
+	fset := flag.NewFlagSet("pull", flag.ExitOnError)
+	var outputDir = fset.String("output_dir",
+		"",
+		"directory to store the artifacts in (default: the directory containing vmlinuz)")
+	var insecure = fset.Bool("insecure",
+		false,
+		"use HTTP instead of HTTPS, e.g. for a local registry")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"download and verify the artifact, but only print the files which would be replaced")
+	verify := addVerifyFlags(fset)
+	keepBackups := addKeepBackupsFlag(fset)
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel pull [flags] <registry/repository[:tag|@digest]>\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	ref, err := oci.ParseReference(fset.Arg(0))
+	if err != nil {
+		return err
+	}
+	dir := *outputDir
+	if dir == "" {
+		kernelPath, err := find("vmlinuz")
+		if err != nil {
+			return err
+		}
+		dir = filepath.Dir(kernelPath)
+	}
+	digest, err := pullArtifacts(dir, ref, *insecure, verify, *keepBackups, &actions{dryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	log.Printf("pulled %s@%s into %s", ref, digest, dir)
+	return nil
+}
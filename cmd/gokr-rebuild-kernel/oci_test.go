@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/oci"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+func tarGz(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUntarDirRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src", "modules")
+	if err := os.MkdirAll(filepath.Join(src, "6.5.7", "kernel"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "6.5.7", "kernel", "i2c.ko"), []byte("module"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("kernel/i2c.ko", filepath.Join(src, "6.5.7", "i2c.ko")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := tarDir(&buf, src, time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := untarDir(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dest, "modules", "6.5.7", "i2c.ko"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "module" {
+		t.Errorf("i2c.ko = %q, want %q", b, "module")
+	}
+}
+
+func TestUntarDirRefuses(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tarEntry
+		wantErr string
+	}{
+		{
+			name:    "parent directory",
+			entries: []tarEntry{{name: "../evil", typeflag: tar.TypeReg}},
+			wantErr: "outside of the destination",
+		},
+		{
+			name:    "parent directory after cleaning",
+			entries: []tarEntry{{name: "modules/../../evil", typeflag: tar.TypeReg}},
+			wantErr: "outside of the destination",
+		},
+		{
+			name:    "absolute",
+			entries: []tarEntry{{name: "/etc/evil", typeflag: tar.TypeReg}},
+			wantErr: "outside of the destination",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tarEntry{{name: "modules/evil", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+			wantErr: "outside of its directory",
+		},
+		{
+			name:    "escaping symlink",
+			entries: []tarEntry{{name: "modules/evil", typeflag: tar.TypeSymlink, linkname: "../../etc"}},
+			wantErr: "outside of its directory",
+		},
+		{
+			name: "write through symlink",
+			entries: []tarEntry{
+				{name: "modules/link", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "modules/link/evil", typeflag: tar.TypeReg, content: "x"},
+			},
+			wantErr: "is a symlink",
+		},
+		{
+			name: "overwrite symlink",
+			entries: []tarEntry{
+				{name: "modules/link", typeflag: tar.TypeSymlink, linkname: "target"},
+				{name: "modules/link", typeflag: tar.TypeReg, content: "x"},
+			},
+			wantErr: "is a symlink",
+		},
+		{
+			name:    "hard link",
+			entries: []tarEntry{{name: "modules/evil", typeflag: tar.TypeLink, linkname: "/etc/passwd"}},
+			wantErr: "unsupported tar entry",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			dest := filepath.Join(dir, "a", "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err = untarDir(bytes.NewReader(tarGz(t, tt.entries)), dest)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("untarDir: err = %v, want an error containing %q", err, tt.wantErr)
+			}
+			for _, outside := range []string{filepath.Join(dir, "evil"), filepath.Join(dir, "a", "evil")} {
+				if _, err := os.Lstat(outside); err == nil {
+					t.Errorf("untarDir created %s", outside)
+				}
+			}
+		})
+	}
+}
+
+// serveArtifact serves a kernel artifact with a single layer, titled title,
+// from a fake registry.
+func serveArtifact(t *testing.T, title string, content []byte) *httptest.Server {
+	layer := oci.Descriptor{
+		MediaType:   "application/octet-stream",
+		Digest:      oci.Digest(content),
+		Size:        int64(len(content)),
+		Annotations: map[string]string{oci.AnnotationTitle: title},
+	}
+	manifest, err := json.Marshal(&oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeManifest,
+		ArtifactType:  ociArtifactType,
+		Config:        oci.Descriptor{MediaType: oci.MediaTypeEmpty},
+		Layers:        []oci.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/kernel/manifests/latest":
+			w.Write(manifest)
+		case "/v2/kernel/blobs/" + layer.Digest:
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestPullArtifactsTitles(t *testing.T) {
+	for _, tt := range []struct {
+		title   string
+		wantErr bool
+	}{
+		{title: "vmlinuz"},
+		{title: "bcm2711-rpi-4-b.dtb"},
+		{title: ".git", wantErr: true},
+		{title: "go.mod", wantErr: true},
+		{title: "kernel.go", wantErr: true},
+		{title: "0001-gokrazy-logo.patch", wantErr: true},
+		{title: "../vmlinuz", wantErr: true},
+	} {
+		t.Run(tt.title, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			repo := filepath.Join(dir, "repo")
+			if err := os.Mkdir(repo, 0755); err != nil {
+				t.Fatal(err)
+			}
+			srv := serveArtifact(t, tt.title, []byte("pulled"))
+			defer srv.Close()
+			ref, err := oci.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			empty := ""
+			verify := &verifyFlags{key: &empty, identity: &empty, issuer: &empty}
+			_, err = pullArtifacts(repo, ref, true, verify, 0, &actions{})
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadFile(filepath.Join(repo, tt.title))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != "pulled" {
+					t.Errorf("%s = %q, want %q", tt.title, b, "pulled")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "is not a kernel artifact") {
+				t.Errorf("pullArtifacts: err = %v, want an error containing %q", err, "is not a kernel artifact")
+			}
+			for _, path := range []string{filepath.Join(repo, tt.title), filepath.Join(dir, "vmlinuz")} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Errorf("pullArtifacts created %s", path)
+				}
+			}
+		})
+	}
+}
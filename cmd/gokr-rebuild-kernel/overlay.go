@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/fdt"
+)
+
+// hostOverlay is a device tree overlay which is compiled on the host (see
+// fdt.Compile) instead of with dtc in the build container, e.g. a custom
+// overlay for a HAT passed via -overlay=myhat.dts.
+type hostOverlay struct {
+	name string // file name without .dts, as in dtoverlay=<name>
+	path string
+	tree *fdt.Tree
+}
+
+// compileOverlay compiles the overlay source at path.
+func compileOverlay(path string) (hostOverlay, error) {
+	if filepath.Ext(path) != ".dts" {
+		return hostOverlay{}, fmt.Errorf("overlay %s: expected a .dts file", path)
+	}
+	// build changes the working directory to -output_dir.
+	b, err := ioutil.ReadFile(startPath(path))
+	if err != nil {
+		return hostOverlay{}, err
+	}
+	t, err := fdt.Compile(path, b)
+	if err != nil {
+		return hostOverlay{}, err
+	}
+	fragments := 0
+	for _, n := range t.Root.Children {
+		if strings.HasPrefix(n.Name, "fragment@") {
+			fragments++
+		}
+	}
+	if fragments == 0 {
+		return hostOverlay{}, fmt.Errorf("%s: not an overlay (missing /plugin/ or fragments)", path)
+	}
+	return hostOverlay{
+		name: strings.TrimSuffix(filepath.Base(path), ".dts"),
+		path: path,
+		tree: t,
+	}, nil
+}
+
+// compileOverlays compiles the comma-separated list of overlay sources
+// paths.
+func compileOverlays(paths string) ([]hostOverlay, error) {
+	if paths == "" {
+		return nil, nil
+	}
+	var overlays []hostOverlay
+	seen := make(map[string]bool)
+	for _, path := range strings.Split(paths, ",") {
+		o, err := compileOverlay(path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[o.name] {
+			return nil, fmt.Errorf("overlay %s specified more than once", o.name)
+		}
+		seen[o.name] = true
+		overlays = append(overlays, o)
+	}
+	return overlays, nil
+}
+
+// checkOverlayFixups returns an error if the overlay references a label
+// (see __fixups__) which the DTB at dtbPath does not export in its
+// __symbols__, i.e. if the firmware could not apply the overlay to it.
+func checkOverlayFixups(o hostOverlay, dtbPath string) error {
+	fixups, err := o.tree.Lookup("/__fixups__")
+	if err != nil {
+		return nil // references no labels of the DTB
+	}
+	base, err := fdt.ReadFile(dtbPath)
+	if err != nil {
+		return err
+	}
+	symbols, err := base.Lookup("/__symbols__")
+	if err != nil {
+		log.Printf("warning: %s has no __symbols__, not checking whether overlay %s applies to it", dtbPath, o.name)
+		return nil
+	}
+	var missing []string
+	for _, p := range fixups.Properties {
+		if _, ok := symbols.Property(p.Name); !ok {
+			missing = append(missing, p.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("overlay %s does not apply to %s: no labels %s", o.name, filepath.Base(dtbPath), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// overlayNames returns the names of all overlays the build exports: those
+// of the profiles and the -overlay overlays.
+func (b *kernelBuild) overlayNames() []string {
+	names := append([]string(nil), b.overlays...)
+	for _, o := range b.hostOverlays {
+		names = append(names, o.name)
+	}
+	return names
+}
+
+// writeHostOverlays writes the -overlay overlays into the work directory,
+// next to the overlays compiled in the build container, after checking that
+// they apply to the built DTBs.
+func (b *kernelBuild) writeHostOverlays() error {
+	if len(b.hostOverlays) == 0 {
+		return nil
+	}
+	if b.opts.dryRun {
+		for _, o := range b.hostOverlays {
+			log.Printf("[dry-run] would check that overlay %s applies to the built DTBs", o.name)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(b.tmp, "overlays"), 0755); err != nil {
+		return err
+	}
+	for _, o := range b.hostOverlays {
+		for _, bo := range b.boards {
+			if bo.DTB == "" {
+				continue
+			}
+			if err := checkOverlayFixups(o, filepath.Join(b.tmp, bo.DTB)); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(b.tmp, "overlays", o.name+".dtbo"), o.tree.Marshal(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlay compiles overlay sources and installs them into overlays/ next to
+// vmlinuz, without rebuilding the kernel.
+func overlay(args []string) error {
+	fset := flag.NewFlagSet("overlay", flag.ExitOnError)
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"compile and check the overlays, but only print the files which would be written")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-rebuild-kernel overlay [flags] <overlay.dts>...\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	overlays, err := compileOverlays(strings.Join(fset.Args(), ","))
+	if err != nil {
+		return err
+	}
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kernelPath)
+	dtbs, err := filepath.Glob(filepath.Join(dir, "*.dtb"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(dtbs)
+	for _, o := range overlays {
+		for _, dtb := range dtbs {
+			if err := checkOverlayFixups(o, dtb); err != nil {
+				return err
+			}
+		}
+	}
+
+	act := &actions{dryRun: *dryRun}
+	overlaysDir := filepath.Join(dir, "overlays")
+	if err := act.mkdirAll(overlaysDir); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "gokr-overlay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, o := range overlays {
+		compiled := filepath.Join(tmp, o.name+".dtbo")
+		if err := ioutil.WriteFile(compiled, o.tree.Marshal(), 0644); err != nil {
+			return err
+		}
+		if err := act.copyFile(filepath.Join(overlaysDir, o.name+".dtbo"), compiled); err != nil {
+			return err
+		}
+		if !*dryRun {
+			log.Printf("installed %s, enable it with dtoverlay=%s in config.txt", filepath.Join(overlaysDir, o.name+".dtbo"), o.name)
+		}
+	}
+	return nil
+}
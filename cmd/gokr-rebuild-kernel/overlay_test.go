@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompileOverlaysRelative(t *testing.T) {
+	// Like -output_dir, change the working directory away from the package
+	// directory (startDir), which the paths are relative to.
+	dir, err := ioutil.TempDir("", "gokr-rebuild-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(startDir)
+
+	overlays, err := compileOverlays("../../dts/overlays/pwm-fan.dts,../../dts/overlays/gpio-fan.dts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range overlays {
+		names = append(names, o.name)
+	}
+	if len(names) != 2 || names[0] != "pwm-fan" || names[1] != "gpio-fan" {
+		t.Errorf("compileOverlays = %q, want [pwm-fan gpio-fan]", names)
+	}
+}
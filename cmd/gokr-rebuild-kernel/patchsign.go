@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// lockSignatureNamespace is the ssh-keygen -Y namespace of kernel.lock
+// signatures, so that a signature made for another purpose (e.g. a git
+// commit) with the same key is not accepted.
+const lockSignatureNamespace = "gokrazy-kernel-lock"
+
+// lockSignatureSuffix is appended to the path of kernel.lock for the path
+// of its signature, as ssh-keygen -Y sign does.
+const lockSignatureSuffix = ".sig"
+
+// sign signs kernel.lock, which pins the patches by their hashes (and the
+// kernel source), with an SSH key. build -verify_patches verifies the
+// signature, so that users building from a copy of the repository fetched
+// over the network can detect tampered patches.
+func sign(args []string) error {
+	fset := flag.NewFlagSet("sign", flag.ExitOnError)
+	var key = fset.String("key",
+		"",
+		"SSH private key (or, with an ssh-agent, public key) to sign kernel.lock with, e.g. ~/.ssh/id_ed25519")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *key == "" {
+		return fmt.Errorf("-key is required")
+	}
+	lockPath, err := find("kernel.lock")
+	if err != nil {
+		return err
+	}
+	// Refuse to sign patches which kernel.lock does not match, as the
+	// signature would not verify in a build anyway.
+	if _, err := verifyLockedPatches(lockPath); err != nil {
+		return err
+	}
+	// ssh-keygen refuses to overwrite an existing signature.
+	if err := os.Remove(lockPath + lockSignatureSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-n", lockSignatureNamespace, "-f", *key, lockPath)
+	if err := runCommand(cmd); err != nil {
+		return err
+	}
+	log.Printf("signed %s, commit %s%s along with it", lockPath, filepath.Base(lockPath), lockSignatureSuffix)
+	return nil
+}
+
+// verifyLockSignature verifies the signature of kernel.lock at lockPath
+// against the allowed signers file (see ssh-keygen(1), ALLOWED SIGNERS) and
+// returns the principal which signed it.
+func verifyLockSignature(lockPath, allowedSigners string) (string, error) {
+	sigPath := lockPath + lockSignatureSuffix
+	if _, err := os.Stat(sigPath); err != nil {
+		return "", fmt.Errorf("kernel.lock is not signed (%v); sign it with gokr-rebuild-kernel sign", err)
+	}
+	findPrincipals := exec.Command("ssh-keygen", "-Y", "find-principals", "-s", sigPath, "-f", allowedSigners)
+	out, err := findPrincipals.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s was not made by a key of %s", sigPath, allowedSigners)
+	}
+	principal := strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	lock, err := os.Open(lockPath)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+	var stderr bytes.Buffer
+	verify := exec.Command("ssh-keygen", "-Y", "verify", "-n", lockSignatureNamespace, "-f", allowedSigners, "-I", principal, "-s", sigPath)
+	verify.Stdin = lock
+	verify.Stderr = &stderr
+	if err := verify.Run(); err != nil {
+		return "", fmt.Errorf("verifying %s: %v: %s", sigPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return principal, nil
+}
+
+// verifyLockedPatches verifies that the kernel.lock at lockPath is the one
+// gokr-rebuild-kernel (and thereby gokr-build-kernel, which the build
+// compiles from the same tree) was built with, and that the patch files
+// match the hashes it records. It returns the number of patches.
+func verifyLockedPatches(lockPath string) (int, error) {
+	b, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0, err
+	}
+	lock, err := kernelversion.ParseLock(b)
+	if err != nil {
+		return 0, err
+	}
+	want, err := lock.Source()
+	if err != nil {
+		return 0, err
+	}
+	compiled := kernelversion.Lock{
+		Version:  kernelversion.Version(),
+		URL:      kernelversion.URL(),
+		SHA256:   kernelversion.SHA256(),
+		Patches:  kernelversion.Patches(),
+		Firmware: kernelversion.PinnedFirmware(),
+		Git:      kernelversion.GitSource(),
+	}
+	got, err := compiled.Source()
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(got, want) {
+		return 0, fmt.Errorf("%s differs from the kernel.lock gokr-rebuild-kernel was built with; run go generate ./kernelversion and rebuild it", lockPath)
+	}
+	genPath := filepath.Join(filepath.Dir(lockPath), "kernelversion", "lock.go")
+	if gen, err := ioutil.ReadFile(genPath); err == nil && !bytes.Equal(gen, want) {
+		return 0, fmt.Errorf("%s does not match %s; run go generate ./kernelversion", genPath, lockPath)
+	}
+	for _, p := range lock.Patches {
+		path, err := find(p.Name)
+		if err != nil {
+			return 0, err
+		}
+		hash, err := fileHash(path)
+		if err != nil {
+			return 0, err
+		}
+		if hash != p.SHA256 {
+			return 0, fmt.Errorf("%s: SHA-256 hash mismatch: got %s, want %s (from kernel.lock)", path, hash, p.SHA256)
+		}
+	}
+	return len(lock.Patches), nil
+}
+
+// verifyPatches verifies, for -verify_patches, the signature of kernel.lock
+// and the patches against it.
+func verifyPatches(allowedSigners string) error {
+	lockPath, err := find("kernel.lock")
+	if err != nil {
+		return err
+	}
+	principal, err := verifyLockSignature(lockPath, allowedSigners)
+	if err != nil {
+		return err
+	}
+	n, err := verifyLockedPatches(lockPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("kernel.lock signed by %s, %d patches verified", principal, n)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// defaultPlatform returns the container platform matching the host: arm64
+// hosts (e.g. Apple Silicon Macs) build natively, everything else builds in
+// an amd64 container with a cross compiler.
+func defaultPlatform() string {
+	if runtime.GOARCH == "arm64" {
+		return "linux/arm64"
+	}
+	return "linux/amd64"
+}
+
+// platformArch returns the GOARCH of a container platform like linux/arm64
+// or linux/arm64/v8.
+func platformArch(platform string) (string, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || parts[0] != "linux" {
+		return "", fmt.Errorf("unsupported platform %q, expected e.g. linux/amd64", platform)
+	}
+	switch parts[1] {
+	case "amd64", "arm64":
+		return parts[1], nil
+	}
+	return "", fmt.Errorf("unsupported platform %q: architecture must be amd64 or arm64", platform)
+}
+
+// toolchain returns the Debian packages providing the aarch64-linux-gnu-gcc
+// compiler on a container of the specified architecture: on arm64, the
+// native compiler has that name, too.
+func toolchain(goarch string) string {
+	if goarch == "arm64" {
+		return "build-essential"
+	}
+	return "crossbuild-essential-arm64"
+}
+
+// gccPluginDev returns the Debian packages with the headers for building GCC
+// plugins (see -hardening) for the compiler of toolchain(goarch), for
+// installing after it, as the package name contains its version.
+func gccPluginDev(goarch string) string {
+	pkg := "gcc-$(aarch64-linux-gnu-gcc -dumpversion | cut -d. -f1)-plugin-dev"
+	if goarch != "arm64" {
+		pkg += "-aarch64-linux-gnu"
+	}
+	return "libgmp-dev libmpc-dev " + pkg
+}
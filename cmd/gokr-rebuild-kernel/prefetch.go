@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// sourceDirName is the directory in the work directory which holds the
+// kernel source tarball, so that resuming a failed build does not download
+// it again.
+const sourceDirName = "src"
+
+// prefetchSource downloads the kernel source tarball into the work
+// directory on the host while the container images are built, as both are
+// network-bound. The build container then finds the tarball and only
+// verifies its hash. The returned channel is closed when the download is
+// done; if it fails, the build container downloads the tarball itself.
+func (b *kernelBuild) prefetchSource(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	if b.opts.dryRun || b.opts.compileStage || b.opts.kernelSrc != "" {
+		// With -compile_stage, a stage of the image build downloads it.
+		close(done)
+		return done
+	}
+	if b.opts.downloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.downloadTimeout)
+		go func() {
+			<-done
+			cancel()
+		}()
+	}
+	go func() {
+		defer close(done)
+		start := time.Now()
+		args := append(b.builderArgs(), "-download_only", "-source_dir="+filepath.Join(b.tmp, sourceDirName))
+		if err := runHostBuilder(ctx, "", args...); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("warning: downloading the kernel source while building the image failed, the build container will download it: %v", err)
+			}
+			return
+		}
+		log.Printf("downloaded the kernel source in %v, while building the image", time.Since(start).Truncate(time.Second))
+	}()
+	return done
+}
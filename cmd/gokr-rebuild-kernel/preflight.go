@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// buildSpace is the space a kernel build needs in the container
+	// storage: tarball, extracted tree and build objects.
+	buildSpace = 25 << 30
+
+	// resultSpace is the space the build result (kernel, DTBs, modules)
+	// needs in the temporary directory.
+	resultSpace = 2 << 30
+)
+
+// freeSpace returns the number of bytes available to unprivileged users in
+// the file system containing dir. df is used instead of statfs(2) because
+// its output is portable across Linux and macOS.
+func freeSpace(dir string) (int64, error) {
+	out, err := exec.Command("df", "-Pk", dir).Output()
+	if err != nil {
+		return 0, fmt.Errorf("df -Pk %s: %v", dir, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("df -Pk %s: unexpected output %q", dir, out)
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("df -Pk %s: %v", dir, err)
+	}
+	return kb * 1024, nil
+}
+
+// containerStorage returns the directory in which the container runtime
+// stores images and containers, or the empty string if it cannot be
+// determined or is not accessible from the host (e.g. Docker Desktop, which
+// runs in a VM).
+func containerStorage(executable string) string {
+	format := "{{.DockerRootDir}}"
+	if detectBackend(executable) == backendPodman {
+		format = "{{.Store.GraphRoot}}"
+	}
+	out, err := containerCommand(executable, "info", "--format", format).Output()
+	if err != nil {
+		return ""
+	}
+	dir := strings.TrimSpace(string(out))
+	if _, err := os.Stat(dir); err != nil {
+		return ""
+	}
+	return dir
+}
+
+// checkSpace returns an error if dir has less than need bytes available.
+func checkSpace(dir, purpose string, need int64) error {
+	if _, err := exec.LookPath("df"); err != nil {
+		return nil // e.g. on Windows: no way to check, proceed
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if free < need {
+		return fmt.Errorf("%s (%s) has only %d MiB available, but the %s needs about %d MiB",
+			dir, purpose, free>>20, purpose, need>>20)
+	}
+	return nil
+}
+
+// preflight verifies that there is enough disk space for a build, so that
+// it fails early with a clear message instead of with ENOSPC at link time.
+func preflight(executable, tmpDir string) error {
+	if err := checkSpace(tmpDir, "build result", resultSpace); err != nil {
+		return err
+	}
+	if storage := containerStorage(executable); storage != "" {
+		if err := checkSpace(storage, "container storage", buildSpace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
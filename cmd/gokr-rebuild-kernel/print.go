@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// printPatches writes the patches a build would apply, in order, with their
+// SHA-256 hashes and upstream status to w, marking patches which were
+// modified since kernel.lock was last updated.
+func printPatches(w io.Writer) error {
+	for _, p := range kernelversion.Patches() {
+		path, err := find(p.Name)
+		if err != nil {
+			return err
+		}
+		hash, err := fileHash(path)
+		if err != nil {
+			return err
+		}
+		status := p.Upstream
+		if status == "" {
+			status = "local"
+		}
+		if hash != p.SHA256 {
+			fmt.Fprintf(w, "%s  %s [%s] (differs from kernel.lock, run bump to update it)\n", hash, p.Name, status)
+			continue
+		}
+		fmt.Fprintf(w, "%s  %s [%s]\n", hash, p.Name, status)
+	}
+	return nil
+}
+
+// printConfigCommand prints the kernel source URL, exported DTBs and config
+// fragments (as determined by gokr-build-kernel -print_config) and
+// optionally the patches a build would use.
+func printConfigCommand(args []string) error {
+	fset := flag.NewFlagSet("print-config", flag.ExitOnError)
+	var cfg = addConfigFlags(fset)
+	var patches = fset.Bool("patches",
+		false,
+		"print the patches a build would apply (with their SHA-256 hashes) instead of the config")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *patches {
+		return printPatches(os.Stdout)
+	}
+	if err := runHostBuilder(context.Background(), "", append(cfg.buildArgs(), "-print_config")...); err != nil {
+		return fmt.Errorf("printing config: %v", err)
+	}
+	return nil
+}
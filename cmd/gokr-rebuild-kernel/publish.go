@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+)
+
+// publish commits the artifacts of a build to the git repository containing
+// them, and optionally pushes the commit.
+func publish(args []string) error {
+	fset := flag.NewFlagSet("publish", flag.ExitOnError)
+	var push = fset.Bool("push",
+		false,
+		"push the commit to the default remote")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kernelPath)
+	paths, release, err := artifactPaths(dir)
+	if err != nil {
+		return err
+	}
+
+	git := func(args ...string) error {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if err := runCommand(cmd); err != nil {
+			return fmt.Errorf("git %s: %v", args[0], err)
+		}
+		return nil
+	}
+	if err := git(append([]string{"add", "--all", "--"}, paths...)...); err != nil {
+		return err
+	}
+	if err := git("commit", "-m", fmt.Sprintf("kernel: update to %s", release)); err != nil {
+		return err
+	}
+	log.Printf("committed kernel %s in %s", release, dir)
+	if *push {
+		if err := git("push"); err != nil {
+			return err
+		}
+		log.Printf("pushed")
+	}
+	return nil
+}
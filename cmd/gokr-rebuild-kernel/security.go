@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strings"
+)
+
+// checkSeccompProfile checks that path is a seccomp profile in the JSON
+// format of the container runtimes, so that a typo fails before the image
+// build instead of when starting the build container.
+func checkSeccompProfile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var profile struct {
+		DefaultAction string `json:"defaultAction"`
+		Syscalls      []json.RawMessage
+	}
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if profile.DefaultAction == "" {
+		return fmt.Errorf("%s: no defaultAction, expected a seccomp profile such as https://github.com/moby/moby/blob/master/profiles/seccomp/default.json", path)
+	}
+	if profile.DefaultAction == "SCMP_ACT_ALLOW" && len(profile.Syscalls) == 0 {
+		log.Printf("warning: the seccomp profile %s allows all syscalls", path)
+	}
+	return nil
+}
+
+// apparmorProfileLoaded reports whether the AppArmor profile name is loaded
+// on the host. It returns an error if AppArmor is not enabled.
+func apparmorProfileLoaded(name string) (bool, error) {
+	b, err := ioutil.ReadFile("/sys/kernel/security/apparmor/profiles")
+	if err != nil {
+		return false, fmt.Errorf("AppArmor is not enabled on the host: %v", err)
+	}
+	// Each line is “<name> (<mode>)”.
+	for _, line := range strings.Split(string(b), "\n") {
+		if idx := strings.LastIndex(line, " ("); idx != -1 && line[:idx] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resolveSecurity returns the container options which confine the build
+// container: it runs the kernel build scripts (and -pre_build_hook), which
+// need no privileges, so the capabilities of -cap_drop are dropped and
+// gaining privileges (e.g. via setuid binaries) is prevented. The seccomp
+// and AppArmor profiles default to those of the container runtime.
+func (b *kernelBuild) resolveSecurity() ([]string, error) {
+	opts := b.opts
+	if opts.compileStage && (opts.seccompProfile != "" || opts.apparmorProfile != "") {
+		return nil, fmt.Errorf("-compile_stage compiles in the image build, which -seccomp_profile and -apparmor_profile do not apply to")
+	}
+	if opts.compileStage && strings.TrimSpace(opts.capDrop) != "" {
+		// The image build cannot drop capabilities of its RUN steps:
+		// refuse an explicit -cap_drop, but not the default.
+		if opts.capDropSet {
+			return nil, fmt.Errorf("-compile_stage compiles in the image build, which -cap_drop does not apply to: pass -cap_drop= to build with the image build's capabilities")
+		}
+		log.Printf("-compile_stage: capabilities cannot be dropped in the image build, compiling with its default capabilities")
+		opts.capDrop = ""
+	}
+	args := []string{"--security-opt=no-new-privileges"}
+	for _, capability := range strings.Split(opts.capDrop, ",") {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			args = append(args, "--cap-drop="+strings.ToUpper(capability))
+		}
+	}
+	switch opts.seccompProfile {
+	case "":
+	case "unconfined":
+		log.Printf("warning: -seccomp_profile=unconfined: the build container can use all syscalls")
+		args = append(args, "--security-opt=seccomp=unconfined")
+	default:
+		path := startPath(opts.seccompProfile)
+		if err := checkSeccompProfile(path); err != nil {
+			return nil, fmt.Errorf("-seccomp_profile: %v", err)
+		}
+		// The container CLI reads the profile and passes its content to
+		// the daemon, so that it need not be mounted into a VM.
+		args = append(args, "--security-opt=seccomp="+path)
+	}
+	switch opts.apparmorProfile {
+	case "":
+	case "unconfined":
+		args = append(args, "--security-opt=apparmor=unconfined")
+	default:
+		// The profile of a backend in a VM is loaded in the VM.
+		if runtime.GOOS == "linux" && !backendInVM(b.backend) {
+			loaded, err := apparmorProfileLoaded(opts.apparmorProfile)
+			if err != nil {
+				return nil, fmt.Errorf("-apparmor_profile: %v", err)
+			}
+			if !loaded {
+				return nil, fmt.Errorf("-apparmor_profile: profile %q is not loaded, load it with sudo apparmor_parser -r <file>", opts.apparmorProfile)
+			}
+		}
+		args = append(args, "--security-opt=apparmor="+opts.apparmorProfile)
+	}
+	return args, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecurity(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    buildOptions
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "default",
+			opts: buildOptions{capDrop: "ALL"},
+			want: []string{"--security-opt=no-new-privileges", "--cap-drop=ALL"},
+		},
+		{
+			name: "capabilities",
+			opts: buildOptions{capDrop: "net_raw, mknod"},
+			want: []string{"--security-opt=no-new-privileges", "--cap-drop=NET_RAW", "--cap-drop=MKNOD"},
+		},
+		{
+			name: "unconfined",
+			opts: buildOptions{seccompProfile: "unconfined", apparmorProfile: "unconfined"},
+			want: []string{"--security-opt=no-new-privileges", "--security-opt=seccomp=unconfined", "--security-opt=apparmor=unconfined"},
+		},
+		{
+			name: "compile stage with the default capabilities",
+			opts: buildOptions{compileStage: true, capDrop: "ALL"},
+			want: []string{"--security-opt=no-new-privileges"},
+		},
+		{
+			name:    "compile stage with explicit capabilities",
+			opts:    buildOptions{compileStage: true, capDrop: "ALL", capDropSet: true},
+			wantErr: "-cap_drop does not apply",
+		},
+		{
+			name:    "compile stage with a seccomp profile",
+			opts:    buildOptions{compileStage: true, seccompProfile: "unconfined"},
+			wantErr: "-seccomp_profile and -apparmor_profile do not apply",
+		},
+		{
+			name: "compile stage",
+			opts: buildOptions{compileStage: true},
+			want: []string{"--security-opt=no-new-privileges"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &kernelBuild{opts: tt.opts}
+			got, err := b.resolveSecurity()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveSecurity: err = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveSecurity = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
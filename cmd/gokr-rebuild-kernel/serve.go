@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kconfig"
+	"github.com/alf632/gokrazy-kernel/kernelrelease"
+)
+
+// serve serves the kernel image over HTTP, for gokr-kexec on a gokrazy
+// device to boot the newest build without a full reboot cycle, and its
+// config, for gokr-kconfig-drift to compare the running kernel against,
+// and its kernel-release, for devices to show whether a newer build is
+// available (see kernelrelease.Fetch).
+func serve(args []string) error {
+	fset := flag.NewFlagSet("serve", flag.ExitOnError)
+	var listen = fset.String("listen",
+		":8097",
+		"[host]:port to listen on")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kernelPath)
+	mux := http.NewServeMux()
+	for _, name := range []string{"vmlinuz", buildinfo.FileName, kernelrelease.FileName} {
+		path := filepath.Join(dir, name)
+		mux.HandleFunc("/"+name, func(w http.ResponseWriter, r *http.Request) {
+			log.Printf("%s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+			// Read the file for each request, so that each new build is
+			// served without restarting.
+			http.ServeFile(w, r, path)
+		})
+	}
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		cfg, err := kconfig.FromImage(kernelPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, sym := range cfg.Symbols() {
+			fmt.Fprintln(w, cfg.Line(sym))
+		}
+	})
+	_, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving %s on %s (use -kernel=http://<this host>:%s/vmlinuz with gokr-kexec, -reference=http://<this host>:%[3]s/config with gokr-kconfig-drift)", kernelPath, *listen, port)
+	return http.ListenAndServe(*listen, mux)
+}
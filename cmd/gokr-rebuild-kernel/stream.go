@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// builderStepRe matches the lines with which gokr-build-kernel logs the
+// start of a step of its pipeline, e.g.
+// 2017/03/01 20:57:29 step: compiling kernel
+var builderStepRe = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d step: (.*)$`)
+
+// builderDownloadStep is the step in which gokr-build-kernel downloads the
+// kernel source, see -download_timeout.
+const builderDownloadStep = "downloading kernel source"
+
+// idleNotice is how often a silent container is logged, so that a hang is
+// visible before the idle timeout kills it.
+const idleNotice = 5 * time.Minute
+
+// lineStreamer is an io.Writer which prefixes each line of the output of
+// the build container with the current step of gokr-build-kernel and the
+// time elapsed since the step started, e.g.
+// [compiling kernel +12m3s] CC drivers/spi/spidev.o
+// It records when it last received output, for detecting hangs.
+type lineStreamer struct {
+	w io.Writer
+
+	mu        sync.Mutex
+	step      string
+	stepStart time.Time
+	last      time.Time // of the last output
+	lastLine  string
+	partial   []byte
+}
+
+func newLineStreamer(w io.Writer) *lineStreamer {
+	now := time.Now()
+	return &lineStreamer{
+		w:         w,
+		step:      "starting",
+		stepStart: now,
+		last:      now,
+	}
+}
+
+func (s *lineStreamer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = time.Now()
+	s.partial = append(s.partial, p...)
+	for {
+		idx := bytes.IndexByte(s.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		if err := s.line(string(s.partial[:idx])); err != nil {
+			return 0, err
+		}
+		s.partial = s.partial[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (s *lineStreamer) line(line string) error {
+	if m := builderStepRe.FindStringSubmatch(line); m != nil {
+		s.step, s.stepStart = m[1], s.last
+	}
+	s.lastLine = line
+	_, err := fmt.Fprintf(s.w, "[%s +%s] %s\n", s.step, s.last.Sub(s.stepStart).Truncate(time.Second), line)
+	return err
+}
+
+// flush writes the last line, if it was not terminated by a newline.
+func (s *lineStreamer) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.partial) == 0 {
+		return nil
+	}
+	err := s.line(string(s.partial))
+	s.partial = nil
+	return err
+}
+
+// idle returns how long the streamer has not received output, in which step
+// (and since when) and its last line.
+func (s *lineStreamer) idle() (silent time.Duration, step string, inStep time.Duration, lastLine string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.last), s.step, time.Since(s.stepStart), s.lastLine
+}
+
+// idleError is returned by runStreamed when the command was killed because
+// it did not print anything for the idle timeout.
+type idleError struct {
+	timeout time.Duration
+	step    string
+}
+
+func (e *idleError) Error() string {
+	return fmt.Sprintf("killed after %v without output during step %q", e.timeout, e.step)
+}
+
+// streamLimits are the limits runStreamed enforces. A zero duration
+// disables the limit.
+type streamLimits struct {
+	// idleTimeout is how long the command may print nothing.
+	idleTimeout time.Duration
+	// stepTimeouts is how long the steps of gokr-build-kernel may take, by
+	// step name.
+	stepTimeouts map[string]time.Duration
+}
+
+// runStreamed runs cmd like runCommand, with its output passed through a
+// lineStreamer. If ctx is done or cmd exceeds the limits, kill is called to
+// stop it. If cmd printed nothing for the idle timeout, an *idleError is
+// returned.
+func runStreamed(ctx context.Context, cmd *exec.Cmd, limits streamLimits, kill func()) error {
+	if verbosity >= 1 {
+		log.Printf("running %s", shellQuote(cmd.Args))
+	}
+	var (
+		out  io.Writer = os.Stdout
+		tail *tailBuffer
+	)
+	if verbosity < 2 {
+		tail = &tailBuffer{max: 1 << 20}
+		out = tail
+	}
+	s := newLineStreamer(out)
+	// The same writer for both, so that exec writes from only one goroutine.
+	cmd.Stdout = s
+	cmd.Stderr = s
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %v", shellQuote(cmd.Args), err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan error, 1)
+	stop := func(err error) {
+		log.Printf("%v, killing the build container", err)
+		stopped <- err
+		kill()
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		noticed := time.Duration(0)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				stop(ctx.Err())
+				return
+			case <-ticker.C:
+			}
+			silent, step, inStep, lastLine := s.idle()
+			if limit := limits.stepTimeouts[step]; limit > 0 && inStep >= limit {
+				stop(fmt.Errorf("step %q did not finish within %v (last line: %q)", step, limit, lastLine))
+				return
+			}
+			if limits.idleTimeout > 0 && silent >= limits.idleTimeout {
+				log.Printf("no output for %v during step %q (last line: %q)", silent.Truncate(time.Second), step, lastLine)
+				stop(&idleError{timeout: limits.idleTimeout, step: step})
+				return
+			}
+			if silent < idleNotice {
+				noticed = 0
+			} else if silent-noticed >= idleNotice {
+				noticed = silent
+				log.Printf("no output for %v during step %q (last line: %q)", silent.Truncate(time.Second), step, lastLine)
+			}
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	s.flush()
+	select {
+	case err := <-stopped:
+		return err
+	default:
+	}
+	if err != nil {
+		if tail != nil {
+			return fmt.Errorf("%s: %v, last lines of output:\n%s", shellQuote(cmd.Args), err, tail.lastLines(50))
+		}
+		return fmt.Errorf("%s: %v", shellQuote(cmd.Args), err)
+	}
+	return nil
+}
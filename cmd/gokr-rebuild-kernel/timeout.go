@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// phaseTimeout returns the flag limiting how long the phase may take and
+// its value, or a zero duration if the phase has no timeout.
+func (b *kernelBuild) phaseTimeout(phase string) (string, time.Duration) {
+	switch phase {
+	case "image":
+		return "image_timeout", b.opts.imageTimeout
+	case "compile":
+		return "compile_timeout", b.opts.compileTimeout
+	}
+	return "", 0
+}
+
+// runPhase runs phase with its timeout (if any) applied to ctx, which
+// carries the timeout of the whole build.
+func (b *kernelBuild) runPhase(ctx context.Context, phase buildPhase) error {
+	flagName, timeout := b.phaseTimeout(phase.name)
+	phaseCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := phase.fn(b, phaseCtx)
+	if err == nil || phaseCtx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%v (the build took longer than -timeout=%v)", err, b.opts.timeout)
+	}
+	return fmt.Errorf("%v (the phase took longer than -%s=%v)", err, flagName, timeout)
+}
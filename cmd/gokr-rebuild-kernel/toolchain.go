@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Stages of the Dockerfile, see dockerfile.
+const (
+	toolchainStage = "toolchain" // the compiler and build tools
+	builderStage   = "builder"   // the build container image
+	artifactsStage = "artifacts" // the build result of -compile_stage
+)
+
+// toolchainTag returns the tag of the toolchain stage image for the build
+// container image tagged imageTag. It can be pushed to a registry (or saved
+// with docker save) and passed to -toolchain_image for offline builds.
+func toolchainTag(imageTag string) string {
+	if idx := strings.LastIndex(imageTag, ":"); idx > strings.LastIndex(imageTag, "/") {
+		return imageTag[:idx] + "-" + toolchainStage + imageTag[idx:]
+	}
+	return imageTag + "-" + toolchainStage
+}
+
+// repoDigests returns the registry digests of the local image, e.g.
+// debian@sha256:….
+func repoDigests(executable, image string) ([]string, error) {
+	cmd := containerCommand(executable, "image", "inspect", "--format={{json .RepoDigests}}", image)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", shellQuote(cmd.Args), err)
+	}
+	var digests []string
+	if s := strings.TrimSpace(string(out)); s != "" && s != "null" {
+		if err := json.Unmarshal([]byte(s), &digests); err != nil {
+			return nil, fmt.Errorf("%s: %v", shellQuote(cmd.Args), err)
+		}
+	}
+	return digests, nil
+}
+
+// pinImage returns image pinned by its registry digest, so that the cached
+// layers built on top of it are only reused for exactly that image. Images
+// which are not present locally are pulled first. Images which are already
+// pinned, or which have no registry digest (e.g. locally built ones), are
+// returned as they are.
+func pinImage(executable, platform, image string) (string, error) {
+	if strings.Contains(image, "@sha256:") {
+		return image, nil
+	}
+	digests, err := repoDigests(executable, image)
+	if err != nil {
+		log.Printf("pulling %s", image)
+		pull := containerCommand(executable, "pull", "--platform="+platform, image)
+		if err := runCommand(pull); err != nil {
+			return "", err
+		}
+		if digests, err = repoDigests(executable, image); err != nil {
+			return "", err
+		}
+	}
+	// Prefer the digest of the repository named by image.
+	repo := image
+	if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+		repo = repo[:idx]
+	}
+	for _, digest := range digests {
+		if strings.HasPrefix(digest, repo+"@") {
+			return digest, nil
+		}
+	}
+	if len(digests) > 0 {
+		return digests[0], nil
+	}
+	log.Printf("%s has no registry digest, not pinning it", image)
+	return image, nil
+}
+
+// baseImage returns the pinned image the build container is based on. When
+// resuming a build, it is read from the Dockerfile in the work directory.
+func (b *kernelBuild) baseImage() string {
+	if b.pinnedImage != "" {
+		return b.pinnedImage
+	}
+	content, err := ioutil.ReadFile(filepath.Join(b.tmp, "Dockerfile"))
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "FROM" {
+				return fields[1]
+			}
+		}
+	}
+	if b.opts.toolchainImage != "" {
+		return b.opts.toolchainImage
+	}
+	return b.opts.baseImage
+}
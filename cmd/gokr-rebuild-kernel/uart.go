@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+// The Raspberry Pi 3, 4 and Zero 2 W have two UARTs: the PL011 (ttyAMA0) and
+// the mini UART (ttyS0), whose baud rate depends on the VPU core clock. By
+// default, the PL011 is connected to the Bluetooth chip and the mini UART to
+// GPIO 14/15 for the serial console.
+const (
+	pl011Bluetooth = "bluetooth"
+	pl011Console   = "console"
+)
+
+// miniUARTCoreFreq pins the VPU core clock on the boards where the mini UART
+// would otherwise change its baud rate with the core clock. This is only
+// needed when Bluetooth uses the mini UART.
+const miniUARTCoreFreq = `[pi3]
+core_freq=250
+[pi02]
+core_freq=250
+[all]`
+
+// uartConfigTxt returns the config.txt lines to add and remove so that the
+// PL011 is used as specified.
+func uartConfigTxt(pl011 string) (add, remove []string, _ error) {
+	switch pl011 {
+	case "":
+		return nil, nil, nil
+	case pl011Bluetooth:
+		return []string{"enable_uart=1"}, []string{"dtoverlay=miniuart-bt", miniUARTCoreFreq}, nil
+	case pl011Console:
+		return []string{"enable_uart=1", "dtoverlay=miniuart-bt", miniUARTCoreFreq}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid -pl011 value %q: expected %q or %q", pl011, pl011Bluetooth, pl011Console)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelrelease"
+	"github.com/alf632/gokrazy-kernel/provenance"
+)
+
+// artifactPaths returns the paths (relative to dir) of the kernel artifacts
+// in the repository directory dir, and the kernel release (see
+// buildinfo.Release).
+func artifactPaths(dir string) (paths []string, release string, _ error) {
+	release, err := buildinfo.Release(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lib", "modules", release)); err != nil {
+		return nil, "", fmt.Errorf("modules of kernel release %s: %v", release, err)
+	}
+	paths, err = presentArtifacts(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return paths, release, nil
+}
+
+// artifactPatterns match the kernel artifacts in the repository directory.
+var artifactPatterns = []string{"vmlinuz", "lib", "*.dtb", "overlays", "config.txt", "cmdline.txt", buildinfo.FileName, kernelrelease.FileName, provenance.FileName, warningsFileName, "vmlinuz-debug", "perf", "kselftest", "bootcode.bin", "start*.elf", "fixup*.dat", moduleCertName}
+
+// isArtifactName reports whether name matches one of artifactPatterns.
+func isArtifactName(name string) bool {
+	for _, pattern := range artifactPatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// presentArtifacts returns the paths (relative to dir) of the kernel
+// artifacts which are present in the directory dir.
+func presentArtifacts(dir string) ([]string, error) {
+	var paths []string
+	for _, pattern := range artifactPatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			paths = append(paths, filepath.Base(match))
+		}
+	}
+	return paths, nil
+}
+
+// uploadNameRe matches the directory names of uploads, which start with the
+// build time so that they sort chronologically.
+var uploadNameRe = regexp.MustCompile(`^\d{8}T\d{6}Z-`)
+
+// uploader stores uploads (directories of artifacts) at a destination. The
+// commands it runs are killed when ctx is done.
+type uploader interface {
+	upload(ctx context.Context, localDir, name string) error
+	// list returns the names of the uploads at the destination.
+	list(ctx context.Context) ([]string, error)
+	remove(ctx context.Context, name string) error
+}
+
+// newUploader returns the uploader for dest, which is one of
+// s3://bucket/prefix (using the aws CLI), gs://bucket/prefix (using
+// gsutil), ssh://[user@]host/path (using rsync) or a local directory.
+func newUploader(dest string, act *actions) (uploader, error) {
+	dest = strings.TrimSuffix(dest, "/")
+	switch {
+	case strings.HasPrefix(dest, "s3://"):
+		return &s3Uploader{url: dest, act: act}, nil
+	case strings.HasPrefix(dest, "gs://"):
+		return &gsUploader{url: dest, act: act}, nil
+	case strings.HasPrefix(dest, "ssh://"):
+		rest := strings.TrimPrefix(dest, "ssh://")
+		idx := strings.IndexByte(rest, '/')
+		if idx <= 0 {
+			return nil, fmt.Errorf("malformed destination %q, expected ssh://[user@]host/path", dest)
+		}
+		return &rsyncUploader{host: rest[:idx], path: rest[idx:], act: act}, nil
+	case strings.Contains(dest, "://"):
+		return nil, fmt.Errorf("unsupported destination %q (supported: s3://, gs://, ssh:// or a local directory)", dest)
+	default:
+		abs, err := filepath.Abs(dest)
+		if err != nil {
+			return nil, err
+		}
+		return &rsyncUploader{path: abs, act: act}, nil
+	}
+}
+
+type s3Uploader struct {
+	url string
+	act *actions
+}
+
+func (u *s3Uploader) upload(ctx context.Context, localDir, name string) error {
+	return u.act.run(exec.CommandContext(ctx, "aws", "s3", "cp", "--recursive", "--only-show-errors", localDir, u.url+"/"+name+"/"))
+}
+
+func (u *s3Uploader) list(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "aws", "s3", "ls", u.url+"/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws s3 ls %s/: %v", u.url, err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// Directories are listed as “PRE name/”.
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "PRE" {
+			names = append(names, strings.TrimSuffix(fields[1], "/"))
+		}
+	}
+	return names, nil
+}
+
+func (u *s3Uploader) remove(ctx context.Context, name string) error {
+	return u.act.run(exec.CommandContext(ctx, "aws", "s3", "rm", "--recursive", "--only-show-errors", u.url+"/"+name+"/"))
+}
+
+type gsUploader struct {
+	url string
+	act *actions
+}
+
+func (u *gsUploader) upload(ctx context.Context, localDir, name string) error {
+	return u.act.run(exec.CommandContext(ctx, "gsutil", "-m", "-q", "cp", "-r", localDir+"/.", u.url+"/"+name+"/"))
+}
+
+func (u *gsUploader) list(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "gsutil", "ls", u.url+"/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("gsutil ls %s/: %v", u.url, err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasSuffix(line, "/") {
+			names = append(names, filepath.Base(strings.TrimSuffix(line, "/")))
+		}
+	}
+	return names, nil
+}
+
+func (u *gsUploader) remove(ctx context.Context, name string) error {
+	return u.act.run(exec.CommandContext(ctx, "gsutil", "-m", "-q", "rm", "-r", u.url+"/"+name+"/"))
+}
+
+// rsyncUploader uploads to path on host via rsync over ssh, or copies to the
+// local directory path if host is empty.
+type rsyncUploader struct {
+	host string
+	path string
+	act  *actions
+}
+
+func (u *rsyncUploader) target(name string) string {
+	if u.host == "" {
+		return filepath.Join(u.path, name)
+	}
+	return u.host + ":" + u.path + "/" + name
+}
+
+func (u *rsyncUploader) upload(ctx context.Context, localDir, name string) error {
+	if u.host == "" {
+		// No need for rsync (which is not available everywhere) locally.
+		if err := u.act.mkdirAll(u.path); err != nil {
+			return err
+		}
+		return u.act.replaceDir(u.target(name), localDir)
+	}
+	if err := u.act.run(exec.CommandContext(ctx, "ssh", u.host, "mkdir", "-p", u.path)); err != nil {
+		return err
+	}
+	return u.act.run(exec.CommandContext(ctx, "rsync", "-a", localDir+"/", u.target(name)+"/"))
+}
+
+func (u *rsyncUploader) list(ctx context.Context) ([]string, error) {
+	if u.host == "" {
+		fis, err := ioutil.ReadDir(u.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var names []string
+		for _, fi := range fis {
+			if fi.IsDir() {
+				names = append(names, fi.Name())
+			}
+		}
+		return names, nil
+	}
+	out, err := exec.CommandContext(ctx, "ssh", u.host, "ls", "-1", u.path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s ls %s: %v", u.host, u.path, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (u *rsyncUploader) remove(ctx context.Context, name string) error {
+	if u.host == "" {
+		if u.act.dryRun {
+			log.Printf("[dry-run] would remove %s", u.target(name))
+			return nil
+		}
+		return os.RemoveAll(u.target(name))
+	}
+	return u.act.run(exec.CommandContext(ctx, "ssh", u.host, "rm", "-rf", u.path+"/"+name))
+}
+
+// uploadArtifacts uploads the kernel artifacts in the repository directory
+// dir to dest, into a directory named after the build time and kernel
+// release. If keep is positive, older uploads are removed so that only the
+// newest keep uploads remain.
+func uploadArtifacts(ctx context.Context, dir, dest string, keep int, act *actions) error {
+	u, err := newUploader(dest, act)
+	if err != nil {
+		return err
+	}
+	paths, release, err := artifactPaths(dir)
+	if err != nil {
+		return err
+	}
+	built := time.Now().UTC()
+	if bi, err := buildinfo.Read(filepath.Join(dir, buildinfo.FileName)); err == nil && !bi.BuildTime.IsZero() {
+		built = bi.BuildTime.UTC()
+	}
+	name := built.Format("20060102T150405Z") + "-" + release
+
+	// Stage the artifacts, so that they can be uploaded as one directory.
+	staging, err := ioutil.TempDir("", "gokr-rebuild-kernel-upload")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for _, path := range paths {
+		src := filepath.Join(dir, path)
+		st, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if st.IsDir() {
+			err = copyDir(filepath.Join(staging, path), src)
+		} else {
+			err = copyFile(filepath.Join(staging, path), src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("uploading %s to %s", name, dest)
+	if err := u.upload(ctx, staging, name); err != nil {
+		return fmt.Errorf("uploading to %s: %v", dest, err)
+	}
+	if keep <= 0 {
+		return nil
+	}
+	names, err := u.list(ctx)
+	if err != nil {
+		return err
+	}
+	var uploads []string
+	for _, n := range names {
+		if uploadNameRe.MatchString(n) {
+			uploads = append(uploads, n)
+		}
+	}
+	sort.Strings(uploads)
+	for len(uploads) > keep {
+		log.Printf("removing old upload %s (keeping the newest %d)", uploads[0], keep)
+		if err := u.remove(ctx, uploads[0]); err != nil {
+			return err
+		}
+		uploads = uploads[1:]
+	}
+	return nil
+}
+
+// upload uploads the kernel artifacts in the repository, e.g. to share them
+// with multiple gokrazy devices.
+func upload(args []string) error {
+	fset := flag.NewFlagSet("upload", flag.ExitOnError)
+	var to = fset.String("to",
+		"",
+		"destination to upload to: s3://bucket/prefix (aws CLI), gs://bucket/prefix (gsutil), ssh://[user@]host/path (rsync) or a local directory")
+	var keep = fset.Int("keep",
+		0,
+		"if positive, remove older uploads so that only the newest ones remain")
+	var dryRun = fset.Bool("dry_run",
+		false,
+		"print the commands an upload would run, without uploading")
+	v, vv := addVerbosityFlags(fset)
+	if err := applyConfigFile(fset); err != nil {
+		return err
+	}
+	fset.Parse(args)
+	applyVerbosity(v, vv)
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+	kernelPath, err := find("vmlinuz")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	return uploadArtifacts(ctx, filepath.Dir(kernelPath), *to, *keep, &actions{dryRun: *dryRun})
+}
@@ -0,0 +1,33 @@
+package main
+
+import "strings"
+
+// User namespace setups of the docker daemon which affect the ownership of
+// files the build container writes to the build result volume.
+const (
+	usernsDefault  = iota
+	usernsRootless // rootless docker: container uid 0 is the host user
+	usernsRemap    // userns-remap: container uids map to subordinate uids
+)
+
+// dockerUserns returns the user namespace setup of the docker daemon, as
+// indicated by its security options. nerdctl reports rootless containerd,
+// and podman's docker-compatible API rootless podman, the same way. The
+// podman CLI is reported as usernsDefault.
+func dockerUserns(executable string) int {
+	if runtimeName(executable) == "podman" {
+		return usernsDefault
+	}
+	out, err := containerCommand(executable, "info", "--format", "{{json .SecurityOptions}}").Output()
+	if err != nil {
+		return usernsDefault
+	}
+	opts := string(out)
+	switch {
+	case strings.Contains(opts, "name=rootless"):
+		return usernsRootless
+	case strings.Contains(opts, "name=userns"):
+		return usernsRemap
+	}
+	return usernsDefault
+}
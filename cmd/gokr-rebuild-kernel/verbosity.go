@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// verbosity is 0 by default (only phases are logged), 1 with -v (commands
+// are logged) and 2 with -vv (container output and HTTP requests are
+// logged, too).
+var verbosity int
+
+// addVerbosityFlags adds -v and -vv to fset. Call applyVerbosity after
+// parsing.
+func addVerbosityFlags(fset *flag.FlagSet) (v, vv *bool) {
+	return fset.Bool("v", false, "log the commands being run"),
+		fset.Bool("vv", false, "log the commands being run, stream their full output (e.g. of the kernel build) and log HTTP request details")
+}
+
+func applyVerbosity(v, vv *bool) {
+	switch {
+	case *vv:
+		verbosity = 2
+	case *v:
+		verbosity = 1
+	}
+}
+
+// tailBuffer retains the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+// lastLines returns the last n lines written to t.
+func (t *tailBuffer) lastLines(n int) string {
+	lines := bytes.Split(bytes.TrimRight(t.buf, "\n"), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
+
+// runCommand runs cmd, logging it with -v. Unless -vv is given, its output
+// is only printed if it fails (the last lines, which typically contain the
+// error).
+func runCommand(cmd *exec.Cmd) error {
+	if verbosity >= 1 {
+		log.Printf("running %s", shellQuote(cmd.Args))
+	}
+	if verbosity >= 2 {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", shellQuote(cmd.Args), err)
+		}
+		return nil
+	}
+	tail := &tailBuffer{max: 1 << 20}
+	cmd.Stdout = tail
+	cmd.Stderr = tail
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v, last lines of output:\n%s", shellQuote(cmd.Args), err, tail.lastLines(50))
+	}
+	return nil
+}
+
+// logResponse logs the details of an HTTP response with -vv.
+func logResponse(resp *http.Response) {
+	if verbosity < 2 {
+		return
+	}
+	var headers []string
+	for _, key := range []string{"Content-Length", "Last-Modified", "Location", "Server"} {
+		if value := resp.Header.Get(key); value != "" {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	log.Printf("HTTP %s %s: %s (%s)", resp.Request.Method, resp.Request.URL, resp.Status, strings.Join(headers, ", "))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/fdt"
+)
+
+// arm64Magic is the magic of the arm64 Image header at offset 0x38, see
+// Documentation/arm64/booting.rst.
+var arm64Magic = []byte("ARM\x64")
+
+// verifyImage returns an error if path is not an arm64 kernel Image (or a
+// gzip-compressed one, see profile.Image).
+func verifyImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	var magic [2]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return fmt.Errorf("%s: truncated: %v", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if magic == [2]byte{0x1f, 0x8b} {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		r = zr
+	}
+	header := make([]byte, 64)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("%s: truncated header: %v", path, err)
+	}
+	if !bytes.Equal(header[0x38:0x3c], arm64Magic) {
+		return fmt.Errorf("%s: not an arm64 kernel Image (magic %q)", path, header[0x38:0x3c])
+	}
+	return nil
+}
+
+// verifyNonEmpty returns an error if path is empty.
+func verifyNonEmpty(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		return fmt.Errorf("%s: empty", path)
+	}
+	return nil
+}
+
+// verifyArtifacts verifies the build result in the work directory before
+// install overwrites the artifacts in the repository with it, so that a
+// broken build (e.g. one which ran out of disk space) cannot clobber good
+// artifacts with truncated ones: kernel images must be arm64 Images, DTBs
+// and overlays must parse, and all other files must be non-empty.
+func (b *kernelBuild) verifyArtifacts() error {
+	check := func(path string) error {
+		if err := verifyNonEmpty(path); err != nil {
+			return err
+		}
+		switch ext := filepath.Ext(path); {
+		case ext == ".dtb" || ext == ".dtbo":
+			_, err := fdt.ReadFile(path)
+			return err
+		case filepath.Base(path) == "vmlinuz" || filepath.Base(path) == "vmlinuz-debug":
+			return verifyImage(path)
+		}
+		return nil
+	}
+	paths := []string{filepath.Join(b.tmp, "vmlinuz")}
+	for _, bo := range b.boards {
+		if bo.DTB != "" {
+			paths = append(paths, filepath.Join(b.tmp, bo.DTB))
+		}
+	}
+	for _, path := range b.artifacts {
+		paths = append(paths, filepath.Join(b.tmp, filepath.Base(path)))
+	}
+	for _, name := range b.overlayNames() {
+		paths = append(paths, filepath.Join(b.tmp, "overlays", name+".dtbo"))
+	}
+	if b.opts.debugVariant {
+		paths = append(paths, filepath.Join(b.tmp, "vmlinuz-debug"))
+	}
+	if b.opts.perf {
+		paths = append(paths, filepath.Join(b.tmp, "perf"))
+	}
+	if b.opts.signModules {
+		paths = append(paths, filepath.Join(b.tmp, moduleCertName))
+	}
+	for _, path := range paths {
+		if err := check(path); err != nil {
+			return err
+		}
+	}
+	modules := 0
+	err := filepath.Walk(filepath.Join(b.tmp, "lib", "modules"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".ko") {
+			modules++
+			return check(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("verified %d artifacts and %d modules", len(paths), modules)
+	return nil
+}
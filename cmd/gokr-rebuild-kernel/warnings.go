@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// warningsFileName is the list of build warnings which gokr-build-kernel
+// writes into the build result. It is installed next to vmlinuz as the
+// baseline for the next build.
+const warningsFileName = "warnings.txt"
+
+// readWarnings returns the warnings listed in path, one per line.
+func readWarnings(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings, nil
+}
+
+// diffWarnings returns the warnings of current which are not in baseline
+// (new) and those of baseline which are not in current (fixed).
+func diffWarnings(baseline, current []string) (added, fixed []string) {
+	inBaseline := make(map[string]bool)
+	for _, w := range baseline {
+		inBaseline[w] = true
+	}
+	inCurrent := make(map[string]bool)
+	for _, w := range current {
+		inCurrent[w] = true
+		if !inBaseline[w] {
+			added = append(added, w)
+		}
+	}
+	for _, w := range baseline {
+		if !inCurrent[w] {
+			fixed = append(fixed, w)
+		}
+	}
+	return added, fixed
+}
+
+// checkWarnings compares the warnings of the build with those of the build
+// which produced the artifacts in the repository. With -warnings=fail, an
+// increase in the number of warnings fails the build.
+func (b *kernelBuild) checkWarnings() error {
+	current, err := readWarnings(filepath.Join(b.tmp, warningsFileName))
+	if os.IsNotExist(err) {
+		// e.g. resuming a build started with an older build container
+		log.Printf("the build result lists no warnings, not checking the warning budget")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	baselinePath := filepath.Join(filepath.Dir(b.kernelPath), warningsFileName)
+	baseline, err := readWarnings(baselinePath)
+	if os.IsNotExist(err) {
+		log.Printf("build warnings: %d, recording them as the baseline for the next build in %s", len(current), baselinePath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	added, fixed := diffWarnings(baseline, current)
+	var report strings.Builder
+	fmt.Fprintf(&report, "build warnings: %d (previous build: %d), %d new, %d fixed\n", len(current), len(baseline), len(added), len(fixed))
+	for _, w := range added {
+		fmt.Fprintf(&report, "  new: %s\n", w)
+	}
+	for _, w := range fixed {
+		fmt.Fprintf(&report, "  fixed: %s\n", w)
+	}
+	log.Printf("warning report:\n%s", report.String())
+	if b.opts.warnings == "fail" && len(current) > len(baseline) {
+		return fmt.Errorf("the build has %d warnings, %d more than the previous build (see the new warnings above); fix them or rebuild with -warnings=annotate to accept them", len(current), len(current)-len(baseline))
+	}
+	return nil
+}
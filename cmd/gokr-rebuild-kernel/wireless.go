@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/board"
+)
+
+// wirelessFirmwareList is written by gokr-build-kernel, see there.
+const wirelessFirmwareList = "wireless-firmware.txt"
+
+// findFirmware returns the first of names which exists in dir (or its brcm
+// subdirectory, like in /lib/firmware), or an empty string.
+func findFirmware(dir string, names ...string) string {
+	for _, name := range names {
+		for _, sub := range []string{"brcm", ""} {
+			if _, err := os.Stat(filepath.Join(dir, sub, name)); err == nil {
+				return filepath.Join(sub, name)
+			}
+		}
+	}
+	return ""
+}
+
+// wirelessReport checks for each of the boards with a wireless chip that
+// the drivers request its firmware (according to list, the content of
+// wirelessFirmwareList) and that dir contains the firmware files. It
+// returns the report and the number of problems.
+func wirelessReport(list string, boards []board.Board, dir string) (string, int) {
+	requested := make(map[string]bool)
+	for _, line := range strings.Split(list, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			requested[fields[0]+" "+fields[1]] = true
+		}
+	}
+	var report strings.Builder
+	problems := 0
+	check := func(what, found string, optional bool) {
+		switch {
+		case found != "":
+			fmt.Fprintf(&report, "  ok      %s: %s\n", what, found)
+		case optional:
+			fmt.Fprintf(&report, "  missing %s (optional)\n", what)
+		default:
+			fmt.Fprintf(&report, "  MISSING %s\n", what)
+			problems++
+		}
+	}
+	for _, bo := range boards {
+		if bo.WiFi == "" {
+			continue
+		}
+		fmt.Fprintf(&report, "%s:\n", bo.Name)
+		if !requested["brcmfmac "+bo.WiFi] {
+			fmt.Fprintf(&report, "  MISSING brcmfmac does not request %s, the kernel does not support the Wi-Fi chip\n", bo.WiFi)
+			problems++
+		}
+		check("Wi-Fi firmware "+bo.WiFi+".bin", findFirmware(dir, bo.WiFi+".bin"), false)
+		check("Wi-Fi NVRAM "+bo.WiFi+"."+bo.Compatible+".txt", findFirmware(dir, bo.WiFi+"."+bo.Compatible+".txt", bo.WiFi+".txt"), false)
+		check("Wi-Fi CLM blob "+bo.WiFi+".clm_blob", findFirmware(dir, bo.WiFi+".clm_blob"), true)
+		if bo.Bluetooth == "" {
+			continue
+		}
+		if !requested["btbcm "+bo.Bluetooth] {
+			fmt.Fprintf(&report, "  MISSING btbcm does not know %s, the kernel does not support the Bluetooth chip\n", bo.Bluetooth)
+			problems++
+		}
+		check("Bluetooth patch "+bo.Bluetooth+".hcd", findFirmware(dir, bo.Bluetooth+"."+bo.Compatible+".hcd", bo.Bluetooth+".hcd"), false)
+	}
+	return report.String(), problems
+}
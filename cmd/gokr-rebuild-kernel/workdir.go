@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockerDesktopShares are the host directories Docker Desktop for macOS
+// shares with its VM by default, see
+// https://docs.docker.com/desktop/settings/mac/#file-sharing. Volume mounts
+// from other directories fail unless the user adds them in the settings.
+var dockerDesktopShares = []string{
+	"/Users",
+	"/Volumes",
+	"/private",
+	"/tmp",
+	"/var/folders",
+}
+
+func addWorkdirFlag(fset *flag.FlagSet) *string {
+	return fset.String("workdir",
+		"",
+		"directory for temporary build files, which is mounted into the build container (default: $TMPDIR, or /tmp if unset). /tmp is a small tmpfs on many systems")
+}
+
+// workDir returns the directory in which to create temporary build
+// directories: dir if non-empty, os.TempDir() otherwise.
+func workDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// warnIfNotShared logs a warning if dir is likely not shared with the VM of
+// backend (e.g. Docker Desktop), in which case the build result volume
+// mount would fail or come back empty.
+func warnIfNotShared(backend, dir string) {
+	shares := backendShares(backend)
+	if len(shares) == 0 {
+		return
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	for _, share := range shares {
+		if abs == share || strings.HasPrefix(abs, share+"/") {
+			return
+		}
+	}
+	hint := "Share it with the VM"
+	if backend == backendDockerDesktop {
+		hint = "Add it under Settings → Resources → File sharing"
+	}
+	log.Printf("warning: %s is not in a directory %s shares by default (%v). %s, or use a different -workdir", abs, backend, shares, hint)
+}
@@ -0,0 +1,233 @@
+// gokr-symbolize resolves the symbol+offset locations in a kernel panic or
+// oops (e.g. copied from the serial console of a gokrazy device) to source
+// file:line, using the vmlinux which gokr-rebuild-kernel stored for the
+// build (identified by the reproducibility hash in its build-info.json):
+//
+//	gokr-symbolize < oops.txt
+//	gokr-symbolize -build_info=/path/to/build-info.json oops.txt
+//	gokr-symbolize -hash=3f2a… oops.txt
+//
+// Resolving to file:line requires a build with -debug_info; otherwise,
+// addr2line only finds the function. Module frames are not resolved, as
+// gokrazy kernels are monolithic.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/symbols"
+)
+
+// frameRe matches a location as printed by the kernel (%pS), e.g.
+// “do_thing+0x1c/0x40” or “do_thing+0x1c/0x40 [module]”.
+var frameRe = regexp.MustCompile(`([A-Za-z_.$][\w.$]*)\+0x([0-9a-f]+)/0x[0-9a-f]+( \[\w+\])?`)
+
+// releaseRe matches the kernel release in the “CPU: 0 PID: 1 Comm: init Not
+// tainted 6.5.7-gokrazy-0123456789ab #1” line.
+var releaseRe = regexp.MustCompile(`(?:Not tainted|Tainted: [A-Z ]+?) (\d+\.\d+(?:\.\d+)?)\S*`)
+
+// systemMap maps symbol names to their addresses, as listed in System.map.
+type systemMap map[string]uint64
+
+func readSystemMap(path string) (systemMap, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(systemMap)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		// Static functions can have the same name in multiple files; keep
+		// the first, as the kernel’s own scripts/decode_stacktrace.sh does.
+		if _, ok := m[fields[2]]; !ok {
+			m[fields[2]] = addr
+		}
+	}
+	return m, nil
+}
+
+// addr2lineTool returns the first addr2line in $PATH which understands
+// arm64 binaries.
+func addr2lineTool() string {
+	for _, name := range []string{"aarch64-linux-gnu-addr2line", "llvm-addr2line", "addr2line"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return "addr2line"
+}
+
+// resolve runs addr2line on addrs and returns, for each address, its
+// location followed by the locations it is inlined into.
+func resolve(tool, vmlinux string, addrs []uint64) (map[uint64][]string, error) {
+	args := []string{"-e", vmlinux, "-f", "-i", "-p", "-a"}
+	for _, addr := range addrs {
+		args = append(args, fmt.Sprintf("0x%x", addr))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	locations := make(map[uint64][]string)
+	var cur uint64
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "0x") {
+			idx := strings.Index(line, ": ")
+			if idx == -1 {
+				continue
+			}
+			if cur, err = strconv.ParseUint(line[2:idx], 16, 64); err != nil {
+				return nil, fmt.Errorf("%s: unexpected output line %q", tool, line)
+			}
+			locations[cur] = append(locations[cur], trimBuildDir(line[idx+2:]))
+			continue
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			locations[cur] = append(locations[cur], trimBuildDir(line))
+		}
+	}
+	return locations, nil
+}
+
+// buildDirRe matches the path of the kernel tree in the build container.
+var buildDirRe = regexp.MustCompile(`/usr/src/linux-[^/]+/`)
+
+func trimBuildDir(location string) string {
+	return buildDirRe.ReplaceAllString(location, "")
+}
+
+// symbolize copies the oops text from r to w, annotating each resolvable
+// location with its source location.
+func symbolize(w io.Writer, r io.Reader, m systemMap, tool, vmlinux, kernelVersion string) error {
+	var lines []string
+	var addrs []uint64
+	lineAddrs := make(map[int]uint64)
+	seen := make(map[uint64]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	warned := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := releaseRe.FindStringSubmatch(line); match != nil && !warned && kernelVersion != "" && match[1] != kernelVersion {
+			log.Printf("warning: the oops is from kernel %s, but the symbols are from kernel %s", match[1], kernelVersion)
+			warned = true
+		}
+		if match := frameRe.FindStringSubmatch(line); match != nil && match[3] == "" {
+			if base, ok := m[match[1]]; ok {
+				off, err := strconv.ParseUint(match[2], 16, 64)
+				if err != nil {
+					return err
+				}
+				if _, ok := seen[base+off]; !ok {
+					seen[base+off] = true
+					addrs = append(addrs, base+off)
+				}
+				lineAddrs[len(lines)] = base + off
+			}
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	var locations map[uint64][]string
+	if len(addrs) > 0 {
+		var err error
+		if locations, err = resolve(tool, vmlinux, addrs); err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for idx, line := range lines {
+		addr, ok := lineAddrs[idx]
+		locs := locations[addr]
+		if !ok || len(locs) == 0 {
+			fmt.Fprintln(bw, line)
+			continue
+		}
+		fmt.Fprintf(bw, "%s\n\t%s\n", line, locs[0])
+		for _, loc := range locs[1:] {
+			fmt.Fprintf(bw, "\t%s\n", loc)
+		}
+	}
+	return bw.Flush()
+}
+
+func main() {
+	var symbolsDir = flag.String("symbols_dir",
+		symbols.DefaultDir(),
+		"directory in which gokr-rebuild-kernel stored the symbols of its builds (see its -symbols_dir flag)")
+	var hash = flag.String("hash",
+		"",
+		"reproducibility hash of the build the oops is from (default: read from -build_info)")
+	var buildInfo = flag.String("build_info",
+		buildinfo.FileName,
+		"build-info.json of the kernel the oops is from")
+	var addr2line = flag.String("addr2line",
+		addr2lineTool(),
+		"addr2line program which understands arm64 binaries")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gokr-symbolize [flags] [oops.txt]\n\nReads the oops from stdin if no file is given.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var kernelVersion string
+	if *hash == "" {
+		bi, err := buildinfo.Read(*buildInfo)
+		if err != nil {
+			log.Fatalf("%v (use -build_info or -hash to identify the build)", err)
+		}
+		*hash = bi.ReproducibilityHash
+		kernelVersion = bi.KernelVersion
+	}
+	dir, err := symbols.Lookup(*symbolsDir, *hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if kernelVersion == "" {
+		if bi, err := buildinfo.Read(filepath.Join(dir, buildinfo.FileName)); err == nil {
+			kernelVersion = bi.KernelVersion
+		}
+	}
+	m, err := readSystemMap(filepath.Join(dir, symbols.SystemMap))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	in := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := symbolize(os.Stdout, in, m, *addr2line, filepath.Join(dir, symbols.Vmlinux), kernelVersion); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package delta
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// bsdiffMagic starts patches in the format of bsdiff 4 (BSDIFF40).
+const bsdiffMagic = "BSDIFF40"
+
+// offtin decodes the sign-magnitude little-endian integers of bsdiff.
+func offtin(b []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+// Patch applies patch, a bsdiff 4 patch (as written by bsdiff(1)), to old
+// and returns the result. It only needs compress/bzip2 (decompression),
+// so that it works on the device without further dependencies. Patches
+// producing more than maxSize bytes are refused before allocating the
+// result, so that a corrupt header cannot exhaust the memory of the device.
+func Patch(old []byte, patch []byte, maxSize int64) ([]byte, error) {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return nil, fmt.Errorf("not a bsdiff 4 patch")
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	body := patch[32:]
+	// Compare against the remaining length instead of summing the
+	// lengths, which could overflow.
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 ||
+		ctrlLen > int64(len(body)) || diffLen > int64(len(body))-ctrlLen {
+		return nil, fmt.Errorf("corrupt bsdiff header")
+	}
+	if newSize > maxSize {
+		return nil, fmt.Errorf("patch produces %d bytes, more than the expected %d", newSize, maxSize)
+	}
+	ctrl := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+
+	out := make([]byte, newSize)
+	var (
+		oldPos, newPos int64
+		triple         [24]byte
+	)
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, triple[:]); err != nil {
+			return nil, fmt.Errorf("reading control block: %v", err)
+		}
+		add, copyLen, seek := offtin(triple[0:8]), offtin(triple[8:16]), offtin(triple[16:24])
+
+		// Add the diff block to the bytes of old.
+		if add < 0 || add > newSize-newPos {
+			return nil, fmt.Errorf("corrupt control block")
+		}
+		if _, err := io.ReadFull(diff, out[newPos:newPos+add]); err != nil {
+			return nil, fmt.Errorf("reading diff block: %v", err)
+		}
+		for i := int64(0); i < add; i++ {
+			if o := oldPos + i; o >= 0 && o < int64(len(old)) {
+				out[newPos+i] += old[o]
+			}
+		}
+		newPos += add
+		oldPos += add
+
+		// Copy new bytes from the extra block.
+		if copyLen < 0 || copyLen > newSize-newPos {
+			return nil, fmt.Errorf("corrupt control block")
+		}
+		if _, err := io.ReadFull(extra, out[newPos:newPos+copyLen]); err != nil {
+			return nil, fmt.Errorf("reading extra block: %v", err)
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+	return out, nil
+}
+
+// readAllLimited reads r, failing if it is larger than limit bytes, so that
+// a corrupt size cannot exhaust the memory of the device.
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("larger than the expected %d bytes", limit)
+	}
+	return b, nil
+}
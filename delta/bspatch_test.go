@@ -0,0 +1,156 @@
+package delta
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const (
+	patchOld = "gokrazy kernel 6.5.7 for the Raspberry Pi\n"
+	patchNew = "gokrazy kernel 6.5.9 for the Raspberry Pi 4 and 5\n"
+
+	// patchHex transforms patchOld into patchNew: it adds a diff block to
+	// all bytes but the last of patchOld and copies the rest from the extra
+	// block. The blocks were compressed with Python’s bz2 module.
+	patchHex = "42534449464634302b000000000000002b000000000000003200000000000000" +
+		"425a683931415926535942b0f342000005d0004828002020002186819a0c56c9" +
+		"b8bb9229c2848215879a10425a6839314159265359b6c5c32500000060005000" +
+		"a0002000218c8334d1095d38bb9229c28485b62e1928425a6839314159265359" +
+		"b470812d000000d9000010400006002401200021898421806ac876f177245385" +
+		"090b470812d0"
+
+	// overflowHex produces 2 bytes, but its second control triple adds
+	// 1<<63-1 bytes at offset 1, which overflows a naive bounds check.
+	overflowHex = "4253444946463430330000000000000025000000000000000200000000000000" +
+		"425a683931415926535997f47c000000046080e804080000008000a000310c00" +
+		"c9ea32404fa8a0ef8bb9229c28484bfa3e0000425a6839314159265359ff489b" +
+		"82000000c00040002000211846c2ee48a70a121fe9137040425a683917724538" +
+		"509000000000"
+)
+
+func testPatch(t *testing.T) []byte {
+	b, err := hex.DecodeString(patchHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPatch(t *testing.T) {
+	got, err := Patch([]byte(patchOld), testPatch(t), int64(len(patchNew)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != patchNew {
+		t.Errorf("Patch = %q, want %q", got, patchNew)
+	}
+}
+
+func TestOfftin(t *testing.T) {
+	for _, tt := range []struct {
+		b    [8]byte
+		want int64
+	}{
+		{[8]byte{0x2a}, 42},
+		{[8]byte{0x2a, 0, 0, 0, 0, 0, 0, 0x80}, -42},
+		{[8]byte{0, 0, 0, 0, 1}, 1 << 32},
+	} {
+		if got := offtin(tt.b[:]); got != tt.want {
+			t.Errorf("offtin(%x) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPatchCorrupt(t *testing.T) {
+	// header returns a copy of the test patch with the header field at
+	// offset off set to v.
+	header := func(off int, v uint64) func([]byte) []byte {
+		return func(b []byte) []byte {
+			binary.LittleEndian.PutUint64(b[off:], v)
+			return b
+		}
+	}
+	for _, tt := range []struct {
+		name    string
+		modify  func([]byte) []byte
+		wantErr string
+	}{
+		{
+			name:    "magic",
+			modify:  func(b []byte) []byte { return append([]byte("BSDIFF41"), b[8:]...) },
+			wantErr: "not a bsdiff 4 patch",
+		},
+		{
+			name:    "short",
+			modify:  func(b []byte) []byte { return b[:31] },
+			wantErr: "not a bsdiff 4 patch",
+		},
+		{
+			name:    "negative control length",
+			modify:  header(8, 1<<63|1),
+			wantErr: "corrupt bsdiff header",
+		},
+		{
+			name:    "blocks beyond the patch",
+			modify:  header(16, 1000),
+			wantErr: "corrupt bsdiff header",
+		},
+		{
+			name: "overflowing block lengths",
+			modify: func(b []byte) []byte {
+				b = header(8, 1<<63-1)(b)
+				return header(16, 1<<63-1)(b)
+			},
+			wantErr: "corrupt bsdiff header",
+		},
+		{
+			name:    "output larger than the limit",
+			modify:  header(24, 1<<40),
+			wantErr: "more than the expected",
+		},
+		{
+			name: "overflowing control block",
+			modify: func([]byte) []byte {
+				b, err := hex.DecodeString(overflowHex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			},
+			wantErr: "corrupt control block",
+		},
+		{
+			name:    "output larger than the control block",
+			modify:  header(24, 100),
+			wantErr: "reading control block",
+		},
+		{
+			name:    "output smaller than the control block",
+			modify:  header(24, 10),
+			wantErr: "corrupt control block",
+		},
+		{
+			name:    "truncated extra block",
+			modify:  func(b []byte) []byte { return b[:len(b)-30] },
+			wantErr: "reading extra block",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Patch([]byte(patchOld), tt.modify(testPatch(t)), 1<<20)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Patch: err = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadAllLimited(t *testing.T) {
+	if b, err := readAllLimited(strings.NewReader("12345"), 5); err != nil || string(b) != "12345" {
+		t.Errorf("readAllLimited(5 bytes, 5) = %q, %v", b, err)
+	}
+	if _, err := readAllLimited(strings.NewReader("123456"), 5); err == nil {
+		t.Errorf("readAllLimited(6 bytes, 5) succeeded unexpectedly")
+	}
+}
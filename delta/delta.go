@@ -0,0 +1,286 @@
+// Package delta describes differential kernel updates: the files which
+// changed between two kernel builds, as bsdiff patches against the files of
+// the older build, so that bandwidth-constrained devices (e.g. connected via
+// LTE) download kilobytes instead of the full artifacts.
+// gokr-rebuild-kernel delta generates them; devices apply them with Apply:
+//
+//	src := delta.HTTPSource("https://example.com/kernel-deltas/6.5.7-to-6.5.9")
+//	m, err := delta.ReadManifest(src, manifestSHA256)
+//	// handle err
+//	err = m.Apply(src, delta.GokrazyPath, "/perm/kernel-update")
+//
+// The delta directory is usually served from the same unauthenticated
+// location as the patches, so its hashes alone prove nothing about where the
+// update came from. The manifest is therefore pinned: ReadManifest refuses a
+// delta.json whose SHA-256 (printed by gokr-rebuild-kernel delta) differs
+// from the one the device received through a trusted channel, e.g. its
+// signed gokrazy update. The hashes in the pinned manifest then vouch for
+// every patch and reconstructed file.
+//
+// The patches are in the format of bsdiff 4, which (unlike zstd
+// --patch-from) only needs compress/bzip2 to apply.
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestName is the name of the manifest in a delta directory.
+const ManifestName = "delta.json"
+
+// SchemaVersion is incremented for incompatible changes of Manifest.
+const SchemaVersion = 1
+
+// Operations which reconstruct a file of the newer build.
+const (
+	OpSame  = "same"  // the file is unchanged, copy it from the older build
+	OpPatch = "patch" // apply the bsdiff patch Delta to the file OldPath
+	OpFull  = "full"  // Delta is the gzip-compressed file
+)
+
+// Manifest is the content of delta.json.
+type Manifest struct {
+	// SchemaVersion is the SchemaVersion the file was written with.
+	SchemaVersion int
+
+	// From and To are the kernel releases (uname -r) of the older and the
+	// newer build.
+	From string
+	To   string
+
+	// Files are the files of the newer build, relative to the repository
+	// (e.g. vmlinuz or lib/modules/6.5.9/modules.dep), slash-separated.
+	// Filter them to update only some files, e.g. those a device has.
+	Files []File
+}
+
+// File describes how to reconstruct a file of the newer build.
+type File struct {
+	Path string
+	Op   string
+
+	// OldPath and OldSHA256 identify the file of the older build which
+	// OpSame and OpPatch start from. OldPath differs from Path for the
+	// modules, whose directory is named after the kernel release.
+	OldPath   string `json:",omitempty"`
+	OldSHA256 string `json:",omitempty"`
+
+	// SHA256 and Size are those of the file of the newer build.
+	SHA256 string
+	Size   int64
+
+	// Delta is the path (relative to the delta directory) of the patch or
+	// compressed file which OpPatch and OpFull download, and DeltaSize its
+	// size.
+	Delta     string `json:",omitempty"`
+	DeltaSize int64  `json:",omitempty"`
+}
+
+// DownloadSize returns how many bytes applying m downloads.
+func (m *Manifest) DownloadSize() int64 {
+	var n int64
+	for _, f := range m.Files {
+		n += f.DeltaSize
+	}
+	return n
+}
+
+// Write writes m as a delta.json file to path.
+func (m *Manifest) Write(path string) error {
+	m.SchemaVersion = SchemaVersion
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Source provides the files of a delta directory.
+type Source interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+type dirSource string
+
+func (d dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// DirSource returns a Source reading the delta directory dir.
+func DirSource(dir string) Source { return dirSource(dir) }
+
+type httpSource string
+
+func (h httpSource) Open(name string) (io.ReadCloser, error) {
+	url := strings.TrimSuffix(string(h), "/") + "/" + name
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected HTTP status %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// HTTPSource returns a Source downloading from the delta directory at the
+// HTTP(S) URL baseURL, e.g. as uploaded to a bucket.
+func HTTPSource(baseURL string) Source { return httpSource(baseURL) }
+
+// maxManifestSize bounds how much of delta.json ReadManifest reads.
+const maxManifestSize = 16 << 20
+
+// ReadManifest reads the manifest of the delta directory src and verifies
+// that its hex-encoded SHA-256 hash is digest, see the package comment.
+func ReadManifest(src Source, digest string) (*Manifest, error) {
+	if digest == "" {
+		return nil, fmt.Errorf("%s: no pinned SHA-256 hash", ManifestName)
+	}
+	rc, err := src.Open(ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(rc, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ManifestName, err)
+	}
+	if len(b) > maxManifestSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", ManifestName, maxManifestSize)
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(b)); got != strings.ToLower(digest) {
+		return nil, fmt.Errorf("%s: SHA-256 %s, want the pinned %s", ManifestName, got, digest)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", ManifestName, err)
+	}
+	if m.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d (want <= %d)", ManifestName, m.SchemaVersion, SchemaVersion)
+	}
+	return &m, nil
+}
+
+// GokrazyPath maps a path of the manifest to where a gokrazy device has the
+// file of the running build: the modules in the root file system, all other
+// files on the boot partition.
+func GokrazyPath(rel string) string {
+	if strings.HasPrefix(rel, "lib/") {
+		return "/" + rel
+	}
+	return "/boot/" + rel
+}
+
+// Apply reconstructs the files of the newer build in newDir, from the files
+// of the older build (which oldPath maps the paths of the manifest to, e.g.
+// GokrazyPath) and the patches of src. The hashes of the older files are
+// verified before, and those of the reconstructed files after patching;
+// each file is written under a temporary name and renamed into place.
+func (m *Manifest) Apply(src Source, oldPath func(rel string) string, newDir string) error {
+	for _, f := range m.Files {
+		if err := m.apply(f, src, oldPath, newDir); err != nil {
+			return fmt.Errorf("%s: %v", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// isRelative reports whether the slash-separated path p names a file within
+// the directory it is relative to.
+func isRelative(p string) bool {
+	clean := path.Clean(p)
+	return p != "" && !path.IsAbs(p) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+func (m *Manifest) apply(f File, src Source, oldPath func(rel string) string, newDir string) error {
+	if !isRelative(f.Path) {
+		return fmt.Errorf("path is not relative")
+	}
+	if (f.Op == OpSame || f.Op == OpPatch) && !isRelative(f.OldPath) {
+		return fmt.Errorf("old path %q is not relative", f.OldPath)
+	}
+	if (f.Op == OpPatch || f.Op == OpFull) && !isRelative(f.Delta) {
+		return fmt.Errorf("delta %q is not relative", f.Delta)
+	}
+	var old []byte
+	if f.Op == OpSame || f.Op == OpPatch {
+		var err error
+		if old, err = ioutil.ReadFile(oldPath(f.OldPath)); err != nil {
+			return err
+		}
+		if got := fmt.Sprintf("%x", sha256.Sum256(old)); got != f.OldSHA256 {
+			return fmt.Errorf("%s is not the file of %s the delta was made against: SHA-256 %s, want %s", oldPath(f.OldPath), m.From, got, f.OldSHA256)
+		}
+	}
+	var content []byte
+	switch f.Op {
+	case OpSame:
+		content = old
+
+	case OpPatch:
+		patch, err := m.download(src, f)
+		if err != nil {
+			return err
+		}
+		if len(patch) >= 32 && offtin(patch[24:32]) != f.Size {
+			return fmt.Errorf("patch produces %d bytes, want %d", offtin(patch[24:32]), f.Size)
+		}
+		if content, err = Patch(old, patch, f.Size); err != nil {
+			return err
+		}
+
+	case OpFull:
+		compressed, err := m.download(src, f)
+		if err != nil {
+			return err
+		}
+		rd, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		if content, err = readAllLimited(rd, f.Size); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown operation %q", f.Op)
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(content)); got != f.SHA256 {
+		return fmt.Errorf("SHA-256 hash mismatch after %s: got %s, want %s", f.Op, got, f.SHA256)
+	}
+	dest := filepath.Join(newDir, filepath.FromSlash(f.Path))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".partial"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// download reads the delta file of f from src.
+func (m *Manifest) download(src Source, f File) ([]byte, error) {
+	rc, err := src.Open(f.Delta)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := readAllLimited(rc, f.DeltaSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Delta, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,114 @@
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Manifest{From: "6.5.7", To: "6.5.9"}
+	if err := m.Write(filepath.Join(dir, ManifestName)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadManifest(DirSource(dir), sha256Hex(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.From != m.From || got.To != m.To {
+		t.Errorf("ReadManifest = %s to %s, want %s to %s", got.From, got.To, m.From, m.To)
+	}
+	for _, digest := range []string{"", sha256Hex([]byte("another manifest"))} {
+		if _, err := ReadManifest(DirSource(dir), digest); err == nil {
+			t.Errorf("ReadManifest(%q) succeeded unexpectedly", digest)
+		}
+	}
+}
+
+func TestApplyRefusesEscapingPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := []byte("secret\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), secret, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(secret)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.gz"), compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"old", "src"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath := func(rel string) string { return filepath.Join(dir, "old", filepath.FromSlash(rel)) }
+
+	sum := sha256Hex(secret)
+	size := int64(len(secret))
+	for _, tt := range []struct {
+		name    string
+		file    File
+		wantErr string
+	}{
+		{
+			name:    "path",
+			file:    File{Path: "../new", Op: OpSame, OldPath: "vmlinuz", SHA256: sum, Size: size},
+			wantErr: "path is not relative",
+		},
+		{
+			name:    "absolute path",
+			file:    File{Path: "/boot/vmlinuz", Op: OpSame, OldPath: "vmlinuz", SHA256: sum, Size: size},
+			wantErr: "path is not relative",
+		},
+		{
+			name:    "old path",
+			file:    File{Path: "vmlinuz", Op: OpSame, OldPath: "../secret", OldSHA256: sum, SHA256: sum, Size: size},
+			wantErr: `old path "../secret" is not relative`,
+		},
+		{
+			name:    "delta",
+			file:    File{Path: "vmlinuz", Op: OpFull, Delta: "../secret.gz", DeltaSize: int64(compressed.Len()), SHA256: sum, Size: size},
+			wantErr: `delta "../secret.gz" is not relative`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			newDir := filepath.Join(dir, "new", tt.name)
+			m := &Manifest{Files: []File{tt.file}}
+			err := m.Apply(DirSource(filepath.Join(dir, "src")), oldPath, newDir)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Apply: err = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(newDir, "vmlinuz")); err == nil {
+				t.Errorf("Apply wrote vmlinuz")
+			}
+		})
+	}
+}
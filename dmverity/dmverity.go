@@ -0,0 +1,170 @@
+// Package dmverity computes and verifies dm-verity hash trees (format
+// version 1 with SHA-256, as created by veritysetup --no-superblock), so that
+// gokrazy root file system images can be booted with verified integrity.
+//
+// The hash tree is typically appended to the (block-aligned) squashfs image
+// and the kernel is told about it via the dm-mod.create= command line
+// parameter (requires CONFIG_DM_INIT and CONFIG_DM_VERITY, see the verity
+// profile).
+package dmverity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// BlockSize is the data and hash block size used by gokrazy.
+const BlockSize = 4096
+
+const sectorSize = 512
+
+// Tree is a computed dm-verity hash tree.
+type Tree struct {
+	// RootHash is the hash of the top-level hash block.
+	RootHash []byte
+
+	// Salt is prepended to every hashed block.
+	Salt []byte
+
+	// DataBlocks is the number of data blocks covered by the tree.
+	DataBlocks int64
+
+	// Hashes contains the hash blocks as laid out on disk: the top level
+	// first, the level hashing the data blocks last.
+	Hashes []byte
+}
+
+func hashBlock(salt, block []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// hashesPerBlockBits is log2 of the number of hashes stored per hash block.
+func hashesPerBlockBits() uint {
+	var bits uint
+	for (1 << (bits + 1)) <= BlockSize/sha256.Size {
+		bits++
+	}
+	return bits
+}
+
+// NewSalt returns a random salt of the same size as the hash.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Compute computes the hash tree over the first size bytes of r, which must
+// be a multiple of BlockSize.
+func Compute(r io.ReaderAt, size int64, salt []byte) (*Tree, error) {
+	if size == 0 || size%BlockSize != 0 {
+		return nil, fmt.Errorf("data size %d is not a positive multiple of the block size %d", size, BlockSize)
+	}
+	dataBlocks := size / BlockSize
+	perBlock := 1 << hashesPerBlockBits()
+
+	// Hash all data blocks, then hash the resulting hash blocks until only
+	// one hash block is left.
+	var levels [][]byte
+	var current bytes.Buffer
+	block := make([]byte, BlockSize)
+	for i := int64(0); i < dataBlocks; i++ {
+		if _, err := r.ReadAt(block, i*BlockSize); err != nil {
+			return nil, err
+		}
+		current.Write(hashBlock(salt, block))
+	}
+	hashes := current.Bytes()
+	if dataBlocks == 1 {
+		// No hash blocks: the root hash covers the only data block.
+		return &Tree{RootHash: hashes, Salt: salt, DataBlocks: dataBlocks}, nil
+	}
+	for {
+		level := pack(hashes, perBlock)
+		levels = append(levels, level)
+		if len(level) == BlockSize {
+			break
+		}
+		var next bytes.Buffer
+		for off := 0; off < len(level); off += BlockSize {
+			next.Write(hashBlock(salt, level[off:off+BlockSize]))
+		}
+		hashes = next.Bytes()
+	}
+
+	var layout bytes.Buffer
+	for i := len(levels) - 1; i >= 0; i-- {
+		layout.Write(levels[i])
+	}
+	top := levels[len(levels)-1]
+	return &Tree{
+		RootHash:   hashBlock(salt, top),
+		Salt:       salt,
+		DataBlocks: dataBlocks,
+		Hashes:     layout.Bytes(),
+	}, nil
+}
+
+// pack stores hashes in hash blocks of perBlock hashes each, zero-padding the
+// remainder of each block.
+func pack(hashes []byte, perBlock int) []byte {
+	var result bytes.Buffer
+	n := len(hashes) / sha256.Size
+	for i := 0; i < n; i += perBlock {
+		end := i + perBlock
+		if end > n {
+			end = n
+		}
+		block := make([]byte, BlockSize)
+		copy(block, hashes[i*sha256.Size:end*sha256.Size])
+		result.Write(block)
+	}
+	return result.Bytes()
+}
+
+// Verify recomputes the hash tree over the first size bytes of r and returns
+// an error if its root hash does not match rootHash.
+func Verify(r io.ReaderAt, size int64, salt, rootHash []byte) error {
+	t, err := Compute(r, size, salt)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(t.RootHash, rootHash) {
+		return fmt.Errorf("root hash mismatch: got %x, want %x", t.RootHash, rootHash)
+	}
+	return nil
+}
+
+// Table returns the device-mapper table line for a verity target whose data
+// is on dataDev and whose hash tree starts at hashStartBlock (in units of
+// BlockSize) on hashDev.
+func (t *Tree) Table(dataDev, hashDev string, hashStartBlock int64) string {
+	return fmt.Sprintf("0 %d verity 1 %s %s %d %d %d %d sha256 %s %s",
+		t.DataBlocks*BlockSize/sectorSize,
+		dataDev,
+		hashDev,
+		BlockSize,
+		BlockSize,
+		t.DataBlocks,
+		hashStartBlock,
+		hex.EncodeToString(t.RootHash),
+		hex.EncodeToString(t.Salt))
+}
+
+// Cmdline returns the kernel command line parameters which set up a verified
+// root file system on dev, with the hash tree appended directly after the
+// data (as written by gokr-dm-verity -append).
+func (t *Tree) Cmdline(dev string) string {
+	return fmt.Sprintf(`dm-mod.create="gokrazy-root,,,ro,%s" dm-mod.waitfor=%s root=/dev/dm-0`,
+		t.Table(dev, dev, t.DataBlocks),
+		dev)
+}
@@ -0,0 +1,115 @@
+package dmverity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+// data returns n blocks of distinct content.
+func data(n int) []byte {
+	b := make([]byte, n*BlockSize)
+	for i := range b {
+		b[i] = byte(i / BlockSize * 7)
+	}
+	return b
+}
+
+func sum(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// padded returns b zero-padded to a multiple of BlockSize.
+func padded(b []byte) []byte {
+	n := (len(b) + BlockSize - 1) / BlockSize * BlockSize
+	return append(b, make([]byte, n-len(b))...)
+}
+
+func TestCompute(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, sha256.Size)
+
+	t.Run("one level", func(t *testing.T) {
+		b := data(2)
+		tree, err := Compute(bytes.NewReader(b), int64(len(b)), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		level := padded(append(sum(salt, b[:BlockSize]), sum(salt, b[BlockSize:])...))
+		if !bytes.Equal(tree.Hashes, level) {
+			t.Errorf("Hashes do not match the hashes of the data blocks")
+		}
+		if want := sum(salt, level); !bytes.Equal(tree.RootHash, want) {
+			t.Errorf("RootHash = %x, want %x", tree.RootHash, want)
+		}
+		if tree.DataBlocks != 2 {
+			t.Errorf("DataBlocks = %d, want 2", tree.DataBlocks)
+		}
+	})
+
+	t.Run("two levels", func(t *testing.T) {
+		// 128 hashes fit into a hash block, so 129 data blocks need a
+		// second level.
+		const n = BlockSize/sha256.Size + 1
+		b := data(n)
+		tree, err := Compute(bytes.NewReader(b), int64(len(b)), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hashes []byte
+		for i := 0; i < n; i++ {
+			hashes = append(hashes, sum(salt, b[i*BlockSize:(i+1)*BlockSize])...)
+		}
+		bottom := padded(hashes)
+		top := padded(append(sum(salt, bottom[:BlockSize]), sum(salt, bottom[BlockSize:])...))
+		if want := append(append([]byte(nil), top...), bottom...); !bytes.Equal(tree.Hashes, want) {
+			t.Errorf("Hashes are not laid out top level first (got %d bytes, want %d)", len(tree.Hashes), len(want))
+		}
+		if want := sum(salt, top); !bytes.Equal(tree.RootHash, want) {
+			t.Errorf("RootHash = %x, want %x", tree.RootHash, want)
+		}
+	})
+
+	for _, size := range []int64{0, BlockSize - 1, BlockSize + 1} {
+		if _, err := Compute(bytes.NewReader(data(2)), size, salt); err == nil {
+			t.Errorf("Compute(size %d) succeeded unexpectedly", size)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := data(3)
+	tree, err := Compute(bytes.NewReader(b), int64(len(b)), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(bytes.NewReader(b), int64(len(b)), salt, tree.RootHash); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	b[BlockSize+17] ^= 1
+	if err := Verify(bytes.NewReader(b), int64(len(b)), salt, tree.RootHash); err == nil {
+		t.Errorf("Verify of a modified block succeeded unexpectedly")
+	}
+}
+
+func TestCmdline(t *testing.T) {
+	tree := &Tree{
+		RootHash:   bytes.Repeat([]byte{0xab}, sha256.Size),
+		Salt:       bytes.Repeat([]byte{0xcd}, sha256.Size),
+		DataBlocks: 10,
+	}
+	want := `dm-mod.create="gokrazy-root,,,ro,0 80 verity 1 /dev/mmcblk0p2 /dev/mmcblk0p2 4096 4096 10 10 sha256 ` +
+		strings.Repeat("ab", sha256.Size) + " " + strings.Repeat("cd", sha256.Size) +
+		`" dm-mod.waitfor=/dev/mmcblk0p2 root=/dev/dm-0`
+	if got := tree.Cmdline("/dev/mmcblk0p2"); got != want {
+		t.Errorf("Cmdline =\n%s\nwant\n%s", got, want)
+	}
+}
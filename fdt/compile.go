@@ -0,0 +1,849 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Compile compiles the device tree source src, like dtc -@ -I dts -O dtb, so
+// that simple overlays can be built without dtc. For overlays (/plugin/),
+// references to labels the overlay does not define are recorded in
+// __fixups__ (for the firmware or fdtoverlay to resolve against the
+// __symbols__ of the base DTB), references to its own labels in
+// __local_fixups__, and its labels in __symbols__. &label { ... } at the top
+// level of an overlay becomes a fragment targeting label.
+//
+// The C preprocessor (#include, #define), /include/, /memreserve/ and
+// expressions in cells are not supported. name is used in error messages.
+func Compile(name string, src []byte) (*Tree, error) {
+	p := &srcParser{name: name, src: string(src), line: 1}
+	root, err := p.file()
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{
+		name:   name,
+		plugin: p.plugin,
+		labels: make(map[string]*srcNode),
+		fixups: make(map[string][]string),
+	}
+	if err := c.merge(root, p.refBlocks); err != nil {
+		return nil, err
+	}
+	return c.compile(root)
+}
+
+// chunk is part of a property value: literal data or a reference.
+type chunk struct {
+	data    []byte
+	ref     string // label, or path if it starts with a slash
+	phandle bool   // whether ref is a phandle (in a cell list) or a path
+}
+
+type srcProp struct {
+	name   string
+	chunks []chunk
+	value  []byte // resolved
+}
+
+type srcNode struct {
+	name     string
+	labels   []string
+	props    []*srcProp
+	children []*srcNode
+	parent   *srcNode
+}
+
+// refBlock is a top-level &label { ... } (or &{/path} { ... }) block.
+type refBlock struct {
+	target string
+	node   *srcNode
+	line   int
+}
+
+func (n *srcNode) child(name string) *srcNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *srcNode) prop(name string) *srcProp {
+	for _, p := range n.props {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (n *srcNode) path() string {
+	if n.parent == nil {
+		return "/"
+	}
+	if n.parent.parent == nil {
+		return "/" + n.name
+	}
+	return n.parent.path() + "/" + n.name
+}
+
+// mergeInto merges the properties and children of src into n, like
+// repeated definitions of a node in dtc: later properties replace earlier
+// ones.
+func (n *srcNode) mergeInto(src *srcNode) {
+	n.labels = append(n.labels, src.labels...)
+	for _, p := range src.props {
+		if existing := n.prop(p.name); existing != nil {
+			*existing = *p
+		} else {
+			n.props = append(n.props, p)
+		}
+	}
+	for _, c := range src.children {
+		if existing := n.child(c.name); existing != nil {
+			existing.mergeInto(c)
+		} else {
+			c.parent = n
+			n.children = append(n.children, c)
+		}
+	}
+}
+
+// srcParser is a recursive descent parser of device tree source.
+type srcParser struct {
+	name      string
+	src       string
+	pos       int
+	line      int
+	plugin    bool
+	refBlocks []refBlock
+}
+
+func (p *srcParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.name, p.line, fmt.Sprintf(format, args...))
+}
+
+var directiveRe = regexp.MustCompile(`^#\s*(include|define|undef|ifdef|ifndef|if|else|elif|endif)\b`)
+
+// skipSpace skips whitespace and comments.
+func (p *srcParser) skipSpace() error {
+	for p.pos < len(p.src) {
+		switch rest := p.src[p.pos:]; {
+		case rest[0] == '\n':
+			p.line++
+			p.pos++
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r':
+			p.pos++
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end == -1 {
+				end = len(rest)
+			}
+			p.pos += end
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest, "*/")
+			if end == -1 {
+				return p.errorf("unterminated comment")
+			}
+			p.line += strings.Count(rest[:end], "\n")
+			p.pos += end + 2
+		case directiveRe.MatchString(rest):
+			return p.errorf("preprocessor directives are not supported: %s (replace macros with their values)", strings.SplitN(rest, "\n", 2)[0])
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// peek returns the next character after whitespace and comments, or 0 at
+// the end of the source.
+func (p *srcParser) peek() (byte, error) {
+	if err := p.skipSpace(); err != nil {
+		return 0, err
+	}
+	if p.pos >= len(p.src) {
+		return 0, nil
+	}
+	return p.src[p.pos], nil
+}
+
+// consume consumes s if the source continues with it.
+func (p *srcParser) consume(s string) (bool, error) {
+	if err := p.skipSpace(); err != nil {
+		return false, err
+	}
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *srcParser) expect(s string) error {
+	ok, err := p.consume(s)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.errorf("expected %q, found %q", s, p.excerpt())
+	}
+	return nil
+}
+
+func (p *srcParser) excerpt() string {
+	rest := p.src[p.pos:]
+	if idx := strings.IndexAny(rest, "\n"); idx > -1 {
+		rest = rest[:idx]
+	}
+	if len(rest) > 20 {
+		rest = rest[:20] + "…"
+	}
+	return rest
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		strings.IndexByte(",._+*#?@-", c) > -1
+}
+
+func isLabelChar(c byte) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		c == '_'
+}
+
+// word reads a node name, property name or label.
+func (p *srcParser) word() (string, error) {
+	if err := p.skipSpace(); err != nil {
+		return "", err
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name, found %q", p.excerpt())
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *srcParser) file() (*srcNode, error) {
+	root := &srcNode{}
+	if err := p.expect("/dts-v1/"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == 0:
+			return root, nil
+
+		case strings.HasPrefix(p.src[p.pos:], "/plugin/"):
+			p.pos += len("/plugin/")
+			p.plugin = true
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+
+		case strings.HasPrefix(p.src[p.pos:], "/memreserve/"),
+			strings.HasPrefix(p.src[p.pos:], "/include/"),
+			strings.HasPrefix(p.src[p.pos:], "/delete-node/"):
+			return nil, p.errorf("%s is not supported at the top level", p.excerpt())
+
+		case c == '/':
+			p.pos++
+			n, err := p.nodeBody("")
+			if err != nil {
+				return nil, err
+			}
+			root.mergeInto(n)
+
+		case c == '&':
+			line := p.line
+			target, err := p.reference()
+			if err != nil {
+				return nil, err
+			}
+			n, err := p.nodeBody("")
+			if err != nil {
+				return nil, err
+			}
+			p.refBlocks = append(p.refBlocks, refBlock{target: target, node: n, line: line})
+
+		default:
+			return nil, p.errorf("unexpected %q at the top level", p.excerpt())
+		}
+	}
+}
+
+// reference reads &label or &{/path} and returns label or /path.
+func (p *srcParser) reference() (string, error) {
+	if err := p.expect("&"); err != nil {
+		return "", err
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '{' {
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end == -1 {
+			return "", p.errorf("unterminated path reference")
+		}
+		path := p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		if !strings.HasPrefix(path, "/") {
+			return "", p.errorf("path reference %q does not start with /", path)
+		}
+		return path, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && isLabelChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a label after &")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// nodeBody parses { ... }; into a node called name.
+func (p *srcParser) nodeBody(name string) (*srcNode, error) {
+	n := &srcNode{name: name}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if c == '}' {
+			p.pos++
+			return n, p.expect(";")
+		}
+		if c == 0 {
+			return nil, p.errorf("unterminated node %q", name)
+		}
+		if ok, err := p.consume("/delete-property/"); err != nil {
+			return nil, err
+		} else if ok {
+			prop, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			for idx, existing := range n.props {
+				if existing.name == prop {
+					n.props = append(n.props[:idx], n.props[idx+1:]...)
+					break
+				}
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if ok, err := p.consume("/delete-node/"); err != nil {
+			return nil, err
+		} else if ok {
+			child, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			for idx, existing := range n.children {
+				if existing.name == child {
+					n.children = append(n.children[:idx], n.children[idx+1:]...)
+					break
+				}
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var labels []string
+		word, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		for p.pos < len(p.src) && p.src[p.pos] == ':' {
+			p.pos++
+			labels = append(labels, word)
+			if word, err = p.word(); err != nil {
+				return nil, err
+			}
+		}
+		c, err = p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case '{':
+			child, err := p.nodeBody(word)
+			if err != nil {
+				return nil, err
+			}
+			child.labels = labels
+			if existing := n.child(word); existing != nil {
+				existing.mergeInto(child)
+			} else {
+				child.parent = n
+				n.children = append(n.children, child)
+			}
+
+		case ';', '=':
+			if len(labels) > 0 {
+				return nil, p.errorf("labels on properties are not supported")
+			}
+			prop := &srcProp{name: word}
+			p.pos++
+			if c == '=' {
+				if prop.chunks, err = p.value(); err != nil {
+					return nil, fmt.Errorf("%v (property %s)", err, word)
+				}
+				if err := p.expect(";"); err != nil {
+					return nil, err
+				}
+			}
+			if existing := n.prop(word); existing != nil {
+				*existing = *prop
+			} else {
+				n.props = append(n.props, prop)
+			}
+
+		default:
+			return nil, p.errorf("expected {, = or ; after %q, found %q", word, p.excerpt())
+		}
+	}
+}
+
+// value parses a property value up to (excluding) the semicolon.
+func (p *srcParser) value() ([]chunk, error) {
+	var chunks []chunk
+	for {
+		c, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		bits := 32
+		if ok, err := p.consume("/bits/"); err != nil {
+			return nil, err
+		} else if ok {
+			w, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			switch w {
+			case "8", "16", "32", "64":
+				bits, _ = strconv.Atoi(w)
+			default:
+				return nil, p.errorf("invalid /bits/ %s, expected 8, 16, 32 or 64", w)
+			}
+			if c, err = p.peek(); err != nil {
+				return nil, err
+			}
+			if c != '<' {
+				return nil, p.errorf("expected < after /bits/ %d", bits)
+			}
+		}
+		switch c {
+		case '"':
+			s, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunk{data: append([]byte(s), 0)})
+
+		case '<':
+			p.pos++
+			more, err := p.cells(bits)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, more...)
+
+		case '[':
+			p.pos++
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end == -1 {
+				return nil, p.errorf("unterminated byte string")
+			}
+			b, err := ParseValue("[" + p.src[p.pos:p.pos+end] + "]")
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			p.line += strings.Count(p.src[p.pos:p.pos+end], "\n")
+			p.pos += end + 1
+			chunks = append(chunks, chunk{data: b})
+
+		case '&':
+			ref, err := p.reference()
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunk{ref: ref})
+
+		default:
+			return nil, p.errorf("expected a string, <cells>, [bytes] or &reference, found %q", p.excerpt())
+		}
+		if ok, err := p.consume(","); err != nil {
+			return nil, err
+		} else if !ok {
+			return chunks, nil
+		}
+	}
+}
+
+func (p *srcParser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) && p.src[p.pos] != '"' {
+		if p.src[p.pos] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		if p.src[p.pos] == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+	s, err := strconv.Unquote(p.src[start:p.pos])
+	if err != nil {
+		return "", p.errorf("invalid string %s: %v", p.src[start:p.pos], err)
+	}
+	return s, nil
+}
+
+// cells parses the contents of a cell list after the < up to and including
+// the >.
+func (p *srcParser) cells(bits int) ([]chunk, error) {
+	var (
+		chunks []chunk
+		data   []byte
+	)
+	for {
+		c, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '>':
+			p.pos++
+			if len(data) > 0 {
+				chunks = append(chunks, chunk{data: data})
+			}
+			return chunks, nil
+
+		case c == '&':
+			if bits != 32 {
+				return nil, p.errorf("references are only supported in 32-bit cells")
+			}
+			ref, err := p.reference()
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > 0 {
+				chunks = append(chunks, chunk{data: data})
+				data = nil
+			}
+			chunks = append(chunks, chunk{ref: ref, phandle: true})
+
+		case c == '(':
+			return nil, p.errorf("expressions are not supported, use the resulting number")
+
+		case c == '\'':
+			end := strings.IndexByte(p.src[p.pos+1:], '\'')
+			if end == -1 {
+				return nil, p.errorf("unterminated character literal")
+			}
+			lit := p.src[p.pos : p.pos+end+2]
+			p.pos += end + 2
+			r, _, tail, err := strconv.UnquoteChar(lit[1:len(lit)-1], '\'')
+			if err != nil || tail != "" || r > 0xff {
+				return nil, p.errorf("invalid character literal %s", lit)
+			}
+			data = appendCell(data, uint64(r), bits)
+
+		case c >= '0' && c <= '9':
+			start := p.pos
+			for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+				p.pos++
+			}
+			lit := strings.TrimRight(p.src[start:p.pos], "ULul")
+			v, err := strconv.ParseUint(lit, 0, bits)
+			if err != nil {
+				return nil, p.errorf("invalid %d-bit cell %s", bits, p.src[start:p.pos])
+			}
+			data = appendCell(data, v, bits)
+
+		default:
+			return nil, p.errorf("expected a number or &reference in cells, found %q", p.excerpt())
+		}
+	}
+}
+
+func appendCell(data []byte, v uint64, bits int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(data, b[8-bits/8:]...)
+}
+
+// compiler resolves the references of a parsed tree and converts it.
+type compiler struct {
+	name    string
+	plugin  bool
+	labels  map[string]*srcNode
+	order   []string // labels in order of definition
+	fixups  map[string][]string
+	fixupOf []string // labels in fixups, in order of first reference
+	local   *Node    // __local_fixups__
+	maxUsed uint32   // highest phandle
+}
+
+// merge merges the top-level &label { ... } blocks into root: for overlays,
+// as new fragments, otherwise into the referenced node.
+func (c *compiler) merge(root *srcNode, blocks []refBlock) error {
+	fragment := 0
+	for _, b := range blocks {
+		if c.plugin {
+			frag := &srcNode{name: fmt.Sprintf("fragment@%d", fragment), parent: root}
+			fragment++
+			target := &srcProp{name: "target", chunks: []chunk{{ref: b.target, phandle: true}}}
+			if strings.HasPrefix(b.target, "/") {
+				target = &srcProp{name: "target-path", chunks: []chunk{{data: append([]byte(b.target), 0)}}}
+			}
+			frag.props = []*srcProp{target}
+			b.node.name = "__overlay__"
+			b.node.parent = frag
+			frag.children = []*srcNode{b.node}
+			root.children = append(root.children, frag)
+			continue
+		}
+		c.collectLabels(root)
+		target := c.find(root, b.target)
+		if target == nil {
+			return fmt.Errorf("%s:%d: reference to undefined node %s", c.name, b.line, b.target)
+		}
+		target.mergeInto(b.node)
+	}
+	return nil
+}
+
+func (c *compiler) collectLabels(n *srcNode) {
+	for _, label := range n.labels {
+		if _, ok := c.labels[label]; !ok {
+			c.order = append(c.order, label)
+		}
+		c.labels[label] = n
+	}
+	for _, child := range n.children {
+		child.parent = n
+		c.collectLabels(child)
+	}
+}
+
+// find returns the node referenced by ref (a label or path), or nil.
+func (c *compiler) find(root *srcNode, ref string) *srcNode {
+	if !strings.HasPrefix(ref, "/") {
+		return c.labels[ref]
+	}
+	n := root
+	for _, name := range strings.Split(strings.Trim(ref, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		next := n.child(name)
+		if next == nil && !strings.Contains(name, "@") {
+			for _, child := range n.children {
+				if strings.HasPrefix(child.name, name+"@") {
+					next = child
+					break
+				}
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// phandle returns the phandle of n, assigning one if necessary.
+func (c *compiler) phandle(n *srcNode) uint32 {
+	if p := n.prop("phandle"); p != nil && len(p.chunks) == 1 && len(p.chunks[0].data) == 4 {
+		return binary.BigEndian.Uint32(p.chunks[0].data)
+	}
+	c.maxUsed++
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], c.maxUsed)
+	// n may have been resolved already, so set the value, too.
+	n.props = append(n.props, &srcProp{name: "phandle", chunks: []chunk{{data: b[:]}}, value: b[:]})
+	return c.maxUsed
+}
+
+// reservePhandles makes sure that assigned phandles do not collide with
+// phandle properties in the source.
+func (c *compiler) reservePhandles(n *srcNode) {
+	if p := n.prop("phandle"); p != nil && len(p.chunks) == 1 && len(p.chunks[0].data) == 4 {
+		if v := binary.BigEndian.Uint32(p.chunks[0].data); v > c.maxUsed && v != 0xffffffff {
+			c.maxUsed = v
+		}
+	}
+	for _, child := range n.children {
+		c.reservePhandles(child)
+	}
+}
+
+// resolve computes the values of the properties of n and its children.
+func (c *compiler) resolve(root, n *srcNode) error {
+	for idx := 0; idx < len(n.props); idx++ {
+		prop := n.props[idx]
+		var value []byte
+		for _, ch := range prop.chunks {
+			if ch.ref == "" {
+				value = append(value, ch.data...)
+				continue
+			}
+			target := c.find(root, ch.ref)
+			if !ch.phandle {
+				if target == nil {
+					return fmt.Errorf("%s: %s: %s: reference to undefined node %s", c.name, n.path(), prop.name, ch.ref)
+				}
+				value = append(append(value, target.path()...), 0)
+				continue
+			}
+			offset := len(value)
+			var phandle uint32
+			switch {
+			case target != nil:
+				phandle = c.phandle(target)
+				if c.plugin {
+					c.addLocalFixup(n, prop.name, offset)
+				}
+			case c.plugin && !strings.HasPrefix(ch.ref, "/"):
+				// Resolved against the __symbols__ of the base DTB.
+				phandle = 0xffffffff
+				if _, ok := c.fixups[ch.ref]; !ok {
+					c.fixupOf = append(c.fixupOf, ch.ref)
+				}
+				c.fixups[ch.ref] = append(c.fixups[ch.ref], fmt.Sprintf("%s:%s:%d", n.path(), prop.name, offset))
+			default:
+				return fmt.Errorf("%s: %s: %s: reference to undefined node %s", c.name, n.path(), prop.name, ch.ref)
+			}
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], phandle)
+			value = append(value, b[:]...)
+		}
+		prop.value = value
+	}
+	for _, child := range n.children {
+		if err := c.resolve(root, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) addLocalFixup(n *srcNode, prop string, offset int) {
+	var chain []*srcNode
+	for ; n.parent != nil; n = n.parent {
+		chain = append([]*srcNode{n}, chain...)
+	}
+	if c.local == nil {
+		c.local = &Node{Name: "__local_fixups__"}
+	}
+	fixup := c.local
+	for _, sn := range chain {
+		var next *Node
+		for _, child := range fixup.Children {
+			if child.Name == sn.name {
+				next = child
+			}
+		}
+		if next == nil {
+			next = &Node{Name: sn.name}
+			fixup.Children = append(fixup.Children, next)
+		}
+		fixup = next
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(offset))
+	for idx := range fixup.Properties {
+		if fixup.Properties[idx].Name == prop {
+			fixup.Properties[idx].Value = append(fixup.Properties[idx].Value, b[:]...)
+			return
+		}
+	}
+	fixup.Properties = append(fixup.Properties, Property{Name: prop, Value: b[:]})
+}
+
+func convert(n *srcNode) *Node {
+	out := &Node{Name: n.name}
+	for _, p := range n.props {
+		value := p.value
+		if value == nil {
+			value = []byte{}
+		}
+		out.Properties = append(out.Properties, Property{Name: p.name, Value: value})
+	}
+	for _, child := range n.children {
+		out.Children = append(out.Children, convert(child))
+	}
+	return out
+}
+
+func (c *compiler) compile(root *srcNode) (*Tree, error) {
+	c.labels = make(map[string]*srcNode)
+	c.order = nil
+	c.collectLabels(root)
+	c.reservePhandles(root)
+	if err := c.resolve(root, root); err != nil {
+		return nil, err
+	}
+	out := convert(root)
+	if c.plugin {
+		if len(c.order) > 0 {
+			symbols := &Node{Name: "__symbols__"}
+			for _, label := range c.order {
+				symbols.Properties = append(symbols.Properties, Property{
+					Name:  label,
+					Value: append([]byte(c.labels[label].path()), 0),
+				})
+			}
+			out.Children = append(out.Children, symbols)
+		}
+		if len(c.fixupOf) > 0 {
+			fixups := &Node{Name: "__fixups__"}
+			for _, label := range c.fixupOf {
+				var value bytes.Buffer
+				for _, loc := range c.fixups[label] {
+					value.WriteString(loc)
+					value.WriteByte(0)
+				}
+				fixups.Properties = append(fixups.Properties, Property{Name: label, Value: value.Bytes()})
+			}
+			out.Children = append(out.Children, fixups)
+		}
+		if c.local != nil {
+			out.Children = append(out.Children, c.local)
+		}
+	}
+	return &Tree{Version: 17, Root: out}, nil
+}
@@ -0,0 +1,170 @@
+package fdt
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fanOverlay = `/dts-v1/;
+/plugin/;
+
+&gpio {
+	fan_pins: fan_pins {
+		brcm,pins = <12>;
+		brcm,function = <1>; // output
+	};
+};
+
+/ {
+	compatible = "brcm,bcm2711";
+
+	fragment@1 {
+		target-path = "/";
+		__overlay__ {
+			fan: gpio-fan@0 {
+				compatible = "gpio-fan";
+				pinctrl-0 = <&fan_pins>;
+				gpios = <&gpio 12 0>;
+				gpio-fan,speed-map = <0 0>, <5000 1>;
+			};
+		};
+	};
+
+	__overrides__ {
+		gpiopin = <&fan>,"gpios:4";
+	};
+};
+`
+
+func cells(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = appendCell(b, uint64(v), 32)
+	}
+	return b
+}
+
+func TestCompileOverlay(t *testing.T) {
+	tree, err := Compile("fan.dts", []byte(fanOverlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path string
+		prop string
+		want []byte
+	}{
+		{"/fragment@0", "target", cells(0xffffffff)},
+		{"/fragment@0/__overlay__/fan_pins", "brcm,pins", cells(12)},
+		{"/fragment@0/__overlay__/fan_pins", "phandle", cells(1)},
+		{"/fragment@1", "target-path", []byte("/\x00")},
+		{"/fragment@1/__overlay__/gpio-fan@0", "pinctrl-0", cells(1)},
+		{"/fragment@1/__overlay__/gpio-fan@0", "gpios", cells(0xffffffff, 12, 0)},
+		{"/fragment@1/__overlay__/gpio-fan@0", "gpio-fan,speed-map", cells(0, 0, 5000, 1)},
+		{"/__overrides__", "gpiopin", append(cells(2), "gpios:4\x00"...)},
+		{"/__symbols__", "fan", []byte("/fragment@1/__overlay__/gpio-fan@0\x00")},
+		{"/__symbols__", "fan_pins", []byte("/fragment@0/__overlay__/fan_pins\x00")},
+		{"/__fixups__", "gpio", []byte("/fragment@1/__overlay__/gpio-fan@0:gpios:0\x00/fragment@0:target:0\x00")},
+		{"/__local_fixups__/fragment@1/__overlay__/gpio-fan@0", "pinctrl-0", cells(0)},
+		{"/__local_fixups__/__overrides__", "gpiopin", cells(0)},
+	} {
+		n, err := tree.Lookup(tt.path)
+		if err != nil {
+			t.Errorf("Lookup(%s): %v", tt.path, err)
+			continue
+		}
+		p, ok := n.Property(tt.prop)
+		if !ok {
+			t.Errorf("%s: no property %s", tt.path, tt.prop)
+			continue
+		}
+		if !bytes.Equal(p.Value, tt.want) {
+			t.Errorf("%s: %s = %q, want %q", tt.path, tt.prop, p.Value, tt.want)
+		}
+	}
+
+	parsed, err := Parse(tree.Marshal())
+	if err != nil {
+		t.Fatalf("Parse(Marshal()): %v", err)
+	}
+	if !reflect.DeepEqual(parsed, tree) {
+		t.Errorf("Parse(Marshal()) does not round-trip")
+	}
+}
+
+func TestCompileBase(t *testing.T) {
+	tree, err := Compile("base.dts", []byte(`/dts-v1/;
+
+/ {
+	aliases {
+		serial0 = &uart0;
+	};
+	soc {
+		uart0: serial@7e201000 {
+			reg = <0x7e201000 0x200>;
+		};
+		consumer {
+			uart = <&uart0>;
+			empty;
+		};
+	};
+};
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tree.Lookup("serial0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Property("reg"); !bytes.Equal(p.Value, cells(0x7e201000, 0x200)) {
+		t.Errorf("serial0: reg = %x", p.Value)
+	}
+	consumer, err := tree.Lookup("/soc/consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phandle, _ := n.Property("phandle")
+	if p, _ := consumer.Property("uart"); !bytes.Equal(p.Value, phandle.Value) {
+		t.Errorf("uart = %x, want the phandle %x of serial0", p.Value, phandle.Value)
+	}
+	if p, ok := consumer.Property("empty"); !ok || len(p.Value) != 0 {
+		t.Errorf("empty = %q, %v, want an empty property", p.Value, ok)
+	}
+	if tree.Root.Child("__symbols__") != nil || tree.Root.Child("__fixups__") != nil {
+		t.Errorf("base tree unexpectedly has overlay metadata")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{
+			name:    "undefined label",
+			src:     "/dts-v1/;\n/ { node { prop = <&missing>; }; };\n",
+			wantErr: "reference to undefined node missing",
+		},
+		{
+			name:    "unterminated node",
+			src:     "/dts-v1/;\n/ { node {\n",
+			wantErr: "bad.dts",
+		},
+		{
+			name:    "unterminated string",
+			src:     "/dts-v1/;\n/ { prop = \"value; };\n",
+			wantErr: "bad.dts",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile("bad.dts", []byte(tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Compile: err = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
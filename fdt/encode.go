@@ -0,0 +1,83 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Marshal returns the tree in the flattened device tree format, version 17,
+// with an empty memory reservation block.
+func (t *Tree) Marshal() []byte {
+	e := &encoder{offsets: make(map[string]int)}
+	e.node(t.Root)
+	e.word(tokenEnd)
+
+	const memRsvmapSize = 16 // only the terminating entry
+	offStruct := headerSize + memRsvmapSize
+	offStrings := offStruct + e.structs.Len()
+	h := header{
+		Magic:           Magic,
+		TotalSize:       uint32(offStrings + e.strings.Len()),
+		OffDtStruct:     uint32(offStruct),
+		OffDtStrings:    uint32(offStrings),
+		OffMemRsvmap:    headerSize,
+		Version:         17,
+		LastCompVersion: 16,
+		SizeDtStrings:   uint32(e.strings.Len()),
+		SizeDtStruct:    uint32(e.structs.Len()),
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	buf.Write(make([]byte, memRsvmapSize))
+	buf.Write(e.structs.Bytes())
+	buf.Write(e.strings.Bytes())
+	return buf.Bytes()
+}
+
+type encoder struct {
+	structs bytes.Buffer
+	strings bytes.Buffer
+	offsets map[string]int // of property names in strings
+}
+
+func (e *encoder) word(w uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], w)
+	e.structs.Write(b[:])
+}
+
+// pad pads the structure block to a multiple of 4 bytes.
+func (e *encoder) pad() {
+	for e.structs.Len()%4 != 0 {
+		e.structs.WriteByte(0)
+	}
+}
+
+func (e *encoder) stringOffset(name string) int {
+	off, ok := e.offsets[name]
+	if !ok {
+		off = e.strings.Len()
+		e.strings.WriteString(name)
+		e.strings.WriteByte(0)
+		e.offsets[name] = off
+	}
+	return off
+}
+
+func (e *encoder) node(n *Node) {
+	e.word(tokenBeginNode)
+	e.structs.WriteString(n.Name)
+	e.structs.WriteByte(0)
+	e.pad()
+	for _, p := range n.Properties {
+		e.word(tokenProp)
+		e.word(uint32(len(p.Value)))
+		e.word(uint32(e.stringOffset(p.Name)))
+		e.structs.Write(p.Value)
+		e.pad()
+	}
+	for _, c := range n.Children {
+		e.node(c)
+	}
+	e.word(tokenEndNode)
+}
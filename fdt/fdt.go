@@ -0,0 +1,218 @@
+// Package fdt reads flattened device trees (FDT), the binary format of the
+// device tree blobs (.dtb) and overlays (.dtbo) the kernel build produces,
+// see https://devicetree-specification.readthedocs.io/en/stable/flattened-format.html.
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// Magic is the first word of a flattened device tree.
+const Magic = 0xd00dfeed
+
+const headerSize = 40
+
+// Tokens of the structure block.
+const (
+	tokenBeginNode = 1
+	tokenEndNode   = 2
+	tokenProp      = 3
+	tokenNop       = 4
+	tokenEnd       = 9
+)
+
+// Property is a property of a node.
+type Property struct {
+	Name  string
+	Value []byte
+}
+
+// Node is a node of the device tree. The root node has the empty name.
+type Node struct {
+	Name       string // including the unit address, e.g. uart@7e201000
+	Properties []Property
+	Children   []*Node
+}
+
+// Tree is a parsed device tree.
+type Tree struct {
+	Version int
+	Root    *Node
+}
+
+// header is the header of a flattened device tree, version 17.
+type header struct {
+	Magic           uint32
+	TotalSize       uint32
+	OffDtStruct     uint32
+	OffDtStrings    uint32
+	OffMemRsvmap    uint32
+	Version         uint32
+	LastCompVersion uint32
+	BootCPUIDPhys   uint32
+	SizeDtStrings   uint32
+	SizeDtStruct    uint32
+}
+
+// Parse parses the flattened device tree b, verifying its header and the
+// structure block.
+func Parse(b []byte) (*Tree, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("truncated header: %d bytes", len(b))
+	}
+	var h header
+	if err := binary.Read(bytes.NewReader(b[:headerSize]), binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if h.Magic != Magic {
+		return nil, fmt.Errorf("bad magic %#x, expected %#x", h.Magic, Magic)
+	}
+	if int64(h.TotalSize) > int64(len(b)) {
+		return nil, fmt.Errorf("truncated: header says %d bytes, got %d", h.TotalSize, len(b))
+	}
+	if h.LastCompVersion > 17 {
+		return nil, fmt.Errorf("unsupported version %d (compatible with %d)", h.Version, h.LastCompVersion)
+	}
+	b = b[:h.TotalSize]
+	if uint64(h.OffDtStruct)+uint64(h.SizeDtStruct) > uint64(len(b)) ||
+		uint64(h.OffDtStrings)+uint64(h.SizeDtStrings) > uint64(len(b)) {
+		return nil, fmt.Errorf("structure or strings block out of bounds")
+	}
+	p := &parser{
+		structs: b[h.OffDtStruct : h.OffDtStruct+h.SizeDtStruct],
+		strings: b[h.OffDtStrings : h.OffDtStrings+h.SizeDtStrings],
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{Version: int(h.Version), Root: root}, nil
+}
+
+// ReadFile parses the flattened device tree in the file path.
+func ReadFile(path string) (*Tree, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+type parser struct {
+	structs []byte
+	strings []byte
+	off     int
+}
+
+func (p *parser) word() (uint32, error) {
+	if p.off+4 > len(p.structs) {
+		return 0, fmt.Errorf("structure block truncated at offset %d", p.off)
+	}
+	w := binary.BigEndian.Uint32(p.structs[p.off:])
+	p.off += 4
+	return w, nil
+}
+
+// cstring returns the NUL-terminated string at off in b.
+func cstring(b []byte, off int) (string, error) {
+	if off < 0 || off >= len(b) {
+		return "", fmt.Errorf("string offset %d out of bounds", off)
+	}
+	end := bytes.IndexByte(b[off:], 0)
+	if end == -1 {
+		return "", fmt.Errorf("unterminated string at offset %d", off)
+	}
+	return string(b[off : off+end]), nil
+}
+
+// align advances the offset to the next multiple of 4.
+func (p *parser) align() {
+	p.off = (p.off + 3) &^ 3
+}
+
+func (p *parser) parse() (*Node, error) {
+	var (
+		root  *Node
+		stack []*Node
+	)
+	for {
+		token, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case tokenBeginNode:
+			name, err := cstring(p.structs, p.off)
+			if err != nil {
+				return nil, err
+			}
+			p.off += len(name) + 1
+			p.align()
+			n := &Node{Name: name}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("more than one root node")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, n)
+			}
+			stack = append(stack, n)
+
+		case tokenEndNode:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unbalanced end of node at offset %d", p.off-4)
+			}
+			stack = stack[:len(stack)-1]
+
+		case tokenProp:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("property outside of a node at offset %d", p.off-4)
+			}
+			length, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			nameoff, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			if p.off+int(length) > len(p.structs) {
+				return nil, fmt.Errorf("property value truncated at offset %d", p.off)
+			}
+			name, err := cstring(p.strings, int(nameoff))
+			if err != nil {
+				return nil, err
+			}
+			n := stack[len(stack)-1]
+			n.Properties = append(n.Properties, Property{
+				Name:  name,
+				Value: p.structs[p.off : p.off+int(length)],
+			})
+			p.off += int(length)
+			p.align()
+
+		case tokenNop:
+
+		case tokenEnd:
+			if len(stack) != 0 {
+				return nil, fmt.Errorf("end of structure block within node %q", stack[len(stack)-1].Name)
+			}
+			if root == nil {
+				return nil, fmt.Errorf("no root node")
+			}
+			return root, nil
+
+		default:
+			return nil, fmt.Errorf("unknown token %#x at offset %d", token, p.off-4)
+		}
+	}
+}
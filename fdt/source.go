@@ -0,0 +1,249 @@
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Property returns the property name of n.
+func (n *Node) Property(name string) (Property, bool) {
+	for _, p := range n.Properties {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Child returns the child name of n. If name has no unit address, it also
+// matches a child with unit address, like a path component for dtc does.
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	if !strings.Contains(name, "@") {
+		for _, c := range n.Children {
+			if strings.HasPrefix(c.Name, name+"@") {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// Alias returns the path which the alias name in /aliases refers to.
+func (t *Tree) Alias(name string) (string, bool) {
+	aliases := t.Root.Child("aliases")
+	if aliases == nil {
+		return "", false
+	}
+	p, ok := aliases.Property(name)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimRight(string(p.Value), "\x00"), true
+}
+
+// Lookup returns the node at path, e.g. /soc/spi@7e204000. If path does not
+// start with a slash, its first component is an alias, e.g. serial0 or
+// spi0/spidev@0.
+func (t *Tree) Lookup(path string) (*Node, error) {
+	if !strings.HasPrefix(path, "/") {
+		alias := path
+		rest := ""
+		if idx := strings.IndexByte(path, '/'); idx > -1 {
+			alias, rest = path[:idx], path[idx:]
+		}
+		target, ok := t.Alias(alias)
+		if !ok {
+			return nil, fmt.Errorf("no alias %q", alias)
+		}
+		path = target + rest
+	}
+	n := t.Root
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n = n.Child(name); n == nil {
+			return nil, fmt.Errorf("%s: no node %q", path, name)
+		}
+	}
+	return n, nil
+}
+
+// isStrings returns whether b is a list of printable NUL-terminated
+// strings, which dtc decompiles as "a", "b".
+func isStrings(b []byte) bool {
+	if len(b) == 0 || b[len(b)-1] != 0 || b[0] == 0 {
+		return false
+	}
+	for idx, c := range b {
+		if c == 0 {
+			if idx > 0 && b[idx-1] == 0 {
+				return false // empty string
+			}
+			continue
+		}
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatValue formats the property value b in device tree source syntax,
+// guessing its type like dtc -I dtb -O dts: a list of strings, of 32-bit
+// cells or of bytes.
+func FormatValue(b []byte) string {
+	switch {
+	case isStrings(b):
+		strs := strings.Split(string(b[:len(b)-1]), "\x00")
+		for idx, s := range strs {
+			strs[idx] = strconv.Quote(s)
+		}
+		return strings.Join(strs, ", ")
+
+	case len(b)%4 == 0:
+		cells := make([]string, len(b)/4)
+		for idx := range cells {
+			cells[idx] = fmt.Sprintf("%#x", binary.BigEndian.Uint32(b[4*idx:]))
+		}
+		return "<" + strings.Join(cells, " ") + ">"
+
+	default:
+		bytes := make([]string, len(b))
+		for idx, c := range b {
+			bytes[idx] = fmt.Sprintf("%02x", c)
+		}
+		return "[" + strings.Join(bytes, " ") + "]"
+	}
+}
+
+// ParseValue parses a property value in device tree source syntax into its
+// binary form: a comma-separated list of strings ("okay"), cell lists
+// (<0x1 2>) and byte strings ([01 02]). References (&label) are not
+// supported.
+func ParseValue(s string) ([]byte, error) {
+	var buf bytes.Buffer
+	s = strings.TrimSpace(s)
+	for s != "" {
+		switch s[0] {
+		case '"':
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string %s", s)
+			}
+			str, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", s[:end+1], err)
+			}
+			buf.WriteString(str)
+			buf.WriteByte(0)
+			s = s[end+1:]
+
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated cell list %s", s)
+			}
+			for _, f := range strings.Fields(s[1:end]) {
+				if strings.HasPrefix(f, "&") {
+					return nil, fmt.Errorf("references are not supported: %s", f)
+				}
+				v, err := strconv.ParseUint(f, 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("cell %s: %v", f, err)
+				}
+				var cell [4]byte
+				binary.BigEndian.PutUint32(cell[:], uint32(v))
+				buf.Write(cell[:])
+			}
+			s = s[end+1:]
+
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated byte string %s", s)
+			}
+			hex := strings.Join(strings.Fields(s[1:end]), "")
+			if len(hex)%2 != 0 {
+				return nil, fmt.Errorf("odd number of hex digits in %s", s[:end+1])
+			}
+			for idx := 0; idx < len(hex); idx += 2 {
+				v, err := strconv.ParseUint(hex[idx:idx+2], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("byte %s: %v", hex[idx:idx+2], err)
+				}
+				buf.WriteByte(byte(v))
+			}
+			s = s[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected %q, expected a string, <cells> or [bytes]", s)
+		}
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+			if s == "" {
+				return nil, fmt.Errorf("trailing comma")
+			}
+		} else if s != "" {
+			return nil, fmt.Errorf("unexpected %q, expected a comma", s)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteSource writes the tree in device tree source syntax (like
+// dtc -I dtb -O dts, but without labels) to w.
+func (t *Tree) WriteSource(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("/dts-v1/;\n\n")
+	writeNode(&buf, t.Root, 0)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteSource writes the node n and its children in device tree source
+// syntax to w.
+func (n *Node) WriteSource(w io.Writer) error {
+	var buf bytes.Buffer
+	writeNode(&buf, n, 0)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeNode(buf *bytes.Buffer, n *Node, depth int) {
+	indent := strings.Repeat("\t", depth)
+	name := n.Name
+	if name == "" {
+		name = "/"
+	}
+	fmt.Fprintf(buf, "%s%s {\n", indent, name)
+	for _, p := range n.Properties {
+		if len(p.Value) == 0 {
+			fmt.Fprintf(buf, "%s\t%s;\n", indent, p.Name)
+			continue
+		}
+		fmt.Fprintf(buf, "%s\t%s = %s;\n", indent, p.Name, FormatValue(p.Value))
+	}
+	for idx, c := range n.Children {
+		if idx > 0 || len(n.Properties) > 0 {
+			buf.WriteString("\n")
+		}
+		writeNode(buf, c, depth+1)
+	}
+	fmt.Fprintf(buf, "%s};\n", indent)
+}
@@ -0,0 +1,140 @@
+// Package hardening describes kernel hardening features which need support
+// from the compiler in addition to config options: a recent GCC, or the GCC
+// plugin headers in the build container. Kconfig silently drops the options
+// when the compiler lacks support, so the build checks the toolchain before
+// configuring the kernel.
+package hardening
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Feature is a hardening feature which -hardening enables.
+type Feature struct {
+	// Name identifies the feature, e.g. “structleak”.
+	Name string
+
+	// Description is a human-readable summary.
+	Description string
+
+	// Config is appended to the gokrazy default config.
+	Config string
+
+	// Require lists config symbols which must be enabled in the final
+	// config. The build fails otherwise.
+	Require []string
+
+	// Plugin is whether the feature is implemented by a GCC plugin, which
+	// the kernel build compiles against the plugin headers of the
+	// cross-compiler.
+	Plugin bool
+
+	// CompilerFlag is a flag the compiler must support, if non-empty.
+	CompilerFlag string
+
+	// Notes are included in the config report.
+	Notes []string
+}
+
+var all = []Feature{
+	{
+		Name:         "stack_zero",
+		Description:  "zero-initialize all stack variables (-ftrivial-auto-var-init=zero)",
+		Config:       "CONFIG_INIT_STACK_ALL_ZERO=y\n",
+		Require:      []string{"INIT_STACK_ALL_ZERO"},
+		CompilerFlag: "-ftrivial-auto-var-init=zero",
+		Notes: []string{
+			"stack_zero needs GCC 12 or newer, e.g. -base_image=debian:bookworm",
+		},
+	},
+
+	{
+		Name:        "structleak",
+		Description: "zero-initialize stack variables passed by reference (GCC plugin), for compilers without stack_zero",
+		Config: `CONFIG_GCC_PLUGINS=y
+CONFIG_GCC_PLUGIN_STRUCTLEAK_BYREF_ALL=y
+`,
+		Require: []string{"GCC_PLUGINS", "GCC_PLUGIN_STRUCTLEAK_BYREF_ALL"},
+		Plugin:  true,
+	},
+
+	{
+		Name:        "randstruct",
+		Description: "randomize the layout of sensitive kernel structures (GCC plugin)",
+		Config: `CONFIG_GCC_PLUGINS=y
+CONFIG_RANDSTRUCT_FULL=y
+`,
+		Require: []string{"GCC_PLUGINS", "RANDSTRUCT_FULL"},
+		Plugin:  true,
+		Notes: []string{
+			"randstruct draws a random seed (scripts/basic/randstruct.seed) for each build, so builds are not reproducible, and out-of-tree modules must be built against the same tree (see -export_src)",
+		},
+	},
+}
+
+// conflicts are pairs of features which select different values of the same
+// Kconfig choice.
+var conflicts = [][2]string{
+	{"stack_zero", "structleak"},
+}
+
+// Names returns the names of all known features in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(all))
+	for _, f := range all {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the feature with the specified name.
+func Lookup(name string) (Feature, error) {
+	for _, f := range all {
+		if f.Name == strings.TrimSpace(name) {
+			return f, nil
+		}
+	}
+	return Feature{}, fmt.Errorf("unknown hardening feature %q, known features: %v", name, Names())
+}
+
+// Resolve looks up the comma-separated list of feature names. Duplicates are
+// removed, and conflicting features are rejected.
+func Resolve(list string) ([]Feature, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var (
+		result []Feature
+		seen   = make(map[string]bool)
+	)
+	for _, name := range strings.Split(list, ",") {
+		f, err := Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[f.Name] {
+			continue
+		}
+		seen[f.Name] = true
+		result = append(result, f)
+	}
+	for _, c := range conflicts {
+		if seen[c[0]] && seen[c[1]] {
+			return nil, fmt.Errorf("hardening features %s and %s are mutually exclusive (both initialize stack variables), pick one", c[0], c[1])
+		}
+	}
+	return result, nil
+}
+
+// NeedPlugins reports whether any of features is a GCC plugin.
+func NeedPlugins(features []Feature) bool {
+	for _, f := range features {
+		if f.Plugin {
+			return true
+		}
+	}
+	return false
+}
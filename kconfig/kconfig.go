@@ -0,0 +1,244 @@
+// Package kconfig reads Linux kernel configuration files (.config) and the
+// configuration embedded into kernel images built with CONFIG_IKCONFIG.
+package kconfig
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Config maps a config symbol (including its CONFIG_ prefix) to its value as
+// written in the .config file, e.g. "y", "m" or "\"gokrazy\"". Symbols which
+// are explicitly disabled (“# CONFIG_FOO is not set”) have the value "n".
+type Config map[string]string
+
+// Parse reads a .config file from r.
+func Parse(r io.Reader) (Config, error) {
+	cfg := make(Config)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set") {
+			sym := strings.TrimSuffix(strings.TrimPrefix(line, "# "), " is not set")
+			cfg[sym] = "n"
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 || !strings.HasPrefix(line, "CONFIG_") {
+			continue
+		}
+		cfg[line[:idx]] = line[idx+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ParseFile reads the .config file at path.
+func ParseFile(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+var (
+	ikconfigStart = []byte("IKCFG_ST")
+	ikconfigEnd   = []byte("IKCFG_ED")
+)
+
+// FromImage extracts the configuration which CONFIG_IKCONFIG embeds into the
+// kernel image (arch/arm64/boot/Image or Image.gz, which gokrazy ships as
+// vmlinuz) at path.
+func FromImage(path string) (Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err = gunzip(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !bytes.Contains(b, ikconfigStart) {
+		return nil, fmt.Errorf("%s: no embedded config found (is CONFIG_IKCONFIG enabled?)", path)
+	}
+	cfg, err := fromImage(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// fromImage extracts the configuration embedded into the uncompressed
+// kernel image b.
+func fromImage(b []byte) (Config, error) {
+	start := bytes.Index(b, ikconfigStart) + len(ikconfigStart)
+	end := bytes.Index(b[start:], ikconfigEnd)
+	if end == -1 {
+		return nil, fmt.Errorf("embedded config is truncated")
+	}
+	rd, err := gzip.NewReader(bytes.NewReader(b[start : start+end]))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return Parse(rd)
+}
+
+// gunzip decompresses b if it is gzip-compressed.
+func gunzip(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		return b, nil
+	}
+	rd, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// ParseBytes reads the configuration in b, which is either a .config file,
+// optionally gzip-compressed (as /proc/config.gz), or a kernel image with an
+// embedded config (see FromImage).
+func ParseBytes(b []byte) (Config, error) {
+	b, err := gunzip(b)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(b, ikconfigStart) {
+		return fromImage(b)
+	}
+	return Parse(bytes.NewReader(b))
+}
+
+// ProcConfig is where CONFIG_IKCONFIG_PROC exposes the configuration of the
+// running kernel.
+const ProcConfig = "/proc/config.gz"
+
+// FromProc returns the configuration of the running kernel.
+func FromProc() (Config, error) {
+	b, err := ioutil.ReadFile(ProcConfig)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s does not exist (is CONFIG_IKCONFIG_PROC enabled?)", ProcConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseBytes(b)
+}
+
+// Enabled returns whether sym is built in or built as a module.
+func (c Config) Enabled(sym string) bool {
+	v := c[sym]
+	return v != "" && v != "n"
+}
+
+// Symbol returns name with the CONFIG_ prefix, which Get and Grep allow to
+// omit, e.g. CONFIG_I2C for i2c.
+func Symbol(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CONFIG_") {
+		name = "CONFIG_" + name
+	}
+	return name
+}
+
+// Get returns the value of the symbol name (see Symbol), or "n" if the
+// symbol is not set, and whether the config contains the symbol.
+func (c Config) Get(name string) (string, bool) {
+	v, ok := c[Symbol(name)]
+	if !ok {
+		return "n", false
+	}
+	return v, true
+}
+
+// Grep returns the symbols whose names (without the CONFIG_ prefix) match
+// the regular expression pattern, case-insensitively, in sorted order.
+func (c Config) Grep(pattern string) ([]string, error) {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	var syms []string
+	for _, sym := range c.Symbols() {
+		if re.MatchString(strings.TrimPrefix(sym, "CONFIG_")) {
+			syms = append(syms, sym)
+		}
+	}
+	return syms, nil
+}
+
+// Line formats sym as a line of a .config file.
+func (c Config) Line(sym string) string {
+	if v := c[sym]; v != "" && v != "n" {
+		return sym + "=" + v
+	}
+	return "# " + sym + " is not set"
+}
+
+// FromDir returns the configuration of the kernel artifacts in dir (e.g.
+// this repository or an unpacked upload), embedded into its vmlinuz.
+func FromDir(dir string) (Config, error) {
+	return FromImage(filepath.Join(dir, "vmlinuz"))
+}
+
+// Symbols returns all symbols of c in sorted order.
+func (c Config) Symbols() []string {
+	syms := make([]string, 0, len(c))
+	for sym := range c {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	return syms
+}
+
+// Change describes how the value of a config symbol differs between two
+// configurations. An empty Old or New value means the symbol is absent.
+type Change struct {
+	Symbol string
+	Old    string
+	New    string
+}
+
+// Diff returns the symbols whose values differ between old and new, sorted
+// by symbol name. Absent symbols and symbols which are not set are treated as
+// equal.
+func Diff(old, new Config) []Change {
+	syms := make(map[string]bool)
+	for sym := range old {
+		syms[sym] = true
+	}
+	for sym := range new {
+		syms[sym] = true
+	}
+	var changes []Change
+	for sym := range syms {
+		oldVal, newVal := old[sym], new[sym]
+		if old.Enabled(sym) == new.Enabled(sym) && (oldVal == newVal || !old.Enabled(sym)) {
+			continue
+		}
+		changes = append(changes, Change{Symbol: sym, Old: oldVal, New: newVal})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Symbol < changes[j].Symbol
+	})
+	return changes
+}
@@ -0,0 +1,150 @@
+package kconfig
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const dotConfig = `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_LOCALVERSION="-gokrazy"
+CONFIG_I2C=y
+CONFIG_I2C_BCM2835=m
+# CONFIG_DEBUG_INFO is not set
+CONFIG_HZ=250
+
+# comment
+not a config line
+`
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(dotConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		"CONFIG_LOCALVERSION": `"-gokrazy"`,
+		"CONFIG_I2C":          "y",
+		"CONFIG_I2C_BCM2835":  "m",
+		"CONFIG_DEBUG_INFO":   "n",
+		"CONFIG_HZ":           "250",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Parse = %v, want %v", cfg, want)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	image := append([]byte("\x00kernel image\x00IKCFG_ST"), gzipBytes(t, []byte(dotConfig))...)
+	image = append(image, []byte("IKCFG_ED\x00more")...)
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"plain", []byte(dotConfig)},
+		{"gzip", gzipBytes(t, []byte(dotConfig))},
+		{"image", image},
+		{"compressed image", gzipBytes(t, image)},
+	} {
+		cfg, err := ParseBytes(tt.b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := cfg["CONFIG_I2C_BCM2835"]; got != "m" {
+			t.Errorf("%s: CONFIG_I2C_BCM2835 = %q, want m", tt.name, got)
+		}
+	}
+
+	truncated := append([]byte("IKCFG_ST"), gzipBytes(t, []byte(dotConfig))...)
+	if _, err := ParseBytes(truncated); err == nil {
+		t.Errorf("ParseBytes(truncated image) succeeded unexpectedly")
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(dotConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		sym  string
+		want bool
+	}{
+		{"CONFIG_I2C", true},
+		{"CONFIG_I2C_BCM2835", true},
+		{"CONFIG_DEBUG_INFO", false},
+		{"CONFIG_MISSING", false},
+	} {
+		if got := cfg.Enabled(tt.sym); got != tt.want {
+			t.Errorf("Enabled(%s) = %v, want %v", tt.sym, got, tt.want)
+		}
+	}
+
+	if got, want := Symbol("i2c_bcm2835"), "CONFIG_I2C_BCM2835"; got != want {
+		t.Errorf("Symbol = %q, want %q", got, want)
+	}
+	if v, ok := cfg.Get("hz"); v != "250" || !ok {
+		t.Errorf("Get(hz) = %q, %v, want 250, true", v, ok)
+	}
+	if v, ok := cfg.Get("missing"); v != "n" || ok {
+		t.Errorf("Get(missing) = %q, %v, want n, false", v, ok)
+	}
+
+	syms, err := cfg.Grep("^i2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"CONFIG_I2C", "CONFIG_I2C_BCM2835"}; !reflect.DeepEqual(syms, want) {
+		t.Errorf("Grep = %q, want %q", syms, want)
+	}
+
+	if got, want := cfg.Line("CONFIG_HZ"), "CONFIG_HZ=250"; got != want {
+		t.Errorf("Line = %q, want %q", got, want)
+	}
+	if got, want := cfg.Line("CONFIG_DEBUG_INFO"), "# CONFIG_DEBUG_INFO is not set"; got != want {
+		t.Errorf("Line = %q, want %q", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := Config{
+		"CONFIG_A": "y",
+		"CONFIG_B": "m",
+		"CONFIG_C": "n",
+		"CONFIG_D": "250",
+		"CONFIG_E": "y",
+	}
+	new := Config{
+		"CONFIG_A": "y",    // unchanged
+		"CONFIG_B": "y",    // m → y
+		"CONFIG_D": "1000", // value changed
+		"CONFIG_F": "n",    // absent and not set are equal
+		"CONFIG_G": "m",    // added
+	}
+	want := []Change{
+		{Symbol: "CONFIG_B", Old: "m", New: "y"},
+		{Symbol: "CONFIG_D", Old: "250", New: "1000"},
+		{Symbol: "CONFIG_E", Old: "y", New: ""},
+		{Symbol: "CONFIG_G", Old: "", New: "m"},
+	}
+	if got := Diff(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %+v, want %+v", got, want)
+	}
+}
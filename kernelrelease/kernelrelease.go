@@ -0,0 +1,222 @@
+// Package kernelrelease defines kernel-release, a small text file which
+// gokr-rebuild-kernel writes next to vmlinuz to identify the kernel build,
+// for baking into the gokrazy root file system as /etc/kernel-release, e.g.
+// via ExtraFilePaths in the instance’s config.json:
+//
+//	"ExtraFilePaths": {
+//	    "/etc/kernel-release": "/path/to/kernel/kernel-release"
+//	}
+//
+// Unlike /proc/version, whose build date is fixed for reproducible builds,
+// it records when and from which commit the kernel was built. Programs on
+// the device (e.g. a status page) read it with Installed, and can compare it
+// with the running kernel (Running) and with the newest build served by
+// gokr-rebuild-kernel serve (Fetch).
+//
+// The format follows os-release(5): one KEY=value per line, with values
+// containing spaces in double quotes.
+package kernelrelease
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+)
+
+// FileName is the name of the file next to vmlinuz.
+const FileName = "kernel-release"
+
+// InstalledPath is where the file is expected in the gokrazy root file
+// system.
+const InstalledPath = "/etc/kernel-release"
+
+// Release identifies a kernel build.
+type Release struct {
+	// KernelRelease is the kernel release (uname -r), e.g.
+	// 6.5.7-gokrazy-1a2b3c4.
+	KernelRelease string
+
+	// KernelVersion is the upstream kernel version, e.g. 6.5.7.
+	KernelVersion string
+
+	// BuildTime is when the build finished.
+	BuildTime time.Time
+
+	// Commit is git describe --always --dirty of the kernel repository at
+	// build time, i.e. the commit the artifacts were built from (not the
+	// one they are committed in), or empty if it is not a git checkout.
+	Commit string
+}
+
+// FromBuildInfo returns the Release described by bi.
+func FromBuildInfo(bi *buildinfo.BuildInfo) *Release {
+	return &Release{
+		KernelRelease: bi.KernelRelease,
+		KernelVersion: bi.KernelVersion,
+		BuildTime:     bi.BuildTime.UTC(),
+		Commit:        bi.GitDescribe,
+	}
+}
+
+// Banner returns a line describing r in the style of uname -a, e.g. for a
+// status page: “Linux 6.5.7-gokrazy-1a2b3c4 (gokrazy kernel 1a2b3c4, built
+// 2023-10-12 08:15 UTC)”.
+func (r *Release) Banner() string {
+	var details []string
+	if r.Commit != "" {
+		details = append(details, "gokrazy kernel "+r.Commit)
+	}
+	if !r.BuildTime.IsZero() {
+		details = append(details, "built "+r.BuildTime.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	banner := "Linux " + r.KernelRelease
+	if len(details) > 0 {
+		banner += " (" + strings.Join(details, ", ") + ")"
+	}
+	return banner
+}
+
+// Same returns whether r and other identify the same build. Builds with
+// -localversion=none share the kernel release across commits, so the
+// commit and build time are compared, too.
+func (r *Release) Same(other *Release) bool {
+	return r.KernelRelease == other.KernelRelease &&
+		r.Commit == other.Commit &&
+		r.BuildTime.Equal(other.BuildTime)
+}
+
+// Marshal returns r in the kernel-release format.
+func (r *Release) Marshal() []byte {
+	var (
+		buf       bytes.Buffer
+		buildTime string
+	)
+	if !r.BuildTime.IsZero() {
+		buildTime = r.BuildTime.UTC().Format(time.RFC3339)
+	}
+	for _, kv := range [][2]string{
+		{"KERNEL_RELEASE", r.KernelRelease},
+		{"KERNEL_VERSION", r.KernelVersion},
+		{"BUILD_TIME", buildTime},
+		{"COMMIT", r.Commit},
+		{"BANNER", r.Banner()},
+	} {
+		value := kv[1]
+		if strings.ContainsAny(value, " \"\\$`'") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", kv[0], value)
+	}
+	return buf.Bytes()
+}
+
+// Write writes r as a kernel-release file to path.
+func (r *Release) Write(path string) error {
+	return ioutil.WriteFile(path, r.Marshal(), 0644)
+}
+
+// Parse reads a kernel-release file from rd. Unknown keys are ignored, so
+// that fields can be added.
+func Parse(rd io.Reader) (*Release, error) {
+	var r Release
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, '=')
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		key, value := line[:idx], line[idx+1:]
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			value = unquoted
+		}
+		switch key {
+		case "KERNEL_RELEASE":
+			r.KernelRelease = value
+		case "KERNEL_VERSION":
+			r.KernelVersion = value
+		case "BUILD_TIME":
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			r.BuildTime = t
+		case "COMMIT":
+			r.Commit = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if r.KernelRelease == "" {
+		return nil, fmt.Errorf("no KERNEL_RELEASE")
+	}
+	return &r, nil
+}
+
+// ReadFile reads the kernel-release file at path.
+func ReadFile(path string) (*Release, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// Installed returns the release baked into the root file system, i.e. of
+// the kernel the image was built with.
+func Installed() (*Release, error) {
+	return ReadFile(InstalledPath)
+}
+
+// Running returns the kernel release (uname -r) of the running kernel.
+// It differs from that of Installed when the device has not been rebooted
+// since an update, or runs a kernel booted via gokr-kexec.
+func Running() (string, error) {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Fetch returns the release served at url, e.g.
+// http://<build host>:8097/kernel-release of gokr-rebuild-kernel serve,
+// i.e. the newest build available.
+func Fetch(url string) (*Release, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected HTTP status %s", url, resp.Status)
+	}
+	r, err := Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	return r, nil
+}
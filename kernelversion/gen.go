@@ -0,0 +1,30 @@
+//go:build ignore
+// +build ignore
+
+// gen generates lock.go from kernel.lock.
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+func main() {
+	b, err := ioutil.ReadFile("../kernel.lock")
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := kernelversion.ParseLock(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := l.Source()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("lock.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,305 @@
+// Package kernelversion provides the version of the Linux kernel which this
+// repository ships, i.e. the kernel source and patches which
+// gokr-rebuild-kernel builds, so that tools can report and compare kernel
+// versions without parsing files.
+//
+// The version is pinned in kernel.lock at the root of the repository, from
+// which lock.go is generated (by gokr-rebuild-kernel bump or go generate).
+package kernelversion
+
+//go:generate go run gen.go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// KernelOrg is the prefix of the kernel source URLs on kernel.org, which a
+// mirror replaces.
+const KernelOrg = "https://cdn.kernel.org/pub/linux/kernel"
+
+// Lock is the content of kernel.lock.
+type Lock struct {
+	// Version is the kernel version, e.g. 6.5.7.
+	Version string
+
+	// URL is the kernel.org URL of the kernel source tarball.
+	URL string
+
+	// SHA256 is the hex-encoded SHA-256 hash of the kernel source tarball,
+	// or empty if unknown.
+	SHA256 string
+
+	// Patches are applied to the kernel source.
+	Patches []Patch
+
+	// Firmware pins the Raspberry Pi firmware to bundle with the kernel
+	// (see gokr-rebuild-kernel build -firmware), or is nil.
+	Firmware *Firmware `json:",omitempty"`
+
+	// Git is the git repository to fetch the kernel source from instead of
+	// the tarball at URL, or nil.
+	Git *Git `json:",omitempty"`
+}
+
+// Git is a ref of a git repository with the kernel source, e.g. a release
+// candidate tag of torvalds/linux or a vendor tree. Only the ref is fetched
+// (a shallow clone), and the kernel source is exported from it with git
+// archive.
+type Git struct {
+	// Repo is the URL of the repository.
+	Repo string
+
+	// Ref is the tag or branch to fetch, e.g. v6.6-rc5.
+	Ref string
+
+	// Commit is the hex-encoded hash of the commit which Ref must resolve
+	// to, so that a moved tag (or an advanced branch) fails the build
+	// instead of silently building different sources. Empty builds
+	// whatever Ref resolves to.
+	Commit string `json:",omitempty"`
+}
+
+// FirmwareRepo is the prefix of the URLs of the Raspberry Pi firmware files,
+// followed by the release and the file name.
+const FirmwareRepo = "https://raw.githubusercontent.com/raspberrypi/firmware"
+
+// FirmwareFiles are the firmware files bundled by default: the bootloader of
+// the Pi 3 and the GPU firmware of the Pi 3 and 4.
+var FirmwareFiles = []string{
+	"bootcode.bin",
+	"start.elf",
+	"fixup.dat",
+	"start4.elf",
+	"fixup4.dat",
+}
+
+// Firmware is a release of the Raspberry Pi firmware
+// (github.com/raspberrypi/firmware).
+type Firmware struct {
+	// Release is the git tag of the release, e.g. 1.20230405.
+	Release string
+
+	// Files are the firmware files with their hashes.
+	Files []FirmwareFile
+}
+
+// FirmwareFile is a file in the boot directory of a firmware release.
+type FirmwareFile struct {
+	Name   string // file name, e.g. start4.elf
+	SHA256 string // hex-encoded SHA-256 hash of the file
+}
+
+// URL returns the download URL of the file name of the release.
+func (f Firmware) URL(name string) string {
+	return FirmwareRepo + "/" + f.Release + "/boot/" + name
+}
+
+// Patch is a patch file in the repository.
+type Patch struct {
+	Name   string // file name, e.g. 0201-enable-spidev.patch
+	SHA256 string // hex-encoded SHA-256 hash of the file
+
+	// Upstream is the upstream status of the patch: empty or “local” for
+	// changes which are only meant for gokrazy, “submitted” (optionally
+	// followed by a space and a link to the submission) for changes
+	// awaiting review upstream, or “merged ” followed by the kernel version
+	// which includes the change, e.g. “merged 6.6”. bump drops merged
+	// patches when bumping to that version or newer.
+	Upstream string `json:",omitempty"`
+}
+
+// MergedIn returns the kernel version which includes the change of p
+// according to its Upstream status, or an empty string.
+func (p Patch) MergedIn() string {
+	if strings.HasPrefix(p.Upstream, "merged ") {
+		return strings.TrimSpace(strings.TrimPrefix(p.Upstream, "merged "))
+	}
+	return ""
+}
+
+// validUpstream reports whether status is a valid Patch.Upstream value.
+func validUpstream(status string) bool {
+	switch {
+	case status == "", status == "local", status == "submitted":
+		return true
+	case strings.HasPrefix(status, "submitted "):
+		return true
+	case strings.HasPrefix(status, "merged "):
+		_, err := TarballURL(strings.TrimPrefix(status, "merged "))
+		return err == nil
+	}
+	return false
+}
+
+// validCommit reports whether commit is empty or a full hex-encoded SHA-1
+// (or SHA-256) commit hash.
+func validCommit(commit string) bool {
+	if commit == "" {
+		return true
+	}
+	if len(commit) != 40 && len(commit) != 64 {
+		return false
+	}
+	for _, r := range commit {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// AtLeast reports whether the kernel version v (e.g. 6.5.7) is min (e.g.
+// 6.6) or newer.
+func AtLeast(v, min string) bool {
+	vs, ms := strings.Split(v, "."), strings.Split(min, ".")
+	for idx := 0; idx < len(ms); idx++ {
+		var a, b int
+		if idx < len(vs) {
+			a, _ = strconv.Atoi(vs[idx])
+		}
+		b, _ = strconv.Atoi(ms[idx])
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// Version returns the kernel version, e.g. 6.5.7.
+func Version() string {
+	return lock.Version
+}
+
+// URL returns the kernel.org URL of the kernel source tarball, e.g.
+// https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.5.7.tar.xz.
+func URL() string {
+	return lock.URL
+}
+
+// SHA256 returns the hex-encoded SHA-256 hash of the kernel source tarball,
+// or an empty string if kernel.lock does not record it.
+func SHA256() string {
+	return lock.SHA256
+}
+
+// Patches returns the patches applied to the kernel source.
+func Patches() []Patch {
+	return append([]Patch(nil), lock.Patches...)
+}
+
+// PinnedFirmware returns the pinned Raspberry Pi firmware, or nil.
+func PinnedFirmware() *Firmware {
+	if lock.Firmware == nil {
+		return nil
+	}
+	fw := *lock.Firmware
+	fw.Files = append([]FirmwareFile(nil), fw.Files...)
+	return &fw
+}
+
+// GitSource returns the git repository to fetch the kernel source from, or
+// nil if the kernel source is the tarball at URL().
+func GitSource() *Git {
+	if lock.Git == nil {
+		return nil
+	}
+	g := *lock.Git
+	return &g
+}
+
+// MirrorURL returns the URL of the kernel source tarball on mirror (which
+// corresponds to KernelOrg), or URL() if mirror is empty.
+func MirrorURL(mirror string) string {
+	if mirror == "" {
+		return lock.URL
+	}
+	return strings.TrimSuffix(mirror, "/") + strings.TrimPrefix(lock.URL, KernelOrg)
+}
+
+// TarballURL returns the kernel.org URL of the source tarball of version,
+// e.g. 6.5.9.
+func TarballURL(version string) (string, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("malformed kernel version %q, expected e.g. 6.5.9", version)
+	}
+	return fmt.Sprintf("%s/v%s.x/linux-%s.tar.xz", KernelOrg, parts[0], version), nil
+}
+
+// ParseLock parses the content of kernel.lock.
+func ParseLock(b []byte) (Lock, error) {
+	var l Lock
+	if err := json.Unmarshal(b, &l); err != nil {
+		return Lock{}, fmt.Errorf("parsing kernel.lock: %v", err)
+	}
+	if l.URL == "" {
+		return Lock{}, fmt.Errorf("parsing kernel.lock: URL is empty")
+	}
+	if want := strings.TrimSuffix(strings.TrimPrefix(path.Base(l.URL), "linux-"), ".tar.xz"); l.Version != want {
+		return Lock{}, fmt.Errorf("parsing kernel.lock: Version %q does not match URL %s", l.Version, l.URL)
+	}
+	if f := l.Firmware; f != nil && (f.Release == "" || len(f.Files) == 0) {
+		return Lock{}, fmt.Errorf("parsing kernel.lock: Firmware needs a Release and Files")
+	}
+	if g := l.Git; g != nil {
+		if g.Repo == "" || g.Ref == "" {
+			return Lock{}, fmt.Errorf("parsing kernel.lock: Git needs a Repo and Ref")
+		}
+		if !validCommit(g.Commit) {
+			return Lock{}, fmt.Errorf("parsing kernel.lock: Git.Commit %q is not a full hex-encoded commit hash", g.Commit)
+		}
+	}
+	for _, p := range l.Patches {
+		if !validUpstream(p.Upstream) {
+			return Lock{}, fmt.Errorf("parsing kernel.lock: %s: invalid Upstream %q, expected local, submitted [link] or merged <version>", p.Name, p.Upstream)
+		}
+	}
+	return l, nil
+}
+
+// Marshal returns the content of kernel.lock for l.
+func (l Lock) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(l, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Source returns the content of lock.go for l.
+func (l Lock) Source() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated from kernel.lock by gen.go. DO NOT EDIT.\n\n")
+	buf.WriteString("package kernelversion\n\n")
+	buf.WriteString("var lock = Lock{\n")
+	fmt.Fprintf(&buf, "Version: %q,\n", l.Version)
+	fmt.Fprintf(&buf, "URL: %q,\n", l.URL)
+	fmt.Fprintf(&buf, "SHA256: %q,\n", l.SHA256)
+	buf.WriteString("Patches: []Patch{\n")
+	for _, p := range l.Patches {
+		if p.Upstream != "" {
+			fmt.Fprintf(&buf, "{Name: %q, SHA256: %q, Upstream: %q},\n", p.Name, p.SHA256, p.Upstream)
+			continue
+		}
+		fmt.Fprintf(&buf, "{Name: %q, SHA256: %q},\n", p.Name, p.SHA256)
+	}
+	buf.WriteString("},\n")
+	if f := l.Firmware; f != nil {
+		fmt.Fprintf(&buf, "Firmware: &Firmware{\nRelease: %q,\nFiles: []FirmwareFile{\n", f.Release)
+		for _, file := range f.Files {
+			fmt.Fprintf(&buf, "{Name: %q, SHA256: %q},\n", file.Name, file.SHA256)
+		}
+		buf.WriteString("},\n},\n")
+	}
+	if g := l.Git; g != nil {
+		fmt.Fprintf(&buf, "Git: &Git{\nRepo: %q,\nRef: %q,\nCommit: %q,\n},\n", g.Repo, g.Ref, g.Commit)
+	}
+	buf.WriteString("}\n")
+	return format.Source(buf.Bytes())
+}
@@ -0,0 +1,118 @@
+package kernelversion
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMirrorURL(t *testing.T) {
+	file := strings.TrimPrefix(URL(), KernelOrg)
+	for _, tt := range []struct {
+		mirror string
+		want   string
+	}{
+		{"", URL()},
+		{KernelOrg, URL()},
+		{"https://mirrors.example.org/linux/kernel", "https://mirrors.example.org/linux/kernel" + file},
+		{"https://mirrors.example.org/linux/kernel/", "https://mirrors.example.org/linux/kernel" + file},
+	} {
+		if got := MirrorURL(tt.mirror); got != tt.want {
+			t.Errorf("MirrorURL(%q) = %q, want %q", tt.mirror, got, tt.want)
+		}
+	}
+}
+
+func TestTarballURL(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "6.5.9", want: KernelOrg + "/v6.x/linux-6.5.9.tar.xz"},
+		{version: "6.6", want: KernelOrg + "/v6.x/linux-6.6.tar.xz"},
+		{version: "5.15.137", want: KernelOrg + "/v5.x/linux-5.15.137.tar.xz"},
+		{version: "6", wantErr: true},
+		{version: "6.5.9.1", wantErr: true},
+	} {
+		got, err := TarballURL(tt.version)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("TarballURL(%q): err = %v, want error: %v", tt.version, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("TarballURL(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseLock(t *testing.T) {
+	const url = `"URL": "https://cdn.kernel.org/pub/linux/kernel/v6.x/linux-6.5.7.tar.xz"`
+	for _, tt := range []struct {
+		name    string
+		lock    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			lock: `{"Version": "6.5.7", ` + url + `, "Patches": [
+				{"Name": "0001-a.patch", "SHA256": "00"},
+				{"Name": "0002-b.patch", "SHA256": "00", "Upstream": "submitted https://lore.kernel.org/"},
+				{"Name": "0003-c.patch", "SHA256": "00", "Upstream": "merged 6.6"}]}`,
+		},
+		{
+			name: "git",
+			lock: `{"Version": "6.5.7", ` + url + `, "Git": {"Repo": "https://git.kernel.org/torvalds/linux.git", "Ref": "v6.5.7", "Commit": "` + strings.Repeat("a", 40) + `"}}`,
+		},
+		{
+			name:    "malformed",
+			lock:    `{`,
+			wantErr: "parsing kernel.lock",
+		},
+		{
+			name:    "no URL",
+			lock:    `{"Version": "6.5.7"}`,
+			wantErr: "URL is empty",
+		},
+		{
+			name:    "version mismatch",
+			lock:    `{"Version": "6.5.8", ` + url + `}`,
+			wantErr: "does not match URL",
+		},
+		{
+			name:    "firmware without files",
+			lock:    `{"Version": "6.5.7", ` + url + `, "Firmware": {"Release": "1.20230405"}}`,
+			wantErr: "Firmware needs a Release and Files",
+		},
+		{
+			name:    "git without ref",
+			lock:    `{"Version": "6.5.7", ` + url + `, "Git": {"Repo": "https://git.kernel.org/torvalds/linux.git"}}`,
+			wantErr: "Git needs a Repo and Ref",
+		},
+		{
+			name:    "abbreviated commit",
+			lock:    `{"Version": "6.5.7", ` + url + `, "Git": {"Repo": "https://git.kernel.org/torvalds/linux.git", "Ref": "v6.5.7", "Commit": "abcdef0"}}`,
+			wantErr: "not a full hex-encoded commit hash",
+		},
+		{
+			name:    "invalid upstream",
+			lock:    `{"Version": "6.5.7", ` + url + `, "Patches": [{"Name": "0001-a.patch", "SHA256": "00", "Upstream": "merged soon"}]}`,
+			wantErr: "invalid Upstream",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := ParseLock([]byte(tt.lock))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if l.Version != "6.5.7" {
+					t.Errorf("Version = %q, want 6.5.7", l.Version)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseLock: err = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
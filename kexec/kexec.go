@@ -0,0 +1,85 @@
+// Package kexec loads kernels with the kexec_file_load system call on arm64
+// gokrazy devices, either to boot into them right away (skipping the
+// firmware and bootloader) or as crash kernel (see gokr-kdump and
+// gokr-kexec). The running kernel needs CONFIG_KEXEC_FILE, e.g. from the
+// kexec or kdump profile.
+package kexec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sysKexecFileLoad is the kexec_file_load system call number on arm64 (see
+// include/uapi/asm-generic/unistd.h), which the syscall package does not
+// define.
+const sysKexecFileLoad = 294
+
+// Flags of kexec_file_load.
+const (
+	FileOnCrash     = 0x2
+	FileNoInitramfs = 0x4
+)
+
+// FileLoad loads the kernel image at path with the command line cmdline and
+// without initramfs. flags can include FileOnCrash.
+func FileLoad(path, cmdline string, flags uintptr) error {
+	if runtime.GOARCH != "arm64" {
+		return fmt.Errorf("kexec_file_load is only implemented for arm64, not %s", runtime.GOARCH)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The command line length includes the terminating NUL byte.
+	cmd := append([]byte(cmdline), 0)
+	_, _, errno := syscall.Syscall6(sysKexecFileLoad,
+		f.Fd(),
+		^uintptr(0), // no initramfs
+		uintptr(len(cmd)),
+		uintptr(unsafe.Pointer(&cmd[0])),
+		flags|FileNoInitramfs,
+		0)
+	if errno != 0 {
+		return fmt.Errorf("kexec_file_load(%s): %v", path, errno)
+	}
+	return nil
+}
+
+// Reboot syncs the file systems and boots the kernel loaded by FileLoad.
+// It only returns on error.
+func Reboot() error {
+	syscall.Sync()
+	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_KEXEC)
+}
+
+// Cmdline returns the command line of the running kernel with the
+// parameters named in drop (e.g. crashkernel) removed and add appended.
+func Cmdline(drop []string, add ...string) (string, error) {
+	b, err := ioutil.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", err
+	}
+	return filterCmdline(strings.TrimSpace(string(b)), drop, add), nil
+}
+
+func filterCmdline(current string, drop, add []string) string {
+	var params []string
+Outer:
+	for _, param := range strings.Fields(current) {
+		name := strings.SplitN(param, "=", 2)[0]
+		for _, d := range drop {
+			if name == d {
+				continue Outer
+			}
+		}
+		params = append(params, param)
+	}
+	return strings.Join(append(params, add...), " ")
+}
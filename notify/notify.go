@@ -0,0 +1,229 @@
+// Package notify sends build results to chat rooms or via email, e.g. for
+// unattended nightly builds.
+//
+// Targets are specified as strings:
+//
+//	slack:https://hooks.slack.com/services/…  (incoming webhook)
+//	matrix:https://matrix.example.org/!room:example.org
+//	mailto:kernel@example.org
+//
+// Matrix targets need an access token in $GOKR_NOTIFY_MATRIX_TOKEN. Email is
+// sent via the SMTP server in $GOKR_NOTIFY_SMTP_ADDR (host:port), optionally
+// authenticating as $GOKR_NOTIFY_SMTP_USER with $GOKR_NOTIFY_SMTP_PASSWORD,
+// from $GOKR_NOTIFY_SMTP_FROM.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message describes the result of a build.
+type Message struct {
+	// Subject summarizes the build, e.g. “kernel 6.5.7 build”.
+	Subject string
+
+	// Err is the error the build failed with, or nil if it succeeded.
+	Err error
+
+	Duration      time.Duration
+	KernelVersion string
+
+	// Hashes maps artifact names to hex-encoded SHA-256 hashes.
+	Hashes map[string]string
+
+	// Details is appended verbatim, e.g. a report.
+	Details string
+}
+
+// Title returns the subject line including the result.
+func (m Message) Title() string {
+	if m.Err != nil {
+		return m.Subject + " failed"
+	}
+	return m.Subject + " succeeded"
+}
+
+// Text returns the message as plain text.
+func (m Message) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", m.Title())
+	if m.KernelVersion != "" {
+		fmt.Fprintf(&b, "kernel version: %s\n", m.KernelVersion)
+	}
+	fmt.Fprintf(&b, "duration: %v\n", m.Duration.Round(time.Second))
+	if m.Err != nil {
+		fmt.Fprintf(&b, "error: %v\n", m.Err)
+	}
+	names := make([]string, 0, len(m.Hashes))
+	for name := range m.Hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if m.Hashes[name] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, m.Hashes[name])
+	}
+	if m.Details != "" {
+		fmt.Fprintf(&b, "\n%s\n", strings.TrimSpace(m.Details))
+	}
+	return b.String()
+}
+
+// Sender sends messages to one target.
+type Sender interface {
+	Send(m Message) error
+}
+
+// Parse returns the Sender for target.
+func Parse(target string) (Sender, error) {
+	idx := strings.IndexByte(target, ':')
+	if idx == -1 {
+		return nil, fmt.Errorf("malformed notification target %q, expected e.g. slack:<webhook URL>", target)
+	}
+	kind, rest := target[:idx], target[idx+1:]
+	switch kind {
+	case "slack":
+		return &slack{webhook: rest}, nil
+	case "matrix":
+		u, err := url.Parse(rest)
+		if err != nil {
+			return nil, err
+		}
+		room := strings.TrimPrefix(u.Path, "/")
+		if u.Scheme == "" || u.Host == "" || room == "" {
+			return nil, fmt.Errorf("malformed matrix target %q, expected matrix:https://<homeserver>/<room id>", target)
+		}
+		return &matrix{homeserver: u.Scheme + "://" + u.Host, room: room}, nil
+	case "mailto":
+		if !strings.Contains(rest, "@") {
+			return nil, fmt.Errorf("malformed mailto target %q", target)
+		}
+		return &email{to: rest}, nil
+	default:
+		return nil, fmt.Errorf("unknown notification target type %q (known: slack, matrix, mailto)", kind)
+	}
+}
+
+// Split returns the targets in the comma-separated list.
+func Split(list string) []string {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// SendAll sends m to all targets, returning the first error. It attempts
+// all targets even if sending to one fails.
+func SendAll(targets []string, m Message) error {
+	var first error
+	for _, target := range targets {
+		s, err := Parse(target)
+		if err == nil {
+			err = s.Send(m)
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("notifying %s: %v", redact(target), err)
+		}
+	}
+	return first
+}
+
+// redact removes the webhook URL from Slack targets, as it is a secret.
+func redact(target string) string {
+	if strings.HasPrefix(target, "slack:") {
+		return "slack:…"
+	}
+	return target
+}
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+func postJSON(method, url, token string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+type slack struct {
+	webhook string
+}
+
+func (s *slack) Send(m Message) error {
+	return postJSON("POST", s.webhook, "", map[string]string{"text": m.Text()})
+}
+
+type matrix struct {
+	homeserver string
+	room       string
+}
+
+func (mx *matrix) Send(m Message) error {
+	token := os.Getenv("GOKR_NOTIFY_MATRIX_TOKEN")
+	if token == "" {
+		return fmt.Errorf("GOKR_NOTIFY_MATRIX_TOKEN is not set")
+	}
+	txn := fmt.Sprintf("gokr-kernel-%d", time.Now().UnixNano())
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", mx.homeserver, url.PathEscape(mx.room), txn)
+	return postJSON("PUT", u, token, map[string]string{"msgtype": "m.text", "body": m.Text()})
+}
+
+type email struct {
+	to string
+}
+
+func (e *email) Send(m Message) error {
+	addr := os.Getenv("GOKR_NOTIFY_SMTP_ADDR")
+	if addr == "" {
+		return fmt.Errorf("GOKR_NOTIFY_SMTP_ADDR is not set")
+	}
+	from := os.Getenv("GOKR_NOTIFY_SMTP_FROM")
+	if from == "" {
+		from = "gokr-kernel@localhost"
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("GOKR_NOTIFY_SMTP_USER"); user != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("GOKR_NOTIFY_SMTP_PASSWORD"), host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		from, e.to, m.Title(), strings.ReplaceAll(m.Text(), "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, []string{e.to}, []byte(msg))
+}
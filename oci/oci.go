@@ -0,0 +1,357 @@
+// Package oci is a minimal client for OCI distribution registries (e.g.
+// ghcr.io or a local registry:2), sufficient to push and pull artifacts
+// consisting of a config blob and layers, like ORAS does.
+//
+// Credentials are taken from $GOKR_OCI_USERNAME and $GOKR_OCI_PASSWORD (e.g.
+// a GitHub token for ghcr.io). Anonymous access works for public pulls.
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Media types of OCI manifests and descriptors.
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeEmpty    = "application/vnd.oci.empty.v1+json"
+)
+
+// AnnotationTitle is the file name of a layer, as used by ORAS.
+const AnnotationTitle = "org.opencontainers.image.title"
+
+// Descriptor references a blob.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+}
+
+// Manifest is an OCI image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Reference identifies a manifest in a registry, e.g.
+// ghcr.io/user/kernel:6.5.7.
+type Reference struct {
+	Registry   string // host[:port]
+	Repository string // e.g. user/kernel
+	Tag        string // tag or digest (sha256:…)
+}
+
+func (r Reference) String() string {
+	if strings.HasPrefix(r.Tag, "sha256:") {
+		return r.Registry + "/" + r.Repository + "@" + r.Tag
+	}
+	return r.Registry + "/" + r.Repository + ":" + r.Tag
+}
+
+// ParseReference parses ref, which must include the registry host. The tag
+// defaults to latest.
+func ParseReference(ref string) (Reference, error) {
+	idx := strings.IndexByte(ref, '/')
+	if idx == -1 || !strings.ContainsAny(ref[:idx], ".:") && ref[:idx] != "localhost" {
+		return Reference{}, fmt.Errorf("malformed reference %q, expected e.g. ghcr.io/user/kernel:6.5.7", ref)
+	}
+	r := Reference{Registry: ref[:idx], Repository: ref[idx+1:], Tag: "latest"}
+	if at := strings.IndexByte(r.Repository, '@'); at != -1 {
+		r.Repository, r.Tag = r.Repository[:at], r.Repository[at+1:]
+	} else if colon := strings.LastIndexByte(r.Repository, ':'); colon != -1 {
+		r.Repository, r.Tag = r.Repository[:colon], r.Repository[colon+1:]
+	}
+	if r.Repository == "" || r.Tag == "" {
+		return Reference{}, fmt.Errorf("malformed reference %q", ref)
+	}
+	return r, nil
+}
+
+// Digest returns the digest of b.
+func Digest(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+// Client talks to the registry of a reference.
+type Client struct {
+	ref Reference
+
+	// Insecure uses HTTP instead of HTTPS, e.g. for a local registry.
+	Insecure bool
+
+	http  *http.Client
+	token string // bearer token, obtained after the first 401
+}
+
+// NewClient returns a client for the repository of ref.
+func NewClient(ref Reference) *Client {
+	return &Client{ref: ref, http: &http.Client{Timeout: 30 * time.Minute}}
+}
+
+func (c *Client) url(path string) string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, c.ref.Registry, c.ref.Repository, path)
+}
+
+// do sends the request created by newReq, authenticating if the registry
+// asks for it. newReq is called again for the retry, as bodies can only be
+// read once.
+func (c *Client) do(newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		user, pass := os.Getenv("GOKR_OCI_USERNAME"), os.Getenv("GOKR_OCI_PASSWORD")
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case user != "":
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if !strings.HasPrefix(challenge, "Bearer ") {
+			return nil, fmt.Errorf("%s: unauthorized (set $GOKR_OCI_USERNAME and $GOKR_OCI_PASSWORD)", req.URL)
+		}
+		if c.token, err = c.fetchToken(challenge, user, pass); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchToken obtains a bearer token as described by the WWW-Authenticate
+// challenge, e.g. Bearer realm="https://ghcr.io/token",service="ghcr.io",
+// scope="repository:user/kernel:pull".
+func (c *Client) fetchToken(challenge, user, pass string) (string, error) {
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("malformed WWW-Authenticate challenge %q", challenge)
+	}
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	// Always ask for push and pull access, so that a single token suffices.
+	q.Set("scope", "repository:"+c.ref.Repository+":pull,push")
+	if params["scope"] != "" && !strings.HasSuffix(params["scope"], "push") {
+		q.Set("scope", params["scope"])
+	}
+	req, err := http.NewRequest("GET", realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching token from %s: unexpected HTTP status %s", realm, resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	return t.AccessToken, nil
+}
+
+func checkStatus(resp *http.Response, want ...int) error {
+	for _, w := range want {
+		if resp.StatusCode == w {
+			return nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s: unexpected HTTP status %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// PushBlob uploads the blob with the specified digest and size, whose
+// content open returns, unless the registry already has it.
+func (c *Client) PushBlob(digest string, size int64, open func() (io.ReadCloser, error)) error {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest("HEAD", c.url("blobs/"+digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil // already present
+	}
+
+	resp, err = c.do(func() (*http.Request, error) {
+		return http.NewRequest("POST", c.url("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+
+	resp, err = c.do(func() (*http.Request, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("PUT", loc.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkStatus(resp, http.StatusCreated)
+}
+
+// PushBytes uploads b as a blob and returns its descriptor.
+func (c *Client) PushBytes(mediaType string, b []byte) (Descriptor, error) {
+	d := Descriptor{MediaType: mediaType, Digest: Digest(b), Size: int64(len(b))}
+	err := c.PushBlob(d.Digest, d.Size, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	})
+	return d, err
+}
+
+// PushManifest uploads m, tagged with tag (or the reference’s tag if
+// empty), and returns its digest.
+func (c *Client) PushManifest(m *Manifest, tag string) (string, error) {
+	if tag == "" {
+		tag = c.ref.Tag
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", c.url("manifests/"+tag), bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", m.MediaType)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return Digest(b), nil
+}
+
+// Manifest fetches the manifest of tag (or the reference’s tag if empty)
+// and returns it with its digest.
+func (c *Client) Manifest(tag string) (*Manifest, string, error) {
+	if tag == "" {
+		tag = c.ref.Tag
+	}
+	resp, err := c.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", c.url("manifests/"+tag), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", MediaTypeManifest)
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	digest := Digest(b)
+	if strings.HasPrefix(tag, "sha256:") && digest != tag {
+		return nil, "", fmt.Errorf("manifest digest mismatch: got %s, want %s", digest, tag)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, "", err
+	}
+	return &m, digest, nil
+}
+
+// FetchBlob writes the blob described by d to w, verifying its digest.
+func (c *Client) FetchBlob(d Descriptor, w io.Writer) error {
+	resp, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", c.url("blobs/"+d.Digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("sha256:%x", h.Sum(nil)); got != d.Digest || n != d.Size {
+		return fmt.Errorf("blob %s: got digest %s and size %d, want size %d", d.Digest, got, n, d.Size)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package packer is the integration point for gokr-packer (and gok): it
+// makes sure that a kernel repository directory (this repository or a fork)
+// contains the artifacts of a requested kernel version, either by pulling
+// prebuilt artifacts from an OCI registry or by rebuilding the kernel, so
+// that gokr-packer -update transparently picks up kernels from it:
+//
+//	res, err := packer.Ensure(packer.Request{
+//		Dir:     kernelPackageDir,
+//		Version: "6.5.7",
+//		Source:  "ghcr.io/example/kernel:{version}",
+//	})
+//
+// The same is available on the command line as gokr-rebuild-kernel ensure.
+// Both run gokr-rebuild-kernel for pulling and rebuilding, which must be
+// installed (and Go, for rebuilding a different version than the pinned one).
+package packer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+	"github.com/alf632/gokrazy-kernel/kernelversion"
+)
+
+// VersionPlaceholder is replaced with the requested version in
+// Request.Source.
+const VersionPlaceholder = "{version}"
+
+// Actions taken by Ensure, see Result.Action.
+const (
+	UpToDate = "up-to-date"
+	Pulled   = "pulled"
+	Rebuilt  = "rebuilt"
+)
+
+// Request specifies the kernel artifacts to ensure.
+type Request struct {
+	// Dir is the kernel repository directory containing kernel.lock and
+	// the artifacts (vmlinuz etc.).
+	Dir string
+
+	// Version is the kernel version, e.g. 6.5.7. If empty, the version
+	// pinned in the kernel.lock in Dir is used.
+	Version string
+
+	// Source is an OCI reference (e.g. ghcr.io/example/kernel:{version},
+	// see gokr-rebuild-kernel push) to pull prebuilt artifacts from, with
+	// VersionPlaceholder replaced by Version. If empty, nothing is pulled.
+	Source string
+
+	// Rebuild allows rebuilding the kernel (bumping kernel.lock to Version
+	// first, if necessary) if the artifacts cannot be pulled.
+	Rebuild bool
+
+	// Executable is the gokr-rebuild-kernel executable (default: found in
+	// $PATH).
+	Executable string
+
+	// Output receives the output of gokr-rebuild-kernel (default: discard).
+	Output io.Writer
+}
+
+// Result describes the artifacts in Request.Dir after Ensure.
+type Result struct {
+	// Action is what Ensure did: UpToDate, Pulled or Rebuilt.
+	Action string
+
+	// BuildInfo describes the artifacts.
+	BuildInfo *buildinfo.BuildInfo
+}
+
+// current returns the build info of the artifacts in dir if they are of
+// version, or nil.
+func current(dir, version string) *buildinfo.BuildInfo {
+	bi, err := buildinfo.Read(filepath.Join(dir, buildinfo.FileName))
+	if err != nil || bi.KernelVersion != version {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vmlinuz")); err != nil {
+		return nil
+	}
+	return bi
+}
+
+// run runs gokr-rebuild-kernel with args in req.Dir.
+func (req *Request) run(args ...string) error {
+	cmd := exec.Command(req.Executable, args...)
+	cmd.Dir = req.Dir
+	cmd.Stdout = req.Output
+	cmd.Stderr = req.Output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", req.Executable, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// Ensure makes sure that req.Dir contains the artifacts of req.Version:
+// artifacts of the version are used as they are, otherwise they are pulled
+// from req.Source (if set) or rebuilt (if req.Rebuild is set).
+func Ensure(req Request) (*Result, error) {
+	if req.Dir == "" {
+		req.Dir = "."
+	}
+	if req.Executable == "" {
+		req.Executable = "gokr-rebuild-kernel"
+	}
+	if req.Output == nil {
+		req.Output = ioutil.Discard
+	}
+	b, err := ioutil.ReadFile(filepath.Join(req.Dir, "kernel.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lock, err := kernelversion.ParseLock(b)
+	if err != nil {
+		return nil, err
+	}
+	if req.Version == "" {
+		req.Version = lock.Version
+	}
+	if bi := current(req.Dir, req.Version); bi != nil {
+		return &Result{Action: UpToDate, BuildInfo: bi}, nil
+	}
+
+	var pullErr error
+	if req.Source != "" {
+		ref := strings.Replace(req.Source, VersionPlaceholder, req.Version, -1)
+		if pullErr = req.run("pull", "-output_dir=.", ref); pullErr == nil {
+			if bi := current(req.Dir, req.Version); bi != nil {
+				return &Result{Action: Pulled, BuildInfo: bi}, nil
+			}
+			pullErr = fmt.Errorf("%s does not contain kernel %s", ref, req.Version)
+		}
+		if !req.Rebuild {
+			return nil, pullErr
+		}
+	}
+	if !req.Rebuild {
+		return nil, fmt.Errorf("%s does not contain kernel %s, and neither Source nor Rebuild are set", req.Dir, req.Version)
+	}
+	build := req.run
+	if lock.Version != req.Version {
+		if err := req.run("bump", "-version="+req.Version); err != nil {
+			return nil, err
+		}
+		// gokr-rebuild-kernel builds the version compiled into it, so
+		// build with the gokr-rebuild-kernel of the bumped repository.
+		build = func(args ...string) error {
+			r := req
+			r.Executable = "go"
+			return r.run(append([]string{"run", "./cmd/gokr-rebuild-kernel"}, args...)...)
+		}
+	}
+	if err := build("build"); err != nil {
+		if pullErr != nil {
+			return nil, fmt.Errorf("%v (after pulling failed: %v)", err, pullErr)
+		}
+		return nil, err
+	}
+	bi := current(req.Dir, req.Version)
+	if bi == nil {
+		return nil, fmt.Errorf("the build did not produce kernel %s in %s", req.Version, req.Dir)
+	}
+	return &Result{Action: Rebuilt, BuildInfo: bi}, nil
+}
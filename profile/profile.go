@@ -0,0 +1,702 @@
+// Package profile defines optional sets of kernel config options (and the
+// Raspberry Pi config.txt lines they need) which can be enabled on top of the
+// gokrazy default config, e.g. a hardened or a size-optimized kernel.
+package profile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile is a named set of config options.
+type Profile struct {
+	// Name identifies the profile, e.g. “hardened”.
+	Name string
+
+	// Description is a human-readable summary.
+	Description string
+
+	// Config is appended to the gokrazy default config. After running
+	// olddefconfig, all options are verified to have the requested value and
+	// deviations are reported in config-report.txt.
+	Config string
+
+	// Image is the file in arch/arm64/boot which is shipped as vmlinuz. If
+	// empty, the uncompressed Image is used.
+	Image string
+
+	// ConfigTxt lists lines (typically dtoverlay= or dtparam=) which must be
+	// present in the Raspberry Pi config.txt.
+	ConfigTxt []string
+
+	// Notes are included in the config report, e.g. to document how to use
+	// the features of the profile.
+	Notes []string
+
+	// Record lists config symbols whose final value (after olddefconfig) is
+	// included in the config report.
+	Record []string
+
+	// Require lists config symbols which must be enabled in the final config
+	// for the profile to work. The build fails otherwise.
+	Require []string
+
+	// Cmdline lists kernel command line parameters which must be present in
+	// cmdline.txt, e.g. cma=256M.
+	Cmdline []string
+
+	// Overlays lists device tree overlays to compile from
+	// dts/overlays/<name>.dts and export as overlays/<name>.dtbo, for use with
+	// dtoverlay=<name> in config.txt.
+	Overlays []string
+}
+
+var all = []Profile{
+	{
+		Name:        "hardened",
+		Description: "kernel self-protection project recommendations for arm64",
+		Config: `
+# See https://kspp.github.io/Recommended_Settings
+CONFIG_STACKPROTECTOR=y
+CONFIG_STACKPROTECTOR_STRONG=y
+CONFIG_STRICT_KERNEL_RWX=y
+CONFIG_STRICT_MODULE_RWX=y
+CONFIG_VMAP_STACK=y
+CONFIG_RANDOMIZE_BASE=y
+CONFIG_RANDOMIZE_MODULE_REGION_FULL=y
+CONFIG_RANDOMIZE_KSTACK_OFFSET_DEFAULT=y
+CONFIG_HARDENED_USERCOPY=y
+CONFIG_FORTIFY_SOURCE=y
+CONFIG_INIT_ON_ALLOC_DEFAULT_ON=y
+CONFIG_INIT_ON_FREE_DEFAULT_ON=y
+CONFIG_INIT_STACK_ALL_ZERO=y
+CONFIG_SLAB_FREELIST_RANDOM=y
+CONFIG_SLAB_FREELIST_HARDENED=y
+CONFIG_SHUFFLE_PAGE_ALLOCATOR=y
+CONFIG_PAGE_TABLE_CHECK=y
+CONFIG_PAGE_TABLE_CHECK_ENFORCED=y
+CONFIG_BUG_ON_DATA_CORRUPTION=y
+CONFIG_SCHED_STACK_END_CHECK=y
+CONFIG_DEBUG_LIST=y
+CONFIG_DEBUG_SG=y
+CONFIG_DEBUG_CREDENTIALS=y
+CONFIG_DEBUG_NOTIFIERS=y
+CONFIG_SECCOMP=y
+CONFIG_SECCOMP_FILTER=y
+
+# arm64 specific:
+CONFIG_ARM64_SW_TTBR0_PAN=y
+CONFIG_ARM64_PTR_AUTH=y
+CONFIG_ARM64_PTR_AUTH_KERNEL=y
+CONFIG_ARM64_BTI_KERNEL=y
+CONFIG_ARM64_MTE=y
+CONFIG_UNMAP_KERNEL_AT_EL0=y
+# CONFIG_CFI_CLANG and CONFIG_SHADOW_CALL_STACK are not requested: the build
+# container uses the GCC cross toolchain, and kernels before 6.7 only support
+# the shadow call stack with clang.
+
+# Lockdown in integrity mode: confidentiality mode would also restrict BPF,
+# which runc needs.
+CONFIG_SECURITY=y
+CONFIG_SECURITY_YAMA=y
+CONFIG_SECURITY_DMESG_RESTRICT=y
+CONFIG_SECURITY_LOCKDOWN_LSM=y
+CONFIG_SECURITY_LOCKDOWN_LSM_EARLY=y
+CONFIG_LOCK_DOWN_KERNEL_FORCE_INTEGRITY=y
+
+# periph.io accesses the GPIO registers via /dev/mem, so restrict instead of
+# disabling it.
+CONFIG_STRICT_DEVMEM=y
+CONFIG_IO_STRICT_DEVMEM=y
+
+# Module signing is left to -sign_modules: gokrazy kernels are built together
+# with their few modules and the root file system is read-only.
+
+# Reduce attack surface:
+# CONFIG_PROC_KCORE is not set
+# CONFIG_COMPAT_BRK is not set
+# CONFIG_KEXEC is not set
+# CONFIG_HIBERNATION is not set
+# CONFIG_LEGACY_PTYS is not set
+# CONFIG_LDISC_AUTOLOAD is not set
+# CONFIG_BINFMT_MISC is not set
+# CONFIG_DEBUG_FS is not set
+`,
+		Notes: []string{
+			"Kconfig drops options the compiler does not support: CONFIG_INIT_STACK_ALL_ZERO needs GCC 12 or newer, CONFIG_ARM64_PTR_AUTH_KERNEL GCC 9 (-mbranch-protection=pac-ret) and CONFIG_ARM64_BTI_KERNEL GCC 10, so with the GCC 8 of the default -base_image they are reported as deviations; use e.g. -base_image=debian:bookworm, or -hardening=stack_zero to fail instead",
+		},
+	},
+
+	{
+		Name:        "tiny",
+		Description: "smaller kernel and faster boot for headless appliances, e.g. on the Pi Zero 2 W",
+		// arm64 kernels cannot decompress themselves (so CONFIG_KERNEL_XZ and
+		// CONFIG_KERNEL_ZSTD do not exist), but the Raspberry Pi firmware
+		// decompresses gzip kernel images when loading them.
+		Image: "Image.gz",
+		Config: `
+CONFIG_CC_OPTIMIZE_FOR_SIZE=y
+# CONFIG_DYNAMIC_DEBUG is not set
+# CONFIG_KALLSYMS_ALL is not set
+# CONFIG_FTRACE is not set
+# CONFIG_PROFILING is not set
+
+# Only the Raspberry Pi SoCs:
+# CONFIG_ARCH_HISI is not set
+# CONFIG_ARCH_MESON is not set
+# CONFIG_ARCH_MVEBU is not set
+# CONFIG_ARCH_QCOM is not set
+# CONFIG_ARCH_SEATTLE is not set
+# CONFIG_ARCH_TEGRA is not set
+# CONFIG_ARCH_THUNDER is not set
+# CONFIG_ARCH_VEXPRESS is not set
+# CONFIG_ARCH_XGENE is not set
+# CONFIG_ACPI is not set
+# CONFIG_XEN is not set
+# CONFIG_VIRTUALIZATION is not set
+
+# Headless: no display, sound or cameras.
+# CONFIG_DRM is not set
+# CONFIG_SOUND is not set
+# CONFIG_MEDIA_SUPPORT is not set
+# CONFIG_LOGO is not set
+
+# Only the file systems gokrazy uses (squashfs root, vfat boot, ext4 perm):
+# CONFIG_BTRFS_FS is not set
+# CONFIG_XFS_FS is not set
+# CONFIG_OCFS2_FS is not set
+# CONFIG_NFS_FS is not set
+# CONFIG_NFSD is not set
+# CONFIG_CIFS is not set
+# CONFIG_9P_FS is not set
+# CONFIG_QUOTA is not set
+
+# Unused network hardware:
+# CONFIG_NET_VENDOR_3COM is not set
+# CONFIG_NET_VENDOR_8390 is not set
+# CONFIG_NET_VENDOR_ADAPTEC is not set
+# CONFIG_NET_VENDOR_CAVIUM is not set
+# CONFIG_NET_VENDOR_DLINK is not set
+# CONFIG_NET_VENDOR_HISILICON is not set
+# CONFIG_NET_VENDOR_INTEL is not set
+# CONFIG_NET_VENDOR_NATSEMI is not set
+# CONFIG_FDDI is not set
+# CONFIG_WLAN_VENDOR_TI is not set
+`,
+	},
+
+	{
+		Name:        "camera",
+		Description: "V4L2 subdevices for the sensors of Raspberry Pi camera modules v1 and v2, without the unicam CSI-2 receiver and ISP this kernel lacks, so they probe but cannot stream (exports overlays/imx219.dtbo and overlays/ov5647.dtbo)",
+		Config: `
+CONFIG_MEDIA_SUPPORT=y
+CONFIG_MEDIA_CONTROLLER=y
+CONFIG_MEDIA_CAMERA_SUPPORT=y
+CONFIG_VIDEO_DEV=y
+CONFIG_VIDEO_V4L2_SUBDEV_API=y
+CONFIG_V4L2_FWNODE=y
+CONFIG_DMA_CMA=y
+
+# Sensor drivers. The CSI-2 receiver (unicam) and the ISP are not part of
+# the upstream kernel this profile builds.
+CONFIG_VIDEO_CAMERA_SENSOR=y
+CONFIG_VIDEO_IMX219=y
+CONFIG_VIDEO_OV5647=y
+`,
+		Require: []string{
+			"VIDEO_IMX219",
+			"VIDEO_OV5647",
+		},
+		ConfigTxt: []string{
+			// Loads the sensor overlay matching the connected camera module.
+			"camera_auto_detect=1",
+		},
+		Overlays: []string{
+			"imx219",
+			"ov5647",
+		},
+		Notes: []string{
+			"camera_auto_detect=1 loads overlays/imx219.dtbo (Camera Module v2) or overlays/ov5647.dtbo (Camera Module v1) for the connected camera; to select one explicitly, set camera_auto_detect=0 and dtoverlay=imx219 or dtoverlay=ov5647",
+			"the sensors only probe as V4L2 subdevices: streaming needs a kernel with the unicam CSI-2 receiver, which this one lacks",
+		},
+	},
+
+	{
+		Name:        "audio",
+		Description: "ALSA with HDMI, headphone jack, USB audio and I²S DAC HATs (exports overlays/i2s-dac-*.dtbo)",
+		Config: `
+CONFIG_SOUND=y
+CONFIG_SND=y
+CONFIG_SND_USB=y
+CONFIG_SND_USB_AUDIO=y
+
+# HDMI audio via the vc4 DRM driver:
+CONFIG_DRM_VC4=y
+CONFIG_SND_SOC=y
+CONFIG_SND_SOC_HDMI_CODEC=y
+
+# Headphone jack via the VideoCore firmware:
+CONFIG_STAGING=y
+CONFIG_BCM_VIDEOCORE=y
+CONFIG_BCM2835_VCHIQ=y
+CONFIG_SND_BCM2835=y
+
+# I²S DAC HATs:
+CONFIG_I2C_BCM2835=y
+CONFIG_SND_BCM2835_SOC_I2S=y
+CONFIG_SND_SIMPLE_CARD=y
+CONFIG_SND_SOC_PCM5102A=y
+CONFIG_SND_SOC_PCM512x_I2C=y
+`,
+		Overlays: []string{
+			"i2s-dac-pcm5102a",
+			"i2s-dac-pcm5122",
+		},
+	},
+
+	{
+		Name:        "display",
+		Description: "KMS graphics (vc4/v3d), framebuffer console and input devices for HDMI kiosks on the Pi 4; updates config.txt and cmdline.txt",
+		Config: `
+CONFIG_DRM=y
+CONFIG_DRM_VC4=y
+CONFIG_DRM_VC4_HDMI_CEC=y
+CONFIG_DRM_V3D=y
+CONFIG_DRM_FBDEV_EMULATION=y
+CONFIG_FB=y
+CONFIG_FRAMEBUFFER_CONSOLE=y
+CONFIG_FRAMEBUFFER_CONSOLE_DETECT_PRIMARY=y
+CONFIG_LOGO=y
+
+# vc4 allocates its buffers from the contiguous memory allocator:
+CONFIG_CMA=y
+CONFIG_DMA_CMA=y
+
+# Keyboards, mice and touchscreens:
+CONFIG_INPUT_EVDEV=y
+CONFIG_HID_GENERIC=y
+CONFIG_USB_HID=y
+CONFIG_HID_MULTITOUCH=y
+`,
+		ConfigTxt: []string{
+			"dtoverlay=vc4-kms-v3d",
+			"max_framebuffers=2",
+		},
+		Cmdline: []string{
+			"cma=256M",
+		},
+	},
+
+	{
+		Name:        "zram",
+		Description: "compressed RAM block devices (zram) and compressed swap cache (zswap) for memory-constrained devices like the Pi Zero 2 W",
+		Config: `
+CONFIG_SWAP=y
+CONFIG_ZSMALLOC=y
+CONFIG_ZRAM=y
+CONFIG_ZRAM_DEF_COMP_ZSTD=y
+CONFIG_ZRAM_MULTI_COMP=y
+CONFIG_ZPOOL=y
+CONFIG_ZSWAP=y
+CONFIG_ZSWAP_COMPRESSOR_DEFAULT_ZSTD=y
+CONFIG_ZSWAP_ZPOOL_DEFAULT_ZSMALLOC=y
+
+CONFIG_CRYPTO_LZO=y
+CONFIG_CRYPTO_LZ4=y
+CONFIG_CRYPTO_LZ4HC=y
+CONFIG_CRYPTO_ZSTD=y
+`,
+		Record: []string{
+			"CONFIG_ZRAM_DEF_COMP",
+			"CONFIG_ZSWAP_COMPRESSOR_DEFAULT",
+			"CONFIG_CRYPTO_LZO",
+			"CONFIG_CRYPTO_LZ4",
+			"CONFIG_CRYPTO_LZ4HC",
+			"CONFIG_CRYPTO_ZSTD",
+		},
+		Notes: []string{
+			"zram: write the size (e.g. 256M) to /sys/block/zram0/disksize (optionally after writing an algorithm to /sys/block/zram0/comp_algorithm), then mkswap and swapon /dev/zram0",
+			"zswap: only applies to swap devices; enable with zswap.enabled=1 or /sys/module/zswap/parameters/enabled",
+		},
+	},
+
+	{
+		Name:        "nftables",
+		Description: "drop legacy iptables (x_tables) in favor of nftables, and enable eBPF tc/XDP hooks",
+		Config: `
+# CONFIG_IP_NF_IPTABLES is not set
+# CONFIG_IP6_NF_IPTABLES is not set
+# CONFIG_NFT_COMPAT is not set
+# CONFIG_NETFILTER_XTABLES is not set
+# CONFIG_BRIDGE_NF_EBTABLES is not set
+
+CONFIG_NF_TABLES=y
+CONFIG_NF_TABLES_INET=y
+CONFIG_NF_TABLES_IPV4=y
+CONFIG_NF_TABLES_IPV6=y
+CONFIG_NFT_CT=y
+CONFIG_NFT_NAT=y
+CONFIG_NFT_MASQ=y
+CONFIG_NFT_REDIR=y
+CONFIG_NFT_REJECT=y
+CONFIG_NFT_LOG=y
+CONFIG_NFT_LIMIT=y
+CONFIG_NFT_COUNTER=y
+
+# eBPF datapath:
+CONFIG_BPF_SYSCALL=y
+CONFIG_BPF_JIT=y
+CONFIG_NET_SCHED=y
+CONFIG_NET_CLS_ACT=y
+CONFIG_NET_SCH_INGRESS=y
+CONFIG_NET_CLS_BPF=y
+CONFIG_NET_ACT_BPF=y
+CONFIG_XDP_SOCKETS=y
+`,
+		Require: []string{
+			"CONFIG_NF_TABLES",
+			"CONFIG_NF_TABLES_INET",
+			"CONFIG_NFT_NAT",
+			"CONFIG_NET_SCH_INGRESS",
+			"CONFIG_NET_CLS_BPF",
+		},
+	},
+
+	{
+		Name:        "storage",
+		Description: "NVMe (CM4 PCIe), USB attached SCSI, md RAID, device-mapper with dm-crypt and dm-verity",
+		Config: `
+CONFIG_PCIE_BRCMSTB=y
+CONFIG_BLK_DEV_NVME=y
+CONFIG_USB_STORAGE=y
+CONFIG_USB_UAS=y
+
+CONFIG_MD=y
+CONFIG_BLK_DEV_MD=y
+CONFIG_MD_RAID0=y
+CONFIG_MD_RAID1=y
+CONFIG_MD_RAID10=y
+CONFIG_MD_RAID456=y
+
+CONFIG_BLK_DEV_DM=y
+# Allows setting up device-mapper targets via dm-mod.create= without an
+# initramfs:
+CONFIG_DM_INIT=y
+CONFIG_DM_CRYPT=y
+CONFIG_DM_VERITY=y
+CONFIG_DM_INTEGRITY=y
+
+# The Raspberry Pi 3 and 4 lack the ARMv8 crypto extensions, so Adiantum is
+# much faster than AES-XTS for disk encryption on them.
+CONFIG_CRYPTO_ADIANTUM=y
+CONFIG_CRYPTO_XTS=y
+CONFIG_CRYPTO_SHA256=y
+# cryptsetup uses the kernel crypto API via AF_ALG:
+CONFIG_CRYPTO_USER_API_HASH=y
+CONFIG_CRYPTO_USER_API_SKCIPHER=y
+`,
+		Require: []string{
+			"CONFIG_BLK_DEV_NVME",
+			"CONFIG_USB_UAS",
+			"CONFIG_BLK_DEV_MD",
+			"CONFIG_DM_CRYPT",
+			"CONFIG_DM_VERITY",
+		},
+	},
+
+	{
+		Name:        "cm4",
+		Description: "Compute Module 4 carrier boards: PCIe with NVMe and common PCIe cards, and the PCF85063A real-time clock of the CM4 IO board",
+		Config: `
+CONFIG_PCI=y
+CONFIG_PCIEPORTBUS=y
+CONFIG_PCIE_BRCMSTB=y
+CONFIG_BLK_DEV_NVME=y
+# USB 3 and 2.5 GbE PCIe cards, as commonly found on carrier boards:
+CONFIG_USB_XHCI_HCD=y
+CONFIG_USB_XHCI_PCI=y
+CONFIG_R8169=y
+CONFIG_IGB=y
+
+CONFIG_I2C_BCM2835=y
+CONFIG_I2C_MUX=y
+CONFIG_I2C_MUX_PINCTRL=y
+CONFIG_RTC_CLASS=y
+CONFIG_RTC_HCTOSYS=y
+CONFIG_RTC_DRV_PCF85063=y
+`,
+		Require: []string{
+			"CONFIG_PCIE_BRCMSTB",
+			"CONFIG_BLK_DEV_NVME",
+			"CONFIG_RTC_DRV_PCF85063",
+		},
+		Notes: []string{
+			"build with -boards=cm4 (optionally alongside other boards) to export bcm2711-rpi-cm4.dtb",
+			"to boot from NVMe, include 6 in BOOT_ORDER of the bootloader EEPROM config, e.g. BOOT_ORDER=0xf416",
+		},
+	},
+
+	{
+		Name:        "verity",
+		Description: "boot a dm-verity protected root file system without initramfs (see gokr-dm-verity)",
+		Config: `
+CONFIG_MD=y
+CONFIG_BLK_DEV_DM=y
+CONFIG_DM_INIT=y
+CONFIG_DM_VERITY=y
+CONFIG_CRYPTO_SHA256=y
+`,
+		Require: []string{
+			"CONFIG_DM_INIT",
+			"CONFIG_DM_VERITY",
+		},
+		Notes: []string{
+			"compute the root hash with gokr-dm-verity and replace root= in cmdline.txt with the printed dm-mod.create= parameters",
+		},
+	},
+
+	{
+		Name:        "fan",
+		Description: "thermal zones with PWM or GPIO fan control, e.g. for Pi 4 cases (exports overlays/pwm-fan.dtbo and overlays/gpio-fan.dtbo)",
+		Config: `
+CONFIG_THERMAL=y
+CONFIG_THERMAL_OF=y
+CONFIG_THERMAL_GOV_STEP_WISE=y
+CONFIG_CPU_THERMAL=y
+CONFIG_BCM2711_THERMAL=y
+CONFIG_BCM2835_THERMAL=y
+CONFIG_HWMON=y
+CONFIG_SENSORS_RASPBERRYPI_HWMON=y
+CONFIG_PWM=y
+CONFIG_PWM_BCM2835=y
+CONFIG_SENSORS_PWM_FAN=y
+CONFIG_SENSORS_GPIO_FAN=y
+`,
+		Overlays: []string{
+			"pwm-fan",
+			"gpio-fan",
+		},
+		Notes: []string{
+			"CPU temperature: /sys/class/thermal/thermal_zone0/temp (millidegrees Celsius)",
+			"fan cooling state: /sys/class/thermal/cooling_device*/cur_state (writable when the thermal zone policy is user_space)",
+			"pwm-fan: /sys/class/hwmon/hwmon*/pwm1 (0–255) where /sys/class/hwmon/hwmon*/name is pwmfan",
+			"gpio-fan: /sys/class/hwmon/hwmon*/fan1_target where /sys/class/hwmon/hwmon*/name is gpio_fan",
+			"pins: pwm-fan uses GPIO 18, gpio-fan GPIO 12 (select another with dtoverlay=gpio-fan,gpiopin=<n>)",
+		},
+	},
+
+	{
+		Name:        "hats",
+		Description: "official Raspberry Pi HATs: PoE/PoE+ fan, Sense HAT and TV HAT (exports overlays/rpi-poe.dtbo, overlays/sense-hat.dtbo and overlays/tv-hat.dtbo)",
+		Config: `
+# PoE and PoE+ HAT fan:
+CONFIG_RASPBERRYPI_FIRMWARE=y
+CONFIG_PWM=y
+CONFIG_PWM_RASPBERRYPI_POE=y
+CONFIG_HWMON=y
+CONFIG_SENSORS_PWM_FAN=y
+CONFIG_THERMAL=y
+CONFIG_THERMAL_OF=y
+CONFIG_BCM2711_THERMAL=y
+CONFIG_BCM2835_THERMAL=y
+
+# Sense HAT:
+CONFIG_I2C_BCM2835=y
+CONFIG_I2C_CHARDEV=y
+CONFIG_MFD_SIMPLE_MFD_I2C=y
+CONFIG_INPUT_JOYSTICK=y
+CONFIG_JOYSTICK_SENSEHAT=y
+CONFIG_IIO=y
+CONFIG_IIO_ST_LSM6DSX=y
+CONFIG_IIO_ST_MAGN_3AXIS=y
+CONFIG_IIO_ST_PRESS=y
+CONFIG_HTS221=y
+
+# TV HAT:
+CONFIG_SPI=y
+CONFIG_SPI_BCM2835=y
+CONFIG_MEDIA_SUPPORT=y
+CONFIG_MEDIA_DIGITAL_TV_SUPPORT=y
+CONFIG_DVB_CORE=y
+CONFIG_DVB_CXD2880=y
+CONFIG_CXD2880_SPI_DRV=y
+`,
+		Overlays: []string{
+			"rpi-poe",
+			"sense-hat",
+			"tv-hat",
+		},
+		Notes: []string{
+			"PoE/PoE+ HAT: dtoverlay=rpi-poe, fan speed in /sys/class/hwmon/hwmon*/pwm1 where /sys/class/hwmon/hwmon*/name is pwmfan",
+			"Sense HAT: dtoverlay=sense-hat, sensors in /sys/bus/iio/devices, joystick in /dev/input/event*, LED matrix via /dev/i2c-1 address 0x46",
+			"TV HAT: dtoverlay=tv-hat, DVB frontend in /dev/dvb/adapter0",
+		},
+	},
+
+	{
+		Name:        "bluetooth",
+		Description: "Bluetooth and Bluetooth Low Energy via the on-board Broadcom chip (see the -pl011 flag of gokr-rebuild-kernel)",
+		Config: `
+CONFIG_BT=y
+CONFIG_BT_BREDR=y
+CONFIG_BT_LE=y
+CONFIG_BT_RFCOMM=y
+CONFIG_BT_BNEP=y
+CONFIG_BT_HIDP=y
+CONFIG_BT_BCM=y
+CONFIG_BT_HCIUART=y
+CONFIG_BT_HCIUART_SERDEV=y
+CONFIG_BT_HCIUART_BCM=y
+CONFIG_SERIAL_DEV_BUS=y
+CONFIG_SERIAL_DEV_CTRL_TTYPORT=y
+CONFIG_CRYPTO_ECDH=y
+CONFIG_CRYPTO_AES=y
+CONFIG_CRYPTO_CMAC=y
+`,
+	},
+
+	{
+		Name:        "kexec",
+		Description: "kexec, to boot a new kernel on a running device without a full reboot cycle (see gokr-kexec)",
+		Config: `
+CONFIG_KEXEC=y
+CONFIG_KEXEC_FILE=y
+CONFIG_RELOCATABLE=y
+`,
+		Require: []string{
+			"CONFIG_KEXEC_FILE",
+		},
+		Notes: []string{
+			"add github.com/alf632/gokrazy-kernel/cmd/gokr-kexec to your gokrazy instance with -kernel=http://<host>:8097/vmlinuz, and serve new kernels with gokr-rebuild-kernel serve",
+			"kernel lockdown (hardened profile) only allows kexec of signed kernels, so do not combine kexec with hardened",
+		},
+	},
+
+	{
+		Name:        "kdump",
+		Description: "kexec and a reserved crash kernel, so that a panic boots a capture kernel which saves /proc/vmcore (see gokr-kdump); updates cmdline.txt",
+		Config: `
+CONFIG_KEXEC=y
+CONFIG_KEXEC_FILE=y
+CONFIG_CRASH_DUMP=y
+CONFIG_PROC_VMCORE=y
+CONFIG_RELOCATABLE=y
+`,
+		Require: []string{
+			"CONFIG_KEXEC_FILE",
+			"CONFIG_CRASH_DUMP",
+			"CONFIG_PROC_VMCORE",
+		},
+		Cmdline: []string{
+			"crashkernel=128M",
+		},
+		Notes: []string{
+			"add github.com/alf632/gokrazy-kernel/cmd/gokr-kdump to your gokrazy instance: it loads this kernel as crash kernel and, after a panic, saves /proc/vmcore to /perm/vmcore and reboots",
+			"kernel lockdown (hardened profile) only allows kexec of signed kernels, so do not combine kdump with hardened",
+		},
+	},
+}
+
+// Names returns the names of all known profiles in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(all))
+	for _, p := range all {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the profile with the specified name.
+func Lookup(name string) (Profile, error) {
+	for _, p := range all {
+		if p.Name == strings.TrimSpace(name) {
+			return p, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("unknown profile %q, known profiles: %v", name, Names())
+}
+
+// Resolve looks up the comma-separated list of profile names. Duplicates are
+// removed.
+func Resolve(list string) ([]Profile, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var (
+		result []Profile
+		seen   = make(map[string]bool)
+	)
+	for _, name := range strings.Split(list, ",") {
+		p, err := Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// Image returns the file in arch/arm64/boot to ship as vmlinuz for the
+// specified profiles.
+func Image(profiles []Profile) string {
+	for _, p := range profiles {
+		if p.Image != "" {
+			return p.Image
+		}
+	}
+	return "Image"
+}
+
+// ConfigTxt returns the config.txt lines required by profiles, without
+// duplicates.
+func ConfigTxt(profiles []Profile) []string {
+	var (
+		lines []string
+		seen  = make(map[string]bool)
+	)
+	for _, p := range profiles {
+		for _, line := range p.ConfigTxt {
+			if seen[line] {
+				continue
+			}
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Overlays returns the names of the overlays required by profiles, without
+// duplicates.
+func Overlays(profiles []Profile) []string {
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+	for _, p := range profiles {
+		for _, name := range p.Overlays {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Cmdline returns the kernel command line parameters required by profiles.
+// Later profiles override parameters of earlier profiles with the same name.
+func Cmdline(profiles []Profile) []string {
+	var params []string
+	for _, p := range profiles {
+		params = append(params, p.Cmdline...)
+	}
+	return params
+}
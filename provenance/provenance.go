@@ -0,0 +1,231 @@
+// Package provenance defines provenance.json, an in-toto statement with a
+// SLSA provenance (v1) predicate which gokr-rebuild-kernel writes next to
+// vmlinuz. It describes the builder, the inputs (kernel source tarball,
+// patches, build flags) and the outputs (artifact digests) of a build.
+//
+// The statement itself is not signed: sign it (e.g. with cosign attest, as
+// gokr-rebuild-kernel push -sign does) to make it verifiable.
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+)
+
+// FileName is the name of the file next to vmlinuz.
+const FileName = "provenance.json"
+
+const (
+	// StatementType is the in-toto statement type.
+	StatementType = "https://in-toto.io/Statement/v1"
+
+	// PredicateType is the SLSA provenance predicate type.
+	PredicateType = "https://slsa.dev/provenance/v1"
+
+	// BuildType identifies how gokr-rebuild-kernel builds, i.e. how to
+	// interpret ExternalParameters.
+	BuildType = "https://github.com/alf632/gokrazy-kernel/buildtypes/gokr-rebuild-kernel/v1"
+
+	// DefaultBuilderID identifies gokr-rebuild-kernel run by hand.
+	DefaultBuilderID = "https://github.com/alf632/gokrazy-kernel/cmd/gokr-rebuild-kernel"
+)
+
+// Statement is an in-toto statement.
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Subject is an output of the build.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Predicate is a SLSA provenance v1 predicate.
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of the build.
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies,omitempty"`
+}
+
+// ResourceDescriptor identifies an input of the build.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// RunDetails describes the build run.
+type RunDetails struct {
+	Builder  Builder  `json:"builder"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Builder identifies the build platform, which users of the provenance
+// trust to have run the build as described.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// Metadata describes when the build ran.
+type Metadata struct {
+	InvocationID string    `json:"invocationId,omitempty"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// Subjects returns the artifacts in the build result directory dir (see
+// buildinfo.ArtifactFiles) with their SHA-256 digests. rename maps artifact
+// names to the names they are installed as, if different.
+func Subjects(dir string, rename map[string]string) ([]Subject, error) {
+	files, err := buildinfo.ArtifactFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	subjects := make([]Subject, 0, len(files))
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		name := rel
+		if r, ok := rename[rel]; ok {
+			name = r
+		}
+		subjects = append(subjects, Subject{
+			Name:   name,
+			Digest: map[string]string{"sha256": fmt.Sprintf("%x", h.Sum(nil))},
+		})
+	}
+	return subjects, nil
+}
+
+// Inputs are the inputs of a build which New does not take from
+// build-info.json.
+type Inputs struct {
+	// BuilderID identifies the builder, e.g. a CI workflow.
+	BuilderID string
+
+	// InvocationID identifies the build run, e.g. a CI job URL.
+	InvocationID string
+
+	// SourceSHA256 is the hex-encoded SHA-256 hash of the kernel source
+	// tarball.
+	SourceSHA256 string
+
+	// BaseImage is the container image the kernel was built in.
+	BaseImage string
+
+	// Parameters are the build flags.
+	Parameters map[string]interface{}
+
+	StartedOn time.Time
+}
+
+// New returns the provenance statement of a build described by bi, which
+// produced subjects.
+func New(bi *buildinfo.BuildInfo, subjects []Subject, in Inputs) *Statement {
+	deps := []ResourceDescriptor{
+		{
+			Name:   "kernel source",
+			URI:    bi.SourceURL,
+			Digest: map[string]string{"sha256": in.SourceSHA256},
+		},
+	}
+	if bi.GitDescribe != "" {
+		deps = append(deps, ResourceDescriptor{
+			Name: "kernel repository",
+			URI:  "git+https://github.com/alf632/gokrazy-kernel@" + bi.GitDescribe,
+		})
+	}
+	for _, p := range bi.Patches {
+		deps = append(deps, ResourceDescriptor{
+			Name:   p.Name,
+			Digest: map[string]string{"sha256": p.SHA256},
+		})
+	}
+	if in.BaseImage != "" {
+		deps = append(deps, ResourceDescriptor{
+			Name: "base image",
+			URI:  "pkg:docker/" + in.BaseImage,
+		})
+	}
+	builderID := in.BuilderID
+	if builderID == "" {
+		builderID = DefaultBuilderID
+	}
+	return &Statement{
+		Type:          StatementType,
+		Subject:       subjects,
+		PredicateType: PredicateType,
+		Predicate: Predicate{
+			BuildDefinition: BuildDefinition{
+				BuildType:          BuildType,
+				ExternalParameters: in.Parameters,
+				InternalParameters: map[string]interface{}{
+					"kernelVersion": bi.KernelVersion,
+					"compiler":      bi.Compiler,
+					"configSHA256":  bi.ConfigSHA256,
+				},
+				ResolvedDependencies: deps,
+			},
+			RunDetails: RunDetails{
+				Builder: Builder{ID: builderID},
+				Metadata: Metadata{
+					InvocationID: in.InvocationID,
+					StartedOn:    in.StartedOn.UTC(),
+					FinishedOn:   bi.BuildTime.UTC(),
+				},
+			},
+		},
+	}
+}
+
+// Read reads the provenance.json file at path.
+func Read(path string) (*Statement, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Statement
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if s.Type != StatementType || s.PredicateType != PredicateType {
+		return nil, fmt.Errorf("%s: not a SLSA provenance v1 statement (type %q, predicate type %q)", path, s.Type, s.PredicateType)
+	}
+	return &s, nil
+}
+
+// Write writes s as a provenance.json file to path.
+func (s *Statement) Write(path string) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,143 @@
+// Package symbols manages a local store of the debug symbols (vmlinux and
+// System.map) of kernel builds, keyed by the reproducibility hash recorded in
+// their build-info.json, so that a panic or oops of a kernel running on a
+// gokrazy device can be symbolized later (see gokr-symbolize).
+package symbols
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+)
+
+// Files are the names of the files stored for each build, next to a copy of
+// its build-info.json.
+const (
+	Vmlinux   = "vmlinux"
+	SystemMap = "System.map"
+)
+
+// DefaultDir returns the default store, in the user’s cache directory.
+func DefaultDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gokr-kernel", "symbols")
+}
+
+// Dir returns the directory of the build with the specified reproducibility
+// hash in the store root.
+func Dir(root, hash string) string {
+	return filepath.Join(root, hash)
+}
+
+// Save copies vmlinux and System.map from srcDir into the store root, along
+// with the build-info.json at buildInfoPath which identifies the build, and
+// returns the directory they were stored in.
+func Save(root, srcDir, buildInfoPath string) (string, error) {
+	bi, err := buildinfo.Read(buildInfoPath)
+	if err != nil {
+		return "", err
+	}
+	if bi.ReproducibilityHash == "" {
+		return "", fmt.Errorf("%s: no reproducibility hash", buildInfoPath)
+	}
+	dir := Dir(root, bi.ReproducibilityHash)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// build-info.json is copied last, so that it marks the build as
+	// completely stored (see Prune).
+	for _, f := range []struct{ dest, src string }{
+		{Vmlinux, filepath.Join(srcDir, Vmlinux)},
+		{SystemMap, filepath.Join(srcDir, SystemMap)},
+		{buildinfo.FileName, buildInfoPath},
+	} {
+		if err := copyFile(filepath.Join(dir, f.dest), f.src); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Lookup returns the directory of the build with the specified
+// reproducibility hash in the store root, or an error if it was not stored.
+func Lookup(root, hash string) (string, error) {
+	dir := Dir(root, hash)
+	if _, err := os.Stat(filepath.Join(dir, Vmlinux)); err != nil {
+		return "", fmt.Errorf("no symbols for build %s in %s (were they stored by gokr-rebuild-kernel -symbols_dir?): %v", hash, root, err)
+	}
+	return dir, nil
+}
+
+// Prune removes all but the keep most recently stored builds from the store
+// root (keep <= 0 keeps all) and returns the removed directories.
+func Prune(root string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type build struct {
+		dir    string
+		stored int64
+	}
+	var builds []build
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		// Only directories written by Save, which copies build-info.json
+		// last, so that its modification time is when the build was stored.
+		st, err := os.Stat(filepath.Join(dir, buildinfo.FileName))
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		builds = append(builds, build{dir, st.ModTime().UnixNano()})
+	}
+	if len(builds) <= keep {
+		return nil, nil
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].stored > builds[j].stored
+	})
+	var removed []string
+	for _, b := range builds[keep:] {
+		if err := os.RemoveAll(b.dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b.dir)
+	}
+	return removed, nil
+}
+
+func copyFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Write to a temporary file, so that an interrupted copy does not
+	// leave a truncated vmlinux behind.
+	out, err := os.Create(dest + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dest+".tmp", dest)
+}
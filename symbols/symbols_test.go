@@ -0,0 +1,85 @@
+package symbols
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alf632/gokrazy-kernel/buildinfo"
+)
+
+func TestSaveLookupPrune(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "symbols-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "store")
+	src := filepath.Join(tmp, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{Vmlinux, SystemMap} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var dirs []string
+	for i := 0; i < 4; i++ {
+		bi := &buildinfo.BuildInfo{ReproducibilityHash: fmt.Sprintf("hash%d", i)}
+		biPath := filepath.Join(src, buildinfo.FileName)
+		if err := bi.Write(biPath); err != nil {
+			t.Fatal(err)
+		}
+		dir, err := Save(root, src, biPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Make the order of the builds independent of the resolution of
+		// the file system timestamps.
+		stored := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dir, buildinfo.FileName), stored, stored); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	if dir, err := Lookup(root, "hash1"); err != nil || dir != dirs[1] {
+		t.Errorf("Lookup(hash1) = %q, %v, want %q", dir, err, dirs[1])
+	}
+	if _, err := Lookup(root, "unknown"); err == nil {
+		t.Errorf("Lookup(unknown) succeeded unexpectedly")
+	}
+
+	// Not stored by Save, so not pruned.
+	if err := os.MkdirAll(filepath.Join(root, "other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := Prune(root, 0); err != nil || len(removed) != 0 {
+		t.Errorf("Prune(0) = %q, %v, want nothing removed", removed, err)
+	}
+	removed, err := Prune(root, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{dirs[1], dirs[0]}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Prune(2) removed %q, want %q", removed, want)
+	}
+	for _, hash := range []string{"hash2", "hash3"} {
+		if _, err := Lookup(root, hash); err != nil {
+			t.Errorf("Lookup(%s) after Prune: %v", hash, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "other")); err != nil {
+		t.Errorf("Prune removed a directory not stored by Save: %v", err)
+	}
+	if removed, err := Prune(filepath.Join(tmp, "missing"), 2); err != nil || len(removed) != 0 {
+		t.Errorf("Prune(missing store) = %q, %v", removed, err)
+	}
+}